@@ -2,6 +2,7 @@ package pack
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/md5"
@@ -9,7 +10,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -25,9 +25,11 @@ import (
 	"github.com/buildpack/pack/docker"
 	"github.com/buildpack/pack/fs"
 	"github.com/buildpack/pack/image"
+	"github.com/buildpack/pack/logging"
 	dockertypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	dockercli "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/term"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
@@ -35,23 +37,27 @@ import (
 
 type BuildFactory struct {
 	Cli    Docker
-	Stdout io.Writer
-	Stderr io.Writer
-	Log    *log.Logger
+	Log    *logging.Logger
 	FS     FS
 	Config *config.Config
 	Images Images
+	// Confirm asks the user a yes or no question. It is nil when pack is not
+	// run interactively.
+	Confirm func(question string) (bool, error)
 }
 
 type BuildFlags struct {
-	AppDir     string
-	Builder    string
-	RunImage   string
-	EnvFile    string
-	RepoName   string
-	Publish    bool
-	NoPull     bool
-	Buildpacks []string
+	AppDir       string
+	Builder      string
+	RunImage     string
+	EnvFile      string
+	RepoName     string
+	Publish      bool
+	PullPolicy   string
+	Buildpacks   []string
+	Descriptor   string
+	TrustBuilder bool
+	Policy       string
 }
 
 type BuildConfig struct {
@@ -61,19 +67,27 @@ type BuildConfig struct {
 	EnvFile    map[string]string
 	RepoName   string
 	Publish    bool
-	NoPull     bool
+	PullPolicy image.PullPolicy
 	Buildpacks []string
+	Exclude    []string
+	// UntrustedBuilder runs every lifecycle phase without network access or
+	// capabilities, and never as root
+	UntrustedBuilder bool
+	Policy           *Policy
 	// Above are copied from BuildFlags are set by init
 	Cli    Docker
-	Stdout io.Writer
-	Stderr io.Writer
-	Log    *log.Logger
+	Log    *logging.Logger
 	FS     FS
 	Config *config.Config
 	Images Images
 	// Above are copied from BuildFactory
 	WorkspaceVolume string
 	CacheVolume     string
+	// runImage is checked in the background, see CheckRunImage
+	runImage *pendingStep
+	// previousMetadata waits for the metadata label of the previous image,
+	// which Run reads while detecting
+	previousMetadata func() (string, error)
 }
 
 const (
@@ -86,37 +100,58 @@ const (
 	planPath      = "/workspace/plan.toml"
 )
 
-func DefaultBuildFactory() (*BuildFactory, error) {
+// DefaultBuildFactory reads the config with the given profile, see config.NewDefault.
+func DefaultBuildFactory(logger *logging.Logger, profile string) (*BuildFactory, error) {
 	f := &BuildFactory{
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
-		Log:    log.New(os.Stdout, "", log.LstdFlags),
+		Log:    logger,
 		FS:     &fs.FS{},
 		Images: &image.Client{},
 	}
 
-	var err error
-	f.Cli, err = docker.New()
+	cli, err := docker.New()
 	if err != nil {
 		return nil, err
 	}
+	cli.Progress = logger.Progress()
+	f.Cli = cli
 
-	f.Config, err = config.NewDefault()
+	f.Config, err = config.NewDefault(profile)
 	if err != nil {
 		return nil, err
 	}
 
+	if term.IsTerminal(os.Stdin.Fd()) {
+		f.Confirm = confirm(logger.Stdout(), os.Stdin)
+	}
+
 	return f, nil
 }
 
+// confirm asks questions on out, which is the logger's so that the prompt
+// also ends up in the transcript, and reads the answers from in.
+func confirm(out io.Writer, in io.Reader) func(question string) (bool, error) {
+	return func(question string) (bool, error) {
+		fmt.Fprintf(out, "%s [y/N] ", question)
+		answer, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes", nil
+	}
+}
+
 func (bf *BuildFactory) BuildConfigFromFlags(f *BuildFlags) (*BuildConfig, error) {
+	pullPolicy, err := image.ParsePullPolicy(f.PullPolicy)
+	if err != nil {
+		return nil, err
+	}
 	if f.AppDir == "current working directory" { // default placeholder
-		var err error
 		f.AppDir, err = os.Getwd()
 		if err != nil {
 			return nil, err
 		}
-		bf.Log.Printf("Defaulting app directory to current working directory '%s' (use --path to override)", f.AppDir)
+		bf.Log.Info("Defaulting app directory to current working directory '%s' (use --path to override)", f.AppDir)
 	}
 	appDir, err := filepath.Abs(f.AppDir)
 	if err != nil {
@@ -127,15 +162,36 @@ func (bf *BuildFactory) BuildConfigFromFlags(f *BuildFlags) (*BuildConfig, error
 		f.RepoName = fmt.Sprintf("pack.local/run/%x", md5.Sum([]byte(appDir)))
 	}
 
+	descriptor, descriptorPath, err := ReadProjectDescriptor(appDir, f.Descriptor)
+	if err != nil {
+		return nil, err
+	}
+	if descriptorPath != "" {
+		bf.Log.Info("Using project descriptor '%s'", descriptorPath)
+	}
+
+	policy, err := ReadPolicy(bf.Config.Path(), f.Policy)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		bf.Log.Info("Using policy '%s'", policy.Path)
+	}
+	if f.Publish {
+		if err := policy.CheckPublish(f.RepoName); err != nil {
+			return nil, err
+		}
+	}
+
 	b := &BuildConfig{
 		AppDir:          appDir,
 		RepoName:        f.RepoName,
 		Publish:         f.Publish,
-		NoPull:          f.NoPull,
+		PullPolicy:      pullPolicy,
 		Buildpacks:      f.Buildpacks,
+		Exclude:         descriptor.Exclude,
+		Policy:          policy,
 		Cli:             bf.Cli,
-		Stdout:          bf.Stdout,
-		Stderr:          bf.Stderr,
 		Log:             bf.Log,
 		FS:              bf.FS,
 		Config:          bf.Config,
@@ -144,43 +200,68 @@ func (bf *BuildFactory) BuildConfigFromFlags(f *BuildFlags) (*BuildConfig, error
 		CacheVolume:     fmt.Sprintf("pack-cache-%x", md5.Sum([]byte(appDir))),
 	}
 
+	if len(b.Buildpacks) == 0 {
+		b.Buildpacks = descriptor.buildpackRefs(filepath.Dir(descriptorPath))
+	}
+
+	if len(descriptor.Env) > 0 {
+		b.EnvFile = map[string]string{}
+		for k, v := range descriptor.Env {
+			b.EnvFile[k] = v
+		}
+	}
 	if f.EnvFile != "" {
-		b.EnvFile, err = parseEnvFile(f.EnvFile)
+		env, err := parseEnvFile(f.EnvFile)
 		if err != nil {
 			return nil, err
 		}
+		if b.EnvFile == nil {
+			b.EnvFile = env
+		}
+		for k, v := range env {
+			b.EnvFile[k] = v
+		}
 	}
 
-	if f.Builder == "" {
-		bf.Log.Printf("Using default builder image '%s'\n", bf.Config.DefaultBuilder)
-		b.Builder = bf.Config.DefaultBuilder
-	} else {
-		bf.Log.Printf("Using user provided builder image '%s'\n", f.Builder)
+	switch {
+	case f.Builder != "":
+		bf.Log.Info("Using user provided builder image '%s'", f.Builder)
 		b.Builder = f.Builder
+	case descriptor.Builder != "":
+		bf.Log.Info("Using builder image '%s' from project descriptor", descriptor.Builder)
+		b.Builder = descriptor.Builder
+	default:
+		bf.Log.Info("Using default builder image '%s'", bf.Config.DefaultBuilder)
+		b.Builder = bf.Config.DefaultBuilder
 	}
-	if !f.NoPull {
-		bf.Log.Printf("Pulling builder image '%s' (use --no-pull flag to skip this step)", b.Builder)
-		if err := bf.Cli.PullImage(b.Builder); err != nil {
-			return nil, err
-		}
+	if err := bf.checkTrust(b, f.TrustBuilder); err != nil {
+		return nil, err
 	}
 
-	builderStackID, err := b.imageLabel(b.Builder, "io.buildpacks.stack.id", true)
-	if err != nil {
-		return nil, fmt.Errorf(`invalid builder image "%s": %s`, b.Builder, err)
-	}
-	if builderStackID == "" {
-		return nil, fmt.Errorf(`invalid builder image "%s": missing required label "io.buildpacks.stack.id"`, b.Builder)
+	// a run image that doesn't depend on the stack of the builder is pulled
+	// while the builder is
+	var runImageLabels func() (map[string]string, error)
+	if f.RunImage != "" {
+		bf.Log.Info("Using user provided run image '%s'", f.RunImage)
+		b.RunImage = f.RunImage
+		runImageLabels = b.fetchRunImage()
+	} else if descriptor.RunImage != "" {
+		bf.Log.Info("Using run image '%s' from project descriptor", descriptor.RunImage)
+		b.RunImage = descriptor.RunImage
+		runImageLabels = b.fetchRunImage()
 	}
-	stack, err := bf.Config.Get(builderStackID)
+
+	builderStackID, stack, err := b.checkBuilder()
 	if err != nil {
+		if runImageLabels != nil {
+			// the builder error is reported, but not before the run image is
+			// done with, so that no pull outlives it
+			runImageLabels()
+		}
 		return nil, err
 	}
 
-	if f.RunImage != "" {
-		bf.Log.Printf("Using user provided run image '%s'\n", f.RunImage)
-		b.RunImage = f.RunImage
-	} else {
+	if runImageLabels == nil {
 		reg, err := config.Registry(f.RepoName)
 		if err != nil {
 			return nil, err
@@ -189,29 +270,38 @@ func (bf *BuildFactory) BuildConfigFromFlags(f *BuildFlags) (*BuildConfig, error
 		if err != nil {
 			return nil, err
 		}
-		b.Log.Printf("Selected run image '%s' from stack '%s'\n", b.RunImage, builderStackID)
+		b.Log.Info("Selected run image '%s' from stack '%s'", b.RunImage, builderStackID)
+		runImageLabels = b.fetchRunImage()
 	}
+	b.runImage = startStep(func() error {
+		return b.checkRunImage(runImageLabels, builderStackID)
+	})
 
-	if !f.NoPull && !f.Publish {
-		bf.Log.Printf("Pulling run image '%s' (use --no-pull flag to skip this step)", b.RunImage)
-		if err := bf.Cli.PullImage(b.RunImage); err != nil {
-			return nil, err
-		}
-	}
+	return b, nil
+}
 
-	if runStackID, err := b.imageLabel(b.RunImage, "io.buildpacks.stack.id", !f.Publish); err != nil {
-		return nil, fmt.Errorf(`invalid run image "%s": %s`, b.RunImage, err)
-	} else if runStackID == "" {
-		return nil, fmt.Errorf(`invalid run image "%s": missing required label "io.buildpacks.stack.id"`, b.RunImage)
-	} else if builderStackID != runStackID {
-		return nil, fmt.Errorf(`invalid stack: stack "%s" from run image "%s" does not match stack "%s" from builder image "%s"`, runStackID, b.RunImage, builderStackID, b.Builder)
+// checkTrust isolates the builder unless it is trusted by flag, by config or by
+// the user when asked.
+func (bf *BuildFactory) checkTrust(b *BuildConfig, trustBuilder bool) error {
+	if trustBuilder || bf.Config.IsTrustedBuilder(b.Builder) {
+		return nil
 	}
-
-	return b, nil
+	if bf.Confirm != nil {
+		trusted, err := bf.Confirm(fmt.Sprintf("Builder '%s' is not trusted. Run it with network access and as root where needed?", b.Builder))
+		if err != nil {
+			return err
+		}
+		if trusted {
+			return nil
+		}
+	}
+	bf.Log.Info("Running untrusted builder '%s' without network access (use --trust-builder or 'pack trust-builder' to trust it)", b.Builder)
+	b.UntrustedBuilder = true
+	return nil
 }
 
 func Build(appDir, buildImage, runImage, repoName string, publish bool) error {
-	bf, err := DefaultBuildFactory()
+	bf, err := DefaultBuildFactory(logging.New(os.Stdout, os.Stderr, logging.Options{}), "")
 	if err != nil {
 		return err
 	}
@@ -230,23 +320,31 @@ func Build(appDir, buildImage, runImage, repoName string, publish bool) error {
 
 func (b *BuildConfig) Run() error {
 	defer b.Cli.VolumeRemove(context.Background(), b.WorkspaceVolume, true)
+	// nothing started in the background outlives the build
+	defer b.CheckRunImage()
+
+	b.previousMetadata = b.readPreviousMetadata()
+	defer func() {
+		b.previousMetadata()
+		b.previousMetadata = nil
+	}()
 
 	group, err := b.Detect()
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("*** ANALYZING: Reading information from previous image for possible re-use")
+	b.Log.Info("*** ANALYZING: Reading information from previous image for possible re-use")
 	if err := b.Analyze(); err != nil {
 		return err
 	}
 
-	fmt.Println("*** BUILDING:")
+	b.Log.Info("*** BUILDING:")
 	if err := b.Build(); err != nil {
 		return err
 	}
 
-	fmt.Println("*** EXPORTING:")
+	b.Log.Info("*** EXPORTING:")
 	if err := b.Export(group); err != nil {
 		return err
 	}
@@ -254,34 +352,245 @@ func (b *BuildConfig) Run() error {
 	return nil
 }
 
-func parseBuildpack(ref string) (string, string) {
+func (b *BuildConfig) parseBuildpack(ref string) (string, string) {
 	parts := strings.Split(ref, "@")
 	if len(parts) == 2 {
 		return parts[0], parts[1]
 	}
-	fmt.Printf("No version for '%s' buildpack provided, will use '%s@latest'\n", parts[0], parts[0])
+	b.Log.Info("No version for '%s' buildpack provided, will use '%s@latest'", parts[0], parts[0])
 	return parts[0], "latest"
 }
 
+// SupportedLifecycleVersions are the major.minor lifecycle versions whose
+// flags pack passes to the lifecycle binaries.
+var SupportedLifecycleVersions = []string{"0.1"}
+
+// checkLifecycleVersion fails when the builder records a lifecycle version
+// pack doesn't support. Builders using the lifecycle of their stack are not checked.
+func checkLifecycleVersion(builder, label string) error {
+	var metadata BuilderMetadata
+	if label == "" || json.Unmarshal([]byte(label), &metadata) != nil || metadata.Lifecycle.Version == "" {
+		return nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(metadata.Lifecycle.Version, "v"), ".", 3)
+	if len(parts) >= 2 {
+		for _, supported := range SupportedLifecycleVersions {
+			if parts[0]+"."+parts[1] == supported {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf(`builder "%s" uses lifecycle %s, which this version of pack doesn't support (supported: %s.x)`, builder, metadata.Lifecycle.Version, strings.Join(SupportedLifecycleVersions, ".x, "))
+}
+
+// validateBuildpackRefs checks buildpacks given by ID against the builder
+// metadata label. Builders without the label are not checked.
+func validateBuildpackRefs(refs []string, builder, label string) error {
+	var metadata BuilderMetadata
+	if label == "" || json.Unmarshal([]byte(label), &metadata) != nil {
+		return nil
+	}
+
+	for _, ref := range refs {
+		if isBuildpackLocation(ref) {
+			continue
+		}
+		id, version := ref, "latest"
+		if parts := strings.Split(ref, "@"); len(parts) == 2 {
+			id, version = parts[0], parts[1]
+		}
+
+		var versions []string
+		found := false
+		for _, bp := range metadata.Buildpacks {
+			if bp.ID != id {
+				continue
+			}
+			versions = append(versions, bp.Version)
+			if bp.Version == version || (version == "latest" && bp.Latest) {
+				found = true
+			}
+		}
+		switch {
+		case found:
+		case len(versions) == 0:
+			msg := fmt.Sprintf(`buildpack "%s" was not found in builder "%s"`, id, builder)
+			if matches := closeBuildpackIDs(id, metadata.Buildpacks); len(matches) > 0 {
+				msg += fmt.Sprintf(`, did you mean "%s"?`, strings.Join(matches, `" or "`))
+			}
+			return errors.New(msg)
+		case version == "latest":
+			return fmt.Errorf(`no version of buildpack "%s" is marked latest in builder "%s", available versions: %s`, id, builder, strings.Join(versions, ", "))
+		default:
+			return fmt.Errorf(`version "%s" of buildpack "%s" was not found in builder "%s", available versions: %s`, version, id, builder, strings.Join(versions, ", "))
+		}
+	}
+	return nil
+}
+
+// closeBuildpackIDs returns the IDs within a few edits of id, closest first.
+func closeBuildpackIDs(id string, buildpacks []BuilderBuildpackMetadata) []string {
+	distances := map[string]int{}
+	var matches []string
+	for _, bp := range buildpacks {
+		if _, ok := distances[bp.ID]; ok {
+			continue
+		}
+		d := editDistance(id, bp.ID)
+		distances[bp.ID] = d
+		if d <= 3 || strings.Contains(bp.ID, id) {
+			matches = append(matches, bp.ID)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return distances[matches[i]] < distances[matches[j]] })
+	return matches
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// checkBuildpackRefs checks buildpacks given by ID against the policy. The
+// version of a buildpack given without one is read from the builder metadata
+// label. Without buildpacks given, detection runs the groups of the builder,
+// so every buildpack in them is checked instead.
+func (b *BuildConfig) checkBuildpackRefs(label string) error {
+	if !b.Policy.hasBuildpackRules() {
+		return nil
+	}
+	var metadata BuilderMetadata
+	if label != "" {
+		json.Unmarshal([]byte(label), &metadata)
+	}
+	if len(b.Buildpacks) == 0 {
+		return b.checkBuilderGroups(metadata)
+	}
+	for _, ref := range b.Buildpacks {
+		if isBuildpackLocation(ref) {
+			continue
+		}
+		id, version := b.parseBuildpack(ref)
+		if version == "latest" {
+			version = latestVersion(metadata, id)
+		}
+		if err := b.Policy.CheckBuildpack(id, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBuilderGroups checks the buildpacks in the groups of the builder
+// metadata against the policy, and fails when the builder has no groups to
+// check.
+func (b *BuildConfig) checkBuilderGroups(metadata BuilderMetadata) error {
+	if len(metadata.Groups) == 0 {
+		return fmt.Errorf(`policy "%s": the buildpacks of builder "%s" cannot be checked, it has no metadata label listing its groups`, b.Policy.Path, b.Builder)
+	}
+	for _, group := range metadata.Groups {
+		for _, bp := range group.Buildpacks {
+			version := bp.Version
+			if version == "" || version == "latest" {
+				version = latestVersion(metadata, bp.ID)
+			}
+			if err := b.Policy.CheckBuildpack(bp.ID, version); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// latestVersion returns the version of the buildpack marked latest in the
+// builder metadata, or an empty version when there is none.
+func latestVersion(metadata BuilderMetadata, id string) string {
+	for _, bp := range metadata.Buildpacks {
+		if bp.ID == id && bp.Latest {
+			return bp.Version
+		}
+	}
+	return ""
+}
+
+// CheckPolicy fetches the buildpacks given by location and checks them against
+// the policy, like a build would before running them. The rest of the policy
+// is checked by BuildConfigFromFlags and CheckRunImage.
+func (b *BuildConfig) CheckPolicy() error {
+	if err := b.CheckRunImage(); err != nil {
+		return err
+	}
+	fetcher := &buildpackFetcher{Log: b.Log, FS: b.FS, Config: b.Config}
+	for _, bp := range b.Buildpacks {
+		if !isBuildpackLocation(bp) {
+			continue
+		}
+		if _, _, _, err := b.fetchBuildpack(fetcher, bp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchBuildpack fetches a buildpack given by location and checks its ID and
+// version against the policy.
+func (b *BuildConfig) fetchBuildpack(fetcher *buildpackFetcher, bp string) (dir, id, version string, err error) {
+	dir, _, err = fetcher.fetch("", bp, "")
+	if err != nil {
+		return "", "", "", errors.Wrapf(err, "fetching buildpack '%s'", bp)
+	}
+	var buildpackTOML struct {
+		Buildpack struct {
+			ID      string `toml:"id"`
+			Version string `toml:"version"`
+		} `toml:"buildpack"`
+	}
+	_, err = toml.DecodeFile(filepath.Join(dir, "buildpack.toml"), &buildpackTOML)
+	if err != nil {
+		return "", "", "", fmt.Errorf(`failed to decode buildpack.toml from "%s": %s`, bp, err)
+	}
+	id = buildpackTOML.Buildpack.ID
+	version = buildpackTOML.Buildpack.Version
+	if err := b.Policy.CheckBuildpack(id, version); err != nil {
+		return "", "", "", err
+	}
+	return dir, id, version, nil
+}
+
 func (b *BuildConfig) copyBuildpacksToContainer(ctx context.Context, ctrID string) ([]*lifecycle.Buildpack, error) {
 	var buildpacks []*lifecycle.Buildpack
+	fetcher := &buildpackFetcher{Log: b.Log, FS: b.FS, Config: b.Config}
 	for _, bp := range b.Buildpacks {
 		var id, version string
-		if _, err := os.Stat(filepath.Join(bp, "buildpack.toml")); !os.IsNotExist(err) {
-			var buildpackTOML struct {
-				Buildpack struct {
-					ID      string `toml:"id"`
-					Version string `toml:"version"`
-				} `toml:"buildpack"`
-			}
-			_, err = toml.DecodeFile(filepath.Join(bp, "buildpack.toml"), &buildpackTOML)
+		if isBuildpackLocation(bp) {
+			dir, bpID, bpVersion, err := b.fetchBuildpack(fetcher, bp)
 			if err != nil {
-				return nil, fmt.Errorf(`failed to decode buildpack.toml from "%s": %s`, bp, err)
+				return nil, err
 			}
-			id = buildpackTOML.Buildpack.ID
-			version = buildpackTOML.Buildpack.Version
+			id, version = bpID, bpVersion
 			bpDir := filepath.Join(buildpacksDir, id, version)
-			ftr, errChan := b.FS.CreateTarReader(bp, bpDir, 0, 0)
+			ftr, errChan := b.FS.CreateTarReader(dir, bpDir, 0, 0)
 			if err := b.Cli.CopyToContainer(ctx, ctrID, "/", ftr, dockertypes.CopyToContainerOptions{}); err != nil {
 				return nil, errors.Wrapf(err, "copying buildpack '%s' to container", bp)
 			}
@@ -289,7 +598,7 @@ func (b *BuildConfig) copyBuildpacksToContainer(ctx context.Context, ctrID strin
 				return nil, errors.Wrapf(err, "copying buildpack '%s' to container", bp)
 			}
 		} else {
-			id, version = parseBuildpack(bp)
+			id, version = b.parseBuildpack(bp)
 		}
 		buildpacks = append(
 			buildpacks,
@@ -301,7 +610,7 @@ func (b *BuildConfig) copyBuildpacksToContainer(ctx context.Context, ctrID strin
 
 func (b *BuildConfig) Detect() (*lifecycle.BuildpackGroup, error) {
 	ctx := context.Background()
-	ctr, err := b.Cli.ContainerCreate(ctx, &container.Config{
+	ctr, err := b.createLifecycleContainer(ctx, &container.Config{
 		Image: b.Builder,
 		Cmd: []string{
 			"/lifecycle/detector",
@@ -314,7 +623,7 @@ func (b *BuildConfig) Detect() (*lifecycle.BuildpackGroup, error) {
 		Binds: []string{
 			fmt.Sprintf("%s:%s:", b.WorkspaceVolume, launchDir),
 		},
-	}, nil, "")
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "container create")
 	}
@@ -322,10 +631,10 @@ func (b *BuildConfig) Detect() (*lifecycle.BuildpackGroup, error) {
 
 	var orderToml string
 	if len(b.Buildpacks) == 0 {
-		fmt.Fprintln(b.Stdout, "*** DETECTING:")
+		b.Log.Info("*** DETECTING:")
 		orderToml = "" // use order toml already in image
 	} else {
-		fmt.Fprintln(b.Stdout, "*** DETECTING WITH MANUALLY-PROVIDED GROUP:")
+		b.Log.Info("*** DETECTING WITH MANUALLY-PROVIDED GROUP:")
 
 		buildpacks, err := b.copyBuildpacksToContainer(ctx, ctr.ID)
 		if err != nil {
@@ -351,7 +660,14 @@ func (b *BuildConfig) Detect() (*lifecycle.BuildpackGroup, error) {
 		return nil, errors.Wrap(err, "detect")
 	}
 
-	tr, errChan := b.FS.CreateTarReader(b.AppDir, launchDir+"/app", uid, gid)
+	var tr io.Reader
+	var errChan chan error
+	if b.UntrustedBuilder {
+		// directories are owned by the pack user, so no root container has to chown them
+		tr, errChan = b.FS.CreateTarReaderWithDirs(b.AppDir, launchDir+"/app", uid, gid, b.Exclude)
+	} else {
+		tr, errChan = b.FS.CreateTarReaderExcluding(b.AppDir, launchDir+"/app", uid, gid, b.Exclude)
+	}
 	if err := b.Cli.CopyToContainer(ctx, ctr.ID, "/", tr, dockertypes.CopyToContainerOptions{}); err != nil {
 		return nil, errors.Wrap(err, "copy app to workspace volume")
 	}
@@ -359,8 +675,10 @@ func (b *BuildConfig) Detect() (*lifecycle.BuildpackGroup, error) {
 		return nil, errors.Wrap(err, "copy app to workspace volume")
 	}
 
-	if err := b.chownDir(launchDir+"/app", uid, gid); err != nil {
-		return nil, errors.Wrap(err, "chown app to workspace volume")
+	if !b.UntrustedBuilder {
+		if err := b.chownDir(launchDir+"/app", uid, gid); err != nil {
+			return nil, errors.Wrap(err, "chown app to workspace volume")
+		}
 	}
 
 	if orderToml != "" {
@@ -373,7 +691,10 @@ func (b *BuildConfig) Detect() (*lifecycle.BuildpackGroup, error) {
 		}
 	}
 
-	if err := b.Cli.RunContainer(ctx, ctr.ID, b.Stdout, b.Stderr); err != nil {
+	if err := b.CheckRunImage(); err != nil {
+		return nil, err
+	}
+	if err := b.runPhase(ctx, ctr.ID, "detector"); err != nil {
 		return nil, errors.Wrap(err, "run detect container")
 	}
 	return b.groupToml(ctr.ID)
@@ -398,21 +719,25 @@ func (b *BuildConfig) groupToml(ctrID string) (*lifecycle.BuildpackGroup, error)
 }
 
 func (b *BuildConfig) Analyze() error {
-	metadata, err := b.imageLabel(b.RepoName, lifecycle.MetadataLabel, !b.Publish)
+	readMetadata := b.previousMetadata
+	if readMetadata == nil {
+		readMetadata = b.readPreviousMetadata()
+	}
+	metadata, err := readMetadata()
 	if err != nil {
 		return errors.Wrap(err, "analyze image label")
 	}
 	if metadata == "" {
 		if b.Publish {
-			b.Log.Printf("WARNING: skipping analyze, image not found or requires authentication to access")
+			b.Log.Warn("skipping analyze, image not found or requires authentication to access")
 		} else {
-			b.Log.Printf("WARNING: skipping analyze, image not found")
+			b.Log.Warn("skipping analyze, image not found")
 		}
 		return nil
 	}
 
 	ctx := context.Background()
-	ctr, err := b.Cli.ContainerCreate(ctx, &container.Config{
+	ctr, err := b.createLifecycleContainer(ctx, &container.Config{
 		Image: b.Builder,
 		Cmd: []string{
 			"/lifecycle/analyzer",
@@ -425,7 +750,7 @@ func (b *BuildConfig) Analyze() error {
 		Binds: []string{
 			fmt.Sprintf("%s:%s:", b.WorkspaceVolume, launchDir),
 		},
-	}, nil, "")
+	})
 	if err != nil {
 		return errors.Wrap(err, "analyze container create")
 	}
@@ -439,7 +764,7 @@ func (b *BuildConfig) Analyze() error {
 		return errors.Wrap(err, "copy image metadata to workspace volume")
 	}
 
-	if err := b.Cli.RunContainer(ctx, ctr.ID, b.Stdout, b.Stderr); err != nil {
+	if err := b.runPhase(ctx, ctr.ID, "analyzer"); err != nil {
 		return errors.Wrap(err, "analyze run container")
 	}
 	return nil
@@ -447,7 +772,7 @@ func (b *BuildConfig) Analyze() error {
 
 func (b *BuildConfig) Build() error {
 	ctx := context.Background()
-	ctr, err := b.Cli.ContainerCreate(ctx, &container.Config{
+	ctr, err := b.createLifecycleContainer(ctx, &container.Config{
 		Image: b.Builder,
 		Cmd: []string{
 			"/lifecycle/builder",
@@ -463,7 +788,7 @@ func (b *BuildConfig) Build() error {
 			fmt.Sprintf("%s:%s:", b.WorkspaceVolume, launchDir),
 			fmt.Sprintf("%s:%s:", b.CacheVolume, cacheDir),
 		},
-	}, nil, "")
+	})
 	if err != nil {
 		return errors.Wrap(err, "build container create")
 	}
@@ -486,7 +811,7 @@ func (b *BuildConfig) Build() error {
 		}
 	}
 
-	return b.Cli.RunContainer(ctx, ctr.ID, b.Stdout, b.Stderr)
+	return b.runPhase(ctx, ctr.ID, "builder")
 }
 
 func parseEnvFile(envFile string) (map[string]string, error) {
@@ -533,7 +858,7 @@ func (b *BuildConfig) tarEnvFile() (io.Reader, error) {
 
 func (b *BuildConfig) Export(group *lifecycle.BuildpackGroup) error {
 	ctx := context.Background()
-	ctr, err := b.Cli.ContainerCreate(ctx, &container.Config{
+	ctr, err := b.createLifecycleContainer(ctx, &container.Config{
 		Image: b.Builder,
 		Cmd: []string{
 			"/lifecycle/exporter",
@@ -547,13 +872,13 @@ func (b *BuildConfig) Export(group *lifecycle.BuildpackGroup) error {
 		Binds: []string{
 			fmt.Sprintf("%s:%s:", b.WorkspaceVolume, launchDir),
 		},
-	}, nil, "")
+	})
 	if err != nil {
 		return errors.Wrap(err, "export container create")
 	}
 	defer b.Cli.ContainerRemove(ctx, ctr.ID, dockertypes.ContainerRemoveOptions{})
 
-	if err := b.Cli.RunContainer(ctx, ctr.ID, b.Stdout, b.Stderr); err != nil {
+	if err := b.runPhase(ctx, ctr.ID, "exporter"); err != nil {
 		return errors.Wrap(err, "run lifecycle/exporter")
 	}
 	defer b.Cli.ContainerRemove(ctx, ctr.ID, dockertypes.ContainerRemoveOptions{})
@@ -585,11 +910,12 @@ func (b *BuildConfig) Export(group *lifecycle.BuildpackGroup) error {
 			return errors.Wrap(err, "access")
 		}
 
+		exporterOut, exporterErr := b.Log.Phase("exporter")
 		exporter := &lifecycle.Exporter{
 			ArtifactsDir: filepath.Join(tmpDir, "pack-exporter"),
 			Buildpacks:   group.Buildpacks,
-			Out:          os.Stdout,
-			Err:          os.Stderr,
+			Out:          exporterOut,
+			Err:          exporterErr,
 		}
 		repoStore, err := img.NewRegistry(b.RepoName)
 		if err != nil {
@@ -633,12 +959,12 @@ func (b *BuildConfig) Export(group *lifecycle.BuildpackGroup) error {
 		}
 
 		// TODO: move to init
-		imgFactory, err := image.DefaultFactory()
+		imgFactory, err := image.DefaultFactory(b.Log)
 		if err != nil {
 			return errors.Wrap(err, "create default factory")
 		}
 
-		img, err := imgFactory.NewLocal(b.RunImage, false)
+		img, err := imgFactory.NewLocal(b.RunImage, image.PullNever)
 		if err != nil {
 			return errors.Wrap(err, "new local")
 		}
@@ -691,27 +1017,27 @@ func (b *BuildConfig) Export(group *lifecycle.BuildpackGroup) error {
 					}
 					// TODO error nicely on not found
 					layer.SHA = prevBP.Layers[layerName].SHA
-					b.Log.Printf("reusing layer '%s/%s' with diffID '%s'\n", bp.ID, layerName, layer.SHA)
+					b.Log.Debug("reusing layer '%s/%s' with diffID '%s'", bp.ID, layerName, layer.SHA)
 					if err := img.ReuseLayer(layer.SHA); err != nil {
 						return errors.Wrapf(err, "reuse layer '%s/%s' from previous image", bp.ID, layerName)
 					}
 					metadata.Buildpacks[index].Layers[layerName] = layer
 				} else {
-					b.Log.Printf("adding layer '%s/%s' with diffID '%s'\n", bp.ID, layerName, layer.SHA)
-					if err := img.AddLayer(filepath.Join(tmpDir, "pack-exporter", strings.TrimPrefix(layer.SHA, "sha256:")+".tar")); err != nil {
+					b.Log.Debug("adding layer '%s/%s' with diffID '%s'", bp.ID, layerName, layer.SHA)
+					if err := img.AddLayerWithDiffID(filepath.Join(tmpDir, "pack-exporter", strings.TrimPrefix(layer.SHA, "sha256:")+".tar"), layer.SHA); err != nil {
 						return errors.Wrapf(err, "add layer '%s/%s'", bp.ID, layerName)
 					}
 				}
 			}
 		}
 
-		b.Log.Printf("adding app layer with diffID '%s'\n", metadata.App.SHA)
-		if err := img.AddLayer(filepath.Join(tmpDir, "pack-exporter", strings.TrimPrefix(metadata.App.SHA, "sha256:")+".tar")); err != nil {
+		b.Log.Debug("adding app layer with diffID '%s'", metadata.App.SHA)
+		if err := img.AddLayerWithDiffID(filepath.Join(tmpDir, "pack-exporter", strings.TrimPrefix(metadata.App.SHA, "sha256:")+".tar"), metadata.App.SHA); err != nil {
 			return errors.Wrap(err, "add app layer")
 		}
 
-		b.Log.Printf("adding config layer with diffID '%s'\n", metadata.Config.SHA)
-		if err := img.AddLayer(filepath.Join(tmpDir, "pack-exporter", strings.TrimPrefix(metadata.Config.SHA, "sha256:")+".tar")); err != nil {
+		b.Log.Debug("adding config layer with diffID '%s'", metadata.Config.SHA)
+		if err := img.AddLayerWithDiffID(filepath.Join(tmpDir, "pack-exporter", strings.TrimPrefix(metadata.Config.SHA, "sha256:")+".tar"), metadata.Config.SHA); err != nil {
 			return errors.Wrap(err, "add config layer")
 		}
 
@@ -727,39 +1053,228 @@ func (b *BuildConfig) Export(group *lifecycle.BuildpackGroup) error {
 		}
 	}
 
-	b.Log.Printf("\n*** Image: %s@%s\n", b.RepoName, imgSHA)
+	b.Log.Info("\n*** Image: %s@%s", b.RepoName, imgSHA)
 	return nil
 }
 
+// builderMetadataStack returns the stack recorded in a builder's metadata
+// label when it matches the builder's stack ID and names run images.
+func builderMetadataStack(label, stackID string) (config.Stack, bool) {
+	var metadata BuilderMetadata
+	if label == "" || json.Unmarshal([]byte(label), &metadata) != nil {
+		return config.Stack{}, false
+	}
+	stack := metadata.Stack.ConfigStack()
+	if stack.ID != stackID || len(stack.RunImages) == 0 {
+		return config.Stack{}, false
+	}
+	return stack, true
+}
+
+// checkBuilder pulls the builder, checks it against the buildpacks and the
+// policy, and returns its stack. The name rules of the policy are checked
+// before the pull, so that a forbidden builder isn't downloaded.
+func (b *BuildConfig) checkBuilder() (string, *config.Stack, error) {
+	if err := b.Policy.CheckBuilder(b.Builder, nil); err != nil {
+		return "", nil, err
+	}
+	if err := b.pullImage(b.Builder, "builder"); err != nil {
+		return "", nil, err
+	}
+
+	builderLabels, err := b.imageLabels(b.Builder, true)
+	if err != nil {
+		return "", nil, fmt.Errorf(`invalid builder image "%s": %s`, b.Builder, err)
+	}
+	builderStackID := builderLabels["io.buildpacks.stack.id"]
+	if builderStackID == "" {
+		return "", nil, fmt.Errorf(`invalid builder image "%s": missing required label "io.buildpacks.stack.id"`, b.Builder)
+	}
+	if err := b.Policy.CheckBuilder(b.Builder, b.imageDigests(b.Builder, true)); err != nil {
+		return "", nil, err
+	}
+	stack, err := b.Config.Get(builderStackID)
+	if err != nil {
+		builderStack, ok := builderMetadataStack(builderLabels[BuilderMetadataLabel], builderStackID)
+		if !ok {
+			return "", nil, err
+		}
+		b.Log.Info("Using stack '%s' from builder image '%s'", builderStackID, b.Builder)
+		stack = &builderStack
+	}
+	if err := validateBuildpackRefs(b.Buildpacks, b.Builder, builderLabels[BuilderMetadataLabel]); err != nil {
+		return "", nil, err
+	}
+	if err := b.checkBuildpackRefs(builderLabels[BuilderMetadataLabel]); err != nil {
+		return "", nil, err
+	}
+	if err := checkLifecycleVersion(b.Builder, builderLabels[BuilderMetadataLabel]); err != nil {
+		return "", nil, err
+	}
+	return builderStackID, stack, nil
+}
+
+// fetchRunImage starts pulling the run image and reading its labels in the
+// background, and returns a func waiting for the labels. When publishing,
+// the labels are read from the registry instead.
+func (b *BuildConfig) fetchRunImage() func() (map[string]string, error) {
+	var labels map[string]string
+	fetch := startStep(func() error {
+		if err := b.Policy.CheckRunImage(b.RunImage, nil); err != nil {
+			return err
+		}
+		if !b.Publish {
+			if err := b.pullImage(b.RunImage, "run"); err != nil {
+				return err
+			}
+		}
+		var err error
+		if labels, err = b.imageLabels(b.RunImage, !b.Publish); err != nil {
+			return fmt.Errorf(`invalid run image "%s": %s`, b.RunImage, err)
+		}
+		return nil
+	})
+	return func() (map[string]string, error) {
+		err := fetch.wait()
+		return labels, err
+	}
+}
+
+// checkRunImage checks the run image against the stack of the builder and
+// the policy, once its labels have been read.
+func (b *BuildConfig) checkRunImage(runImageLabels func() (map[string]string, error), builderStackID string) error {
+	labels, err := runImageLabels()
+	if err != nil {
+		return err
+	}
+	if runStackID := labels["io.buildpacks.stack.id"]; runStackID == "" {
+		return fmt.Errorf(`invalid run image "%s": missing required label "io.buildpacks.stack.id"`, b.RunImage)
+	} else if builderStackID != runStackID {
+		return fmt.Errorf(`invalid stack: stack "%s" from run image "%s" does not match stack "%s" from builder image "%s"`, runStackID, b.RunImage, builderStackID, b.Builder)
+	}
+	return b.Policy.CheckRunImage(b.RunImage, b.imageDigests(b.RunImage, !b.Publish))
+}
+
+// CheckRunImage waits for the run image to be pulled and checked against the
+// stack of the builder and the policy. BuildConfigFromFlags starts this in
+// the background, so that Detect can upload the app meanwhile.
+func (b *BuildConfig) CheckRunImage() error {
+	return b.runImage.wait()
+}
+
+// readPreviousMetadata starts reading the metadata label of the previous
+// image in the background, and returns a func waiting for it.
+func (b *BuildConfig) readPreviousMetadata() func() (string, error) {
+	var metadata string
+	read := startStep(func() error {
+		var err error
+		metadata, err = b.imageLabel(b.RepoName, lifecycle.MetadataLabel, !b.Publish)
+		return err
+	})
+	return func() (string, error) {
+		err := read.wait()
+		return metadata, err
+	}
+}
+
+// pendingStep is a step of a build running in the background.
+type pendingStep struct {
+	done chan struct{}
+	err  error
+}
+
+func startStep(step func() error) *pendingStep {
+	p := &pendingStep{done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		p.err = step()
+	}()
+	return p
+}
+
+// wait returns the error of the step once it has finished. There is nothing
+// to wait for when the step was never started.
+func (p *pendingStep) wait() error {
+	if p == nil {
+		return nil
+	}
+	<-p.done
+	return p.err
+}
+
+// pullImage pulls the builder or run image as b.PullPolicy requires.
+func (b *BuildConfig) pullImage(repoName, kind string) error {
+	pull, err := image.NeedsPull(b.Cli, repoName, b.PullPolicy)
+	if err != nil || !pull {
+		return err
+	}
+	b.Log.Info("Pulling %s image '%s' (use --pull-policy to change when images are pulled)", kind, repoName)
+	return b.Cli.PullImage(repoName)
+}
+
 func (b *BuildConfig) imageLabel(repoName, key string, useDaemon bool) (string, error) {
+	labels, err := b.imageLabels(repoName, useDaemon)
+	if err != nil {
+		return "", err
+	}
+	return labels[key], nil
+}
+
+func (b *BuildConfig) imageLabels(repoName string, useDaemon bool) (map[string]string, error) {
 	var labels map[string]string
 	if useDaemon {
 		i, _, err := b.Cli.ImageInspectWithRaw(context.Background(), repoName)
 		if dockercli.IsErrNotFound(err) {
-			return "", nil
+			return nil, nil
 		} else if err != nil {
-			return "", errors.Wrap(err, "analyze read previous image config")
+			return nil, errors.Wrap(err, "analyze read previous image config")
 		}
 		labels = i.Config.Labels
 	} else {
 		origImage, err := b.Images.ReadImage(repoName, false)
 		if err != nil || origImage == nil {
-			return "", err
+			return nil, err
 		}
 		config, err := origImage.ConfigFile()
 		if err != nil {
 			if remoteErr, ok := err.(*remote.Error); ok && len(remoteErr.Errors) > 0 {
 				switch remoteErr.Errors[0].Code {
 				case remote.UnauthorizedErrorCode, remote.ManifestUnknownErrorCode:
-					return "", nil
+					return nil, nil
 				}
 			}
-			return "", errors.Wrapf(err, "access manifest: %s", repoName)
+			return nil, errors.Wrapf(err, "access manifest: %s", repoName)
 		}
 		labels = config.Config.Labels
 	}
 
-	return labels[key], nil
+	return labels, nil
+}
+
+// imageDigests returns a func reading the digests of an image, for checking
+// policy rules that name digests.
+func (b *BuildConfig) imageDigests(repoName string, useDaemon bool) func() ([]string, error) {
+	return func() ([]string, error) {
+		if useDaemon {
+			i, _, err := b.Cli.ImageInspectWithRaw(context.Background(), repoName)
+			if err != nil {
+				return nil, err
+			}
+			return append(i.RepoDigests, i.ID), nil
+		}
+		origImage, err := b.Images.ReadImage(repoName, false)
+		if err != nil {
+			return nil, err
+		}
+		if origImage == nil {
+			return nil, fmt.Errorf(`image "%s" was not found`, repoName)
+		}
+		digest, err := origImage.Digest()
+		if err != nil {
+			return nil, err
+		}
+		return []string{digest.String()}, nil
+	}
 }
 
 func (b *BuildConfig) packUidGid(builder string) (int, int, error) {
@@ -791,6 +1306,32 @@ func (b *BuildConfig) packUidGid(builder string) (int, int, error) {
 	return uid, gid, nil
 }
 
+// createLifecycleContainer creates a container from the builder to run a
+// lifecycle phase. When the builder is untrusted the container has no network
+// and no capabilities, and runs as the builder's pack user.
+func (b *BuildConfig) createLifecycleContainer(ctx context.Context, ctrConfig *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+	if b.UntrustedBuilder {
+		uid, gid, err := b.packUidGid(b.Builder)
+		if err != nil {
+			return container.ContainerCreateCreatedBody{}, err
+		}
+		if uid == 0 {
+			return container.ContainerCreateCreatedBody{}, fmt.Errorf(`untrusted builder "%s" cannot run as root: PACK_USER_ID is 0`, b.Builder)
+		}
+		ctrConfig.User = fmt.Sprintf("%d:%d", uid, gid)
+		hostConfig.NetworkMode = "none"
+		hostConfig.CapDrop = []string{"ALL"}
+		hostConfig.SecurityOpt = []string{"no-new-privileges"}
+	}
+	return b.Cli.ContainerCreate(ctx, ctrConfig, hostConfig, nil, "")
+}
+
+// runPhase runs a lifecycle container, prefixing its output with the phase.
+func (b *BuildConfig) runPhase(ctx context.Context, id, phase string) error {
+	stdout, stderr := b.Log.Phase(phase)
+	return b.Cli.RunContainer(ctx, id, stdout, stderr)
+}
+
 func (b *BuildConfig) chownDir(path string, uid, gid int) error {
 	ctx := context.Background()
 	ctr, err := b.Cli.ContainerCreate(ctx, &container.Config{
@@ -806,7 +1347,7 @@ func (b *BuildConfig) chownDir(path string, uid, gid int) error {
 		return err
 	}
 	defer b.Cli.ContainerRemove(ctx, ctr.ID, dockertypes.ContainerRemoveOptions{})
-	if err := b.Cli.RunContainer(ctx, ctr.ID, b.Stdout, b.Stderr); err != nil {
+	if err := b.runPhase(ctx, ctr.ID, "chown"); err != nil {
 		return err
 	}
 	return nil
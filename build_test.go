@@ -2,8 +2,10 @@ package pack_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -21,6 +23,7 @@ import (
 	"github.com/buildpack/pack/docker"
 	"github.com/buildpack/pack/fs"
 	"github.com/buildpack/pack/image"
+	"github.com/buildpack/pack/logging"
 	"github.com/buildpack/pack/mocks"
 	h "github.com/buildpack/pack/testhelpers"
 	dockertypes "github.com/docker/docker/api/types"
@@ -62,9 +65,7 @@ func testBuild(t *testing.T, when spec.G, it spec.S) {
 			Publish:         false,
 			WorkspaceVolume: fmt.Sprintf("pack-workspace-%x", uuid.New().String()),
 			CacheVolume:     fmt.Sprintf("pack-cache-%x", uuid.New().String()),
-			Stdout:          &buf,
-			Stderr:          &buf,
-			Log:             log.New(&buf, "", log.LstdFlags|log.Lshortfile),
+			Log:             logging.New(&buf, &buf, logging.Options{}),
 			FS:              &fs.FS{},
 			Images:          &image.Client{},
 		}
@@ -82,9 +83,13 @@ func testBuild(t *testing.T, when spec.G, it spec.S) {
 			mockController *gomock.Controller
 			mockImages     *mocks.MockImages
 			mockDocker     *mocks.MockDocker
+			tmpDir         string
 		)
 
 		it.Before(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "build-config-test")
+			h.AssertNil(t, err)
 			mockController = gomock.NewController(t)
 			mockImages = mocks.NewMockImages(mockController)
 			mockDocker = mocks.NewMockDocker(mockController)
@@ -101,12 +106,13 @@ func testBuild(t *testing.T, when spec.G, it spec.S) {
 					},
 				},
 				Cli: mockDocker,
-				Log: log.New(&buf, "", log.LstdFlags|log.Lshortfile),
+				Log: logging.New(&buf, &buf, logging.Options{}),
 			}
 		})
 
 		it.After(func() {
 			mockController.Finish()
+			os.RemoveAll(tmpDir)
 		})
 
 		it("defaults to daemon, default-builder, pulls builder and run images, selects run-image using builder's stack", func() {
@@ -128,9 +134,50 @@ func testBuild(t *testing.T, when spec.G, it spec.S) {
 				Builder:  "",
 			})
 			h.AssertNil(t, err)
+			h.AssertNil(t, config.CheckRunImage())
 			h.AssertEq(t, config.RunImage, "some/run")
 		})
 
+		when("the pull policy is if-not-present", func() {
+			it("only pulls images the daemon doesn't have", func() {
+				builderInspect := dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{"io.buildpacks.stack.id": "some.stack.id"},
+					},
+				}
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/builder").Return(builderInspect, nil, nil).Times(2)
+				gomock.InOrder(
+					mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/run").Return(dockertypes.ImageInspect{}, nil, notFoundError{}),
+					mockDocker.EXPECT().PullImage("some/run"),
+					mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/run").Return(dockertypes.ImageInspect{
+						Config: &dockercontainer.Config{
+							Labels: map[string]string{"io.buildpacks.stack.id": "some.stack.id"},
+						},
+					}, nil, nil),
+				)
+
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName:   "some/app",
+					PullPolicy: "if-not-present",
+				})
+				h.AssertNil(t, err)
+				h.AssertNil(t, config.CheckRunImage())
+				h.AssertEq(t, config.PullPolicy, image.PullIfNotPresent)
+				h.AssertContains(t, buf.String(), "Pulling run image 'some/run'")
+				if strings.Contains(buf.String(), "Pulling builder image") {
+					t.Fatalf("expected the builder image not to be pulled, output: %s", buf.String())
+				}
+			})
+		})
+
+		it("fails for an invalid pull policy", func() {
+			_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+				RepoName:   "some/app",
+				PullPolicy: "sometimes",
+			})
+			h.AssertError(t, err, `invalid pull policy "sometimes", expected one of: always, if-not-present, never`)
+		})
+
 		it("respects builder from flags", func() {
 			mockDocker.EXPECT().PullImage("custom/builder")
 			mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "custom/builder").Return(dockertypes.ImageInspect{
@@ -150,9 +197,202 @@ func testBuild(t *testing.T, when spec.G, it spec.S) {
 				Builder:  "custom/builder",
 			})
 			h.AssertNil(t, err)
+			h.AssertNil(t, config.CheckRunImage())
 			h.AssertEq(t, config.RunImage, "some/run")
 		})
 
+		when("the run image is given by flag", func() {
+			var builderInspect dockertypes.ImageInspect
+
+			it.Before(func() {
+				builderInspect = dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{"io.buildpacks.stack.id": "some.stack.id"},
+						Env:    []string{"PACK_USER_ID=1000", "PACK_GROUP_ID=1000"},
+					},
+				}
+			})
+
+			it("pulls it while pulling the builder", func() {
+				runPullStarted := make(chan struct{})
+				mockDocker.EXPECT().PullImage("some/builder").Do(func(string) {
+					select {
+					case <-runPullStarted:
+					case <-time.After(5 * time.Second):
+						t.Error("expected the run image to be pulled while pulling the builder")
+					}
+				})
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/builder").Return(builderInspect, nil, nil)
+				mockDocker.EXPECT().PullImage("some/run").Do(func(string) {
+					close(runPullStarted)
+				})
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/run").Return(builderInspect, nil, nil)
+
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName: "some/app",
+					RunImage: "some/run",
+				})
+				h.AssertNil(t, err)
+				h.AssertNil(t, config.CheckRunImage())
+			})
+
+			it("uploads the app while the run image is pulled, and detects once it is checked", func() {
+				uploaded := make(chan struct{})
+				runPulled := make(chan struct{})
+				mockDocker.EXPECT().PullImage("some/builder")
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/builder").Return(builderInspect, nil, nil).AnyTimes()
+				mockDocker.EXPECT().PullImage("some/run").Do(func(string) {
+					select {
+					case <-uploaded:
+					case <-time.After(5 * time.Second):
+						t.Error("expected the app to be uploaded while pulling the run image")
+					}
+					close(runPulled)
+				})
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/run").Return(builderInspect, nil, nil)
+				mockDocker.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), "").
+					Return(dockercontainer.ContainerCreateCreatedBody{ID: "detect-container"}, nil)
+				mockDocker.EXPECT().CopyToContainer(gomock.Any(), "detect-container", "/", gomock.Any(), gomock.Any()).
+					Do(func(_ context.Context, _, _ string, content io.Reader, _ dockertypes.CopyToContainerOptions) {
+						ioutil.ReadAll(content)
+						close(uploaded)
+					})
+				mockDocker.EXPECT().RunContainer(gomock.Any(), "detect-container", gomock.Any(), gomock.Any()).
+					Do(func(context.Context, string, io.Writer, io.Writer) {
+						select {
+						case <-runPulled:
+						default:
+							t.Error("expected the detector to run once the run image is checked")
+						}
+					}).
+					Return(fmt.Errorf("some detect error"))
+				mockDocker.EXPECT().ContainerRemove(gomock.Any(), "detect-container", gomock.Any())
+
+				factory.FS = &fs.FS{}
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					AppDir:   "acceptance/testdata/node_app",
+					RepoName: "some/app",
+					RunImage: "some/run",
+				})
+				h.AssertNil(t, err)
+
+				_, err = config.Detect()
+				h.AssertError(t, err, "run detect container: some detect error")
+			})
+
+			it("reports the run image error from Detect", func() {
+				mockDocker.EXPECT().PullImage("some/builder")
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/builder").Return(builderInspect, nil, nil).AnyTimes()
+				mockDocker.EXPECT().PullImage("some/run").Return(fmt.Errorf("some run image error"))
+				mockDocker.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), "").
+					Return(dockercontainer.ContainerCreateCreatedBody{ID: "detect-container"}, nil)
+				mockDocker.EXPECT().CopyToContainer(gomock.Any(), "detect-container", "/", gomock.Any(), gomock.Any()).
+					Do(func(_ context.Context, _, _ string, content io.Reader, _ dockertypes.CopyToContainerOptions) {
+						ioutil.ReadAll(content)
+					})
+				mockDocker.EXPECT().ContainerRemove(gomock.Any(), "detect-container", gomock.Any())
+
+				factory.FS = &fs.FS{}
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					AppDir:   "acceptance/testdata/node_app",
+					RepoName: "some/app",
+					RunImage: "some/run",
+				})
+				h.AssertNil(t, err)
+
+				_, err = config.Detect()
+				h.AssertError(t, err, "some run image error")
+			})
+
+			it("reports the builder error when both pulls fail, once the run image pull is done", func() {
+				runPulled := make(chan struct{})
+				mockDocker.EXPECT().PullImage("some/builder").Return(fmt.Errorf("some builder error"))
+				mockDocker.EXPECT().PullImage("some/run").Do(func(string) {
+					time.Sleep(10 * time.Millisecond)
+					close(runPulled)
+				}).Return(fmt.Errorf("some run image error"))
+
+				_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName: "some/app",
+					RunImage: "some/run",
+				})
+				h.AssertError(t, err, "some builder error")
+				select {
+				case <-runPulled:
+				default:
+					t.Fatal("expected the run image pull to be done")
+				}
+			})
+		})
+
+		when("the builder is not trusted", func() {
+			it.Before(func() {
+				mockDocker.EXPECT().PullImage("custom/builder")
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "custom/builder").Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{"io.buildpacks.stack.id": "some.stack.id"},
+					},
+				}, nil, nil)
+				mockDocker.EXPECT().PullImage("some/run")
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/run").Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{"io.buildpacks.stack.id": "some.stack.id"},
+					},
+				}, nil, nil)
+			})
+
+			it("isolates it", func() {
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName: "some/app",
+					Builder:  "custom/builder",
+				})
+				h.AssertNil(t, err)
+				h.AssertNil(t, config.CheckRunImage())
+				h.AssertEq(t, config.UntrustedBuilder, true)
+				h.AssertContains(t, buf.String(), "Running untrusted builder 'custom/builder' without network access")
+			})
+
+			it("does not isolate it with --trust-builder", func() {
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName:     "some/app",
+					Builder:      "custom/builder",
+					TrustBuilder: true,
+				})
+				h.AssertNil(t, err)
+				h.AssertNil(t, config.CheckRunImage())
+				h.AssertEq(t, config.UntrustedBuilder, false)
+			})
+
+			it("does not isolate it when it is in the trusted builders", func() {
+				factory.Config.TrustedBuilders = []string{"custom/builder"}
+
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName: "some/app",
+					Builder:  "custom/builder",
+				})
+				h.AssertNil(t, err)
+				h.AssertNil(t, config.CheckRunImage())
+				h.AssertEq(t, config.UntrustedBuilder, false)
+			})
+
+			it("asks the user when pack is run interactively", func() {
+				var questions []string
+				factory.Confirm = func(question string) (bool, error) {
+					questions = append(questions, question)
+					return true, nil
+				}
+
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName: "some/app",
+					Builder:  "custom/builder",
+				})
+				h.AssertNil(t, err)
+				h.AssertNil(t, config.CheckRunImage())
+				h.AssertEq(t, config.UntrustedBuilder, false)
+				h.AssertEq(t, questions, []string{"Builder 'custom/builder' is not trusted. Run it with network access and as root where needed?"})
+			})
+		})
+
 		it("selects run images with matching registry", func() {
 			mockDocker.EXPECT().PullImage("some/builder")
 			mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/builder").Return(dockertypes.ImageInspect{
@@ -172,6 +412,7 @@ func testBuild(t *testing.T, when spec.G, it spec.S) {
 				Builder:  "some/builder",
 			})
 			h.AssertNil(t, err)
+			h.AssertNil(t, config.CheckRunImage())
 			h.AssertEq(t, config.RunImage, "registry.com/some/run")
 		})
 
@@ -198,6 +439,7 @@ func testBuild(t *testing.T, when spec.G, it spec.S) {
 				Publish:  true,
 			})
 			h.AssertNil(t, err)
+			h.AssertNil(t, config.CheckRunImage())
 			h.AssertEq(t, config.RunImage, "some/run")
 		})
 
@@ -225,6 +467,7 @@ func testBuild(t *testing.T, when spec.G, it spec.S) {
 				Publish:  true,
 			})
 			h.AssertNil(t, err)
+			h.AssertNil(t, config.CheckRunImage())
 			h.AssertEq(t, config.RunImage, "override/run")
 		})
 
@@ -245,13 +488,14 @@ func testBuild(t *testing.T, when spec.G, it spec.S) {
 				},
 			}, nil)
 
-			_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+			config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
 				RepoName: "some/app",
 				Builder:  "some/builder",
 				RunImage: "override/run",
 				Publish:  true,
 			})
-			h.AssertError(t, err, `invalid stack: stack "other.stack.id" from run image "override/run" does not match stack "some.stack.id" from builder image "some/builder"`)
+			h.AssertNil(t, err)
+			h.AssertError(t, config.CheckRunImage(), `invalid stack: stack "other.stack.id" from run image "override/run" does not match stack "some.stack.id" from builder image "some/builder"`)
 		})
 
 		it("uses working dir if appDir is set to placeholder value", func() {
@@ -279,6 +523,7 @@ func testBuild(t *testing.T, when spec.G, it spec.S) {
 				AppDir:   "current working directory",
 			})
 			h.AssertNil(t, err)
+			h.AssertNil(t, config.CheckRunImage())
 			h.AssertEq(t, config.RunImage, "override/run")
 			h.AssertEq(t, config.AppDir, os.Getenv("PWD"))
 		})
@@ -298,6 +543,212 @@ func testBuild(t *testing.T, when spec.G, it spec.S) {
 			h.AssertError(t, err, `invalid builder image "some/builder": missing required label "io.buildpacks.stack.id"`)
 		})
 
+		when("the builder's stack is not in the local config", func() {
+			it("uses the stack recorded in the builder metadata label", func() {
+				mockDocker.EXPECT().PullImage("some/builder")
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/builder").Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{
+							"io.buildpacks.stack.id": "some.other.stack",
+							"io.buildpacks.builder.metadata": `{"stack": {"id": "some.other.stack", "build-image": "other/build",
+								"run-image": {"image": "other/run", "mirrors": ["registry.com/other/run"]}}}`,
+						},
+					},
+				}, nil, nil)
+				mockDocker.EXPECT().PullImage("registry.com/other/run")
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "registry.com/other/run").Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{"io.buildpacks.stack.id": "some.other.stack"},
+					},
+				}, nil, nil)
+
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName: "registry.com/some/app",
+					Builder:  "some/builder",
+				})
+				h.AssertNil(t, err)
+				h.AssertNil(t, config.CheckRunImage())
+				h.AssertEq(t, config.RunImage, "registry.com/other/run")
+			})
+
+			it("fails when the builder doesn't record its stack", func() {
+				mockDocker.EXPECT().PullImage("some/builder")
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/builder").Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{"io.buildpacks.stack.id": "some.other.stack"},
+					},
+				}, nil, nil)
+
+				_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName: "some/app",
+					Builder:  "some/builder",
+				})
+				h.AssertError(t, err, `Missing stack: stack with id "some.other.stack" not found in pack config.toml`)
+			})
+		})
+
+		when("buildpacks are given by ID", func() {
+			it.Before(func() {
+				mockDocker.EXPECT().PullImage("some/builder")
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/builder").Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{
+							"io.buildpacks.stack.id": "some.stack.id",
+							"io.buildpacks.builder.metadata": `{"buildpacks": [
+								{"id": "org.example.nodejs", "version": "1.0.0", "latest": true, "layers": ["sha256:aaa"]},
+								{"id": "org.example.nodejs", "version": "0.9.0", "latest": false, "layers": ["sha256:bbb"]},
+								{"id": "org.example.ruby", "version": "2.0.0", "latest": false, "layers": ["sha256:ccc"]}
+							]}`,
+						},
+					},
+				}, nil, nil)
+			})
+
+			it("accepts buildpacks found in the builder metadata", func() {
+				mockDocker.EXPECT().PullImage("some/run")
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/run").Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{"io.buildpacks.stack.id": "some.stack.id"},
+					},
+				}, nil, nil)
+
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName:   "some/app",
+					Builder:    "some/builder",
+					Buildpacks: []string{"org.example.nodejs", "org.example.nodejs@0.9.0", "org.example.ruby@2.0.0"},
+				})
+				h.AssertNil(t, err)
+				h.AssertNil(t, config.CheckRunImage())
+			})
+
+			it("suggests close matches for an unknown ID", func() {
+				_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName:   "some/app",
+					Builder:    "some/builder",
+					Buildpacks: []string{"org.example.node"},
+				})
+				h.AssertError(t, err, `buildpack "org.example.node" was not found in builder "some/builder", did you mean "org.example.nodejs"?`)
+			})
+
+			it("lists the available versions for an unknown version", func() {
+				_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName:   "some/app",
+					Builder:    "some/builder",
+					Buildpacks: []string{"org.example.nodejs@2.0.0"},
+				})
+				h.AssertError(t, err, `version "2.0.0" of buildpack "org.example.nodejs" was not found in builder "some/builder", available versions: 1.0.0, 0.9.0`)
+			})
+
+			it("fails when no version is marked latest", func() {
+				_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName:   "some/app",
+					Builder:    "some/builder",
+					Buildpacks: []string{"org.example.ruby"},
+				})
+				h.AssertError(t, err, `no version of buildpack "org.example.ruby" is marked latest in builder "some/builder", available versions: 2.0.0`)
+			})
+
+			it("checks the latest version against the policy", func() {
+				policyPath := filepath.Join(tmpDir, "policy.toml")
+				h.AssertNil(t, ioutil.WriteFile(policyPath, []byte(`[[buildpacks]]
+id = "org.example.nodejs"
+versions = ">=2"
+`), 0666))
+
+				_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName:   "some/app",
+					Builder:    "some/builder",
+					Buildpacks: []string{"org.example.nodejs"},
+					Policy:     policyPath,
+				})
+				h.AssertError(t, err, `policy "`+policyPath+`": version "1.0.0" of buildpack "org.example.nodejs" is not allowed by rule "buildpacks" (allowed: >=2)`)
+			})
+		})
+
+		it("fails for a builder that the policy does not allow without pulling it", func() {
+			policyPath := filepath.Join(tmpDir, "policy.toml")
+			h.AssertNil(t, ioutil.WriteFile(policyPath, []byte(`builders = ["registry.example.com/"]`), 0666))
+
+			_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+				RepoName: "some/app",
+				Policy:   policyPath,
+			})
+			h.AssertError(t, err, `policy "`+policyPath+`": builder "some/builder" is not allowed by rule "builders" (allowed: registry.example.com/)`)
+			h.AssertContains(t, buf.String(), "Using policy '"+policyPath+"'")
+		})
+
+		when("no buildpacks are given and the policy has buildpack rules", func() {
+			var policyPath string
+
+			it.Before(func() {
+				policyPath = filepath.Join(tmpDir, "policy.toml")
+				h.AssertNil(t, ioutil.WriteFile(policyPath, []byte(`[[buildpacks]]
+id = "org.example.nodejs"
+`), 0666))
+				mockDocker.EXPECT().PullImage("some/builder")
+			})
+
+			it("checks the buildpacks in the groups of the builder", func() {
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/builder").Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{
+							"io.buildpacks.stack.id": "some.stack.id",
+							"io.buildpacks.builder.metadata": `{
+								"buildpacks": [
+									{"id": "org.example.nodejs", "version": "1.0.0", "latest": true},
+									{"id": "org.example.ruby", "version": "2.0.0", "latest": true}
+								],
+								"groups": [
+									{"buildpacks": [{"id": "org.example.nodejs", "version": "latest"}]},
+									{"buildpacks": [{"id": "org.example.ruby", "version": "latest"}]}
+								]
+							}`,
+						},
+					},
+				}, nil, nil)
+
+				_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName: "some/app",
+					Builder:  "some/builder",
+					Policy:   policyPath,
+				})
+				h.AssertError(t, err, `policy "`+policyPath+`": buildpack "org.example.ruby" is not allowed by rule "buildpacks" (allowed: org.example.nodejs)`)
+			})
+
+			it("fails for a builder without metadata", func() {
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/builder").Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{"io.buildpacks.stack.id": "some.stack.id"},
+					},
+				}, nil, nil)
+
+				_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					RepoName: "some/app",
+					Builder:  "some/builder",
+					Policy:   policyPath,
+				})
+				h.AssertError(t, err, `policy "`+policyPath+`": the buildpacks of builder "some/builder" cannot be checked, it has no metadata label listing its groups`)
+			})
+		})
+
+		it("fails early when the builder's lifecycle version is not supported", func() {
+			mockDocker.EXPECT().PullImage("some/builder")
+			mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/builder").Return(dockertypes.ImageInspect{
+				Config: &dockercontainer.Config{
+					Labels: map[string]string{
+						"io.buildpacks.stack.id":         "some.stack.id",
+						"io.buildpacks.builder.metadata": `{"lifecycle": {"version": "0.9.0"}}`,
+					},
+				},
+			}, nil, nil)
+
+			_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+				RepoName: "some/app",
+				Builder:  "some/builder",
+			})
+			h.AssertError(t, err, `builder "some/builder" uses lifecycle 0.9.0, which this version of pack doesn't support (supported: 0.1.x)`)
+		})
+
 		it("sets EnvFile", func() {
 			mockDocker.EXPECT().PullImage("some/builder")
 			mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/builder").Return(dockertypes.ImageInspect{
@@ -330,6 +781,7 @@ USER
 				EnvFile:  envFile.Name(),
 			})
 			h.AssertNil(t, err)
+			h.AssertNil(t, config.CheckRunImage())
 			h.AssertEq(t, config.EnvFile, map[string]string{
 				"VAR1": "value1",
 				"VAR2": "value2 with spaces",
@@ -337,6 +789,130 @@ USER
 			})
 			h.AssertNotEq(t, os.Getenv("USER"), "")
 		})
+
+		when("the app has a project descriptor", func() {
+			var appDir string
+
+			expectImages := func(builder, runImage string) {
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), builder).Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{"io.buildpacks.stack.id": "some.stack.id"},
+					},
+				}, nil, nil)
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), runImage).Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{"io.buildpacks.stack.id": "some.stack.id"},
+					},
+				}, nil, nil)
+			}
+
+			it.Before(func() {
+				var err error
+				appDir, err = ioutil.TempDir("", "pack.build.descriptor")
+				h.AssertNil(t, err)
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(appDir, "project.toml"), []byte(`
+builder = "descriptor/builder"
+run-image = "descriptor/run"
+exclude = ["node_modules", "*.log"]
+
+[[buildpacks]]
+id = "some.bp"
+version = "1.2.3"
+
+[[buildpacks]]
+uri = "local-buildpack"
+
+[[buildpacks]]
+id = "other.bp"
+
+[env]
+VAR1 = "from-descriptor"
+VAR2 = "from-descriptor"
+`), 0644))
+			})
+
+			it.After(func() {
+				os.RemoveAll(appDir)
+			})
+
+			it("uses its settings", func() {
+				expectImages("descriptor/builder", "descriptor/run")
+
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					AppDir:     appDir,
+					RepoName:   "some/app",
+					PullPolicy: "never",
+				})
+				h.AssertNil(t, err)
+				h.AssertNil(t, config.CheckRunImage())
+				h.AssertEq(t, config.Builder, "descriptor/builder")
+				h.AssertEq(t, config.RunImage, "descriptor/run")
+				h.AssertEq(t, config.Buildpacks, []string{"some.bp@1.2.3", filepath.Join(appDir, "local-buildpack"), "other.bp"})
+				h.AssertEq(t, config.Exclude, []string{"node_modules", "*.log"})
+				h.AssertEq(t, config.EnvFile, map[string]string{"VAR1": "from-descriptor", "VAR2": "from-descriptor"})
+				h.AssertContains(t, buf.String(), fmt.Sprintf("Using project descriptor '%s'", filepath.Join(appDir, "project.toml")))
+			})
+
+			it("gives precedence to flags", func() {
+				expectImages("flag/builder", "flag/run")
+				envFile := filepath.Join(appDir, "env")
+				h.AssertNil(t, ioutil.WriteFile(envFile, []byte("VAR2=from-flag\n"), 0644))
+
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					AppDir:     appDir,
+					RepoName:   "some/app",
+					Builder:    "flag/builder",
+					RunImage:   "flag/run",
+					Buildpacks: []string{"flag.bp"},
+					EnvFile:    envFile,
+					PullPolicy: "never",
+				})
+				h.AssertNil(t, err)
+				h.AssertNil(t, config.CheckRunImage())
+				h.AssertEq(t, config.Builder, "flag/builder")
+				h.AssertEq(t, config.RunImage, "flag/run")
+				h.AssertEq(t, config.Buildpacks, []string{"flag.bp"})
+				h.AssertEq(t, config.EnvFile, map[string]string{"VAR1": "from-descriptor", "VAR2": "from-flag"})
+			})
+
+			it("reads the descriptor given by --descriptor", func() {
+				descriptor := filepath.Join(appDir, "ci.toml")
+				h.AssertNil(t, ioutil.WriteFile(descriptor, []byte(`builder = "ci/builder"`), 0644))
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "ci/builder").Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{"io.buildpacks.stack.id": "some.stack.id"},
+					},
+				}, nil, nil)
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/run").Return(dockertypes.ImageInspect{
+					Config: &dockercontainer.Config{
+						Labels: map[string]string{"io.buildpacks.stack.id": "some.stack.id"},
+					},
+				}, nil, nil)
+
+				config, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					AppDir:     appDir,
+					RepoName:   "some/app",
+					Descriptor: descriptor,
+					PullPolicy: "never",
+				})
+				h.AssertNil(t, err)
+				h.AssertNil(t, config.CheckRunImage())
+				h.AssertEq(t, config.Builder, "ci/builder")
+				h.AssertEq(t, len(config.Buildpacks), 0)
+			})
+
+			it("rejects unknown keys", func() {
+				descriptor := filepath.Join(appDir, "pack.toml")
+				h.AssertNil(t, ioutil.WriteFile(descriptor, []byte(`buildr = "typo/builder"`), 0644))
+
+				_, err := factory.BuildConfigFromFlags(&pack.BuildFlags{
+					AppDir:     appDir,
+					RepoName:   "some/app",
+					Descriptor: descriptor,
+				})
+				h.AssertError(t, err, fmt.Sprintf(`invalid project descriptor "%s": unknown key "buildr"`, descriptor))
+			})
+		})
 	})
 
 	when("#Detect", func() {
@@ -351,6 +927,21 @@ USER
 			}
 		})
 
+		when("the builder is not trusted", func() {
+			it("copies the app owned by the pack user without a root container", func() {
+				subject.UntrustedBuilder = true
+
+				_, err := subject.Detect()
+				h.AssertNil(t, err)
+
+				for _, name := range []string{"/workspace/app", "/workspace/app/mydir", "/workspace/app/mydir/myfile.txt"} {
+					txt, err := exec.Command("docker", "run", "--rm", "-v", subject.WorkspaceVolume+":/workspace", subject.Builder, "ls", "-ld", name).Output()
+					h.AssertNil(t, err)
+					h.AssertContains(t, string(txt), "pack pack")
+				}
+			})
+		})
+
 		when("app is detected", func() {
 			it("returns the successful group with node", func() {
 				group, err := subject.Detect()
@@ -408,7 +999,7 @@ USER
 					_, err := subject.Detect()
 					h.AssertNil(t, err)
 
-					h.AssertMatch(t, buf.String(), regexp.MustCompile(`DETECTING WITH MANUALLY-PROVIDED GROUP:\n[0-9\s:\/]* Group: My Sample Buildpack: pass\n`))
+					h.AssertMatch(t, buf.String(), regexp.MustCompile(`DETECTING WITH MANUALLY-PROVIDED GROUP:\n\[detector\] [0-9\s:\/]* Group: My Sample Buildpack: pass\n`))
 				})
 			})
 			when("id@version buildpack", func() {
@@ -420,7 +1011,7 @@ USER
 					_, err := subject.Detect()
 					h.AssertNil(t, err)
 
-					h.AssertMatch(t, buf.String(), regexp.MustCompile(`DETECTING WITH MANUALLY-PROVIDED GROUP:\n[0-9\s:\/]* Group: Sample Node.js Buildpack: pass\n`))
+					h.AssertMatch(t, buf.String(), regexp.MustCompile(`DETECTING WITH MANUALLY-PROVIDED GROUP:\n\[detector\] [0-9\s:\/]* Group: Sample Node.js Buildpack: pass\n`))
 				})
 			})
 		})
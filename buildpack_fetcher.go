@@ -0,0 +1,353 @@
+package pack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/buildpack/pack/config"
+	"github.com/buildpack/pack/fs"
+	"github.com/buildpack/pack/logging"
+)
+
+// buildpackFetcher turns a buildpack location (a directory, an archive, or a
+// file:// or http(s):// URI) into a local directory. It backs both
+// `create-builder` and `build --buildpack`.
+type buildpackFetcher struct {
+	Log    *logging.Logger
+	FS     FS
+	Config *config.Config
+	// Offline serves http(s) buildpacks from the download cache only
+	Offline bool
+}
+
+// isBuildpackLocation tells a location that fetch understands apart from a
+// buildpack ID.
+func isBuildpackLocation(ref string) bool {
+	if u, err := url.Parse(ref); err == nil {
+		switch u.Scheme {
+		case "file", "http", "https":
+			return true
+		}
+	}
+	_, err := os.Stat(ref)
+	return err == nil
+}
+
+// fetch returns the directory holding the buildpack at uri, along with the
+// sha256 of the archive it was extracted from. Relative paths are resolved
+// against baseDir. When expectedSHA is set it must match the archive.
+func (f *buildpackFetcher) fetch(baseDir, uri, expectedSHA string) (dir, digest string, err error) {
+	asurl, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+	switch asurl.Scheme {
+	case "", // This is the only way to support relative filepaths
+		"file": // URIs with file:// protocol force the use of absolute paths. Host=localhost may be implied with file:///
+
+		path := asurl.Path
+
+		if !asurl.IsAbs() && !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+
+		// a missing buildpack is reported once its buildpack.toml is read
+		if fi, err := os.Stat(path); err != nil || fi.IsDir() {
+			if expectedSHA != "" {
+				return "", "", fmt.Errorf(`sha256 can only be checked for archives and downloads: %q is a directory`, uri)
+			}
+			return path, "", nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "could not open file to extract: %q", path)
+		}
+		defer file.Close()
+		if digest, err = fileDigest(file); err != nil {
+			return "", "", errors.Wrapf(err, "could not read file: %q", path)
+		}
+		if err := checkDigest(uri, expectedSHA, digest); err != nil {
+			return "", "", err
+		}
+		tmpDir, err := ioutil.TempDir("", "pack-buildpack-")
+		if err != nil {
+			return "", "", fmt.Errorf(`failed to create temporary directory: %s`, err)
+		}
+		if err = f.extract(file, tmpDir); err != nil {
+			return "", "", errors.Wrapf(err, "could not extract %q", path)
+		}
+		return tmpDir, digest, nil
+	case "http", "https":
+		return f.download(uri, expectedSHA)
+	default:
+		return "", "", fmt.Errorf("unsupported protocol in uri %q", uri)
+	}
+}
+
+// downloadAttempts and downloadRetryDelay control how often a failed
+// download is retried; the delay doubles after every attempt.
+var (
+	downloadAttempts   = 4
+	downloadRetryDelay = 500 * time.Millisecond
+)
+
+// download fetches uri into the download cache. Downloads are extracted into
+// a staging directory and renamed into place, and the entry's .sha256 file is
+// written last, so an interrupted download never looks complete. A lock on the
+// entry keeps concurrent pack processes from downloading it at the same time,
+// and the returned dir is a copy of the entry made while the lock is held.
+func (f *buildpackFetcher) download(uri, expectedSHA string) (dir, digest string, err error) {
+	cache := NewDownloadCache(f.Config.Path())
+	if err := os.MkdirAll(cache.Dir, 0755); err != nil {
+		return "", "", err
+	}
+	cachedDir := cache.entryPath(uri)
+	lock, err := fs.Lock(cachedDir + ".lock")
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to lock download cache for %q", uri)
+	}
+	defer lock.Unlock()
+
+	etag, digest := cache.cached(cachedDir)
+	if f.Offline {
+		if digest == "" {
+			return "", "", fmt.Errorf("%q is not in the download cache and cannot be downloaded in offline mode", uri)
+		}
+		if err := checkDigest(uri, expectedSHA, digest); err != nil {
+			return "", "", err
+		}
+		f.Log.Info("Using cached version of %q", uri)
+		if err := f.useCached(cache, cachedDir, uri); err != nil {
+			return "", "", err
+		}
+		return f.copyEntry(cachedDir, digest)
+	}
+
+	var archive *os.File
+	delay := downloadRetryDelay
+	for attempt := 1; ; attempt++ {
+		var newEtag string
+		// a failed attempt keeps etag, so that a retry can still be answered
+		// with 304 Not Modified
+		archive, newEtag, err = f.downloadToFile(uri, etag)
+		if err == nil {
+			etag = newEtag
+			break
+		}
+		if attempt == downloadAttempts || !isRetryable(err) {
+			break
+		}
+		f.Log.Warn("Failed to download %q, retrying in %s: %s", uri, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to download from %q", uri)
+	} else if archive == nil {
+		// can use cached content
+		if err := checkDigest(uri, expectedSHA, digest); err != nil {
+			return "", "", err
+		}
+		if err := f.useCached(cache, cachedDir, uri); err != nil {
+			return "", "", err
+		}
+		return f.copyEntry(cachedDir, digest)
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	if digest, err = fileDigest(archive); err != nil {
+		return "", "", err
+	}
+	if err := checkDigest(uri, expectedSHA, digest); err != nil {
+		return "", "", err
+	}
+
+	stagingDir, err := ioutil.TempDir(cache.Dir, downloadCacheStagingPrefix)
+	if err != nil {
+		return "", "", fmt.Errorf(`failed to create temporary directory: %s`, err)
+	}
+	defer os.RemoveAll(stagingDir)
+	if err = f.extract(archive, stagingDir); err != nil {
+		return "", "", errors.Wrapf(err, "could not extract download from %q", uri)
+	}
+	if err = cache.remove(cachedDir); err != nil {
+		return "", "", err
+	}
+	if err = os.Rename(stagingDir, cachedDir); err != nil {
+		return "", "", err
+	}
+	if err = fs.WriteFileAtomic(cachedDir+".uri", []byte(uri), 0644); err != nil {
+		return "", "", err
+	}
+	if err = fs.WriteFileAtomic(cachedDir+".etag", []byte(etag), 0644); err != nil {
+		return "", "", err
+	}
+	if err = fs.WriteFileAtomic(cachedDir+".sha256", []byte(digest), 0644); err != nil {
+		return "", "", err
+	}
+	return f.copyEntry(cachedDir, digest)
+}
+
+// copyEntry copies the cache entry at cachedDir into a temporary directory,
+// which stays readable once the lock on the entry is released and another
+// pack process replaces or removes the entry.
+func (f *buildpackFetcher) copyEntry(cachedDir, digest string) (string, string, error) {
+	tmpDir, err := ioutil.TempDir("", "pack-buildpack-")
+	if err != nil {
+		return "", "", fmt.Errorf(`failed to create temporary directory: %s`, err)
+	}
+	r, errChan := f.FS.CreateTarReaderWithDirs(cachedDir, ".", 0, 0, nil)
+	if err := f.FS.Untar(r, tmpDir); err != nil {
+		io.Copy(ioutil.Discard, r)
+		<-errChan
+		return "", "", errors.Wrapf(err, "could not copy cache entry %q", cachedDir)
+	}
+	if err := <-errChan; err != nil {
+		return "", "", errors.Wrapf(err, "could not copy cache entry %q", cachedDir)
+	}
+	return tmpDir, digest, nil
+}
+
+// useCached records that a cache entry was used, which also names the URI
+// of entries cached before the URI was recorded.
+func (f *buildpackFetcher) useCached(cache *DownloadCache, cachedDir, uri string) error {
+	if _, err := os.Stat(cachedDir + ".uri"); os.IsNotExist(err) {
+		return fs.WriteFileAtomic(cachedDir+".uri", []byte(uri), 0644)
+	}
+	return cache.touch(cachedDir)
+}
+
+type downloadStatusError struct {
+	uri  string
+	code int
+}
+
+func (e *downloadStatusError) Error() string {
+	return fmt.Sprintf("could not download from %q, code http status %d", e.uri, e.code)
+}
+
+// isRetryable tells failures that may succeed on another attempt, such as
+// dropped connections and server errors, apart from ones that won't.
+func isRetryable(err error) bool {
+	if statusErr, ok := errors.Cause(err).(*downloadStatusError); ok {
+		return statusErr.code >= 500
+	}
+	return true
+}
+
+// downloadToFile downloads uri into a temporary file, unless the server
+// reports that the content matching etag is still current, in which case the
+// returned file is nil.
+func (f *buildpackFetcher) downloadToFile(uri string, etag string) (*os.File, string, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		f.Log.Info("Using cached version of %q", uri)
+		return nil, etag, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, "", &downloadStatusError{uri: uri, code: resp.StatusCode}
+	}
+
+	f.Log.Info("Downloading from %q", uri)
+	file, err := ioutil.TempFile("", "pack-buildpack-")
+	if err != nil {
+		return nil, "", fmt.Errorf(`failed to create temporary file: %s`, err)
+	}
+	n, err := io.Copy(file, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = fmt.Errorf("received %d of %d bytes", n, resp.ContentLength)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, "", err
+	}
+	return file, resp.Header.Get("Etag"), nil
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+	tarMagic  = []byte("ustar")
+)
+
+// extract unpacks a gzipped tar, plain tar or zip archive into dir, telling
+// them apart by content rather than by file name.
+func (f *buildpackFetcher) extract(file *os.File, dir string) error {
+	header := make([]byte, 262)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	header = header[:n]
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		gzr, err := gzip.NewReader(file)
+		if err != nil {
+			return errors.Wrapf(err, "could not unzip")
+		}
+		defer gzr.Close()
+		return f.FS.Untar(gzr, dir)
+	case bytes.HasPrefix(header, zipMagic):
+		fi, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		return f.FS.Unzip(file, fi.Size(), dir)
+	case len(header) >= 262 && bytes.HasPrefix(header[257:], tarMagic):
+		return f.FS.Untar(file, dir)
+	default:
+		return errors.New("unsupported archive format, expected a gzipped tar, tar or zip archive")
+	}
+}
+
+func fileDigest(file *os.File) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+func checkDigest(uri, expected, actual string) error {
+	if expected == "" || strings.EqualFold(expected, actual) {
+		return nil
+	}
+	return fmt.Errorf(`sha256 mismatch for %q: expected %s, got %s`, uri, expected, actual)
+}
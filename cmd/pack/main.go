@@ -1,44 +1,126 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/buildpack/pack"
 	"github.com/buildpack/pack/config"
 	"github.com/buildpack/pack/docker"
 	"github.com/buildpack/pack/fs"
 	"github.com/buildpack/pack/image"
+	"github.com/buildpack/pack/logging"
+	"github.com/docker/docker/pkg/term"
 	"github.com/spf13/cobra"
 )
 
 var Version = "UNKNOWN"
 
+// logger is set up from the global flags before any command runs
+var logger = logging.New(os.Stdout, os.Stderr, logging.Options{})
+
+// profile is the config profile given with --profile, passed to config.NewDefault
+var profile string
+
+type logFlags struct {
+	verbose    bool
+	quiet      bool
+	noColor    bool
+	timestamps bool
+	file       string
+}
+
 func main() {
-	rootCmd := &cobra.Command{Use: "pack"}
+	var (
+		lf      logFlags
+		logFile *os.File
+	)
+	rootCmd := &cobra.Command{
+		Use:           "pack",
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			l, f, err := newLogger(lf)
+			if err != nil {
+				return err
+			}
+			logger, logFile = l, f
+			return nil
+		},
+	}
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "config profile to use instead of the active one")
+	rootCmd.PersistentFlags().BoolVarP(&lf.verbose, "verbose", "v", false, "show debug output")
+	rootCmd.PersistentFlags().BoolVarP(&lf.quiet, "quiet", "q", false, "only show warnings, errors and the error output of lifecycle phases")
+	rootCmd.PersistentFlags().BoolVar(&lf.noColor, "no-color", false, "don't color the output")
+	rootCmd.PersistentFlags().BoolVar(&lf.timestamps, "timestamps", false, "prefix output with the time")
+	rootCmd.PersistentFlags().StringVar(&lf.file, "log-file", "", "write a transcript of all output, including debug output, to a file")
 	for _, f := range [](func() *cobra.Command){
 		buildCommand,
 		runCommand,
+		logsCommand,
+		stopCommand,
 		rebaseCommand,
 		createBuilderCommand,
+		packageBuildpackCommand,
+		dlCacheCommand,
 		addStackCommand,
 		updateStackCommand,
 		deleteStackCommand,
 		setDefaultStackCommand,
 		setDefaultBuilderCommand,
+		trustBuilderCommand,
+		untrustBuilderCommand,
+		stacksCommand,
+		inspectStackCommand,
+		configCommand,
+		policyCommand,
 		versionCommand,
 	} {
 		rootCmd.AddCommand(f())
 	}
-	if err := rootCmd.Execute(); err != nil {
+	cmd, err := rootCmd.ExecuteC()
+	if err != nil {
+		logger.Error("%s", err)
+		// commands silence usage once their arguments are valid
+		if !cmd.SilenceUsage {
+			fmt.Fprintf(os.Stderr, "Run '%s --help' for usage.\n", cmd.CommandPath())
+		}
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+	if err != nil {
 		os.Exit(1)
 	}
 }
 
+func newLogger(f logFlags) (*logging.Logger, *os.File, error) {
+	if f.verbose && f.quiet {
+		return nil, nil, fmt.Errorf("--verbose cannot be used with --quiet")
+	}
+	opts := logging.Options{
+		Verbose:    f.verbose,
+		Quiet:      f.quiet,
+		Color:      !f.noColor && term.IsTerminal(os.Stdout.Fd()),
+		Timestamps: f.timestamps,
+	}
+	var file *os.File
+	if f.file != "" {
+		var err error
+		if file, err = os.OpenFile(f.file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
+			return nil, nil, fmt.Errorf("failed to open log file: %s", err)
+		}
+		opts.Transcript = file
+	}
+	return logging.New(os.Stdout, os.Stderr, opts), file, nil
+}
+
 func buildCommand() *cobra.Command {
 	var buildFlags pack.BuildFlags
 	buildCommand := &cobra.Command{
@@ -48,7 +130,7 @@ func buildCommand() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SilenceUsage = true
 			buildFlags.RepoName = args[0]
-			bf, err := pack.DefaultBuildFactory()
+			bf, err := pack.DefaultBuildFactory(logger, profile)
 			if err != nil {
 				return err
 			}
@@ -67,11 +149,17 @@ func buildCommand() *cobra.Command {
 func runCommand() *cobra.Command {
 	var runFlags pack.RunFlags
 	runCommand := &cobra.Command{
-		Use:   "run",
+		Use:   "run [-- <args>...]",
 		Short: "Create and immediately run an app image from source code using buildpacks",
-		Args:  cobra.NoArgs,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 && cmd.ArgsLenAtDash() != 0 {
+				return fmt.Errorf("unexpected arguments %v, arguments for the app must follow --", args)
+			}
+			return nil
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			bf, err := pack.DefaultBuildFactory()
+			runFlags.Args = args
+			bf, err := pack.DefaultBuildFactory(logger, profile)
 			if err != nil {
 				return err
 			}
@@ -86,16 +174,100 @@ func runCommand() *cobra.Command {
 
 	buildCommandFlags(runCommand, &runFlags.BuildFlags)
 	runCommand.Flags().StringVar(&runFlags.Port, "port", "", "comma separated ports to publish, defaults to ports exposed by the container")
+	runCommand.Flags().BoolVar(&runFlags.Watch, "watch", false, "rebuild and restart the app when files in the app dir change")
+	runCommand.Flags().StringArrayVar(&runFlags.Env, "run-env", []string{}, "environment variable KEY=VAL for the app, \n\t\t repeat for each variable")
+	runCommand.Flags().StringVar(&runFlags.EnvFile, "run-env-file", "", "file of environment variables for the app")
+	runCommand.Flags().StringVar(&runFlags.Process, "process", "", "process type to launch, defaults to web")
+	runCommand.Flags().StringArrayVar(&runFlags.Volumes, "run-volume", []string{}, "volume to mount in the app container, as <host-path-or-volume>:<container-path>[:ro], \n\t\t repeat for each volume")
+	runCommand.Flags().StringVar(&runFlags.Name, "name", "", "name of the app container")
+	runCommand.Flags().BoolVarP(&runFlags.Detach, "detach", "d", false, "run the app in the background")
+	runCommand.Flags().StringVar(&runFlags.HealthPath, "health-path", "", "HTTP path that responds with 2xx once the app is ready, \n\t\t instead of waiting for published ports to accept connections")
+	runCommand.Flags().DurationVar(&runFlags.ReadyTimeout, "ready-timeout", time.Minute, "how long to wait for the app to be ready, 0 to not wait")
 	return runCommand
 }
 
+func logsCommand() *cobra.Command {
+	var follow bool
+	cmd := &cobra.Command{
+		Use:   "logs <container>",
+		Short: "Show the output of an app started with run --detach",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			docker, err := docker.New()
+			if err != nil {
+				return err
+			}
+			return pack.Logs(docker, args[0], follow, logger.Stdout(), logger.Stderr())
+		},
+	}
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "keep showing output until the app exits")
+	return cmd
+}
+
+func stopCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stop <container>",
+		Short: "Stop and remove an app started with run --detach",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			docker, err := docker.New()
+			if err != nil {
+				return err
+			}
+			if err := pack.Stop(docker, args[0]); err != nil {
+				return err
+			}
+			logger.Info("Stopped container '%s'", args[0])
+			return nil
+		},
+	}
+	return cmd
+}
+
 func buildCommandFlags(cmd *cobra.Command, buildFlags *pack.BuildFlags) {
 	cmd.Flags().StringVarP(&buildFlags.AppDir, "path", "p", "current working directory", "path to app dir")
 	cmd.Flags().StringVar(&buildFlags.Builder, "builder", "", "builder")
 	cmd.Flags().StringVar(&buildFlags.RunImage, "run-image", "", "run image")
 	cmd.Flags().StringVar(&buildFlags.EnvFile, "env-file", "", "env file")
-	cmd.Flags().BoolVar(&buildFlags.NoPull, "no-pull", false, "don't pull images before use")
+	pullPolicyFlags(cmd, &buildFlags.PullPolicy)
 	cmd.Flags().StringArrayVar(&buildFlags.Buildpacks, "buildpack", []string{}, "buildpack ID or host directory path, \n\t\t repeat for each buildpack in order")
+	cmd.Flags().StringVar(&buildFlags.Descriptor, "descriptor", "", "project descriptor file (defaults to project.toml or pack.toml in the app dir)")
+	cmd.Flags().StringVar(&buildFlags.Policy, "policy", "", "policy file (defaults to policy.toml in PACK_HOME)")
+	cmd.Flags().BoolVar(&buildFlags.TrustBuilder, "trust-builder", false, "run the builder with network access and as root where needed, even if it isn't trusted")
+}
+
+// pullPolicyFlags adds --pull-policy, and --no-pull which is kept as a
+// deprecated alias of --pull-policy never.
+func pullPolicyFlags(cmd *cobra.Command, policy *string) {
+	cmd.Flags().StringVar(policy, "pull-policy", string(image.PullAlways), "when to pull images before use: always, if-not-present or never")
+	cmd.Flags().Var(&noPullValue{policy: policy}, "no-pull", "don't pull images before use")
+	cmd.Flags().Lookup("no-pull").NoOptDefVal = "true"
+	cmd.Flags().MarkDeprecated("no-pull", "use --pull-policy never instead")
+}
+
+type noPullValue struct {
+	policy *string
+}
+
+func (v *noPullValue) String() string {
+	return strconv.FormatBool(*v.policy == string(image.PullNever))
+}
+
+func (v *noPullValue) Set(s string) error {
+	noPull, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if noPull {
+		*v.policy = string(image.PullNever)
+	}
+	return nil
+}
+
+func (v *noPullValue) Type() string {
+	return "bool"
 }
 
 func rebaseCommand() *cobra.Command {
@@ -108,16 +280,16 @@ func rebaseCommand() *cobra.Command {
 			cmd.SilenceUsage = true
 			flags.RepoName = args[0]
 
-			imageFactory, err := image.DefaultFactory()
+			imageFactory, err := image.DefaultFactory(logger)
 			if err != nil {
 				return err
 			}
-			cfg, err := config.NewDefault()
+			cfg, err := config.NewDefault(profile)
 			if err != nil {
 				return err
 			}
 			factory := pack.RebaseFactory{
-				Log:          log.New(os.Stdout, "", log.LstdFlags),
+				Log:          logger,
 				Config:       cfg,
 				ImageFactory: imageFactory,
 			}
@@ -129,7 +301,54 @@ func rebaseCommand() *cobra.Command {
 		},
 	}
 	cmd.Flags().BoolVar(&flags.Publish, "publish", false, "publish to registry")
-	cmd.Flags().BoolVar(&flags.NoPull, "no-pull", false, "don't pull images before use")
+	pullPolicyFlags(cmd, &flags.PullPolicy)
+	cmd.Flags().StringVar(&flags.Policy, "policy", "", "policy file (defaults to policy.toml in PACK_HOME)")
+	return cmd
+}
+
+func policyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "policy",
+		Short: "Check builds against the policy for builders, buildpacks and registries",
+	}
+	cmd.AddCommand(policyCheckCommand())
+	return cmd
+}
+
+func policyCheckCommand() *cobra.Command {
+	var buildFlags pack.BuildFlags
+	cmd := &cobra.Command{
+		Use:   "check [<image-name>]",
+		Short: "Check whether the policy allows building an app, without building it",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			if len(args) > 0 {
+				buildFlags.RepoName = args[0]
+			}
+			bf, err := pack.DefaultBuildFactory(logger, profile)
+			if err != nil {
+				return err
+			}
+			// nothing is run, so there is no need to ask whether to trust the builder
+			bf.Confirm = nil
+			b, err := bf.BuildConfigFromFlags(&buildFlags)
+			if err != nil {
+				return err
+			}
+			if err := b.CheckPolicy(); err != nil {
+				return err
+			}
+			if b.Policy == nil {
+				logger.Info("No policy found, everything is allowed.")
+				return nil
+			}
+			logger.Info("Policy '%s' allows this build.", b.Policy.Path)
+			return nil
+		},
+	}
+	buildCommandFlags(cmd, &buildFlags)
+	cmd.Flags().BoolVar(&buildFlags.Publish, "publish", false, "check publishing to the registry of the image name")
 	return cmd
 }
 
@@ -147,13 +366,14 @@ func createBuilderCommand() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			cfg, err := config.NewDefault()
+			docker.Progress = logger.Progress()
+			cfg, err := config.NewDefault(profile)
 			if err != nil {
 				return err
 			}
 			builderFactory := pack.BuilderFactory{
 				FS:     &fs.FS{},
-				Log:    log.New(os.Stdout, "", log.LstdFlags),
+				Log:    logger,
 				Docker: docker,
 				Config: cfg,
 				Images: &image.Client{},
@@ -162,16 +382,162 @@ func createBuilderCommand() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if flags.ValidateOnly {
+				if err := builderFactory.Validate(builderConfig); err != nil {
+					return err
+				}
+				logger.Info("%s is valid", flags.BuilderTomlPath)
+				return nil
+			}
 			return builderFactory.Create(builderConfig)
 		},
 	}
-	createBuilderCommand.Flags().BoolVar(&flags.NoPull, "no-pull", false, "don't pull stack image before use")
+	pullPolicyFlags(createBuilderCommand, &flags.PullPolicy)
 	createBuilderCommand.Flags().StringVarP(&flags.BuilderTomlPath, "builder-config", "b", "", "path to builder.toml file")
 	createBuilderCommand.Flags().StringVarP(&flags.StackID, "stack", "s", "", "stack ID")
 	createBuilderCommand.Flags().BoolVar(&flags.Publish, "publish", false, "publish to registry")
+	createBuilderCommand.Flags().BoolVar(&flags.ValidateOnly, "validate-only", false, "check builder.toml and its buildpacks without creating the builder")
+	createBuilderCommand.Flags().BoolVar(&flags.Lock, "lock", false, "write the sha256 digests of buildpack archives to builder.toml")
+	createBuilderCommand.Flags().BoolVar(&flags.Offline, "offline", false, "use previously downloaded buildpacks and local images instead of downloading them")
+	createBuilderCommand.Flags().StringVar(&flags.Policy, "policy", "", "policy file (defaults to policy.toml in PACK_HOME)")
 	return createBuilderCommand
 }
 
+func packageBuildpackCommand() *cobra.Command {
+	var flags pack.PackageBuildpackFlags
+	cmd := &cobra.Command{
+		Use:   "package-buildpack <path-to-buildpack>",
+		Short: "Package a buildpack directory into an archive or image",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			flags.BuildpackDir = args[0]
+
+			factory := pack.PackageFactory{
+				FS:     &fs.FS{},
+				Log:    logger,
+				Images: &image.Client{},
+			}
+			packageConfig, err := factory.PackageConfigFromFlags(flags)
+			if err != nil {
+				return err
+			}
+			return factory.Package(packageConfig)
+		},
+	}
+	cmd.Flags().StringVarP(&flags.OutputPath, "output", "o", "", "path of the archive to write (default <id>-<version>.tgz)")
+	cmd.Flags().StringVar(&flags.ImageName, "image", "", "also create a buildpack image with this name")
+	cmd.Flags().BoolVar(&flags.Publish, "publish", false, "publish the buildpack image to registry")
+	return cmd
+}
+
+func dlCacheCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dl-cache",
+		Short: "Manage buildpacks downloaded by `pack create-builder`",
+	}
+	cmd.AddCommand(dlCacheListCommand(), dlCachePruneCommand(), dlCacheClearCommand())
+	return cmd
+}
+
+func downloadCache() (*pack.DownloadCache, error) {
+	cfg, err := config.NewDefault(profile)
+	if err != nil {
+		return nil, err
+	}
+	return pack.NewDownloadCache(cfg.Path()), nil
+}
+
+func dlCacheListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List downloaded buildpacks",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cache, err := downloadCache()
+			if err != nil {
+				return err
+			}
+			entries, err := cache.List()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "URI\tSIZE\tLAST USED")
+			for _, entry := range entries {
+				uri := entry.URI
+				if uri == "" {
+					uri = "<unknown>"
+				}
+				if !entry.Complete {
+					uri += " (incomplete)"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", uri, humanSize(entry.Size), entry.LastUsed.Format("2006-01-02 15:04:05"))
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func dlCachePruneCommand() *cobra.Command {
+	var unusedFor time.Duration
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove downloaded buildpacks that have not been used recently",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cache, err := downloadCache()
+			if err != nil {
+				return err
+			}
+			pruned, err := cache.Prune(unusedFor)
+			var freed int64
+			for _, entry := range pruned {
+				freed += entry.Size
+			}
+			logger.Info("Removed %d entries, freeing %s", len(pruned), humanSize(freed))
+			return err
+		},
+	}
+	cmd.Flags().DurationVar(&unusedFor, "unused-for", 30*24*time.Hour, "remove entries that have not been used for this long")
+	return cmd
+}
+
+func dlCacheClearCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "clear",
+		Short: "Remove all downloaded buildpacks",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cache, err := downloadCache()
+			if err != nil {
+				return err
+			}
+			if err := cache.Clear(); err != nil {
+				return err
+			}
+			logger.Info("Download cache cleared")
+			return nil
+		},
+	}
+}
+
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
 func addStackCommand() *cobra.Command {
 	flags := struct {
 		BuildImages []string
@@ -183,7 +549,7 @@ func addStackCommand() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SilenceUsage = true
-			cfg, err := config.NewDefault()
+			cfg, err := config.NewDefault(profile)
 			if err != nil {
 				return err
 			}
@@ -194,7 +560,7 @@ func addStackCommand() *cobra.Command {
 			}); err != nil {
 				return err
 			}
-			fmt.Printf("%s successfully added\n", args[0])
+			logger.Info("%s successfully added", args[0])
 			return nil
 		},
 	}
@@ -210,7 +576,7 @@ func setDefaultStackCommand() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SilenceUsage = true
-			cfg, err := config.NewDefault()
+			cfg, err := config.NewDefault(profile)
 			if err != nil {
 				return err
 			}
@@ -218,7 +584,7 @@ func setDefaultStackCommand() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			fmt.Printf("%s is now the default stack\n", args[0])
+			logger.Info("%s is now the default stack", args[0])
 			return nil
 		},
 	}
@@ -231,7 +597,7 @@ func setDefaultBuilderCommand() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SilenceUsage = true
-			cfg, err := config.NewDefault()
+			cfg, err := config.NewDefault(profile)
 			if err != nil {
 				return err
 			}
@@ -239,7 +605,47 @@ func setDefaultBuilderCommand() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			fmt.Printf("Successfully set '%s' as default builder.\n", args[0])
+			logger.Info("Successfully set '%s' as default builder.", args[0])
+			return nil
+		},
+	}
+}
+
+func trustBuilderCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "trust-builder <builder-name>",
+		Short: "Let `pack build` run a builder with network access and as root where needed",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := config.NewDefault(profile)
+			if err != nil {
+				return err
+			}
+			if err := cfg.TrustBuilder(args[0]); err != nil {
+				return err
+			}
+			logger.Info("Builder '%s' is now trusted.", args[0])
+			return nil
+		},
+	}
+}
+
+func untrustBuilderCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "untrust-builder <builder-name>",
+		Short: "Isolate a builder again when `pack build` runs it",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := config.NewDefault(profile)
+			if err != nil {
+				return err
+			}
+			if err := cfg.UntrustBuilder(args[0]); err != nil {
+				return err
+			}
+			logger.Info("Builder '%s' is no longer trusted.", args[0])
 			return nil
 		},
 	}
@@ -256,7 +662,7 @@ func updateStackCommand() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SilenceUsage = true
-			cfg, err := config.NewDefault()
+			cfg, err := config.NewDefault(profile)
 			if err != nil {
 				return err
 			}
@@ -266,7 +672,7 @@ func updateStackCommand() *cobra.Command {
 			}); err != nil {
 				return err
 			}
-			fmt.Printf("%s successfully updated\n", args[0])
+			logger.Info("%s successfully updated", args[0])
 			return nil
 		},
 	}
@@ -282,20 +688,340 @@ func deleteStackCommand() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SilenceUsage = true
-			cfg, err := config.NewDefault()
+			cfg, err := config.NewDefault(profile)
 			if err != nil {
 				return err
 			}
 			if err := cfg.Delete(args[0]); err != nil {
 				return err
 			}
-			fmt.Printf("%s has been successfully deleted\n", args[0])
+			logger.Info("%s has been successfully deleted", args[0])
 			return nil
 		},
 	}
 	return addStackCommand
 }
 
+func stacksCommand() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "stacks",
+		Short: "List the stacks in your pack config",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := config.NewDefault(profile)
+			if err != nil {
+				return err
+			}
+			for _, id := range cfg.DuplicateStackIDs() {
+				logger.Warn(`stack "%s" is listed more than once in config.toml, only the first one is used`, id)
+			}
+			stacks := pack.ListStacks(cfg)
+			return printFormatted(format, stacks, func() error {
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+				fmt.Fprintln(w, "ID\tBUILD IMAGES\tRUN IMAGES")
+				for _, stack := range stacks {
+					id := stack.ID
+					if stack.Default {
+						id += " (default)"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\n", id, strings.Join(stack.BuildImages, ", "), strings.Join(stack.RunImages, ", "))
+				}
+				return w.Flush()
+			})
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "table", "output format: table or json")
+	return cmd
+}
+
+func inspectStackCommand() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "inspect-stack <stack-name>",
+		Short: "Show whether the images of a stack exist locally and remotely",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			if err := checkFormat(format); err != nil {
+				return err
+			}
+			cfg, err := config.NewDefault(profile)
+			if err != nil {
+				return err
+			}
+			imageFactory, err := image.DefaultFactory(logger)
+			if err != nil {
+				return err
+			}
+			inspector := pack.StackInspector{Config: cfg, ImageFactory: imageFactory}
+			details, err := inspector.Inspect(args[0])
+			if err != nil {
+				return err
+			}
+			return printFormatted(format, details, func() error {
+				id := details.ID
+				if details.Default {
+					id += " (default)"
+				}
+				fmt.Printf("Stack: %s\n\n", id)
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+				fmt.Fprintln(w, "IMAGE\tTYPE\tLOCAL\tREMOTE")
+				for _, img := range details.Images {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", img.Name, img.Type, describeLocation(img.Local, details.ID), describeLocation(img.Remote, details.ID))
+				}
+				return w.Flush()
+			})
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "table", "output format: table or json")
+	return cmd
+}
+
+func describeLocation(location pack.StackImageLocation, stackID string) string {
+	switch {
+	case location.Error != "":
+		return "unknown: " + location.Error
+	case !location.Exists:
+		return "not found"
+	case location.StackID == "":
+		return "found, missing stack label"
+	case !location.Matches(stackID):
+		return fmt.Sprintf("found, wrong stack label %q", location.StackID)
+	default:
+		return "found"
+	}
+}
+
+func checkFormat(format string) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf(`unknown format "%s", expected table or json`, format)
+	}
+	return nil
+}
+
+// printFormatted prints v as JSON when format is json, and otherwise calls printTable.
+func printFormatted(format string, v interface{}, printTable func() error) error {
+	if err := checkFormat(format); err != nil {
+		return err
+	}
+	if format == "table" {
+		return printTable()
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func configCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Show and change the settings in your pack config",
+	}
+	cmd.AddCommand(configListCommand(), configGetCommand(), configSetCommand(), configUnsetCommand(), configProfileCommand())
+	return cmd
+}
+
+func configProfileCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "profile",
+		Short: "Manage named sets of settings layered over the shared config",
+	}
+	cmd.AddCommand(configProfileCreateCommand(), configProfileUseCommand(), configProfileListCommand())
+	return cmd
+}
+
+// sharedConfig reads the config without any profile, so that profiles can be
+// managed even when the active one is broken.
+func sharedConfig() (*config.Config, error) {
+	return config.NewWithProfile(config.DefaultPath(), config.DefaultProfile)
+}
+
+func configProfileCreateCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "create <profile-name>",
+		Short: "Create a profile that inherits every setting of the shared config",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := sharedConfig()
+			if err != nil {
+				return err
+			}
+			if err := cfg.CreateProfile(args[0]); err != nil {
+				return err
+			}
+			logger.Info("Successfully created profile '%s'.", args[0])
+			return nil
+		},
+	}
+}
+
+func configProfileUseCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "use <profile-name>",
+		Short: "Make a profile active, or the shared config with 'default'",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := sharedConfig()
+			if err != nil {
+				return err
+			}
+			if err := cfg.UseProfile(args[0]); err != nil {
+				return err
+			}
+			logger.Info("Successfully switched to profile '%s'.", args[0])
+			return nil
+		},
+	}
+}
+
+func configProfileListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the profiles and mark the active one",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := sharedConfig()
+			if err != nil {
+				return err
+			}
+			profiles, err := cfg.Profiles()
+			if err != nil {
+				return err
+			}
+			active := cfg.ActiveProfile
+			if active == "" {
+				active = config.DefaultProfile
+			}
+			for _, profile := range append([]string{config.DefaultProfile}, profiles...) {
+				if profile == active {
+					profile += " (active)"
+				}
+				fmt.Println(profile)
+			}
+			return nil
+		},
+	}
+}
+
+type configEntry struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Override string `json:"override,omitempty"`
+}
+
+func configListCommand() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List every setting and its value",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := config.NewDefault(profile)
+			if err != nil {
+				return err
+			}
+			var entries []configEntry
+			for _, key := range cfg.Keys() {
+				value, err := cfg.GetValue(key)
+				if err != nil {
+					return err
+				}
+				envVar, _ := cfg.Override(key)
+				entries = append(entries, configEntry{Key: key, Value: value, Override: envVar})
+			}
+			return printFormatted(format, entries, func() error {
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+				fmt.Fprintln(w, "KEY\tVALUE")
+				for _, entry := range entries {
+					value := entry.Value
+					if entry.Override != "" {
+						value += fmt.Sprintf(" (from %s)", entry.Override)
+					}
+					fmt.Fprintf(w, "%s\t%s\n", entry.Key, value)
+				}
+				return w.Flush()
+			})
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "table", "output format: table or json")
+	return cmd
+}
+
+func configGetCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "get <key>",
+		Short: "Print the value of a setting",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := config.NewDefault(profile)
+			if err != nil {
+				return err
+			}
+			value, err := cfg.GetValue(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Println(value)
+			return nil
+		},
+	}
+}
+
+func configSetCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set <key> <value>",
+		Short: "Change a setting",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := config.NewDefault(profile)
+			if err != nil {
+				return err
+			}
+			if err := cfg.SetValue(args[0], args[1]); err != nil {
+				return err
+			}
+			logger.Info("Successfully set '%s' to '%s'.", args[0], args[1])
+			warnOverridden(cfg, args[0])
+			return nil
+		},
+	}
+}
+
+func configUnsetCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "unset <key>",
+		Short: "Restore the default value of a setting",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := config.NewDefault(profile)
+			if err != nil {
+				return err
+			}
+			if err := cfg.UnsetValue(args[0]); err != nil {
+				return err
+			}
+			logger.Info("Successfully unset '%s'.", args[0])
+			warnOverridden(cfg, args[0])
+			return nil
+		},
+	}
+}
+
+func warnOverridden(cfg *config.Config, key string) {
+	if envVar, ok := cfg.Override(key); ok {
+		logger.Info("Note: %s is set and overrides this setting.", envVar)
+	}
+}
+
 func versionCommand() *cobra.Command {
 	return &cobra.Command{
 		Use:   "version",
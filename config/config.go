@@ -1,74 +1,247 @@
 package config
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/buildpack/pack/fs"
 )
 
 type Config struct {
+	SchemaVersion  int     `toml:"schema-version"`
 	Stacks         []Stack `toml:"stacks"`
 	DefaultStackID string  `toml:"default-stack-id"`
 	DefaultBuilder string  `toml:"default-builder"`
-	configPath     string
+	// TrustedBuilders run lifecycle phases with network access and as root
+	// where needed. Other builders are isolated.
+	TrustedBuilders []string `toml:"trusted-builders,omitempty"`
+	ActiveProfile   string   `toml:"active-profile,omitempty"`
+	configPath      string
+	// profile is the profile layered over the shared config, if any
+	profile string
+	// overrides maps keys to the environment variables that set them
+	overrides map[string]string
+	environ   []string
 }
 
+const (
+	defaultStackID = "io.buildpacks.stacks.bionic"
+	defaultBuilder = "packs/samples"
+)
+
 type Stack struct {
 	ID          string   `toml:"id"`
 	BuildImages []string `toml:"build-images"`
 	RunImages   []string `toml:"run-images"`
 }
 
-func NewDefault() (*Config, error) {
-	packHome := os.Getenv("PACK_HOME")
-	if packHome == "" {
-		packHome = filepath.Join(os.Getenv("HOME"), ".pack")
+// migrations upgrade a config from the schema version at their index to the
+// next one. The length of migrations is the current schema version.
+var migrations = []func(*Config) error{
+	// 0 -> 1: schema-version is recorded, nothing else changes
+	func(c *Config) error { return nil },
+	// 1 -> 2: the default builder, which used to be trusted implicitly, is
+	// listed in trusted-builders so that it can be untrusted
+	func(c *Config) error {
+		for _, trusted := range c.TrustedBuilders {
+			if trusted == defaultBuilder {
+				return nil
+			}
+		}
+		c.TrustedBuilders = append([]string{defaultBuilder}, c.TrustedBuilders...)
+		return nil
+	},
+}
+
+// NewDefault reads the config in PACK_HOME, or ~/.pack when it isn't set,
+// layers the given profile over it, falling back to the one named by
+// PACK_PROFILE and then the active one, and applies the PACK_* environment
+// variables that override its settings.
+func NewDefault(profile string) (*Config, error) {
+	if profile == "" {
+		profile = os.Getenv("PACK_PROFILE")
+	}
+	config, err := NewWithProfile(DefaultPath(), profile)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.applyOverrides(os.Environ()); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// DefaultPath returns PACK_HOME, or ~/.pack when it isn't set.
+func DefaultPath() string {
+	if packHome := os.Getenv("PACK_HOME"); packHome != "" {
+		return packHome
 	}
-	return New(packHome)
+	return filepath.Join(os.Getenv("HOME"), ".pack")
 }
 
+// New reads the config in path, adding the defaults and migrating it to the
+// current schema version. The file is only written when that changed it. The
+// active profile, if any, is layered over it.
 func New(path string) (*Config, error) {
+	return NewWithProfile(path, "")
+}
+
+// NewWithProfile is like New, but layers the given profile instead of the
+// active one. The profile "default" selects the shared config alone.
+func NewWithProfile(path, profile string) (*Config, error) {
+	shared, changed, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	if profile == "" {
+		profile = shared.ActiveProfile
+	}
+	config, err := shared.withProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		// another process may have written the config in the meantime
+		if err := config.update(func(*Config) error { return nil }); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// load reads the config in path and reports whether adding the defaults or
+// migrating it changed it.
+func load(path string) (*Config, bool, error) {
 	configPath := filepath.Join(path, "config.toml")
 	config, err := previousConfig(path)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	original, err := encode(config)
+	if err != nil {
+		return nil, false, err
+	}
+	_, statErr := os.Stat(configPath)
+
+	if err := migrate(config, configPath); err != nil {
+		return nil, false, err
 	}
 
 	if config.DefaultStackID == "" {
-		config.DefaultStackID = "io.buildpacks.stacks.bionic"
+		config.DefaultStackID = defaultStackID
 	}
 	if config.DefaultBuilder == "" {
-		config.DefaultBuilder = "packs/samples"
+		config.DefaultBuilder = defaultBuilder
 	}
 	appendStackIfMissing(config, Stack{
-		ID:          "io.buildpacks.stacks.bionic",
+		ID:          defaultStackID,
 		BuildImages: []string{"packs/build"},
 		RunImages:   []string{"packs/run"},
 	})
-
 	config.configPath = configPath
-	if err := config.save(); err != nil {
-		return nil, err
+
+	updated, err := encode(config)
+	if err != nil {
+		return nil, false, err
 	}
+	return config, os.IsNotExist(statErr) || !bytes.Equal(original, updated), nil
+}
 
-	return config, nil
+// migrate upgrades the config read from configPath to the current schema
+// version.
+func migrate(config *Config, configPath string) error {
+	if config.SchemaVersion > len(migrations) {
+		return fmt.Errorf(`config "%s" has schema version %d, but this version of pack only supports up to %d: upgrade pack to use it`, configPath, config.SchemaVersion, len(migrations))
+	}
+	for ; config.SchemaVersion < len(migrations); config.SchemaVersion++ {
+		if err := migrations[config.SchemaVersion](config); err != nil {
+			return fmt.Errorf(`failed to migrate config "%s" to schema version %d: %s`, configPath, config.SchemaVersion+1, err)
+		}
+	}
+	return nil
 }
 
-func (c *Config) save() error {
-	if err := os.MkdirAll(filepath.Dir(c.configPath), 0777); err != nil {
+// update applies fn to the latest config on disk and saves the result. A lock
+// keeps other pack processes from changing the config in between, so that no
+// change is lost. The config is only modified when fn succeeds.
+func (c *Config) update(fn func(*Config) error) error {
+	lock, err := c.lock()
+	if err != nil {
 		return err
 	}
-	w, err := os.Create(c.configPath)
+	defer lock.Unlock()
+
+	shared, _, err := load(c.Path())
+	if err != nil {
+		return err
+	}
+	latest, err := shared.withProfile(c.profile)
+	if err != nil {
+		return err
+	}
+	if err := fn(latest); err != nil {
+		return err
+	}
+	if latest.profile == "" {
+		err = latest.save(latest.configPath)
+	} else {
+		err = saveProfile(shared, latest)
+	}
 	if err != nil {
 		return err
 	}
-	defer w.Close()
+	environ := c.environ
+	*c = *latest
+	if environ != nil {
+		return c.applyOverrides(environ)
+	}
+	return nil
+}
 
-	return toml.NewEncoder(w).Encode(c)
+// lock keeps other pack processes from changing the shared config or any
+// profile until it is released.
+func (c *Config) lock() (*fs.FileLock, error) {
+	if err := os.MkdirAll(c.Path(), 0777); err != nil {
+		return nil, err
+	}
+	lock, err := fs.Lock(c.configPath + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf(`failed to lock config "%s": %s`, c.configPath, err)
+	}
+	return lock, nil
+}
+
+func (c *Config) save(path string) error {
+	return writeTOML(path, c)
+}
+
+// writeTOML encodes v to path, leaving the file alone when it already holds it.
+func writeTOML(path string, v interface{}) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	return fs.WriteFileAtomic(path, data, 0644)
+}
+
+func encode(c *Config) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func previousConfig(path string) (*Config, error) {
@@ -102,50 +275,72 @@ func (c *Config) Get(stackID string) (*Stack, error) {
 	return nil, fmt.Errorf(`Missing stack: stack with id "%s" not found in pack config.toml`, stackID)
 }
 
-func (c *Config) Add(stack Stack) error {
-	if _, err := c.Get(stack.ID); err == nil {
-		return fmt.Errorf(`stack "%s" already exists`, stack.ID)
+// DuplicateStackIDs returns the IDs of stacks that are listed more than once,
+// of which only the first is ever used.
+func (c *Config) DuplicateStackIDs() []string {
+	seen := map[string]int{}
+	var ids []string
+	for _, stack := range c.Stacks {
+		if seen[stack.ID]++; seen[stack.ID] == 2 {
+			ids = append(ids, stack.ID)
+		}
 	}
-	c.Stacks = append(c.Stacks, stack)
-	return c.save()
+	return ids
+}
+
+func (c *Config) Add(stack Stack) error {
+	return c.update(func(c *Config) error {
+		if _, err := c.Get(stack.ID); err == nil {
+			return fmt.Errorf(`stack "%s" already exists`, stack.ID)
+		}
+		c.Stacks = append(c.Stacks, stack)
+		return nil
+	})
 }
 
 func (c *Config) Update(stackID string, stack Stack) error {
-	for i, stk := range c.Stacks {
-		if stk.ID == stackID {
-			if len(stack.BuildImages) > 0 {
-				stk.BuildImages = stack.BuildImages
-			}
-			if len(stack.RunImages) > 0 {
-				stk.RunImages = stack.RunImages
+	return c.update(func(c *Config) error {
+		for i, stk := range c.Stacks {
+			if stk.ID == stackID {
+				if len(stack.BuildImages) > 0 {
+					stk.BuildImages = stack.BuildImages
+				}
+				if len(stack.RunImages) > 0 {
+					stk.RunImages = stack.RunImages
+				}
+				c.Stacks[i] = stk
+				return nil
 			}
-			c.Stacks[i] = stk
-			return c.save()
 		}
-	}
-	return fmt.Errorf(`Missing stack: stack with id "%s" not found in pack config.toml`, stackID)
+		return fmt.Errorf(`Missing stack: stack with id "%s" not found in pack config.toml`, stackID)
+	})
 }
 
 func (c *Config) Delete(stackID string) error {
-	if c.DefaultStackID == stackID {
-		return fmt.Errorf(`%s cannot be deleted when it is the default stack. You can change your default stack by running "pack set-default-stack".`, stackID)
-	}
-	for i, s := range c.Stacks {
-		if s.ID == stackID {
-			c.Stacks = append(c.Stacks[:i], c.Stacks[i+1:]...)
-			return c.save()
+	return c.update(func(c *Config) error {
+		if c.DefaultStackID == stackID {
+			return fmt.Errorf(`%s cannot be deleted when it is the default stack. You can change your default stack by running "pack set-default-stack".`, stackID)
 		}
-	}
-	return fmt.Errorf(`"%s" does not exist. Please pass in a valid stack ID.`, stackID)
+		for i, s := range c.Stacks {
+			if s.ID == stackID {
+				c.Stacks = append(c.Stacks[:i], c.Stacks[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf(`"%s" does not exist. Please pass in a valid stack ID.`, stackID)
+	})
 }
+
 func (c *Config) SetDefaultStack(stackID string) error {
-	for _, s := range c.Stacks {
-		if s.ID == stackID {
-			c.DefaultStackID = stackID
-			return c.save()
+	return c.update(func(c *Config) error {
+		for _, s := range c.Stacks {
+			if s.ID == stackID {
+				c.DefaultStackID = stackID
+				return nil
+			}
 		}
-	}
-	return fmt.Errorf(`"%s" does not exist. Please pass in a valid stack ID.`, stackID)
+		return fmt.Errorf(`"%s" does not exist. Please pass in a valid stack ID.`, stackID)
+	})
 }
 
 // Path returns the directory path where the config is stored as a toml file.
@@ -155,8 +350,62 @@ func (c *Config) Path() string {
 }
 
 func (c *Config) SetDefaultBuilder(builder string) error {
-	c.DefaultBuilder = builder
-	return c.save()
+	return c.update(func(c *Config) error {
+		c.DefaultBuilder = builder
+		return nil
+	})
+}
+
+// IsTrustedBuilder tells whether builder is in TrustedBuilders. Entries
+// without a tag or digest trust every tag of their repository.
+func (c *Config) IsTrustedBuilder(builder string) bool {
+	for _, trusted := range c.TrustedBuilders {
+		if trusted == builder {
+			return true
+		}
+		if strings.ContainsAny(trusted[strings.LastIndex(trusted, "/")+1:], ":@") {
+			continue
+		}
+		trustedRef, err := name.ParseReference(trusted, name.WeakValidation)
+		if err != nil {
+			continue
+		}
+		builderRef, err := name.ParseReference(builder, name.WeakValidation)
+		if err != nil {
+			continue
+		}
+		if trustedRef.Context().Name() == builderRef.Context().Name() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) TrustBuilder(builder string) error {
+	return c.update(func(c *Config) error {
+		if err := validateImageName(builder); err != nil {
+			return err
+		}
+		for _, trusted := range c.TrustedBuilders {
+			if trusted == builder {
+				return nil
+			}
+		}
+		c.TrustedBuilders = append(c.TrustedBuilders, builder)
+		return nil
+	})
+}
+
+func (c *Config) UntrustBuilder(builder string) error {
+	return c.update(func(c *Config) error {
+		for i, trusted := range c.TrustedBuilders {
+			if trusted == builder {
+				c.TrustedBuilders = append(c.TrustedBuilders[:i], c.TrustedBuilders[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf(`builder "%s" is not trusted`, builder)
+	})
 }
 
 func ImageByRegistry(registry string, images []string) (string, error) {
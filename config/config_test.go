@@ -1,11 +1,14 @@
 package config_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
@@ -164,6 +167,121 @@ default-builder = "some/builder"
 		})
 	})
 
+	when("schema version", func() {
+		it("records the current schema version", func() {
+			_, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+
+			b, err := ioutil.ReadFile(filepath.Join(tmpDir, "config.toml"))
+			h.AssertNil(t, err)
+			h.AssertContains(t, string(b), `schema-version = 2`)
+		})
+
+		it("migrates configs without a schema version", func() {
+			h.AssertNil(t, ioutil.WriteFile(filepath.Join(tmpDir, "config.toml"), []byte(`
+default-stack-id = "my.stack"
+[[stacks]]
+  id = "my.stack"
+  build-images = ["first/build"]
+[[stacks]]
+  id = "my.stack"
+  build-images = ["second/build"]
+`), 0666))
+
+			subject, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, subject.SchemaVersion, 2)
+			h.AssertEq(t, len(subject.Stacks), 3)
+			h.AssertEq(t, subject.DuplicateStackIDs(), []string{"my.stack"})
+			stack, err := subject.Get("my.stack")
+			h.AssertNil(t, err)
+			h.AssertEq(t, stack.BuildImages, []string{"first/build"})
+
+			b, err := ioutil.ReadFile(filepath.Join(tmpDir, "config.toml"))
+			h.AssertNil(t, err)
+			h.AssertContains(t, string(b), `schema-version = 2`)
+			h.AssertContains(t, string(b), "second/build")
+		})
+
+		it("keeps trusting the default builder when migrating", func() {
+			h.AssertNil(t, ioutil.WriteFile(filepath.Join(tmpDir, "config.toml"), []byte(`
+schema-version = 1
+trusted-builders = ["some/builder"]
+`), 0666))
+
+			subject, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, subject.TrustedBuilders, []string{"packs/samples", "some/builder"})
+		})
+
+		it("refuses configs written by a newer version of pack", func() {
+			configPath := filepath.Join(tmpDir, "config.toml")
+			h.AssertNil(t, ioutil.WriteFile(configPath, []byte(`schema-version = 99`), 0666))
+
+			_, err := config.New(tmpDir)
+			h.AssertError(t, err, `config "`+configPath+`" has schema version 99, but this version of pack only supports up to 2: upgrade pack to use it`)
+		})
+	})
+
+	when("writing the config", func() {
+		it("does not rewrite an unchanged config", func() {
+			configPath := filepath.Join(tmpDir, "config.toml")
+			_, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			past := time.Now().Add(-time.Hour).Truncate(time.Second)
+			h.AssertNil(t, os.Chtimes(configPath, past, past))
+
+			_, err = config.New(tmpDir)
+			h.AssertNil(t, err)
+
+			fi, err := os.Stat(configPath)
+			h.AssertNil(t, err)
+			h.AssertEq(t, fi.ModTime().Equal(past), true)
+		})
+
+		it("keeps changes made through another config", func() {
+			first, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			second, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+
+			h.AssertNil(t, first.Add(config.Stack{ID: "first.stack"}))
+			h.AssertNil(t, second.Add(config.Stack{ID: "second.stack"}))
+
+			subject, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			_, err = subject.Get("first.stack")
+			h.AssertNil(t, err)
+			_, err = subject.Get("second.stack")
+			h.AssertNil(t, err)
+		})
+
+		it("keeps every change made concurrently", func() {
+			var wg sync.WaitGroup
+			errs := make([]error, 10)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					cfg, err := config.New(tmpDir)
+					if err != nil {
+						errs[i] = err
+						return
+					}
+					errs[i] = cfg.Add(config.Stack{ID: fmt.Sprintf("stack-%d", i)})
+				}(i)
+			}
+			wg.Wait()
+			for _, err := range errs {
+				h.AssertNil(t, err)
+			}
+
+			subject, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, len(subject.Stacks), 11)
+		})
+	})
+
 	when("Config#Get", func() {
 		var subject *config.Config
 		it.Before(func() {
@@ -450,6 +568,48 @@ default-stack-id = "stack-1"
 		})
 	})
 
+	when("Config#TrustBuilder", func() {
+		var subject *config.Config
+
+		it.Before(func() {
+			var err error
+			subject, err = config.New(tmpDir)
+			h.AssertNil(t, err)
+		})
+
+		it("trusts the default builder shipped with pack until it is untrusted", func() {
+			h.AssertEq(t, subject.TrustedBuilders, []string{"packs/samples"})
+			h.AssertEq(t, subject.IsTrustedBuilder("packs/samples"), true)
+			h.AssertEq(t, subject.IsTrustedBuilder("some/builder"), false)
+
+			h.AssertNil(t, subject.UntrustBuilder("packs/samples"))
+			reloaded, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, len(reloaded.TrustedBuilders), 0)
+			h.AssertEq(t, reloaded.IsTrustedBuilder("packs/samples"), false)
+		})
+
+		it("trusts every tag of a repository without a tag", func() {
+			h.AssertNil(t, subject.TrustBuilder("some/builder"))
+			h.AssertNil(t, subject.TrustBuilder("other/builder:v1"))
+
+			reloaded, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, reloaded.TrustedBuilders, []string{"packs/samples", "some/builder", "other/builder:v1"})
+			h.AssertEq(t, reloaded.IsTrustedBuilder("some/builder:latest"), true)
+			h.AssertEq(t, reloaded.IsTrustedBuilder("index.docker.io/some/builder:v2"), true)
+			h.AssertEq(t, reloaded.IsTrustedBuilder("other/builder:v1"), true)
+			h.AssertEq(t, reloaded.IsTrustedBuilder("other/builder:v2"), false)
+		})
+
+		it("stops trusting a builder", func() {
+			h.AssertNil(t, subject.TrustBuilder("some/builder"))
+			h.AssertNil(t, subject.UntrustBuilder("some/builder"))
+			h.AssertEq(t, subject.IsTrustedBuilder("some/builder"), false)
+			h.AssertError(t, subject.UntrustBuilder("some/builder"), `builder "some/builder" is not trusted`)
+		})
+	})
+
 	when("ImageByRegistry", func() {
 		var images []string
 		it.Before(func() {
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	defaultBuilderKey  = "default-builder"
+	defaultStackIDKey  = "default-stack-id"
+	trustedBuildersKey = "trusted-builders"
+	buildImagesSuffix  = ".build-images"
+	runImagesSuffix    = ".run-images"
+)
+
+// Keys returns the names of every setting that GetValue and SetValue accept.
+// Stack images are named stacks.<stack-id>.build-images and
+// stacks.<stack-id>.run-images.
+func (c *Config) Keys() []string {
+	keys := []string{defaultBuilderKey, defaultStackIDKey, trustedBuildersKey}
+	for _, stack := range c.Stacks {
+		keys = append(keys, "stacks."+stack.ID+buildImagesSuffix, "stacks."+stack.ID+runImagesSuffix)
+	}
+	return keys
+}
+
+// EnvVar returns the environment variable that overrides key, such as
+// PACK_DEFAULT_BUILDER for default-builder.
+func EnvVar(key string) string {
+	return "PACK_" + strings.ToUpper(nonAlphanumeric.ReplaceAllString(key, "_"))
+}
+
+var nonAlphanumeric = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// Override returns the environment variable that set key, if any.
+func (c *Config) Override(key string) (string, bool) {
+	envVar, ok := c.overrides[key]
+	return envVar, ok
+}
+
+// applyOverrides sets every key whose environment variable is set in environ.
+// Overrides only last for this invocation of pack and are never saved.
+func (c *Config) applyOverrides(environ []string) error {
+	env := map[string]string{}
+	for _, kv := range environ {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	overrides := map[string]string{}
+	for _, key := range c.Keys() {
+		envVar := EnvVar(key)
+		value, ok := env[envVar]
+		if !ok {
+			continue
+		}
+		if err := c.setValue(key, value); err != nil {
+			return fmt.Errorf(`invalid value for %s: %s`, envVar, err)
+		}
+		overrides[key] = envVar
+	}
+	c.overrides = overrides
+	c.environ = environ
+	return nil
+}
+
+func (c *Config) GetValue(key string) (string, error) {
+	switch key {
+	case defaultBuilderKey:
+		return c.DefaultBuilder, nil
+	case defaultStackIDKey:
+		return c.DefaultStackID, nil
+	case trustedBuildersKey:
+		return strings.Join(c.TrustedBuilders, ","), nil
+	}
+	stack, images, err := c.stackImages(key)
+	if err != nil {
+		return "", err
+	}
+	if images == buildImagesSuffix {
+		return strings.Join(stack.BuildImages, ","), nil
+	}
+	return strings.Join(stack.RunImages, ","), nil
+}
+
+// SetValue validates and saves the setting. Stack images are given as a
+// comma separated list.
+func (c *Config) SetValue(key, value string) error {
+	return c.update(func(c *Config) error {
+		return c.setValue(key, value)
+	})
+}
+
+// UnsetValue restores the default of the setting and saves it.
+func (c *Config) UnsetValue(key string) error {
+	return c.update(func(c *Config) error {
+		switch key {
+		case defaultBuilderKey:
+			c.DefaultBuilder = defaultBuilder
+			return nil
+		case defaultStackIDKey:
+			c.DefaultStackID = defaultStackID
+			return nil
+		case trustedBuildersKey:
+			c.TrustedBuilders = []string{defaultBuilder}
+			return nil
+		}
+		if _, _, err := c.stackImages(key); err != nil {
+			return err
+		}
+		return fmt.Errorf(`"%s" cannot be unset, use "pack delete-stack" to remove the stack`, key)
+	})
+}
+
+func (c *Config) setValue(key, value string) error {
+	switch key {
+	case defaultBuilderKey:
+		if err := validateImageName(value); err != nil {
+			return err
+		}
+		c.DefaultBuilder = value
+		return nil
+	case defaultStackIDKey:
+		if _, err := c.Get(value); err != nil {
+			return err
+		}
+		c.DefaultStackID = value
+		return nil
+	case trustedBuildersKey:
+		names, err := imageNames(value)
+		if err != nil {
+			return err
+		}
+		c.TrustedBuilders = names
+		return nil
+	}
+
+	stack, images, err := c.stackImages(key)
+	if err != nil {
+		return err
+	}
+	names, err := imageNames(value)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf(`"%s" requires at least one image`, key)
+	}
+	if images == buildImagesSuffix {
+		stack.BuildImages = names
+	} else {
+		stack.RunImages = names
+	}
+	return nil
+}
+
+// stackImages returns the stack that a stacks.<stack-id>.<images> key refers
+// to along with the suffix naming its images.
+func (c *Config) stackImages(key string) (*Stack, string, error) {
+	if strings.HasPrefix(key, "stacks.") {
+		for _, suffix := range []string{buildImagesSuffix, runImagesSuffix} {
+			if !strings.HasSuffix(key, suffix) {
+				continue
+			}
+			stackID := strings.TrimSuffix(strings.TrimPrefix(key, "stacks."), suffix)
+			for i := range c.Stacks {
+				if c.Stacks[i].ID == stackID {
+					return &c.Stacks[i], suffix, nil
+				}
+			}
+			return nil, "", fmt.Errorf(`Missing stack: stack with id "%s" not found in pack config.toml`, stackID)
+		}
+	}
+	keys := c.Keys()
+	sort.Strings(keys)
+	return nil, "", fmt.Errorf(`unknown config key "%s", expected one of: %s`, key, strings.Join(keys, ", "))
+}
+
+// imageNames splits a comma separated list of image names and validates them.
+func imageNames(value string) ([]string, error) {
+	var names []string
+	for _, image := range strings.Split(value, ",") {
+		image = strings.TrimSpace(image)
+		if image == "" {
+			continue
+		}
+		if err := validateImageName(image); err != nil {
+			return nil, err
+		}
+		names = append(names, image)
+	}
+	return names, nil
+}
+
+func validateImageName(image string) error {
+	if _, err := name.ParseReference(image, name.WeakValidation); err != nil {
+		return fmt.Errorf(`invalid image name "%s": %s`, image, err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/pack/config"
+	h "github.com/buildpack/pack/testhelpers"
+)
+
+func TestConfigKeys(t *testing.T) {
+	spec.Run(t, "config-keys", testConfigKeys, spec.Sequential(), spec.Report(report.Terminal{}))
+}
+
+func testConfigKeys(t *testing.T, when spec.G, it spec.S) {
+	var (
+		tmpDir  string
+		subject *config.Config
+	)
+
+	it.Before(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "pack.config.keys.test.")
+		h.AssertNil(t, err)
+		h.AssertNil(t, ioutil.WriteFile(filepath.Join(tmpDir, "config.toml"), []byte(`
+default-stack-id = "my.stack"
+[[stacks]]
+  id = "my.stack"
+  build-images = ["my/build"]
+  run-images = ["my/run", "registry.com/my/run"]
+`), 0666))
+		subject, err = config.New(tmpDir)
+		h.AssertNil(t, err)
+	})
+
+	it.After(func() {
+		h.AssertNil(t, os.RemoveAll(tmpDir))
+	})
+
+	when("#Keys", func() {
+		it("lists the defaults and the images of every stack", func() {
+			h.AssertEq(t, subject.Keys(), []string{
+				"default-builder",
+				"default-stack-id",
+				"trusted-builders",
+				"stacks.my.stack.build-images",
+				"stacks.my.stack.run-images",
+				"stacks.io.buildpacks.stacks.bionic.build-images",
+				"stacks.io.buildpacks.stacks.bionic.run-images",
+			})
+		})
+	})
+
+	when("#GetValue", func() {
+		it("returns the value of a key", func() {
+			value, err := subject.GetValue("default-stack-id")
+			h.AssertNil(t, err)
+			h.AssertEq(t, value, "my.stack")
+
+			value, err = subject.GetValue("stacks.my.stack.run-images")
+			h.AssertNil(t, err)
+			h.AssertEq(t, value, "my/run,registry.com/my/run")
+		})
+
+		it("fails for an unknown key", func() {
+			_, err := subject.GetValue("default-buildr")
+			h.AssertError(t, err, `unknown config key "default-buildr", expected one of: default-builder, default-stack-id, stacks.io.buildpacks.stacks.bionic.build-images, stacks.io.buildpacks.stacks.bionic.run-images, stacks.my.stack.build-images, stacks.my.stack.run-images, trusted-builders`)
+		})
+	})
+
+	when("#SetValue", func() {
+		it("saves the value", func() {
+			h.AssertNil(t, subject.SetValue("default-builder", "some/builder"))
+			h.AssertNil(t, subject.SetValue("stacks.my.stack.run-images", "new/run, registry.com/new/run"))
+
+			reloaded, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, reloaded.DefaultBuilder, "some/builder")
+			stack, err := reloaded.Get("my.stack")
+			h.AssertNil(t, err)
+			h.AssertEq(t, stack.RunImages, []string{"new/run", "registry.com/new/run"})
+		})
+
+		it("validates the value", func() {
+			err := subject.SetValue("default-builder", "Not/A/Valid:Image:Name")
+			h.AssertNotNil(t, err)
+			h.AssertContains(t, err.Error(), `invalid image name "Not/A/Valid:Image:Name"`)
+			h.AssertError(t, subject.SetValue("default-stack-id", "some.missing.stack"), `Missing stack: stack with id "some.missing.stack" not found in pack config.toml`)
+			h.AssertError(t, subject.SetValue("stacks.my.stack.build-images", " , "), `"stacks.my.stack.build-images" requires at least one image`)
+			h.AssertEq(t, subject.DefaultStackID, "my.stack")
+		})
+	})
+
+	when("#UnsetValue", func() {
+		it("restores the default", func() {
+			h.AssertNil(t, subject.SetValue("default-builder", "some/builder"))
+			h.AssertNil(t, subject.UnsetValue("default-builder"))
+			h.AssertNil(t, subject.UnsetValue("default-stack-id"))
+			h.AssertNil(t, subject.SetValue("trusted-builders", "some/builder"))
+			h.AssertNil(t, subject.UnsetValue("trusted-builders"))
+
+			reloaded, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, reloaded.TrustedBuilders, []string{"packs/samples"})
+			h.AssertEq(t, reloaded.DefaultBuilder, "packs/samples")
+			h.AssertEq(t, reloaded.DefaultStackID, "io.buildpacks.stacks.bionic")
+		})
+
+		it("does not unset stack images", func() {
+			h.AssertError(t, subject.UnsetValue("stacks.my.stack.run-images"), `"stacks.my.stack.run-images" cannot be unset, use "pack delete-stack" to remove the stack`)
+		})
+	})
+
+	when("environment variables are set", func() {
+		it.Before(func() {
+			os.Setenv("PACK_HOME", tmpDir)
+			os.Setenv("PACK_DEFAULT_BUILDER", "env/builder")
+			os.Setenv("PACK_STACKS_MY_STACK_RUN_IMAGES", "env/run")
+		})
+
+		it.After(func() {
+			os.Unsetenv("PACK_HOME")
+			os.Unsetenv("PACK_DEFAULT_BUILDER")
+			os.Unsetenv("PACK_STACKS_MY_STACK_RUN_IMAGES")
+		})
+
+		it("overrides the config without saving", func() {
+			cfg, err := config.NewDefault("")
+			h.AssertNil(t, err)
+			h.AssertEq(t, cfg.DefaultBuilder, "env/builder")
+			stack, err := cfg.Get("my.stack")
+			h.AssertNil(t, err)
+			h.AssertEq(t, stack.RunImages, []string{"env/run"})
+			envVar, ok := cfg.Override("default-builder")
+			h.AssertEq(t, ok, true)
+			h.AssertEq(t, envVar, "PACK_DEFAULT_BUILDER")
+
+			h.AssertNil(t, cfg.SetDefaultStack("io.buildpacks.stacks.bionic"))
+			h.AssertEq(t, cfg.DefaultBuilder, "env/builder")
+
+			reloaded, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, reloaded.DefaultBuilder, "packs/samples")
+			h.AssertEq(t, reloaded.DefaultStackID, "io.buildpacks.stacks.bionic")
+		})
+
+		it("fails for an invalid value", func() {
+			os.Setenv("PACK_DEFAULT_BUILDER", "Not/Valid")
+
+			_, err := config.NewDefault("")
+			h.AssertNotNil(t, err)
+			h.AssertContains(t, err.Error(), `invalid value for PACK_DEFAULT_BUILDER: invalid image name "Not/Valid"`)
+		})
+
+		it("layers the given profile in place of PACK_PROFILE", func() {
+			h.AssertNil(t, subject.CreateProfile("laptop"))
+			h.AssertNil(t, subject.CreateProfile("mirror"))
+			os.Setenv("PACK_PROFILE", "laptop")
+			defer os.Unsetenv("PACK_PROFILE")
+
+			cfg, err := config.NewDefault("mirror")
+			h.AssertNil(t, err)
+			h.AssertEq(t, cfg.Profile(), "mirror")
+
+			cfg, err = config.NewDefault("")
+			h.AssertNil(t, err)
+			h.AssertEq(t, cfg.Profile(), "laptop")
+		})
+	})
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// DefaultProfile names the shared config without any profile layered over it.
+const DefaultProfile = "default"
+
+var profileName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Profile returns the name of the profile layered over the shared config, or
+// DefaultProfile when there is none.
+func (c *Config) Profile() string {
+	if c.profile == "" {
+		return DefaultProfile
+	}
+	return c.profile
+}
+
+// Profiles returns the names of the profiles in the config directory.
+func (c *Config) Profiles() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(c.Path(), "profiles"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var profiles []string
+	for _, entry := range entries {
+		if _, err := os.Stat(profilePath(c.Path(), entry.Name())); entry.IsDir() && err == nil {
+			profiles = append(profiles, entry.Name())
+		}
+	}
+	sort.Strings(profiles)
+	return profiles, nil
+}
+
+// CreateProfile adds an empty profile, which inherits every setting from the
+// shared config until it is changed while the profile is in use.
+func (c *Config) CreateProfile(name string) error {
+	if name == DefaultProfile || !profileName.MatchString(name) {
+		return fmt.Errorf(`invalid profile name "%s"`, name)
+	}
+	lock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	path := profilePath(c.Path(), name)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf(`profile "%s" already exists`, name)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return (&Config{SchemaVersion: len(migrations)}).save(path)
+}
+
+// UseProfile makes name the active profile of every later invocation of pack
+// and of this config. DefaultProfile switches back to the shared config.
+func (c *Config) UseProfile(name string) error {
+	lock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	shared, _, err := load(c.Path())
+	if err != nil {
+		return err
+	}
+	latest, err := shared.withProfile(name)
+	if err != nil {
+		return err
+	}
+	if name == DefaultProfile {
+		name = ""
+	}
+	shared.ActiveProfile = name
+	if err := shared.save(shared.configPath); err != nil {
+		return err
+	}
+	latest.ActiveProfile = name
+	environ := c.environ
+	*c = *latest
+	if environ != nil {
+		return c.applyOverrides(environ)
+	}
+	return nil
+}
+
+// profileFile is the config.toml of a profile. It writes trusted-builders even
+// when the list is empty, so that a profile can clear the shared list, and
+// leaves it out when the profile doesn't change the list.
+type profileFile struct {
+	Config
+	TrustedBuilders *[]string `toml:"trusted-builders"`
+}
+
+func profilePath(dir, name string) string {
+	return filepath.Join(dir, "profiles", name, "config.toml")
+}
+
+// withProfile returns the shared config with the settings of the named profile
+// layered over it: its defaults replace the shared ones and its stacks replace
+// the shared stacks with the same ID.
+func (c *Config) withProfile(name string) (*Config, error) {
+	layered := *c
+	layered.Stacks = append([]Stack(nil), c.Stacks...)
+	layered.TrustedBuilders = append([]string(nil), c.TrustedBuilders...)
+	if name == "" || name == DefaultProfile {
+		layered.profile = ""
+		return &layered, nil
+	}
+
+	path := profilePath(c.Path(), name)
+	file := &profileFile{}
+	if _, err := toml.DecodeFile(path, file); os.IsNotExist(err) {
+		return nil, fmt.Errorf(`profile "%s" does not exist, create it with "pack config profile create %s"`, name, name)
+	} else if err != nil {
+		return nil, err
+	}
+	profile := &file.Config
+	if file.TrustedBuilders != nil {
+		profile.TrustedBuilders = *file.TrustedBuilders
+	}
+	if err := migrate(profile, path); err != nil {
+		return nil, err
+	}
+	if file.TrustedBuilders != nil {
+		file.TrustedBuilders = &profile.TrustedBuilders
+	}
+
+	if profile.DefaultStackID != "" {
+		layered.DefaultStackID = profile.DefaultStackID
+	}
+	if profile.DefaultBuilder != "" {
+		layered.DefaultBuilder = profile.DefaultBuilder
+	}
+	if file.TrustedBuilders != nil {
+		layered.TrustedBuilders = *file.TrustedBuilders
+	}
+	for _, stack := range profile.Stacks {
+		replaced := false
+		for i := range layered.Stacks {
+			if layered.Stacks[i].ID == stack.ID {
+				layered.Stacks[i] = stack
+				replaced = true
+			}
+		}
+		if !replaced {
+			layered.Stacks = append(layered.Stacks, stack)
+		}
+	}
+	layered.profile = name
+	return &layered, nil
+}
+
+// saveProfile saves the settings of layered that differ from the shared config
+// to its profile.
+func saveProfile(shared, layered *Config) error {
+	file := &profileFile{Config: Config{SchemaVersion: len(migrations)}}
+	profile := &file.Config
+	if layered.DefaultStackID != shared.DefaultStackID {
+		profile.DefaultStackID = layered.DefaultStackID
+	}
+	if layered.DefaultBuilder != shared.DefaultBuilder {
+		profile.DefaultBuilder = layered.DefaultBuilder
+	}
+	if len(layered.TrustedBuilders) > 0 || len(shared.TrustedBuilders) > 0 {
+		if trusted := layered.TrustedBuilders; !reflect.DeepEqual(trusted, shared.TrustedBuilders) {
+			if trusted == nil {
+				trusted = []string{}
+			}
+			file.TrustedBuilders = &trusted
+		}
+	}
+	for _, stack := range layered.Stacks {
+		if sharedStack, err := shared.Get(stack.ID); err != nil || !reflect.DeepEqual(*sharedStack, stack) {
+			profile.Stacks = append(profile.Stacks, stack)
+		}
+	}
+	for _, stack := range shared.Stacks {
+		if _, err := layered.Get(stack.ID); err != nil {
+			return fmt.Errorf(`stack "%s" is in the shared config and cannot be deleted while using profile "%s"`, stack.ID, layered.profile)
+		}
+	}
+	return writeTOML(profilePath(shared.Path(), layered.profile), file)
+}
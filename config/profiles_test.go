@@ -0,0 +1,179 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/pack/config"
+	h "github.com/buildpack/pack/testhelpers"
+)
+
+func TestProfiles(t *testing.T) {
+	spec.Run(t, "profiles", testProfiles, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+func testProfiles(t *testing.T, when spec.G, it spec.S) {
+	var (
+		tmpDir string
+		shared *config.Config
+	)
+
+	it.Before(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "pack.config.profiles.test.")
+		h.AssertNil(t, err)
+		h.AssertNil(t, ioutil.WriteFile(filepath.Join(tmpDir, "config.toml"), []byte(`
+default-builder = "shared/builder"
+[[stacks]]
+  id = "my.stack"
+  build-images = ["my/build"]
+  run-images = ["my/run"]
+`), 0666))
+		shared, err = config.New(tmpDir)
+		h.AssertNil(t, err)
+		h.AssertNil(t, shared.CreateProfile("mirror"))
+	})
+
+	it.After(func() {
+		h.AssertNil(t, os.RemoveAll(tmpDir))
+	})
+
+	when("#CreateProfile", func() {
+		it("lists the new profile", func() {
+			h.AssertNil(t, shared.CreateProfile("laptop"))
+
+			profiles, err := shared.Profiles()
+			h.AssertNil(t, err)
+			h.AssertEq(t, profiles, []string{"laptop", "mirror"})
+		})
+
+		it("fails when the profile exists", func() {
+			h.AssertError(t, shared.CreateProfile("mirror"), `profile "mirror" already exists`)
+		})
+
+		it("fails for an invalid name", func() {
+			h.AssertError(t, shared.CreateProfile("default"), `invalid profile name "default"`)
+			h.AssertError(t, shared.CreateProfile("../escape"), `invalid profile name "../escape"`)
+		})
+	})
+
+	when("a profile is in use", func() {
+		var subject *config.Config
+
+		it.Before(func() {
+			var err error
+			subject, err = config.NewWithProfile(tmpDir, "mirror")
+			h.AssertNil(t, err)
+		})
+
+		it("inherits the shared settings", func() {
+			h.AssertEq(t, subject.Profile(), "mirror")
+			h.AssertEq(t, subject.DefaultBuilder, "shared/builder")
+			stack, err := subject.Get("my.stack")
+			h.AssertNil(t, err)
+			h.AssertEq(t, stack.RunImages, []string{"my/run"})
+		})
+
+		it("saves changes to the profile only", func() {
+			h.AssertNil(t, subject.SetDefaultBuilder("mirror/builder"))
+			h.AssertNil(t, subject.Update("my.stack", config.Stack{RunImages: []string{"mirror.com/my/run"}}))
+			h.AssertNil(t, subject.Add(config.Stack{ID: "mirror.stack", BuildImages: []string{"mirror/build"}, RunImages: []string{"mirror/run"}}))
+
+			reloaded, err := config.NewWithProfile(tmpDir, "mirror")
+			h.AssertNil(t, err)
+			h.AssertEq(t, reloaded.DefaultBuilder, "mirror/builder")
+			stack, err := reloaded.Get("my.stack")
+			h.AssertNil(t, err)
+			h.AssertEq(t, stack.BuildImages, []string{"my/build"})
+			h.AssertEq(t, stack.RunImages, []string{"mirror.com/my/run"})
+			_, err = reloaded.Get("mirror.stack")
+			h.AssertNil(t, err)
+
+			reloaded, err = config.New(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, reloaded.DefaultBuilder, "shared/builder")
+			stack, err = reloaded.Get("my.stack")
+			h.AssertNil(t, err)
+			h.AssertEq(t, stack.RunImages, []string{"my/run"})
+			_, err = reloaded.Get("mirror.stack")
+			h.AssertNotNil(t, err)
+
+			contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "profiles", "mirror", "config.toml"))
+			h.AssertNil(t, err)
+			h.AssertEq(t, strings.Contains(string(contents), "io.buildpacks.stacks.bionic"), false)
+		})
+
+		it("keeps a cleared list of trusted builders", func() {
+			h.AssertNil(t, shared.TrustBuilder("shared/trusted"))
+			h.AssertNil(t, subject.UntrustBuilder("shared/trusted"))
+			h.AssertNil(t, subject.UntrustBuilder("packs/samples"))
+			h.AssertNil(t, shared.TrustBuilder("other/trusted"))
+
+			reloaded, err := config.NewWithProfile(tmpDir, "mirror")
+			h.AssertNil(t, err)
+			h.AssertEq(t, len(reloaded.TrustedBuilders), 0)
+
+			reloaded, err = config.New(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, reloaded.TrustedBuilders, []string{"packs/samples", "shared/trusted", "other/trusted"})
+		})
+
+		it("inherits the trusted builders until it changes them", func() {
+			h.AssertNil(t, subject.SetDefaultBuilder("mirror/builder"))
+			h.AssertNil(t, shared.TrustBuilder("shared/trusted"))
+
+			reloaded, err := config.NewWithProfile(tmpDir, "mirror")
+			h.AssertNil(t, err)
+			h.AssertEq(t, reloaded.TrustedBuilders, []string{"packs/samples", "shared/trusted"})
+		})
+
+		it("picks up later changes to the shared settings", func() {
+			h.AssertNil(t, shared.SetDefaultBuilder("new/builder"))
+
+			reloaded, err := config.NewWithProfile(tmpDir, "mirror")
+			h.AssertNil(t, err)
+			h.AssertEq(t, reloaded.DefaultBuilder, "new/builder")
+		})
+
+		it("does not delete shared stacks", func() {
+			h.AssertError(t, subject.Delete("my.stack"), `stack "my.stack" is in the shared config and cannot be deleted while using profile "mirror"`)
+		})
+	})
+
+	when("#UseProfile", func() {
+		it("makes the profile active for later configs", func() {
+			mirror, err := config.NewWithProfile(tmpDir, "mirror")
+			h.AssertNil(t, err)
+			h.AssertNil(t, mirror.SetDefaultBuilder("mirror/builder"))
+
+			h.AssertNil(t, shared.UseProfile("mirror"))
+			h.AssertEq(t, shared.DefaultBuilder, "mirror/builder")
+
+			active, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, active.Profile(), "mirror")
+			h.AssertEq(t, active.DefaultBuilder, "mirror/builder")
+
+			explicit, err := config.NewWithProfile(tmpDir, "default")
+			h.AssertNil(t, err)
+			h.AssertEq(t, explicit.Profile(), "default")
+			h.AssertEq(t, explicit.DefaultBuilder, "shared/builder")
+
+			h.AssertNil(t, active.UseProfile("default"))
+			reloaded, err := config.New(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, reloaded.Profile(), "default")
+			h.AssertEq(t, reloaded.DefaultBuilder, "shared/builder")
+		})
+
+		it("fails for a missing profile", func() {
+			h.AssertError(t, shared.UseProfile("missing"), `profile "missing" does not exist, create it with "pack config profile create missing"`)
+		})
+	})
+}
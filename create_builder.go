@@ -1,17 +1,17 @@
 package pack
 
 import (
-	"compress/gzip"
+	"bytes"
 	"context"
-	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/buildpack/lifecycle"
@@ -20,18 +20,43 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
 	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/pkg/errors"
 
 	"github.com/buildpack/pack/config"
+	"github.com/buildpack/pack/fs"
+	"github.com/buildpack/pack/image"
+	"github.com/buildpack/pack/logging"
 )
 
 type BuilderTOML struct {
-	Buildpacks []struct {
-		ID     string `toml:"id"`
-		URI    string `toml:"uri"`
-		Latest bool   `toml:"latest"`
-	} `toml:"buildpacks"`
-	Groups []lifecycle.BuildpackGroup `toml:"groups"`
+	Buildpacks []BuilderTOMLBuildpack     `toml:"buildpacks"`
+	Groups     []lifecycle.BuildpackGroup `toml:"groups"`
+	Stack      *BuilderTOMLStack          `toml:"stack,omitempty"`
+	Lifecycle  *BuilderTOMLLifecycle      `toml:"lifecycle,omitempty"`
+}
+
+// BuilderTOMLLifecycle selects the lifecycle added to a builder. Without a URI
+// the release of the given version is downloaded.
+type BuilderTOMLLifecycle struct {
+	Version string `toml:"version"`
+	URI     string `toml:"uri,omitempty"`
+}
+
+// BuilderTOMLStack describes the stack a builder is made for, so that the
+// builder can be used without a matching stack in the local config.
+type BuilderTOMLStack struct {
+	ID              string   `toml:"id"`
+	BuildImage      string   `toml:"build-image"`
+	RunImage        string   `toml:"run-image"`
+	RunImageMirrors []string `toml:"run-image-mirrors,omitempty"`
+}
+
+type BuilderTOMLBuildpack struct {
+	ID     string `toml:"id"`
+	URI    string `toml:"uri"`
+	Latest bool   `toml:"latest,omitempty"`
+	SHA256 string `toml:"sha256,omitempty"` // digest of the archive or download, rejected for directories and images; --lock rewrites it
 }
 
 type BuilderConfig struct {
@@ -41,11 +66,81 @@ type BuilderConfig struct {
 	Groups     []lifecycle.BuildpackGroup
 	BaseImage  v1.Image
 	BuilderDir string //original location of builder.toml, used for interpreting relative paths in buildpack URIs
+	// BuilderTomlPath is the builder.toml the config was read from, used to report problems by line
+	BuilderTomlPath string
+	Stack           config.Stack
+	Lifecycle       Lifecycle
+}
+
+// Lifecycle is a lifecycle to add to the builder. An empty Dir keeps the
+// lifecycle of the stack build image.
+type Lifecycle struct {
+	Version string
+	Dir     string
+}
+
+const lifecycleReleaseURL = "https://github.com/buildpack/lifecycle/releases/download/v%[1]s/lifecycle-v%[1]s+linux.x86-64.tgz"
+
+var lifecycleBinaries = []string{"detector", "analyzer", "builder", "exporter"}
+
+const BuilderMetadataLabel = "io.buildpacks.builder.metadata"
+
+type BuilderMetadata struct {
+	Stack      BuilderStackMetadata       `json:"stack"`
+	Buildpacks []BuilderBuildpackMetadata `json:"buildpacks"`
+	Groups     []BuilderGroupMetadata     `json:"groups"`
+	Lifecycle  BuilderLifecycleMetadata   `json:"lifecycle"`
+}
+
+type BuilderLifecycleMetadata struct {
+	Version string `json:"version,omitempty"`
+}
+
+type BuilderBuildpackMetadata struct {
+	ID      string   `json:"id"`
+	Version string   `json:"version"`
+	Latest  bool     `json:"latest"`
+	Layers  []string `json:"layers"` // diffIDs of the layers holding the buildpack
+}
+
+type BuilderGroupMetadata struct {
+	Buildpacks []BuilderBuildpackRef `json:"buildpacks"`
+}
+
+type BuilderBuildpackRef struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+}
+
+type BuilderStackMetadata struct {
+	ID         string                  `json:"id"`
+	BuildImage string                  `json:"build-image"`
+	RunImage   BuilderRunImageMetadata `json:"run-image"`
+}
+
+type BuilderRunImageMetadata struct {
+	Image   string   `json:"image"`
+	Mirrors []string `json:"mirrors"`
+}
+
+// ConfigStack returns the stack recorded on a builder in the form used by the local config.
+func (s BuilderStackMetadata) ConfigStack() config.Stack {
+	stack := config.Stack{ID: s.ID}
+	if s.BuildImage != "" {
+		stack.BuildImages = []string{s.BuildImage}
+	}
+	if s.RunImage.Image != "" {
+		stack.RunImages = append([]string{s.RunImage.Image}, s.RunImage.Mirrors...)
+	}
+	return stack
 }
+
 type Buildpack struct {
 	ID     string
 	Dir    string
 	Latest bool
+	Layers []v1.Layer // image layers holding only this buildpack, appended to the builder as-is
+	SHA256 string     // digest of the archive the buildpack was read from, empty for directories and images
 }
 
 //go:generate mockgen -package mocks -destination mocks/docker.go github.com/buildpack/pack Docker
@@ -55,6 +150,9 @@ type Docker interface {
 	VolumeRemove(ctx context.Context, volumeID string, force bool) error
 	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error)
 	ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error
+	ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error
+	ContainerLogs(ctx context.Context, container string, options types.ContainerLogsOptions) (io.ReadCloser, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
 	CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error
 	CopyFromContainer(ctx context.Context, containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error)
 	ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error)
@@ -73,7 +171,7 @@ type Task interface {
 }
 
 type BuilderFactory struct {
-	Log    *log.Logger
+	Log    *logging.Logger
 	Docker Docker
 	FS     FS
 	Config *config.Config
@@ -84,7 +182,10 @@ type BuilderFactory struct {
 type FS interface {
 	CreateTGZFile(tarFile, srcDir, tarDir string, uid, gid int) error
 	CreateTarReader(srcDir, tarDir string, uid, gid int) (io.Reader, chan error)
+	CreateTarReaderExcluding(srcDir, tarDir string, uid, gid int, exclude []string) (io.Reader, chan error)
+	CreateTarReaderWithDirs(srcDir, tarDir string, uid, gid int, exclude []string) (io.Reader, chan error)
 	Untar(r io.Reader, dest string) error
+	Unzip(r io.ReaderAt, size int64, dest string) error
 	CreateSingleFileTar(path, txt string) (io.Reader, error)
 }
 
@@ -93,141 +194,290 @@ type CreateBuilderFlags struct {
 	BuilderTomlPath string
 	StackID         string
 	Publish         bool
-	NoPull          bool
+	PullPolicy      string
+	Lock            bool
+	ValidateOnly    bool
+	Offline         bool
+	Policy          string
 }
 
 func (f *BuilderFactory) BuilderConfigFromFlags(flags CreateBuilderFlags) (BuilderConfig, error) {
-	baseImage, err := f.baseImageName(flags.StackID, flags.RepoName)
+	builderTOML := &BuilderTOML{}
+	_, err := toml.DecodeFile(flags.BuilderTomlPath, &builderTOML)
 	if err != nil {
+		return BuilderConfig{}, fmt.Errorf(`failed to decode builder config from file "%s": %s`, flags.BuilderTomlPath, err)
+	}
+
+	if _, err := image.ParsePullPolicy(flags.PullPolicy); err != nil {
 		return BuilderConfig{}, err
 	}
-	if !flags.NoPull && !flags.Publish {
-		f.Log.Println("Pulling builder base image ", baseImage)
-		err := f.Docker.PullImage(baseImage)
-		if err != nil {
-			return BuilderConfig{}, fmt.Errorf(`failed to pull stack build image "%s": %s`, baseImage, err)
+	policy, err := ReadPolicy(f.Config.Path(), flags.Policy)
+	if err != nil {
+		return BuilderConfig{}, err
+	}
+	if policy != nil {
+		f.Log.Info("Using policy '%s'", policy.Path)
+	}
+	if flags.Publish {
+		if err := policy.CheckPublish(flags.RepoName); err != nil {
+			return BuilderConfig{}, err
 		}
 	}
 
-	builderConfig := BuilderConfig{RepoName: flags.RepoName}
-	builderConfig.BuilderDir = filepath.Dir(flags.BuilderTomlPath)
-	builderConfig.BaseImage, err = f.Images.ReadImage(baseImage, !flags.Publish)
-	if err != nil {
-		return BuilderConfig{}, fmt.Errorf(`failed to read base image "%s": %s`, baseImage, err)
+	var tomlStack BuilderTOMLStack
+	if builderTOML.Stack != nil {
+		tomlStack = *builderTOML.Stack
 	}
-	if builderConfig.BaseImage == nil {
-		return BuilderConfig{}, fmt.Errorf(`base image "%s" was not found`, baseImage)
+	stack, err := f.builderStack(flags.StackID, tomlStack)
+	if err != nil {
+		return BuilderConfig{}, err
 	}
-	builderConfig.Repo, err = f.Images.RepoStore(flags.RepoName, !flags.Publish)
+	baseImage, err := f.baseImageName(stack, flags.RepoName)
 	if err != nil {
-		return BuilderConfig{}, fmt.Errorf(`failed to create repository store for builder image "%s": %s`, flags.RepoName, err)
+		return BuilderConfig{}, err
 	}
 
-	builderTOML := &BuilderTOML{}
-	_, err = toml.DecodeFile(flags.BuilderTomlPath, &builderTOML)
-	if err != nil {
-		return BuilderConfig{}, fmt.Errorf(`failed to decode builder config from file "%s": %s`, flags.BuilderTomlPath, err)
+	builderConfig := BuilderConfig{
+		RepoName:        flags.RepoName,
+		BuilderDir:      filepath.Dir(flags.BuilderTomlPath),
+		BuilderTomlPath: flags.BuilderTomlPath,
+		Stack:           *stack,
 	}
-	builderConfig.Groups = builderTOML.Groups
+	// validating builder.toml doesn't need the base image
+	if !flags.ValidateOnly {
+		if err := f.pullImage(baseImage, "stack build image", flags); err != nil {
+			return BuilderConfig{}, err
+		}
 
-	for _, b := range builderTOML.Buildpacks {
-		bp, err := f.resolveBuildpackURI(builderConfig.BuilderDir, b)
+		builderConfig.BaseImage, err = f.Images.ReadImage(baseImage, !flags.Publish)
+		if err != nil {
+			return BuilderConfig{}, fmt.Errorf(`failed to read base image "%s": %s`, baseImage, err)
+		}
+		if builderConfig.BaseImage == nil {
+			if flags.Offline {
+				return BuilderConfig{}, fmt.Errorf(`base image "%s" was not found locally, and it is not pulled in offline mode`, baseImage)
+			}
+			return BuilderConfig{}, fmt.Errorf(`base image "%s" was not found`, baseImage)
+		}
+		builderConfig.Repo, err = f.Images.RepoStore(flags.RepoName, !flags.Publish)
 		if err != nil {
+			return BuilderConfig{}, fmt.Errorf(`failed to create repository store for builder image "%s": %s`, flags.RepoName, err)
+		}
+	}
+
+	builderConfig.Groups = builderTOML.Groups
+
+	if builderTOML.Lifecycle != nil {
+		if builderConfig.Lifecycle, err = f.resolveLifecycle(builderConfig.BuilderDir, *builderTOML.Lifecycle, flags); err != nil {
 			return BuilderConfig{}, err
 		}
+	}
+
+	// buildpacks that can't be fetched or aren't allowed are reported together
+	// with the problems Validate finds in the others
+	lines := readBuilderTOMLLines(flags.BuilderTomlPath)
+	verr := &BuilderTOMLError{Path: flags.BuilderTomlPath}
+	unreadable := map[string]bool{}
+	var tomlIndexes []int
+	for i, b := range builderTOML.Buildpacks {
+		if flags.Lock {
+			b.SHA256 = ""
+		}
+		bp, err := f.resolveBuildpackURI(builderConfig.BuilderDir, b, flags)
+		if err != nil {
+			verr.add(lines.buildpack(i), "%s", err)
+			unreadable[b.ID] = true
+			continue
+		}
+		if policy.hasBuildpackRules() {
+			version, err := f.buildpackVersion(bp)
+			if err != nil {
+				verr.add(lines.buildpack(i), "%s", err)
+				unreadable[b.ID] = true
+				continue
+			}
+			if err := policy.CheckBuildpack(bp.ID, version); err != nil {
+				verr.add(lines.buildpack(i), "%s", err)
+			}
+		}
+		builderTOML.Buildpacks[i].SHA256 = bp.SHA256
 		builderConfig.Buildpacks = append(builderConfig.Buildpacks, bp)
+		tomlIndexes = append(tomlIndexes, i)
+	}
+	if len(verr.Problems) > 0 {
+		f.validate(builderConfig, verr, unreadable, tomlIndexes)
+		sort.SliceStable(verr.Problems, func(i, j int) bool { return verr.Problems[i].Line < verr.Problems[j].Line })
+		return BuilderConfig{}, verr
+	}
+
+	if flags.Lock {
+		if err := writeBuilderTOML(flags.BuilderTomlPath, builderTOML); err != nil {
+			return BuilderConfig{}, fmt.Errorf(`failed to write buildpack digests to "%s": %s`, flags.BuilderTomlPath, err)
+		}
+		f.Log.Info("Wrote buildpack digests to %s", flags.BuilderTomlPath)
 	}
 	return builderConfig, nil
 }
 
-func (f *BuilderFactory) resolveBuildpackURI(builderDir string, b struct {
-	ID     string `toml:"id"`
-	URI    string `toml:"uri"`
-	Latest bool   `toml:"latest"`
-}) (Buildpack, error) {
+func (f *BuilderFactory) resolveLifecycle(builderDir string, l BuilderTOMLLifecycle, flags CreateBuilderFlags) (Lifecycle, error) {
+	if l.Version == "" {
+		return Lifecycle{}, errors.New("lifecycle in builder.toml must provide version")
+	}
+	uri := l.URI
+	if uri == "" {
+		uri = fmt.Sprintf(lifecycleReleaseURL, l.Version)
+	}
 
-	var dir string
+	fetcher := &buildpackFetcher{Log: f.Log, FS: f.FS, Config: f.Config, Offline: flags.Offline}
+	dir, _, err := fetcher.fetch(builderDir, uri, "")
+	if err != nil {
+		return Lifecycle{}, errors.Wrapf(err, "failed to fetch lifecycle %s", l.Version)
+	}
+	// release archives hold the binaries in a lifecycle directory
+	if _, err := os.Stat(filepath.Join(dir, "lifecycle", "detector")); err == nil {
+		dir = filepath.Join(dir, "lifecycle")
+	}
+	var missing []string
+	for _, binary := range lifecycleBinaries {
+		if _, err := os.Stat(filepath.Join(dir, binary)); err != nil {
+			missing = append(missing, binary)
+		}
+	}
+	if len(missing) > 0 {
+		return Lifecycle{}, fmt.Errorf(`lifecycle %s from %q is missing: %s`, l.Version, uri, strings.Join(missing, ", "))
+	}
+	return Lifecycle{Version: l.Version, Dir: dir}, nil
+}
 
-	asurl, err := url.Parse(b.URI)
+// writeBuilderTOML writes the digests of the buildpacks back to the
+// builder.toml at path. Only the sha256 keys of its [[buildpacks]] tables are
+// changed, keeping comments and formatting. Buildpacks written inline can't be
+// located, so such a builder.toml is re-encoded as a whole instead.
+func writeBuilderTOML(path string, builderTOML *BuilderTOML) error {
+	contents, err := ioutil.ReadFile(path)
 	if err != nil {
-		return Buildpack{}, err
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
 	}
-	switch asurl.Scheme {
-	case "", // This is the only way to support relative filepaths
-		"file": // URIs with file:// protocol force the use of absolute paths. Host=localhost may be implied with file:///
 
-		path := asurl.Path
+	lines := parseBuilderTOMLLines(string(contents))
+	if len(lines.buildpacks) == len(builderTOML.Buildpacks) {
+		return fs.WriteFileAtomic(path, []byte(lines.withDigests(builderTOML.Buildpacks)), fi.Mode())
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(builderTOML); err != nil {
+		return err
+	}
+	return fs.WriteFileAtomic(path, buf.Bytes(), fi.Mode())
+}
 
-		if !asurl.IsAbs() && !filepath.IsAbs(path) {
-			path = filepath.Join(builderDir, path)
+func (f *BuilderFactory) resolveBuildpackURI(builderDir string, b BuilderTOMLBuildpack, flags CreateBuilderFlags) (Buildpack, error) {
+	if strings.HasPrefix(b.URI, "docker://") {
+		if b.SHA256 != "" {
+			return Buildpack{}, fmt.Errorf(`sha256 of buildpack "%s" can only be checked for archives and downloads: pin %q by image digest instead`, b.ID, b.URI)
 		}
-
-		if filepath.Ext(path) == ".tgz" {
-			file, err := os.Open(path)
-			if err != nil {
-				return Buildpack{}, errors.Wrapf(err, "could not open file to untar: %q", path)
-			}
-			defer file.Close()
-			tmpDir, err := ioutil.TempDir("", fmt.Sprintf("create-builder-%s-", b.ID))
-			if err != nil {
-				return Buildpack{}, fmt.Errorf(`failed to create temporary directory: %s`, err)
-			}
-			if err = f.untarZ(file, tmpDir); err != nil {
-				return Buildpack{}, err
-			}
-			dir = tmpDir
-		} else {
-			dir = path
-		}
-	case "http", "https":
-		uriDigest := fmt.Sprintf("%x", sha256.Sum256([]byte(b.URI)))
-		cachedDir := filepath.Join(f.Config.Path(), "dl-cache", uriDigest)
-		_, err := os.Stat(cachedDir)
-		if os.IsNotExist(err) {
-			if err = os.MkdirAll(cachedDir, 0744); err != nil {
-				return Buildpack{}, err
-			}
-		}
-		etagFile := cachedDir + ".etag"
-		bytes, err := ioutil.ReadFile(etagFile)
-		etag := ""
-		if err == nil {
-			etag = string(bytes)
-		}
-
-		reader, etag, err := f.downloadAsStream(b.URI, etag)
+		dir, layers, err := f.buildpackFromImage(strings.TrimPrefix(b.URI, "docker://"), b.ID, flags)
 		if err != nil {
-			return Buildpack{}, errors.Wrapf(err, "failed to download from %q", b.URI)
-		} else if reader == nil {
-			// can use cached content
-			dir = cachedDir
-			break
-		} else {
-			if err = f.untarZ(reader, cachedDir); err != nil {
-				return Buildpack{}, err
-			}
-			if err = ioutil.WriteFile(etagFile, []byte(etag), 0744); err != nil {
-				return Buildpack{}, err
-			}
+			return Buildpack{}, err
 		}
-
-		dir = cachedDir
-	default:
-		return Buildpack{}, fmt.Errorf("unsupported protocol in uri %q", b.URI)
+		return Buildpack{ID: b.ID, Latest: b.Latest, Dir: dir, Layers: layers}, nil
 	}
 
+	fetcher := &buildpackFetcher{Log: f.Log, FS: f.FS, Config: f.Config, Offline: flags.Offline}
+	dir, digest, err := fetcher.fetch(builderDir, b.URI, b.SHA256)
+	if err != nil {
+		return Buildpack{}, errors.Wrapf(err, "failed to fetch buildpack %q", b.ID)
+	}
 	return Buildpack{
 		ID:     b.ID,
 		Latest: b.Latest,
 		Dir:    dir,
+		SHA256: digest,
 	}, nil
 }
 
-func (f *BuilderFactory) baseImageName(stackID, repoName string) (string, error) {
-	stack, err := f.Config.Get(stackID)
+// pullImage pulls imageName as the pull policy requires. Nothing is pulled
+// when publishing, since images are then read from their registry, or when
+// offline, since images must then be present locally.
+func (f *BuilderFactory) pullImage(imageName, kind string, flags CreateBuilderFlags) error {
+	if flags.Publish {
+		return nil
+	}
+	policy, err := image.ParsePullPolicy(flags.PullPolicy)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if flags.Offline {
+		policy = image.PullNever
+	}
+	if pull, err := image.NeedsPull(f.Docker, imageName, policy); err != nil || !pull {
+		return err
+	}
+	f.Log.Info("Pulling %s %s", kind, imageName)
+	if err := f.Docker.PullImage(imageName); err != nil {
+		return fmt.Errorf(`failed to pull %s "%s": %s`, kind, imageName, err)
+	}
+	return nil
+}
+
+// buildpackFromImage extracts a buildpack distributed as an image so that its
+// buildpack.toml can be read, and returns the image layers that can be reused.
+func (f *BuilderFactory) buildpackFromImage(imageName, id string, flags CreateBuilderFlags) (string, []v1.Layer, error) {
+	if err := f.pullImage(imageName, "buildpack image", flags); err != nil {
+		return "", nil, err
+	}
+	bpImage, err := f.Images.ReadImage(imageName, !flags.Publish)
+	if err != nil {
+		return "", nil, fmt.Errorf(`failed to read buildpack image "%s": %s`, imageName, err)
+	}
+	if bpImage == nil {
+		if flags.Offline {
+			return "", nil, fmt.Errorf(`buildpack image "%s" was not found locally, and it is not pulled in offline mode`, imageName)
+		}
+		return "", nil, fmt.Errorf(`buildpack image "%s" was not found`, imageName)
+	}
+
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("create-builder-%s-", id))
+	if err != nil {
+		return "", nil, fmt.Errorf(`failed to create temporary directory: %s`, err)
+	}
+	version, layers, err := image.ExtractBuildpack(bpImage, id, tmpDir)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "reading buildpack from image %q", imageName)
+	}
+	data, err := readBuildpackData(tmpDir)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "reading buildpack from image %q", imageName)
+	}
+	if data.BP.Version != version {
+		return "", nil, fmt.Errorf(`buildpack "%s" is stored as version "%s" in image "%s", but its buildpack.toml has version "%s"`, id, version, imageName, data.BP.Version)
+	}
+	return tmpDir, layers, nil
+}
+
+// builderStack picks the stack from the -s flag, then from the [stack] table
+// in builder.toml, and finally the default stack in the local config.
+func (f *BuilderFactory) builderStack(stackID string, tomlStack BuilderTOMLStack) (*config.Stack, error) {
+	if stackID != "" && tomlStack.ID != "" && stackID != tomlStack.ID {
+		return nil, fmt.Errorf(`stack "%s" does not match stack "%s" from builder.toml`, stackID, tomlStack.ID)
+	}
+	if stackID != "" || tomlStack.ID == "" {
+		return f.Config.Get(stackID)
+	}
+	if tomlStack.BuildImage == "" || tomlStack.RunImage == "" {
+		return nil, fmt.Errorf(`invalid stack "%s" in builder.toml: build-image and run-image are required`, tomlStack.ID)
 	}
+	return &config.Stack{
+		ID:          tomlStack.ID,
+		BuildImages: []string{tomlStack.BuildImage},
+		RunImages:   append([]string{tomlStack.RunImage}, tomlStack.RunImageMirrors...),
+	}, nil
+}
+
+func (f *BuilderFactory) baseImageName(stack *config.Stack, repoName string) (string, error) {
 	if len(stack.BuildImages) == 0 {
 		return "", fmt.Errorf(`Invalid stack: stack "%s" requires at least one build image`, stack.ID)
 	}
@@ -239,6 +489,10 @@ func (f *BuilderFactory) baseImageName(stackID, repoName string) (string, error)
 }
 
 func (f *BuilderFactory) Create(config BuilderConfig) error {
+	if err := f.Validate(config); err != nil {
+		return err
+	}
+
 	tmpDir, err := ioutil.TempDir("", "create-builder") // TODO
 	if err != nil {
 		return fmt.Errorf(`failed to create temporary directory: %s`, err)
@@ -253,14 +507,52 @@ func (f *BuilderFactory) Create(config BuilderConfig) error {
 	if err != nil {
 		return fmt.Errorf(`failed append order.toml layer to image: %s`, err)
 	}
+	metadata := builderMetadata(config)
 	for _, buildpack := range config.Buildpacks {
-		tarFile, err := f.buildpackLayer(tmpDir, buildpack, config.BuilderDir)
+		version, err := f.buildpackVersion(buildpack)
 		if err != nil {
 			return fmt.Errorf(`failed generate layer for buildpack "%s": %s`, buildpack.ID, err)
 		}
+		layers := buildpack.Layers
+		if len(layers) > 0 {
+			builderImage, err = mutate.AppendLayers(builderImage, layers...)
+			if err != nil {
+				return fmt.Errorf(`failed append buildpack layer to image: %s`, err)
+			}
+		} else {
+			tarFile, err := f.buildpackLayer(tmpDir, buildpack, version)
+			if err != nil {
+				return fmt.Errorf(`failed generate layer for buildpack "%s": %s`, buildpack.ID, err)
+			}
+			var layer v1.Layer
+			builderImage, layer, err = img.Append(builderImage, tarFile)
+			if err != nil {
+				return fmt.Errorf(`failed append buildpack layer to image: %s`, err)
+			}
+			layers = []v1.Layer{layer}
+		}
+		bpMetadata := BuilderBuildpackMetadata{
+			ID:      buildpack.ID,
+			Version: version,
+			Latest:  buildpack.Latest,
+		}
+		for _, layer := range layers {
+			diffID, err := layer.DiffID()
+			if err != nil {
+				return fmt.Errorf(`failed to read diffID of buildpack "%s" layer: %s`, buildpack.ID, err)
+			}
+			bpMetadata.Layers = append(bpMetadata.Layers, diffID.String())
+		}
+		metadata.Buildpacks = append(metadata.Buildpacks, bpMetadata)
+	}
+	if config.Lifecycle.Dir != "" {
+		tarFile := filepath.Join(tmpDir, "lifecycle.tar")
+		if err := f.FS.CreateTGZFile(tarFile, config.Lifecycle.Dir, "/lifecycle", 0, 0); err != nil {
+			return fmt.Errorf(`failed generate layer for lifecycle: %s`, err)
+		}
 		builderImage, _, err = img.Append(builderImage, tarFile)
 		if err != nil {
-			return fmt.Errorf(`failed append buildpack layer to image: %s`, err)
+			return fmt.Errorf(`failed append lifecycle layer to image: %s`, err)
 		}
 	}
 	tarFile, err := f.latestLayer(config.Buildpacks, tmpDir, config.BuilderDir)
@@ -272,17 +564,258 @@ func (f *BuilderFactory) Create(config BuilderConfig) error {
 		return fmt.Errorf(`failed append latest link layer to image: %s`, err)
 	}
 
+	label, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf(`failed to encode builder metadata: %s`, err)
+	}
+	builderImage, err = img.Label(builderImage, BuilderMetadataLabel, string(label))
+	if err != nil {
+		return fmt.Errorf(`failed to set label "%s" on image: %s`, BuilderMetadataLabel, err)
+	}
+
 	if err := config.Repo.Write(builderImage); err != nil {
 		return err
 	}
 
-	f.Log.Println("Successfully created builder image:", config.RepoName)
-	f.Log.Println("")
-	f.Log.Println(`Tip: Run "pack build <image name> --builder <builder image> --path <app source code>" to use this builder`)
+	f.Log.Info("Successfully created builder image: %s", config.RepoName)
+	f.Log.Info("")
+	f.Log.Info(`Tip: Run "pack build <image name> --builder <builder image> --path <app source code>" to use this builder`)
 
 	return nil
 }
 
+func builderMetadata(config BuilderConfig) BuilderMetadata {
+	var metadata BuilderMetadata
+	metadata.Stack.ID = config.Stack.ID
+	if len(config.Stack.BuildImages) > 0 {
+		metadata.Stack.BuildImage = config.Stack.BuildImages[0]
+	}
+	if len(config.Stack.RunImages) > 0 {
+		metadata.Stack.RunImage.Image = config.Stack.RunImages[0]
+		metadata.Stack.RunImage.Mirrors = config.Stack.RunImages[1:]
+	}
+	metadata.Lifecycle.Version = config.Lifecycle.Version
+	for _, group := range config.Groups {
+		var refs []BuilderBuildpackRef
+		for _, bp := range group.Buildpacks {
+			refs = append(refs, BuilderBuildpackRef{ID: bp.ID, Version: bp.Version})
+		}
+		metadata.Groups = append(metadata.Groups, BuilderGroupMetadata{Buildpacks: refs})
+	}
+	return metadata
+}
+
+// BuilderTOMLProblem is a single problem found in a builder.toml. Line is 0 when
+// the problem could not be traced to a line.
+type BuilderTOMLProblem struct {
+	Line    int
+	Message string
+}
+
+// BuilderTOMLError reports every problem found while validating a builder.toml.
+type BuilderTOMLError struct {
+	Path     string
+	Problems []BuilderTOMLProblem
+}
+
+func (e *BuilderTOMLError) Error() string {
+	msg := fmt.Sprintf("invalid builder config %q:", e.Path)
+	for _, p := range e.Problems {
+		if p.Line > 0 {
+			msg += fmt.Sprintf("\n  %s:%d: %s", e.Path, p.Line, p.Message)
+		} else {
+			msg += fmt.Sprintf("\n  %s: %s", e.Path, p.Message)
+		}
+	}
+	return msg
+}
+
+func (e *BuilderTOMLError) add(line int, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, BuilderTOMLProblem{Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks the buildpacks and groups of a builder before any layer is
+// created, returning a *BuilderTOMLError that lists every problem found.
+func (f *BuilderFactory) Validate(config BuilderConfig) error {
+	verr := &BuilderTOMLError{Path: config.BuilderTomlPath}
+	f.validate(config, verr, map[string]bool{}, nil)
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// validate adds the problems of config to verr. Groups aren't checked for the
+// buildpacks in unreadable, whose problems have already been reported.
+// tomlIndexes holds the index in builder.toml of each buildpack when some
+// were left out, and is nil when config has all of them.
+func (f *BuilderFactory) validate(config BuilderConfig, verr *BuilderTOMLError, unreadable map[string]bool, tomlIndexes []int) {
+	lines := readBuilderTOMLLines(config.BuilderTomlPath)
+
+	type idVersion struct{ id, version string }
+	included := map[idVersion]bool{}
+	latest := map[string]bool{}
+	for i, bp := range config.Buildpacks {
+		line := lines.buildpack(i)
+		if tomlIndexes != nil {
+			line = lines.buildpack(tomlIndexes[i])
+		}
+		data, err := f.buildpackData(bp, bp.Dir)
+		if err != nil {
+			verr.add(line, "%s", err)
+			unreadable[bp.ID] = true
+			continue
+		}
+		if data.BP.ID != bp.ID {
+			verr.add(line, `buildpack ids did not match: %s != %s`, bp.ID, data.BP.ID)
+		}
+		if data.BP.Version == "" {
+			verr.add(line, `buildpack.toml must provide version: %s`, filepath.Join(bp.Dir, "buildpack.toml"))
+			unreadable[bp.ID] = true
+			continue
+		}
+
+		key := idVersion{bp.ID, data.BP.Version}
+		if included[key] {
+			verr.add(line, `buildpack "%s" version "%s" is included more than once`, bp.ID, data.BP.Version)
+		}
+		included[key] = true
+
+		if bp.Latest {
+			if latest[bp.ID] {
+				verr.add(line, `more than one version of buildpack "%s" is marked latest`, bp.ID)
+			}
+			latest[bp.ID] = true
+		}
+
+		if config.Stack.ID != "" && !supportsStack(data, config.Stack.ID) {
+			verr.add(line, `buildpack "%s" version "%s" does not support stack "%s"`, bp.ID, data.BP.Version, config.Stack.ID)
+		}
+	}
+
+	for i, group := range config.Groups {
+		for _, ref := range group.Buildpacks {
+			if unreadable[ref.ID] || included[idVersion{ref.ID, ref.Version}] {
+				continue
+			}
+			verr.add(lines.groupBuildpack(i, ref.ID), `group %d refers to buildpack "%s" version "%s" which is not included in the builder`, i+1, ref.ID, ref.Version)
+		}
+	}
+}
+
+func supportsStack(data *BuildpackData, stackID string) bool {
+	for _, stack := range data.Stacks {
+		if stack.ID == stackID {
+			return true
+		}
+	}
+	return false
+}
+
+// builderTOMLLines locates buildpacks and groups in a builder.toml so problems
+// can be reported by line. Tables written inline can't be located.
+type builderTOMLLines struct {
+	text       []string
+	buildpacks []int
+	groups     [][2]int // first and last line of each [[groups]] table
+}
+
+func readBuilderTOMLLines(path string) builderTOMLLines {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return builderTOMLLines{}
+	}
+	return parseBuilderTOMLLines(string(contents))
+}
+
+func parseBuilderTOMLLines(contents string) builderTOMLLines {
+	var lines builderTOMLLines
+	lines.text = strings.Split(contents, "\n")
+	for i, text := range lines.text {
+		text = strings.TrimSpace(text)
+		if !strings.HasPrefix(text, "[") || strings.HasPrefix(text, "[[groups.") {
+			continue
+		}
+		if n := len(lines.groups); n > 0 && lines.groups[n-1][1] == 0 {
+			lines.groups[n-1][1] = i
+		}
+		switch text {
+		case "[[buildpacks]]":
+			lines.buildpacks = append(lines.buildpacks, i+1)
+		case "[[groups]]":
+			lines.groups = append(lines.groups, [2]int{i + 1, 0})
+		}
+	}
+	if n := len(lines.groups); n > 0 && lines.groups[n-1][1] == 0 {
+		lines.groups[n-1][1] = len(lines.text)
+	}
+	return lines
+}
+
+func (l builderTOMLLines) buildpack(i int) int {
+	if i < len(l.buildpacks) {
+		return l.buildpacks[i]
+	}
+	return 0
+}
+
+var sha256Key = regexp.MustCompile(`^(\s*sha256\s*=\s*)"[^"]*"(.*)$`)
+
+// withDigests returns the text with the sha256 key of each [[buildpacks]]
+// table set to the digest of the matching buildpack, adding the key after the
+// last line of the table or removing it when there is no digest.
+func (l builderTOMLLines) withDigests(buildpacks []BuilderTOMLBuildpack) string {
+	text := append([]string{}, l.text...)
+	for i := len(l.buildpacks) - 1; i >= 0; i-- {
+		start, end := l.buildpacks[i], len(text)
+		for line := start; line < len(text); line++ {
+			if strings.HasPrefix(strings.TrimSpace(text[line]), "[") {
+				end = line
+				break
+			}
+		}
+
+		digest, last, keyLine := buildpacks[i].SHA256, start-1, -1
+		for line := start; line < end; line++ {
+			trimmed := strings.TrimSpace(text[line])
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			last = line
+			if sha256Key.MatchString(text[line]) {
+				keyLine = line
+			}
+		}
+
+		switch {
+		case keyLine >= 0 && digest == "":
+			text = append(text[:keyLine], text[keyLine+1:]...)
+		case keyLine >= 0:
+			text[keyLine] = sha256Key.ReplaceAllString(text[keyLine], fmt.Sprintf(`${1}%q${2}`, digest))
+		case digest != "":
+			indent := ""
+			if last >= start {
+				indent = text[last][:len(text[last])-len(strings.TrimLeft(text[last], " \t"))]
+			}
+			key := fmt.Sprintf(`%ssha256 = %q`, indent, digest)
+			text = append(text[:last+1], append([]string{key}, text[last+1:]...)...)
+		}
+	}
+	return strings.Join(text, "\n")
+}
+
+func (l builderTOMLLines) groupBuildpack(i int, id string) int {
+	if i >= len(l.groups) {
+		return 0
+	}
+	for line := l.groups[i][0]; line <= l.groups[i][1]; line++ {
+		if strings.Contains(l.text[line-1], fmt.Sprintf("%q", id)) {
+			return line
+		}
+	}
+	return l.groups[i][0]
+}
+
 type order struct {
 	Groups []lifecycle.BuildpackGroup `toml:"groups"`
 }
@@ -315,15 +848,28 @@ type BuildpackData struct {
 		ID      string `toml:"id"`
 		Version string `toml:"version"`
 	} `toml:"buildpack"`
+	Stacks []struct {
+		ID string `toml:"id"`
+	} `toml:"stacks"`
 }
 
 // buildpackLayer creates and returns the location of a tgz file for a buildpack layer. That file will reside in the `dest` directory.
 // The tgz file is either created from an initially local directory, or it is downloaded (and validated) from
 // a remote location if the buildpack uri uses the http(s) protocol.
-func (f *BuilderFactory) buildpackLayer(dest string, buildpack Buildpack, builderDir string) (layerTar string, err error) {
+func (f *BuilderFactory) buildpackLayer(dest string, buildpack Buildpack, version string) (layerTar string, err error) {
 	dir := buildpack.Dir
 
-	data, err := f.buildpackData(buildpack, dir)
+	tarFile := filepath.Join(dest, fmt.Sprintf("%s.%s.tar", buildpack.ID, version))
+	if err := f.FS.CreateTGZFile(tarFile, dir, filepath.Join("/buildpacks", buildpack.ID, version), 0, 0); err != nil {
+		return "", err
+	}
+	return tarFile, err
+}
+
+// buildpackVersion reads the version from the buildpack's buildpack.toml after
+// checking that it describes the buildpack declared in builder.toml.
+func (f *BuilderFactory) buildpackVersion(buildpack Buildpack) (string, error) {
+	data, err := f.buildpackData(buildpack, buildpack.Dir)
 	if err != nil {
 		return "", err
 	}
@@ -334,15 +880,14 @@ func (f *BuilderFactory) buildpackLayer(dest string, buildpack Buildpack, builde
 	if bp.Version == "" {
 		return "", fmt.Errorf("buildpack.toml must provide version: %s", filepath.Join(buildpack.Dir, "!/buildpack.toml"))
 	}
-
-	tarFile := filepath.Join(dest, fmt.Sprintf("%s.%s.tar", buildpack.ID, bp.Version))
-	if err := f.FS.CreateTGZFile(tarFile, dir, filepath.Join("/buildpacks", buildpack.ID, bp.Version), 0, 0); err != nil {
-		return "", err
-	}
-	return tarFile, err
+	return bp.Version, nil
 }
 
 func (f *BuilderFactory) buildpackData(buildpack Buildpack, dir string) (*BuildpackData, error) {
+	return readBuildpackData(dir)
+}
+
+func readBuildpackData(dir string) (*BuildpackData, error) {
 	data := &BuildpackData{}
 	_, err := toml.DecodeFile(filepath.Join(dir, "buildpack.toml"), &data)
 	if err != nil {
@@ -368,7 +913,7 @@ func (f *BuilderFactory) latestLayer(buildpacks []Buildpack, dest, builderDir st
 			}
 			err = os.Symlink(filepath.Join("/", "buildpacks", bp.ID, data.BP.Version), filepath.Join(tmpDir, bp.ID, "latest"))
 			if err != nil {
-				fmt.Println("E")
+				return "", errors.Wrapf(err, "link latest version of buildpack '%s'", bp.ID)
 			}
 		}
 	}
@@ -378,36 +923,3 @@ func (f *BuilderFactory) latestLayer(buildpacks []Buildpack, dest, builderDir st
 	}
 	return tarFile, err
 }
-
-func (f *BuilderFactory) downloadAsStream(uri string, etag string) (io.Reader, string, error) {
-	c := http.Client{}
-	req, err := http.NewRequest("GET", uri, nil)
-	if err != nil {
-		return nil, "", err
-	}
-	if etag != "" {
-		req.Header.Set("If-None-Match", etag)
-	}
-	if resp, err := c.Do(req); err != nil {
-		return nil, "", err
-	} else {
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			f.Log.Printf("Downloading from %q\n", uri)
-			return resp.Body, resp.Header.Get("Etag"), nil
-		} else if resp.StatusCode == 304 {
-			f.Log.Printf("Using cached version of %q\n", uri)
-			return nil, etag, nil
-		} else {
-			return nil, "", fmt.Errorf("could not download from %q, code http status %d", uri, resp.StatusCode)
-		}
-	}
-}
-
-func (f *BuilderFactory) untarZ(r io.Reader, dir string) error {
-	gzr, err := gzip.NewReader(r)
-	if err != nil {
-		return errors.Wrapf(err, "could not unzip")
-	}
-	defer gzr.Close()
-	return f.FS.Untar(gzr, dir)
-}
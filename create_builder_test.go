@@ -1,27 +1,40 @@
 package pack_test
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/buildpack/lifecycle"
+	"github.com/docker/docker/api/types"
 	"github.com/golang/mock/gomock"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
 
 	"github.com/buildpack/pack"
 	"github.com/buildpack/pack/config"
 	"github.com/buildpack/pack/fs"
+	"github.com/buildpack/pack/logging"
 	"github.com/buildpack/pack/mocks"
 	h "github.com/buildpack/pack/testhelpers"
 )
@@ -76,7 +89,7 @@ func testCreateBuilder(t *testing.T, when spec.G, it spec.S) {
 			factory = pack.BuilderFactory{
 				FS:     &fs.FS{},
 				Docker: mockDocker,
-				Log:    log.New(&buf, "", log.LstdFlags),
+				Log:    logging.New(&buf, &buf, logging.Options{}),
 				Config: cfg,
 				Images: mockImages,
 			}
@@ -131,7 +144,7 @@ func testCreateBuilder(t *testing.T, when spec.G, it spec.S) {
 				h.AssertEq(t, config.RepoName, "registry.com/some/image")
 			})
 
-			it("doesn't pull base a new image when --no-pull flag is provided", func() {
+			it("doesn't pull the base image when the pull policy is never", func() {
 				mockBaseImage := mocks.NewMockV1Image(mockController)
 				mockImageStore := mocks.NewMockStore(mockController)
 				mockImages.EXPECT().ReadImage("default/build", true).Return(mockBaseImage, nil)
@@ -140,7 +153,7 @@ func testCreateBuilder(t *testing.T, when spec.G, it spec.S) {
 				config, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
 					RepoName:        "some/image",
 					BuilderTomlPath: filepath.Join("testdata", "builder.toml"),
-					NoPull:          true,
+					PullPolicy:      "never",
 				})
 				if err != nil {
 					t.Fatalf("error creating builder config: %s", err)
@@ -152,13 +165,38 @@ func testCreateBuilder(t *testing.T, when spec.G, it spec.S) {
 				h.AssertEq(t, config.BuilderDir, "testdata")
 			})
 
+			it("doesn't pull a base image the daemon has when the pull policy is if-not-present", func() {
+				mockBaseImage := mocks.NewMockV1Image(mockController)
+				mockImageStore := mocks.NewMockStore(mockController)
+				mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "default/build").Return(types.ImageInspect{}, nil, nil)
+				mockImages.EXPECT().ReadImage("default/build", true).Return(mockBaseImage, nil)
+				mockImages.EXPECT().RepoStore("some/image", true).Return(mockImageStore, nil)
+
+				config, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "some/image",
+					BuilderTomlPath: filepath.Join("testdata", "builder.toml"),
+					PullPolicy:      "if-not-present",
+				})
+				h.AssertNil(t, err)
+				h.AssertSameInstance(t, config.BaseImage, mockBaseImage)
+			})
+
+			it("fails for an invalid pull policy", func() {
+				_, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "some/image",
+					BuilderTomlPath: filepath.Join("testdata", "builder.toml"),
+					PullPolicy:      "sometimes",
+				})
+				h.AssertError(t, err, `invalid pull policy "sometimes", expected one of: always, if-not-present, never`)
+			})
+
 			it("fails if the base image cannot be found", func() {
 				mockImages.EXPECT().ReadImage("default/build", true).Return(nil, nil)
 
 				_, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
 					RepoName:        "some/image",
 					BuilderTomlPath: filepath.Join("testdata", "builder.toml"),
-					NoPull:          true,
+					PullPolicy:      "never",
 				})
 				if err == nil {
 					t.Fatalf("Expected error when base image is missing from daemon")
@@ -189,7 +227,7 @@ func testCreateBuilder(t *testing.T, when spec.G, it spec.S) {
 				_, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
 					RepoName:        "some/image",
 					BuilderTomlPath: filepath.Join("testdata", "builder.toml"),
-					NoPull:          true,
+					PullPolicy:      "never",
 				})
 				h.AssertError(t, err, `Invalid stack: stack "some.bad.stack" requires at least one build image`)
 			})
@@ -222,7 +260,7 @@ func testCreateBuilder(t *testing.T, when spec.G, it spec.S) {
 					_, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
 						RepoName:        "some/image",
 						BuilderTomlPath: filepath.Join("testdata", "builder.toml"),
-						NoPull:          true,
+						PullPolicy:      "never",
 						StackID:         "some.missing.stack",
 					})
 					h.AssertError(t, err, `Missing stack: stack with id "some.missing.stack" not found in pack config.toml`)
@@ -276,6 +314,397 @@ func testCreateBuilder(t *testing.T, when spec.G, it spec.S) {
 					h.AssertContains(t, buf.String(), "Successfully created builder image: myorg/mybuilder")
 					h.AssertContains(t, buf.String(), `Tip: Run "pack build <image name> --builder <builder image> --path <app source code>" to use this builder`)
 				})
+
+				it("records the buildpacks and groups in the builder metadata label", func() {
+					bpDir, err := ioutil.TempDir("", "create-builder-bp")
+					h.AssertNil(t, err)
+					defer os.RemoveAll(bpDir)
+					h.AssertNil(t, ioutil.WriteFile(filepath.Join(bpDir, "buildpack.toml"), []byte(`[buildpack]
+id = "some.bp1"
+version = "1.2.3"
+
+[[stacks]]
+id = "some.default.stack"
+`), 0644))
+
+					var builderImage v1.Image
+					mockImageStore := mocks.NewMockStore(mockController)
+					mockImageStore.EXPECT().Write(gomock.Any()).Do(func(i v1.Image) { builderImage = i })
+
+					err = factory.Create(pack.BuilderConfig{
+						RepoName:   "myorg/mybuilder",
+						Repo:       mockImageStore,
+						Buildpacks: []pack.Buildpack{{ID: "some.bp1", Dir: bpDir, Latest: true}},
+						Groups: []lifecycle.BuildpackGroup{
+							{Buildpacks: []*lifecycle.Buildpack{{ID: "some.bp1", Version: "1.2.3"}}},
+						},
+						BaseImage: empty.Image,
+						Stack:     config.Stack{ID: "some.default.stack"},
+					})
+					h.AssertNil(t, err)
+
+					layers, err := builderImage.Layers()
+					h.AssertNil(t, err)
+					h.AssertEq(t, len(layers), 3) // order, buildpack, latest
+					bpDiffID, err := layers[1].DiffID()
+					h.AssertNil(t, err)
+
+					configFile, err := builderImage.ConfigFile()
+					h.AssertNil(t, err)
+					var metadata pack.BuilderMetadata
+					h.AssertNil(t, json.Unmarshal([]byte(configFile.Config.Labels[pack.BuilderMetadataLabel]), &metadata))
+					h.AssertEq(t, metadata.Buildpacks, []pack.BuilderBuildpackMetadata{
+						{ID: "some.bp1", Version: "1.2.3", Latest: true, Layers: []string{bpDiffID.String()}},
+					})
+					h.AssertEq(t, metadata.Groups, []pack.BuilderGroupMetadata{
+						{Buildpacks: []pack.BuilderBuildpackRef{{ID: "some.bp1", Version: "1.2.3"}}},
+					})
+				})
+
+				it("records every layer of a buildpack that is reused from an image", func() {
+					bpDir, err := ioutil.TempDir("", "create-builder-bp")
+					h.AssertNil(t, err)
+					defer os.RemoveAll(bpDir)
+					h.AssertNil(t, ioutil.WriteFile(filepath.Join(bpDir, "buildpack.toml"), []byte(`[buildpack]
+id = "some.bp1"
+version = "1.2.3"
+
+[[stacks]]
+id = "some.default.stack"
+`), 0644))
+					var bpLayers []v1.Layer
+					var bpDiffIDs []string
+					for _, name := range []string{"first.tgz", "second.tgz"} {
+						layerFile := filepath.Join(bpDir, name)
+						h.AssertNil(t, (&fs.FS{}).CreateTGZFile(layerFile, filepath.Join("testdata", "used-to-test-various-uri-schemes", "buildpack"), "/buildpacks/some.bp1/1.2.3", 0, 0))
+						layer, err := tarball.LayerFromFile(layerFile)
+						h.AssertNil(t, err)
+						diffID, err := layer.DiffID()
+						h.AssertNil(t, err)
+						bpLayers = append(bpLayers, layer)
+						bpDiffIDs = append(bpDiffIDs, diffID.String())
+					}
+
+					var builderImage v1.Image
+					mockImageStore := mocks.NewMockStore(mockController)
+					mockImageStore.EXPECT().Write(gomock.Any()).Do(func(i v1.Image) { builderImage = i })
+
+					err = factory.Create(pack.BuilderConfig{
+						RepoName:   "myorg/mybuilder",
+						Repo:       mockImageStore,
+						Buildpacks: []pack.Buildpack{{ID: "some.bp1", Dir: bpDir, Layers: bpLayers}},
+						Groups: []lifecycle.BuildpackGroup{
+							{Buildpacks: []*lifecycle.Buildpack{{ID: "some.bp1", Version: "1.2.3"}}},
+						},
+						BaseImage: empty.Image,
+						Stack:     config.Stack{ID: "some.default.stack"},
+					})
+					h.AssertNil(t, err)
+
+					configFile, err := builderImage.ConfigFile()
+					h.AssertNil(t, err)
+					var metadata pack.BuilderMetadata
+					h.AssertNil(t, json.Unmarshal([]byte(configFile.Config.Labels[pack.BuilderMetadataLabel]), &metadata))
+					h.AssertEq(t, metadata.Buildpacks[0].Layers, bpDiffIDs)
+				})
+			})
+		})
+		when("builder.toml has a [stack]", func() {
+			var builderTomlPath string
+
+			it.Before(func() {
+				f, err := ioutil.TempFile("", "*.toml")
+				h.AssertNil(t, err)
+				builderTomlPath = f.Name()
+				h.AssertNil(t, ioutil.WriteFile(builderTomlPath, []byte(`[stack]
+id = "some.unconfigured.stack"
+build-image = "some/build"
+run-image = "some/run"
+run-image-mirrors = ["registry.com/some/run"]
+`), 0644))
+			})
+
+			it("uses its build image and records it on the builder", func() {
+				mockImageStore := mocks.NewMockStore(mockController)
+				mockImages.EXPECT().ReadImage("some/build", true).Return(empty.Image, nil)
+				mockImages.EXPECT().RepoStore("myorg/mybuilder", true).Return(mockImageStore, nil)
+
+				builderConfig, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: builderTomlPath,
+					PullPolicy:      "never",
+				})
+				h.AssertNil(t, err)
+				h.AssertEq(t, builderConfig.Stack, config.Stack{
+					ID:          "some.unconfigured.stack",
+					BuildImages: []string{"some/build"},
+					RunImages:   []string{"some/run", "registry.com/some/run"},
+				})
+
+				var builderImage v1.Image
+				mockImageStore.EXPECT().Write(gomock.Any()).Do(func(i v1.Image) { builderImage = i })
+				h.AssertNil(t, factory.Create(builderConfig))
+
+				configFile, err := builderImage.ConfigFile()
+				h.AssertNil(t, err)
+				var metadata pack.BuilderMetadata
+				h.AssertNil(t, json.Unmarshal([]byte(configFile.Config.Labels[pack.BuilderMetadataLabel]), &metadata))
+				h.AssertEq(t, metadata.Stack, pack.BuilderStackMetadata{
+					ID:         "some.unconfigured.stack",
+					BuildImage: "some/build",
+					RunImage: pack.BuilderRunImageMetadata{
+						Image:   "some/run",
+						Mirrors: []string{"registry.com/some/run"},
+					},
+				})
+			})
+
+			it("fails when -s names a different stack", func() {
+				_, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: builderTomlPath,
+					StackID:         "some.default.stack",
+				})
+				h.AssertError(t, err, `stack "some.default.stack" does not match stack "some.unconfigured.stack" from builder.toml`)
+			})
+		})
+
+		when("builder.toml has a [lifecycle]", func() {
+			var builderDir string
+
+			it.Before(func() {
+				var err error
+				builderDir, err = ioutil.TempDir("", "create-builder-lifecycle")
+				h.AssertNil(t, err)
+				h.AssertNil(t, os.MkdirAll(filepath.Join(builderDir, "lifecycle"), 0755))
+				for _, binary := range []string{"detector", "analyzer", "builder"} {
+					h.AssertNil(t, ioutil.WriteFile(filepath.Join(builderDir, "lifecycle", binary), []byte(binary), 0755))
+				}
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(builderDir, "builder.toml"), []byte(`[lifecycle]
+version = "0.1.0"
+uri = "lifecycle"
+`), 0644))
+			})
+
+			it.After(func() {
+				os.RemoveAll(builderDir)
+			})
+
+			it("adds the lifecycle as a layer and records its version", func() {
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(builderDir, "lifecycle", "exporter"), []byte("exporter"), 0755))
+				mockImageStore := mocks.NewMockStore(mockController)
+				mockImages.EXPECT().ReadImage("default/build", true).Return(empty.Image, nil)
+				mockImages.EXPECT().RepoStore("myorg/mybuilder", true).Return(mockImageStore, nil)
+
+				builderConfig, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: filepath.Join(builderDir, "builder.toml"),
+					PullPolicy:      "never",
+				})
+				h.AssertNil(t, err)
+				h.AssertEq(t, builderConfig.Lifecycle, pack.Lifecycle{Version: "0.1.0", Dir: filepath.Join(builderDir, "lifecycle")})
+
+				var (
+					builderImage v1.Image
+					names        []string
+				)
+				mockImageStore.EXPECT().Write(gomock.Any()).Do(func(i v1.Image) {
+					// layer files only exist until Create returns
+					builderImage = i
+					layers, err := i.Layers()
+					h.AssertNil(t, err)
+					h.AssertEq(t, len(layers), 3) // order, lifecycle, latest
+					rc, err := layers[1].Uncompressed()
+					h.AssertNil(t, err)
+					defer rc.Close()
+					tr := tar.NewReader(rc)
+					for {
+						hdr, err := tr.Next()
+						if err == io.EOF {
+							break
+						}
+						h.AssertNil(t, err)
+						names = append(names, hdr.Name)
+					}
+				})
+				h.AssertNil(t, factory.Create(builderConfig))
+				h.AssertContains(t, strings.Join(names, ","), "/lifecycle/detector")
+
+				configFile, err := builderImage.ConfigFile()
+				h.AssertNil(t, err)
+				var metadata pack.BuilderMetadata
+				h.AssertNil(t, json.Unmarshal([]byte(configFile.Config.Labels[pack.BuilderMetadataLabel]), &metadata))
+				h.AssertEq(t, metadata.Lifecycle.Version, "0.1.0")
+			})
+
+			it("fails when the lifecycle is missing binaries", func() {
+				_, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: filepath.Join(builderDir, "builder.toml"),
+					PullPolicy:      "never",
+					ValidateOnly:    true,
+				})
+				h.AssertError(t, err, `lifecycle 0.1.0 from "lifecycle" is missing: exporter`)
+			})
+		})
+
+		when("#Validate", func() {
+			var builderDir string
+
+			writeBuildpack := func(dir, id, version, stack string) {
+				h.AssertNil(t, os.MkdirAll(filepath.Join(builderDir, dir), 0755))
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(builderDir, dir, "buildpack.toml"), []byte(fmt.Sprintf(`[buildpack]
+id = "%s"
+version = "%s"
+
+[[stacks]]
+id = "%s"
+`, id, version, stack)), 0644))
+			}
+
+			it.Before(func() {
+				var err error
+				builderDir, err = ioutil.TempDir("", "create-builder-validate")
+				h.AssertNil(t, err)
+			})
+
+			it.After(func() {
+				os.RemoveAll(builderDir)
+			})
+
+			it("reports every problem with its line", func() {
+				writeBuildpack("a", "some.bp1", "1.2.3", "some.default.stack")
+				writeBuildpack("b", "some.bp1", "1.2.3", "some.default.stack")
+				writeBuildpack("c", "some.bp2", "1.0.0", "some.other.stack")
+				writeBuildpack("d", "some.bp2", "2.0.0", "some.default.stack")
+				builderTomlPath := filepath.Join(builderDir, "builder.toml")
+				h.AssertNil(t, ioutil.WriteFile(builderTomlPath, []byte(`[[buildpacks]]
+id = "some.bp1"
+uri = "a"
+
+[[buildpacks]]
+id = "some.bp1"
+uri = "b"
+
+[[buildpacks]]
+id = "some.bp2"
+uri = "c"
+latest = true
+
+[[buildpacks]]
+id = "some.bp2"
+uri = "d"
+latest = true
+
+[[groups]]
+buildpacks = [
+  { id = "some.bp1", version = "1.2.3" },
+  { id = "some.missing", version = "0.0.1" },
+]
+`), 0644))
+
+				builderConfig, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: builderTomlPath,
+					ValidateOnly:    true,
+				})
+				h.AssertNil(t, err)
+				h.AssertEq(t, builderConfig.Stack.ID, "some.default.stack")
+
+				err = factory.Validate(builderConfig)
+				h.AssertError(t, err, fmt.Sprintf(`invalid builder config %q:
+  %[2]s:5: buildpack "some.bp1" version "1.2.3" is included more than once
+  %[2]s:9: buildpack "some.bp2" version "1.0.0" does not support stack "some.default.stack"
+  %[2]s:14: more than one version of buildpack "some.bp2" is marked latest
+  %[2]s:22: group 1 refers to buildpack "some.missing" version "0.0.1" which is not included in the builder`, builderTomlPath, builderTomlPath))
+			})
+
+			it("reports buildpacks that can't be fetched or aren't allowed with the other problems", func() {
+				writeBuildpack("a", "some.bp1", "1.2.3", "some.default.stack")
+				writeBuildpack("c", "some.bp2", "1.0.0", "some.other.stack")
+				notAnArchive := filepath.Join(builderDir, "not-an-archive")
+				h.AssertNil(t, ioutil.WriteFile(notAnArchive, []byte("some text"), 0644))
+				policyPath := filepath.Join(builderDir, "policy.toml")
+				h.AssertNil(t, ioutil.WriteFile(policyPath, []byte(`[[buildpacks]]
+id = "some.bp2"
+`), 0644))
+				builderTomlPath := filepath.Join(builderDir, "builder.toml")
+				h.AssertNil(t, ioutil.WriteFile(builderTomlPath, []byte(`[[buildpacks]]
+id = "some.bp1"
+uri = "a"
+
+[[buildpacks]]
+id = "some.bp2"
+uri = "c"
+
+[[buildpacks]]
+id = "some.bp3"
+uri = "not-an-archive"
+
+[[groups]]
+buildpacks = [
+  { id = "some.bp1", version = "1.2.3" },
+  { id = "some.bp3", version = "1.0.0" },
+]
+`), 0644))
+
+				_, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: builderTomlPath,
+					ValidateOnly:    true,
+					Policy:          policyPath,
+				})
+				h.AssertError(t, err, fmt.Sprintf(`invalid builder config %q:
+  %[1]s:1: policy %q: buildpack "some.bp1" is not allowed by rule "buildpacks" (allowed: some.bp2)
+  %[1]s:5: buildpack "some.bp2" version "1.0.0" does not support stack "some.default.stack"
+  %[1]s:9: failed to fetch buildpack "some.bp3": could not extract %[3]q: unsupported archive format, expected a gzipped tar, tar or zip archive`, builderTomlPath, policyPath, notAnArchive))
+			})
+
+			it("reports the problems of the buildpacks after one that can't be fetched at their own line", func() {
+				writeBuildpack("c", "some.bp2", "1.0.0", "some.other.stack")
+				notAnArchive := filepath.Join(builderDir, "not-an-archive")
+				h.AssertNil(t, ioutil.WriteFile(notAnArchive, []byte("some text"), 0644))
+				builderTomlPath := filepath.Join(builderDir, "builder.toml")
+				h.AssertNil(t, ioutil.WriteFile(builderTomlPath, []byte(`[[buildpacks]]
+id = "some.bp1"
+uri = "not-an-archive"
+
+[[buildpacks]]
+id = "some.bp2"
+uri = "c"
+`), 0644))
+
+				_, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: builderTomlPath,
+					ValidateOnly:    true,
+				})
+				h.AssertError(t, err, fmt.Sprintf(`invalid builder config %q:
+  %[1]s:1: failed to fetch buildpack "some.bp1": could not extract %[2]q: unsupported archive format, expected a gzipped tar, tar or zip archive
+  %[1]s:5: buildpack "some.bp2" version "1.0.0" does not support stack "some.default.stack"`, builderTomlPath, notAnArchive))
+			})
+
+			it("accepts a valid builder", func() {
+				writeBuildpack("a", "some.bp1", "1.2.3", "some.default.stack")
+				builderTomlPath := filepath.Join(builderDir, "builder.toml")
+				h.AssertNil(t, ioutil.WriteFile(builderTomlPath, []byte(`[[buildpacks]]
+id = "some.bp1"
+uri = "a"
+latest = true
+
+[[groups]]
+buildpacks = [
+  { id = "some.bp1", version = "1.2.3" },
+]
+`), 0644))
+
+				builderConfig, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: builderTomlPath,
+					ValidateOnly:    true,
+				})
+				h.AssertNil(t, err)
+				h.AssertNil(t, factory.Validate(builderConfig))
 			})
 		})
 		when("a buildpack location uses no scheme uris", func() {
@@ -291,7 +720,7 @@ func testCreateBuilder(t *testing.T, when spec.G, it spec.S) {
 					BuilderTomlPath: "testdata/used-to-test-various-uri-schemes/builder-with-schemeless-uris.toml",
 					StackID:         "some.default.stack",
 					Publish:         false,
-					NoPull:          true,
+					PullPolicy:      "never",
 				}
 
 				builderConfig, err := factory.BuilderConfigFromFlags(flags)
@@ -337,7 +766,7 @@ buildpacks = [
 					BuilderTomlPath: f.Name(),
 					StackID:         "some.default.stack",
 					Publish:         false,
-					NoPull:          true,
+					PullPolicy:      "never",
 				}
 
 				builderConfig, err := factory.BuilderConfigFromFlags(flags)
@@ -347,6 +776,85 @@ buildpacks = [
 				h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[1].Dir, "bin/build", "I come from an archive")
 			})
 		})
+		when("a buildpack location is an archive without a known extension", func() {
+			var archiveDir string
+
+			it.Before(func() {
+				var err error
+				archiveDir, err = ioutil.TempDir("", "create-builder-archives")
+				h.AssertNil(t, err)
+
+				tr, errChan := (&fs.FS{}).CreateTarReader(filepath.Join("testdata", "used-to-test-various-uri-schemes", "buildpack"), ".", 0, 0)
+				tarFile, err := os.Create(filepath.Join(archiveDir, "tar-buildpack"))
+				h.AssertNil(t, err)
+				_, err = io.Copy(tarFile, tr)
+				h.AssertNil(t, err)
+				h.AssertNil(t, <-errChan)
+				h.AssertNil(t, tarFile.Close())
+
+				zipFile, err := os.Create(filepath.Join(archiveDir, "zip-buildpack"))
+				h.AssertNil(t, err)
+				zw := zip.NewWriter(zipFile)
+				w, err := zw.Create("bin/detect")
+				h.AssertNil(t, err)
+				_, err = w.Write([]byte("I come from a zip"))
+				h.AssertNil(t, err)
+				h.AssertNil(t, zw.Close())
+				h.AssertNil(t, zipFile.Close())
+			})
+
+			it.After(func() {
+				os.RemoveAll(archiveDir)
+			})
+
+			it("detects tar and zip archives by content", func() {
+				mockImages.EXPECT().ReadImage("default/build", true).Return(mocks.NewMockV1Image(mockController), nil)
+				mockImages.EXPECT().RepoStore("myorg/mybuilder", true).Return(mocks.NewMockStore(mockController), nil)
+
+				builderTomlPath := filepath.Join(archiveDir, "builder.toml")
+				h.AssertNil(t, ioutil.WriteFile(builderTomlPath, []byte(`[[buildpacks]]
+id = "some.bp.in.a.tar"
+uri = "tar-buildpack"
+
+[[buildpacks]]
+id = "some.bp.in.a.zip"
+uri = "zip-buildpack"
+`), 0644))
+
+				builderConfig, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: builderTomlPath,
+					StackID:         "some.default.stack",
+					PullPolicy:      "never",
+				})
+				h.AssertNil(t, err)
+
+				h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[0].Dir, "bin/detect", "I come from a directory")
+				h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[1].Dir, "bin/detect", "I come from a zip")
+			})
+
+			it("fails on files that are not archives", func() {
+				mockImages.EXPECT().ReadImage("default/build", true).Return(mocks.NewMockV1Image(mockController), nil)
+				mockImages.EXPECT().RepoStore("myorg/mybuilder", true).Return(mocks.NewMockStore(mockController), nil)
+
+				notAnArchive := filepath.Join(archiveDir, "not-an-archive")
+				h.AssertNil(t, ioutil.WriteFile(notAnArchive, []byte("some text"), 0644))
+				builderTomlPath := filepath.Join(archiveDir, "builder.toml")
+				h.AssertNil(t, ioutil.WriteFile(builderTomlPath, []byte(`[[buildpacks]]
+id = "some.bp"
+uri = "not-an-archive"
+`), 0644))
+
+				_, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: builderTomlPath,
+					StackID:         "some.default.stack",
+					PullPolicy:      "never",
+				})
+				h.AssertError(t, err, fmt.Sprintf(`invalid builder config %q:
+  %[1]s:1: failed to fetch buildpack "some.bp": could not extract %q: unsupported archive format, expected a gzipped tar, tar or zip archive`, builderTomlPath, notAnArchive))
+			})
+		})
 		when("a buildpack location uses file:// uris", func() {
 			it("supports absolute directories as well as archives", func() {
 				mockBaseImage := mocks.NewMockV1Image(mockController)
@@ -385,7 +893,7 @@ buildpacks = [
 					BuilderTomlPath: f.Name(),
 					StackID:         "some.default.stack",
 					Publish:         false,
-					NoPull:          true,
+					PullPolicy:      "never",
 				}
 
 				builderConfig, err := factory.BuilderConfigFromFlags(flags)
@@ -395,6 +903,474 @@ buildpacks = [
 				h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[1].Dir, "bin/build", "I come from an archive")
 			})
 		})
+		when("a buildpack provides a sha256", func() {
+			var (
+				tgzPath string
+				tgzSHA  = "c3cd2dcc113b0face668f4297b126c68b7a7285769f3cae8d701a45540c404df"
+				flags   pack.CreateBuilderFlags
+			)
+
+			writeBuilderTOML := func(sha string) string {
+				f, err := ioutil.TempFile("", "*.toml")
+				h.AssertNil(t, err)
+				h.AssertNil(t, ioutil.WriteFile(f.Name(), []byte(fmt.Sprintf(`[[buildpacks]]
+id = "some.bp.with.sha"
+uri = "%s"
+sha256 = "%s"
+
+[[groups]]
+buildpacks = [
+  { id = "some.bp.with.sha", version = "1.2.3" },
+]`, tgzPath, sha)), 0644))
+				return f.Name()
+			}
+
+			it.Before(func() {
+				var err error
+				tgzPath, err = filepath.Abs("testdata/used-to-test-various-uri-schemes/buildpack.tgz")
+				h.AssertNil(t, err)
+
+				mockImages.EXPECT().ReadImage("default/build", true).Return(mocks.NewMockV1Image(mockController), nil)
+				mockImages.EXPECT().RepoStore("myorg/mybuilder", true).Return(mocks.NewMockStore(mockController), nil)
+
+				flags = pack.CreateBuilderFlags{
+					RepoName:   "myorg/mybuilder",
+					StackID:    "some.default.stack",
+					PullPolicy: "never",
+				}
+			})
+
+			it("accepts an archive with a matching digest", func() {
+				flags.BuilderTomlPath = writeBuilderTOML(tgzSHA)
+
+				builderConfig, err := factory.BuilderConfigFromFlags(flags)
+				h.AssertNil(t, err)
+
+				h.AssertEq(t, builderConfig.Buildpacks[0].SHA256, tgzSHA)
+				h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[0].Dir, "bin/build", "I come from an archive")
+			})
+
+			it("fails with both digests when they do not match", func() {
+				flags.BuilderTomlPath = writeBuilderTOML("0000")
+
+				_, err := factory.BuilderConfigFromFlags(flags)
+				h.AssertError(t, err, fmt.Sprintf(`invalid builder config %q:
+  %[1]s:1: failed to fetch buildpack "some.bp.with.sha": sha256 mismatch for %q: expected 0000, got %s`, flags.BuilderTomlPath, tgzPath, tgzSHA))
+			})
+
+			when("--lock is passed", func() {
+				it("writes the observed digests to builder.toml", func() {
+					flags.BuilderTomlPath = writeBuilderTOML("0000")
+					flags.Lock = true
+
+					_, err := factory.BuilderConfigFromFlags(flags)
+					h.AssertNil(t, err)
+
+					builderTOML := pack.BuilderTOML{}
+					_, err = toml.DecodeFile(flags.BuilderTomlPath, &builderTOML)
+					h.AssertNil(t, err)
+					h.AssertEq(t, builderTOML.Buildpacks[0].SHA256, tgzSHA)
+					h.AssertEq(t, builderTOML.Groups[0].Buildpacks[0].ID, "some.bp.with.sha")
+					h.AssertContains(t, buf.String(), "Wrote buildpack digests to "+flags.BuilderTomlPath)
+				})
+
+				it("only changes the sha256 keys, keeping comments and formatting", func() {
+					dirPath, err := filepath.Abs("testdata/used-to-test-various-uri-schemes/buildpack")
+					h.AssertNil(t, err)
+					f, err := ioutil.TempFile("", "*.toml")
+					h.AssertNil(t, err)
+					h.AssertNil(t, ioutil.WriteFile(f.Name(), []byte(fmt.Sprintf(`# some builder
+[[buildpacks]]
+id = "some.bp.with.sha"
+uri = "%s"
+sha256 = "0000" # pinned
+
+[[buildpacks]]
+  id = "some.bp.without.sha"
+  uri = "%s"
+
+[[buildpacks]]
+id = "some.bp.from.dir"
+uri = "%s"
+sha256 = "0000"
+
+[[groups]]
+buildpacks = [
+  { id = "some.bp.with.sha", version = "1.2.3" },
+]
+`, tgzPath, tgzPath, dirPath)), 0644))
+					flags.BuilderTomlPath = f.Name()
+					flags.Lock = true
+
+					_, err = factory.BuilderConfigFromFlags(flags)
+					h.AssertNil(t, err)
+
+					contents, err := ioutil.ReadFile(flags.BuilderTomlPath)
+					h.AssertNil(t, err)
+					h.AssertEq(t, string(contents), fmt.Sprintf(`# some builder
+[[buildpacks]]
+id = "some.bp.with.sha"
+uri = "%s"
+sha256 = "%s" # pinned
+
+[[buildpacks]]
+  id = "some.bp.without.sha"
+  uri = "%s"
+  sha256 = "%s"
+
+[[buildpacks]]
+id = "some.bp.from.dir"
+uri = "%s"
+
+[[groups]]
+buildpacks = [
+  { id = "some.bp.with.sha", version = "1.2.3" },
+]
+`, tgzPath, tgzSHA, tgzPath, tgzSHA, dirPath))
+				})
+
+				it("re-encodes a builder.toml whose buildpacks are written inline", func() {
+					f, err := ioutil.TempFile("", "*.toml")
+					h.AssertNil(t, err)
+					h.AssertNil(t, ioutil.WriteFile(f.Name(), []byte(fmt.Sprintf(`buildpacks = [
+  { id = "some.bp.with.sha", uri = "%s" },
+]
+`, tgzPath)), 0644))
+					flags.BuilderTomlPath = f.Name()
+					flags.Lock = true
+
+					_, err = factory.BuilderConfigFromFlags(flags)
+					h.AssertNil(t, err)
+
+					builderTOML := pack.BuilderTOML{}
+					_, err = toml.DecodeFile(flags.BuilderTomlPath, &builderTOML)
+					h.AssertNil(t, err)
+					h.AssertEq(t, builderTOML.Buildpacks[0].SHA256, tgzSHA)
+				})
+			})
+		})
+		when("a buildpack location uses docker:// uris", func() {
+			var bpImage v1.Image
+
+			// buildpackImage stores version 1.2.3 of some.bp.from.image, with
+			// tomlVersion as the version in its buildpack.toml
+			buildpackImage := func(tomlVersion string) v1.Image {
+				tmpDir, err := ioutil.TempDir("", "create-builder-test-bp-image")
+				h.AssertNil(t, err)
+				bpDir := filepath.Join(tmpDir, "buildpack")
+				h.AssertNil(t, os.MkdirAll(filepath.Join(bpDir, "bin"), 0755))
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(bpDir, "bin", "detect"), []byte("I come from a directory"), 0755))
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(bpDir, "buildpack.toml"), []byte(`[buildpack]
+id = "some.bp.from.image"
+version = "`+tomlVersion+`"
+`), 0644))
+				layerFile := filepath.Join(tmpDir, "buildpack.tgz")
+				h.AssertNil(t, (&fs.FS{}).CreateTGZFile(layerFile, bpDir, "/buildpacks/some.bp.from.image/1.2.3", 0, 0))
+				layer, err := tarball.LayerFromFile(layerFile)
+				h.AssertNil(t, err)
+				img, err := mutate.AppendLayers(empty.Image, layer)
+				h.AssertNil(t, err)
+				return img
+			}
+
+			it.Before(func() {
+				bpImage = buildpackImage("1.2.3")
+			})
+
+			it("extracts the buildpack and reuses its layer", func() {
+				mockBaseImage := mocks.NewMockV1Image(mockController)
+				mockImageStore := mocks.NewMockStore(mockController)
+
+				mockImages.EXPECT().ReadImage("default/build", true).Return(mockBaseImage, nil)
+				mockImages.EXPECT().RepoStore("myorg/mybuilder", true).Return(mockImageStore, nil)
+				mockDocker.EXPECT().PullImage("registry.com/org/some-bp:1.2.3").Return(nil)
+				mockImages.EXPECT().ReadImage("registry.com/org/some-bp:1.2.3", true).Return(bpImage, nil)
+
+				f, err := ioutil.TempFile("", "*.toml")
+				h.AssertNil(t, err)
+				ioutil.WriteFile(f.Name(), []byte(`[[buildpacks]]
+id = "some.bp.from.image"
+uri = "docker://registry.com/org/some-bp:1.2.3"
+
+[[groups]]
+buildpacks = [
+  { id = "some.bp.from.image", version = "1.2.3" },
+]`), 0644)
+
+				flags := pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: f.Name(),
+					StackID:         "some.default.stack",
+				}
+
+				mockDocker.EXPECT().PullImage("default/build").Return(nil)
+				builderConfig, err := factory.BuilderConfigFromFlags(flags)
+				h.AssertNil(t, err)
+
+				h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[0].Dir, "bin/detect", "I come from a directory")
+				h.AssertEq(t, len(builderConfig.Buildpacks[0].Layers), 1)
+			})
+
+			it("fails when the image does not contain the buildpack", func() {
+				mockImages.EXPECT().ReadImage("default/build", true).Return(mocks.NewMockV1Image(mockController), nil)
+				mockImages.EXPECT().RepoStore("myorg/mybuilder", true).Return(mocks.NewMockStore(mockController), nil)
+				mockImages.EXPECT().ReadImage("registry.com/org/some-bp:1.2.3", true).Return(bpImage, nil)
+
+				f, err := ioutil.TempFile("", "*.toml")
+				h.AssertNil(t, err)
+				ioutil.WriteFile(f.Name(), []byte(`[[buildpacks]]
+id = "some.other.bp"
+uri = "docker://registry.com/org/some-bp:1.2.3"
+`), 0644)
+
+				_, err = factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: f.Name(),
+					StackID:         "some.default.stack",
+					PullPolicy:      "never",
+				})
+				h.AssertError(t, err, fmt.Sprintf(`invalid builder config %q:
+  %[1]s:1: reading buildpack from image "registry.com/org/some-bp:1.2.3": buildpack 'some.other.bp' was not found in /buildpacks`, f.Name()))
+			})
+
+			it("fails when the image has a symlink leading outside of the buildpack", func() {
+				outside, err := ioutil.TempDir("", "create-builder-test-outside")
+				h.AssertNil(t, err)
+				defer os.RemoveAll(outside)
+				layerFile, err := ioutil.TempFile("", "create-builder-test-layer")
+				h.AssertNil(t, err)
+				defer os.Remove(layerFile.Name())
+				tw := tar.NewWriter(layerFile)
+				h.AssertNil(t, tw.WriteHeader(&tar.Header{Name: "/buildpacks/some.bp.from.image/1.2.3/bin", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777}))
+				h.AssertNil(t, (&fs.FS{}).AddTextToTar(tw, "/buildpacks/some.bp.from.image/1.2.3/bin/detect", []byte("I escaped")))
+				h.AssertNil(t, tw.Close())
+				h.AssertNil(t, layerFile.Close())
+				layer, err := tarball.LayerFromFile(layerFile.Name())
+				h.AssertNil(t, err)
+				img, err := mutate.AppendLayers(empty.Image, layer)
+				h.AssertNil(t, err)
+
+				mockImages.EXPECT().ReadImage("default/build", true).Return(mocks.NewMockV1Image(mockController), nil)
+				mockImages.EXPECT().RepoStore("myorg/mybuilder", true).Return(mocks.NewMockStore(mockController), nil)
+				mockImages.EXPECT().ReadImage("registry.com/org/some-bp:1.2.3", true).Return(img, nil)
+
+				f, err := ioutil.TempFile("", "*.toml")
+				h.AssertNil(t, err)
+				ioutil.WriteFile(f.Name(), []byte(`[[buildpacks]]
+id = "some.bp.from.image"
+uri = "docker://registry.com/org/some-bp:1.2.3"
+`), 0644)
+
+				_, err = factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: f.Name(),
+					StackID:         "some.default.stack",
+					PullPolicy:      "never",
+				})
+				h.AssertContains(t, err.Error(), fmt.Sprintf("illegal file path in layer: /buildpacks/some.bp.from.image/1.2.3/bin: symlink to absolute path %s", outside))
+				_, err = os.Stat(filepath.Join(outside, "detect"))
+				h.AssertEq(t, os.IsNotExist(err), true)
+			})
+
+			it("doesn't pull buildpack images when offline", func() {
+				mockImages.EXPECT().ReadImage("default/build", true).Return(mocks.NewMockV1Image(mockController), nil)
+				mockImages.EXPECT().RepoStore("myorg/mybuilder", true).Return(mocks.NewMockStore(mockController), nil)
+				mockImages.EXPECT().ReadImage("registry.com/org/some-bp:1.2.3", true).Return(nil, nil)
+
+				f, err := ioutil.TempFile("", "*.toml")
+				h.AssertNil(t, err)
+				ioutil.WriteFile(f.Name(), []byte(`[[buildpacks]]
+id = "some.bp.from.image"
+uri = "docker://registry.com/org/some-bp:1.2.3"
+`), 0644)
+
+				_, err = factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: f.Name(),
+					StackID:         "some.default.stack",
+					PullPolicy:      "always",
+					Offline:         true,
+				})
+				h.AssertError(t, err, fmt.Sprintf(`invalid builder config %q:
+  %[1]s:1: buildpack image "registry.com/org/some-bp:1.2.3" was not found locally, and it is not pulled in offline mode`, f.Name()))
+			})
+
+			it("fails when the version in buildpack.toml does not match the image", func() {
+				mockImages.EXPECT().ReadImage("default/build", true).Return(mocks.NewMockV1Image(mockController), nil)
+				mockImages.EXPECT().RepoStore("myorg/mybuilder", true).Return(mocks.NewMockStore(mockController), nil)
+				mockImages.EXPECT().ReadImage("registry.com/org/some-bp:1.2.3", true).Return(buildpackImage("1.0.0"), nil)
+
+				f, err := ioutil.TempFile("", "*.toml")
+				h.AssertNil(t, err)
+				ioutil.WriteFile(f.Name(), []byte(`[[buildpacks]]
+id = "some.bp.from.image"
+uri = "docker://registry.com/org/some-bp:1.2.3"
+`), 0644)
+
+				_, err = factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: f.Name(),
+					StackID:         "some.default.stack",
+					PullPolicy:      "never",
+				})
+				h.AssertError(t, err, fmt.Sprintf(`invalid builder config %q:
+  %[1]s:1: buildpack "some.bp.from.image" is stored as version "1.2.3" in image "registry.com/org/some-bp:1.2.3", but its buildpack.toml has version "1.0.0"`, f.Name()))
+			})
+		})
+		when("a download fails", func() {
+			var (
+				server        *httptest.Server
+				archive       []byte
+				mu            sync.Mutex
+				requests      int
+				downloads     int
+				etagsReceived []string
+				dropRequests  int
+				builderToml   string
+			)
+
+			it.Before(func() {
+				var err error
+				archive, err = ioutil.ReadFile(filepath.Join("testdata", "used-to-test-various-uri-schemes", "buildpack.tgz"))
+				h.AssertNil(t, err)
+				requests, downloads, dropRequests, etagsReceived = 0, 0, 0, nil
+
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					requests++
+					drop := requests <= dropRequests
+					etagsReceived = append(etagsReceived, r.Header.Get("If-None-Match"))
+					mu.Unlock()
+
+					w.Header().Set("Etag", `"v1"`)
+					w.Header().Set("Content-Length", fmt.Sprintf("%d", len(archive)))
+					if drop {
+						// send half of the archive and hang up
+						w.Write(archive[:len(archive)/2])
+						w.(http.Flusher).Flush()
+						if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+							conn.Close()
+						}
+						return
+					}
+					if r.Header.Get("If-None-Match") == `"v1"` {
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+					time.Sleep(100 * time.Millisecond)
+					mu.Lock()
+					downloads++
+					mu.Unlock()
+					w.Write(archive)
+				}))
+
+				f, err := ioutil.TempFile("", "*.toml")
+				h.AssertNil(t, err)
+				defer f.Close()
+				_, err = f.Write([]byte(fmt.Sprintf(`[[buildpacks]]
+id = "some.bp.with.no.uri.scheme"
+uri = "%s/buildpack.tgz"
+`, server.URL)))
+				h.AssertNil(t, err)
+				builderToml = f.Name()
+			})
+
+			it.After(func() {
+				server.Close()
+				os.Remove(builderToml)
+			})
+
+			resolve := func() (pack.BuilderConfig, error) {
+				return factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: builderToml,
+					StackID:         "some.default.stack",
+					ValidateOnly:    true,
+				})
+			}
+
+			it("retries when the connection drops", func() {
+				dropRequests = 2
+
+				builderConfig, err := resolve()
+				h.AssertNil(t, err)
+				h.AssertEq(t, requests, 3)
+				h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[0].Dir, "bin/build", "I come from an archive")
+				h.AssertContains(t, buf.String(), "retrying in")
+			})
+
+			it("keeps asking whether the cached version is current when retrying", func() {
+				_, err := resolve()
+				h.AssertNil(t, err)
+
+				dropRequests = 2
+				builderConfig, err := resolve()
+				h.AssertNil(t, err)
+				h.AssertEq(t, etagsReceived, []string{"", `"v1"`, `"v1"`})
+				h.AssertEq(t, downloads, 1)
+				h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[0].Dir, "bin/build", "I come from an archive")
+			})
+
+			it("leaves no cache entry behind when every attempt fails", func() {
+				dropRequests = 100
+
+				_, err := resolve()
+				h.AssertNotNil(t, err)
+				h.AssertContains(t, err.Error(), "failed to download from")
+
+				entries, err := pack.NewDownloadCache(factory.Config.Path()).List()
+				h.AssertNil(t, err)
+				h.AssertEq(t, len(entries), 0)
+
+				dropRequests = 0
+				builderConfig, err := resolve()
+				h.AssertNil(t, err)
+				h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[0].Dir, "bin/build", "I come from an archive")
+			})
+
+			it("does not trust an entry that was never completely extracted", func() {
+				_, err := resolve()
+				h.AssertNil(t, err)
+				cache := pack.NewDownloadCache(factory.Config.Path())
+				entries, err := cache.List()
+				h.AssertNil(t, err)
+				h.AssertEq(t, len(entries), 1)
+				h.AssertNil(t, os.Remove(entries[0].Path+".sha256"))
+				h.AssertNil(t, os.RemoveAll(filepath.Join(entries[0].Path, "bin")))
+
+				builderConfig, err := resolve()
+				h.AssertNil(t, err)
+				h.AssertEq(t, etagsReceived, []string{"", ""})
+				h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[0].Dir, "bin/build", "I come from an archive")
+			})
+
+			it("reads the buildpack from a copy that outlives the cache entry", func() {
+				builderConfig, err := resolve()
+				h.AssertNil(t, err)
+
+				h.AssertNil(t, pack.NewDownloadCache(factory.Config.Path()).Clear())
+				h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[0].Dir, "bin/build", "I come from an archive")
+			})
+
+			it("downloads once when several builders are created at the same time", func() {
+				var wg sync.WaitGroup
+				errs := make([]error, 3)
+				for i := range errs {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						_, errs[i] = resolve()
+					}(i)
+				}
+				wg.Wait()
+				for _, err := range errs {
+					h.AssertNil(t, err)
+				}
+				h.AssertEq(t, downloads, 1)
+				h.AssertEq(t, requests, 3)
+			})
+		})
+
 		when("a buildpack location uses http(s):// uris", func() {
 			var (
 				server *http.Server
@@ -452,7 +1428,7 @@ buildpacks = [
 					BuilderTomlPath: f.Name(),
 					StackID:         "some.default.stack",
 					Publish:         false,
-					NoPull:          true,
+					PullPolicy:      "never",
 				}
 
 				builderConfig, err := factory.BuilderConfigFromFlags(flags)
@@ -460,6 +1436,85 @@ buildpacks = [
 
 				h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[0].Dir, "bin/build", "I come from an archive")
 			})
+			it("fails when the downloaded archive does not match the sha256", func() {
+				mockImages.EXPECT().ReadImage("default/build", true).Return(mocks.NewMockV1Image(mockController), nil)
+				mockImages.EXPECT().RepoStore("myorg/mybuilder", true).Return(mocks.NewMockStore(mockController), nil)
+
+				uri := fmt.Sprintf("http://%s/used-to-test-various-uri-schemes/buildpack.tgz", server.Addr)
+				f, err := ioutil.TempFile("", "*.toml")
+				h.AssertNil(t, err)
+				ioutil.WriteFile(f.Name(), []byte(fmt.Sprintf(`[[buildpacks]]
+id = "some.bp.with.no.uri.scheme"
+uri = "%s"
+sha256 = "0000"
+`, uri)), 0644)
+
+				_, err = factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+					RepoName:        "myorg/mybuilder",
+					BuilderTomlPath: f.Name(),
+					StackID:         "some.default.stack",
+					PullPolicy:      "never",
+				})
+				h.AssertError(t, err, fmt.Sprintf(`invalid builder config %q:
+  %[1]s:1: failed to fetch buildpack "some.bp.with.no.uri.scheme": sha256 mismatch for %q: expected 0000, got c3cd2dcc113b0face668f4297b126c68b7a7285769f3cae8d701a45540c404df`, f.Name(), uri))
+			})
+			when("offline", func() {
+				var builderTomlPath, uri string
+
+				it.Before(func() {
+					uri = fmt.Sprintf("http://%s/used-to-test-various-uri-schemes/buildpack.tgz", server.Addr)
+					f, err := ioutil.TempFile("", "*.toml")
+					h.AssertNil(t, err)
+					defer f.Close()
+					_, err = f.Write([]byte(fmt.Sprintf(`[[buildpacks]]
+id = "some.bp.with.no.uri.scheme"
+uri = "%s"
+`, uri)))
+					h.AssertNil(t, err)
+					builderTomlPath = f.Name()
+				})
+
+				it.After(func() {
+					os.Remove(builderTomlPath)
+				})
+
+				it("uses the cached download without contacting the server", func() {
+					_, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+						RepoName:        "myorg/mybuilder",
+						BuilderTomlPath: builderTomlPath,
+						StackID:         "some.default.stack",
+						ValidateOnly:    true,
+					})
+					h.AssertNil(t, err)
+
+					ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+					defer cancel()
+					h.AssertNil(t, server.Shutdown(ctx))
+					server = nil
+
+					builderConfig, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+						RepoName:        "myorg/mybuilder",
+						BuilderTomlPath: builderTomlPath,
+						StackID:         "some.default.stack",
+						ValidateOnly:    true,
+						Offline:         true,
+					})
+					h.AssertNil(t, err)
+					h.AssertDirContainsFileWithContents(t, builderConfig.Buildpacks[0].Dir, "bin/build", "I come from an archive")
+				})
+
+				it("fails when the download is not cached", func() {
+					_, err := factory.BuilderConfigFromFlags(pack.CreateBuilderFlags{
+						RepoName:        "myorg/mybuilder",
+						BuilderTomlPath: builderTomlPath,
+						StackID:         "some.default.stack",
+						ValidateOnly:    true,
+						Offline:         true,
+					})
+					h.AssertError(t, err, fmt.Sprintf(`invalid builder config %q:
+  %[1]s:1: failed to fetch buildpack "some.bp.with.no.uri.scheme": %q is not in the download cache and cannot be downloaded in offline mode`, builderTomlPath, uri))
+				})
+			})
 			it.After(func() {
 				if server != nil {
 					ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
@@ -2,19 +2,34 @@ package docker
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
+	"sync"
 
 	dockertypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	dockercli "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/docker/pkg/term"
 	"github.com/pkg/errors"
 )
 
 type Client struct {
 	*dockercli.Client
+	// Progress receives the progress of image pulls, see ShowPullProgress
+	Progress io.Writer
+
+	mu sync.Mutex
+	// rendering is set while a pull renders its progress on a terminal, which
+	// concurrent pulls would garble
+	rendering bool
+	// held are the status lines of concurrent pulls, written once rendering
+	// is done
+	held []string
 }
 
 func New() (*Client, error) {
@@ -22,7 +37,7 @@ func New() (*Client, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "new docker client")
 	}
-	return &Client{cli}, nil
+	return &Client{Client: cli}, nil
 }
 
 func (d *Client) RunContainer(ctx context.Context, id string, stdout io.Writer, stderr io.Writer) error {
@@ -48,8 +63,7 @@ func (d *Client) RunContainer(ctx context.Context, id string, stdout io.Writer,
 			return fmt.Errorf("failed with status code: %d", body.StatusCode)
 		}
 	case err := <-errChan:
-		fmt.Printf("ERR: %#v\n", err)
-		return err
+		return errors.Wrap(err, "container wait")
 	}
 	return nil
 }
@@ -59,8 +73,118 @@ func (d *Client) PullImage(ref string) error {
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
-		return err
+	defer rc.Close()
+
+	out := d.Progress
+	if _, isTerminal := terminalInfo(out); isTerminal {
+		d.mu.Lock()
+		if d.rendering {
+			d.mu.Unlock()
+			if err := ShowPullProgress(ref, rc, nil); err != nil {
+				return err
+			}
+			d.status(fmt.Sprintf("Pulled image '%s'\n", ref))
+			return nil
+		}
+		d.rendering = true
+		d.mu.Unlock()
+		defer d.doneRendering()
+	}
+	return ShowPullProgress(ref, rc, out)
+}
+
+// status writes a line about a pull whose progress isn't rendered, holding
+// it back while another pull renders its progress.
+func (d *Client) status(line string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.rendering {
+		d.held = append(d.held, line)
+		return
+	}
+	io.WriteString(d.Progress, line)
+}
+
+func (d *Client) doneRendering() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rendering = false
+	for _, line := range d.held {
+		io.WriteString(d.Progress, line)
+	}
+	d.held = nil
+}
+
+// PullEvent is written by ShowPullProgress whenever the status of a layer
+// being pulled changes. Events about the image as a whole have no layer.
+type PullEvent struct {
+	Image   string `json:"image"`
+	Layer   string `json:"layer,omitempty"`
+	Status  string `json:"status"`
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+}
+
+// terminal is implemented by writers that wrap a terminal, such as the
+// progress writer of logging.Logger.
+type terminal interface {
+	FD() uintptr
+	IsTerminal() bool
+}
+
+func terminalInfo(out io.Writer) (uintptr, bool) {
+	if t, ok := out.(terminal); ok {
+		return t.FD(), t.IsTerminal()
+	}
+	return term.GetFdInfo(out)
+}
+
+// ShowPullProgress reads the progress stream of pulling ref and writes it to
+// out, which may be nil to discard it. A terminal gets the progress of each
+// layer rendered in place, any other writer gets one PullEvent per line. It
+// returns the error the pull failed with, which the daemon reports in the
+// stream rather than in the response. Client.PullImage only renders one pull
+// at a time on a terminal, writing a single line for each concurrent pull
+// once it is done.
+func ShowPullProgress(ref string, in io.Reader, out io.Writer) error {
+	if out == nil {
+		out = ioutil.Discard
+	}
+	if fd, isTerminal := terminalInfo(out); isTerminal {
+		return jsonmessage.DisplayJSONMessagesStream(in, out, fd, true, nil)
+	}
+
+	dec := json.NewDecoder(in)
+	enc := json.NewEncoder(out)
+	statuses := map[string]string{}
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if msg.ErrorMessage != "" {
+			return errors.New(msg.ErrorMessage)
+		}
+		if msg.Status == "" || statuses[msg.ID] == msg.Status {
+			continue
+		}
+		statuses[msg.ID] = msg.Status
+
+		event := PullEvent{Image: ref, Layer: msg.ID, Status: msg.Status}
+		if strings.HasPrefix(msg.Status, "Pulling from ") {
+			// the id is the tag being pulled
+			event.Layer = ""
+		}
+		if msg.Progress != nil {
+			event.Current, event.Total = msg.Progress.Current, msg.Progress.Total
+		}
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
 	}
-	return rc.Close()
 }
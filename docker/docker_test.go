@@ -0,0 +1,124 @@
+package docker_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dockercli "github.com/docker/docker/client"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/pack/docker"
+	h "github.com/buildpack/pack/testhelpers"
+)
+
+func TestDocker(t *testing.T) {
+	spec.Run(t, "docker", testDocker, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+func testDocker(t *testing.T, when spec.G, it spec.S) {
+	when("#ShowPullProgress", func() {
+		it("writes a JSON event when the status of a layer changes", func() {
+			var out bytes.Buffer
+			stream := strings.NewReader(`
+{"status":"Pulling from some/image","id":"latest"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"layer1"}
+{"status":"Downloading","progressDetail":{"current":10,"total":100},"progress":"[=>   ]","id":"layer1"}
+{"status":"Downloading","progressDetail":{"current":50,"total":100},"progress":"[==>  ]","id":"layer1"}
+{"status":"Already exists","progressDetail":{},"id":"layer2"}
+{"status":"Download complete","progressDetail":{},"id":"layer1"}
+{"status":"Status: Downloaded newer image for some/image:latest"}
+`)
+
+			h.AssertNil(t, docker.ShowPullProgress("some/image", stream, &out))
+
+			h.AssertEq(t, out.String(), `{"image":"some/image","status":"Pulling from some/image"}
+{"image":"some/image","layer":"layer1","status":"Pulling fs layer"}
+{"image":"some/image","layer":"layer1","status":"Downloading","current":10,"total":100}
+{"image":"some/image","layer":"layer2","status":"Already exists"}
+{"image":"some/image","layer":"layer1","status":"Download complete"}
+{"image":"some/image","status":"Status: Downloaded newer image for some/image:latest"}
+`)
+		})
+
+		it("returns the error the pull failed with", func() {
+			stream := strings.NewReader(`
+{"status":"Pulling from some/image","id":"latest"}
+{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}
+`)
+
+			err := docker.ShowPullProgress("some/image", stream, nil)
+
+			h.AssertError(t, err, "manifest unknown")
+		})
+	})
+
+	when("#PullImage", func() {
+		it("writes a line for a pull done while another one renders its progress", func() {
+			// a terminal without terminfo is rendered to without cursor moves
+			defer os.Setenv("TERM", os.Getenv("TERM"))
+			os.Setenv("TERM", "pack-test-terminal")
+
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				image := r.URL.Query().Get("fromImage")
+				fmt.Fprintf(w, `{"status":"Pulling from %s","id":"latest"}`+"\n", image)
+				w.(http.Flusher).Flush()
+				if image == "some/builder" {
+					<-release
+				}
+				fmt.Fprintf(w, `{"status":"Status: Downloaded newer image for %s:latest"}`+"\n", image)
+			}))
+			defer server.Close()
+			cli, err := dockercli.NewClientWithOpts(dockercli.WithHost("tcp://"+server.Listener.Addr().String()), dockercli.WithVersion("1.38"))
+			h.AssertNil(t, err)
+			out := &fakeTerminal{}
+			client := &docker.Client{Client: cli, Progress: out}
+
+			builderPulled := make(chan error, 1)
+			go func() { builderPulled <- client.PullImage("some/builder") }()
+			for !strings.Contains(out.String(), "Pulling from some/builder") {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			h.AssertNil(t, client.PullImage("some/run"))
+			if strings.Contains(out.String(), "some/run") {
+				t.Fatalf("expected nothing about some/run while some/builder renders its progress, got %q", out.String())
+			}
+
+			close(release)
+			h.AssertNil(t, <-builderPulled)
+			if !strings.HasSuffix(out.String(), "Status: Downloaded newer image for some/builder:latest\nPulled image 'some/run'\n") {
+				t.Fatalf("expected a line for some/run after the progress of some/builder, got %q", out.String())
+			}
+		})
+	})
+}
+
+// fakeTerminal is a progress writer claiming to be a terminal.
+type fakeTerminal struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (f *fakeTerminal) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.buf.Write(p)
+}
+
+func (f *fakeTerminal) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.buf.String()
+}
+
+func (f *fakeTerminal) FD() uintptr      { return ^uintptr(0) }
+func (f *fakeTerminal) IsTerminal() bool { return true }
@@ -0,0 +1,225 @@
+package pack
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildpack/pack/fs"
+)
+
+// DownloadCache holds the buildpacks and lifecycles downloaded over http(s).
+// Each entry is a directory named after the sha256 of its URI. Next to it,
+// a .uri file records where it came from (its modification time is the last
+// time the entry was used), and .etag and .sha256 files describe the download.
+// An entry without a .sha256 file was never completely extracted, and a
+// .lock file guards each entry while it is downloaded or removed.
+type DownloadCache struct {
+	Dir string
+}
+
+type DownloadCacheEntry struct {
+	URI      string
+	Path     string
+	Size     int64
+	LastUsed time.Time
+	Complete bool
+}
+
+var downloadCacheSidecars = []string{".sha256", ".uri", ".etag"}
+
+// downloadCacheStagingPrefix names directories that downloads are extracted
+// into before they are renamed into place.
+const downloadCacheStagingPrefix = ".staging-"
+
+// stagingTimeout is how long a staging directory may exist before Prune
+// considers it abandoned.
+const stagingTimeout = time.Hour
+
+func NewDownloadCache(packHome string) *DownloadCache {
+	return &DownloadCache{Dir: filepath.Join(packHome, "dl-cache")}
+}
+
+func (c *DownloadCache) entryPath(uri string) string {
+	return filepath.Join(c.Dir, fmt.Sprintf("%x", sha256.Sum256([]byte(uri))))
+}
+
+// cached returns the etag and digest of the complete entry at path, or empty
+// strings when there is none.
+func (c *DownloadCache) cached(path string) (etag, digest string) {
+	// only trust cached content whose digest was recorded when it was downloaded
+	cachedDigest, err := ioutil.ReadFile(path + ".sha256")
+	if err != nil {
+		return "", ""
+	}
+	cachedEtag, err := ioutil.ReadFile(path + ".etag")
+	if err != nil {
+		return "", ""
+	}
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		return "", ""
+	}
+	return string(cachedEtag), string(cachedDigest)
+}
+
+// touch records that the entry at path was just used.
+func (c *DownloadCache) touch(path string) error {
+	now := time.Now()
+	return os.Chtimes(path+".uri", now, now)
+}
+
+func (c *DownloadCache) List() ([]DownloadCacheEntry, error) {
+	files, err := ioutil.ReadDir(c.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []DownloadCacheEntry
+	for _, fi := range files {
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		entry, err := c.readEntry(filepath.Join(c.Dir, fi.Name()), fi)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+func (c *DownloadCache) readEntry(path string, fi os.FileInfo) (DownloadCacheEntry, error) {
+	entry := DownloadCacheEntry{Path: path, LastUsed: fi.ModTime()}
+	if uriInfo, err := os.Stat(path + ".uri"); err == nil {
+		uri, err := ioutil.ReadFile(path + ".uri")
+		if err != nil {
+			return DownloadCacheEntry{}, err
+		}
+		entry.URI = string(uri)
+		entry.LastUsed = uriInfo.ModTime()
+	}
+	if _, err := os.Stat(path + ".sha256"); err == nil {
+		entry.Complete = true
+	}
+	err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			entry.Size += fi.Size()
+		}
+		return nil
+	})
+	return entry, err
+}
+
+// Prune removes entries that have not been used for the given duration,
+// incomplete entries, abandoned staging directories, and files left behind by
+// entries that no longer exist.
+func (c *DownloadCache) Prune(unusedFor time.Duration) ([]DownloadCacheEntry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var pruned []DownloadCacheEntry
+	for _, entry := range entries {
+		if entry.Complete && time.Since(entry.LastUsed) < unusedFor {
+			continue
+		}
+		if err := c.removeLocked(entry.Path); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, entry)
+	}
+
+	files, err := ioutil.ReadDir(c.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return pruned, err
+	}
+	for _, fi := range files {
+		path := filepath.Join(c.Dir, fi.Name())
+		if strings.HasPrefix(fi.Name(), downloadCacheStagingPrefix) {
+			if time.Since(fi.ModTime()) > stagingTimeout {
+				if err := os.RemoveAll(path); err != nil {
+					return pruned, err
+				}
+			}
+			continue
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") || filepath.Ext(path) == ".lock" {
+			continue
+		}
+		entryPath := strings.TrimSuffix(path, filepath.Ext(path))
+		if _, err := os.Stat(entryPath); os.IsNotExist(err) {
+			if err := os.Remove(path); err != nil {
+				return pruned, err
+			}
+		}
+	}
+	return pruned, nil
+}
+
+// Clear removes every entry, taking its lock first like Prune does so that a
+// download in progress finishes before its entry is removed. Lock files are
+// kept for processes waiting on them, and staging directories are only removed
+// once they are abandoned.
+func (c *DownloadCache) Clear() error {
+	files, err := ioutil.ReadDir(c.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		path := filepath.Join(c.Dir, fi.Name())
+		if strings.HasPrefix(fi.Name(), downloadCacheStagingPrefix) {
+			if time.Since(fi.ModTime()) > stagingTimeout {
+				if err := os.RemoveAll(path); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(fi.Name(), ".") || filepath.Ext(path) == ".lock" {
+			continue
+		}
+		if !fi.IsDir() {
+			path = strings.TrimSuffix(path, filepath.Ext(path))
+		}
+		if err := c.removeLocked(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeLocked removes the entry at path once no download holds it.
+func (c *DownloadCache) removeLocked(path string) error {
+	lock, err := fs.Lock(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return c.remove(path)
+}
+
+// remove deletes the entry's .sha256 file first, so that an interrupted
+// removal leaves an incomplete entry rather than a corrupt one.
+func (c *DownloadCache) remove(path string) error {
+	for _, ext := range downloadCacheSidecars {
+		if err := os.Remove(path + ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(path)
+}
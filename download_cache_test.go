@@ -0,0 +1,133 @@
+package pack_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/pack"
+	"github.com/buildpack/pack/fs"
+	h "github.com/buildpack/pack/testhelpers"
+)
+
+func TestDownloadCache(t *testing.T) {
+	spec.Run(t, "download-cache", testDownloadCache, spec.Sequential(), spec.Report(report.Terminal{}))
+}
+
+func testDownloadCache(t *testing.T, when spec.G, it spec.S) {
+	var (
+		packHome string
+		cache    *pack.DownloadCache
+	)
+
+	writeEntry := func(name, uri string, complete bool, lastUsed time.Time) string {
+		path := filepath.Join(cache.Dir, name)
+		h.AssertNil(t, os.MkdirAll(filepath.Join(path, "bin"), 0755))
+		h.AssertNil(t, ioutil.WriteFile(filepath.Join(path, "bin", "build"), []byte("12345"), 0755))
+		h.AssertNil(t, ioutil.WriteFile(filepath.Join(path, "buildpack.toml"), []byte("123"), 0644))
+		h.AssertNil(t, ioutil.WriteFile(path+".uri", []byte(uri), 0644))
+		h.AssertNil(t, ioutil.WriteFile(path+".etag", []byte("some-etag"), 0644))
+		if complete {
+			h.AssertNil(t, ioutil.WriteFile(path+".sha256", []byte("some-sha"), 0644))
+		}
+		h.AssertNil(t, os.Chtimes(path+".uri", lastUsed, lastUsed))
+		return path
+	}
+
+	it.Before(func() {
+		var err error
+		packHome, err = ioutil.TempDir("", "download-cache-test")
+		h.AssertNil(t, err)
+		cache = pack.NewDownloadCache(packHome)
+	})
+
+	it.After(func() {
+		os.RemoveAll(packHome)
+	})
+
+	when("#List", func() {
+		it("returns nothing when nothing was downloaded", func() {
+			entries, err := cache.List()
+			h.AssertNil(t, err)
+			h.AssertEq(t, len(entries), 0)
+		})
+
+		it("lists entries with their uri, size and last use, most recent first", func() {
+			old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+			recent := time.Now().Add(-1 * time.Hour).Truncate(time.Second)
+			oldPath := writeEntry("aaa", "https://example.com/old.tgz", true, old)
+			recentPath := writeEntry("bbb", "https://example.com/recent.tgz", false, recent)
+
+			entries, err := cache.List()
+			h.AssertNil(t, err)
+			h.AssertEq(t, entries, []pack.DownloadCacheEntry{
+				{URI: "https://example.com/recent.tgz", Path: recentPath, Size: 8, LastUsed: recent, Complete: false},
+				{URI: "https://example.com/old.tgz", Path: oldPath, Size: 8, LastUsed: old, Complete: true},
+			})
+		})
+	})
+
+	when("#Prune", func() {
+		it("removes entries that are unused or incomplete", func() {
+			keep := writeEntry("keep", "https://example.com/keep.tgz", true, time.Now())
+			unused := writeEntry("unused", "https://example.com/unused.tgz", true, time.Now().Add(-72*time.Hour))
+			incomplete := writeEntry("incomplete", "https://example.com/incomplete.tgz", false, time.Now())
+			h.AssertNil(t, ioutil.WriteFile(filepath.Join(cache.Dir, "orphan.etag"), []byte("some-etag"), 0644))
+
+			pruned, err := cache.Prune(24 * time.Hour)
+			h.AssertNil(t, err)
+			h.AssertEq(t, len(pruned), 2)
+
+			for _, path := range []string{unused, incomplete, filepath.Join(cache.Dir, "orphan")} {
+				for _, ext := range []string{"", ".uri", ".etag", ".sha256"} {
+					if _, err := os.Stat(path + ext); !os.IsNotExist(err) {
+						t.Fatalf("expected %s to be removed", path+ext)
+					}
+				}
+			}
+			for _, ext := range []string{"", ".uri", ".etag", ".sha256"} {
+				_, err := os.Stat(keep + ext)
+				h.AssertNil(t, err)
+			}
+		})
+	})
+
+	when("#Clear", func() {
+		it("removes every entry", func() {
+			writeEntry("aaa", "https://example.com/some.tgz", true, time.Now())
+
+			h.AssertNil(t, cache.Clear())
+
+			entries, err := cache.List()
+			h.AssertNil(t, err)
+			h.AssertEq(t, len(entries), 0)
+		})
+
+		it("waits for a download of the entry to finish", func() {
+			path := writeEntry("aaa", "https://example.com/some.tgz", true, time.Now())
+			lock, err := fs.Lock(path + ".lock")
+			h.AssertNil(t, err)
+
+			cleared := make(chan error)
+			go func() { cleared <- cache.Clear() }()
+			select {
+			case <-cleared:
+				t.Fatal("expected Clear to wait for the lock")
+			case <-time.After(100 * time.Millisecond):
+			}
+			_, err = os.Stat(path + ".sha256")
+			h.AssertNil(t, err)
+
+			h.AssertNil(t, lock.Unlock())
+			h.AssertNil(t, <-cleared)
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("expected %s to be removed", path)
+			}
+		})
+	})
+}
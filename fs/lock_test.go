@@ -0,0 +1,108 @@
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/pack/fs"
+)
+
+func TestLock(t *testing.T) {
+	spec.Run(t, "lock", testLock, spec.Report(report.Terminal{}))
+}
+
+func testLock(t *testing.T, when spec.G, it spec.S) {
+	var tmpDir string
+
+	it.Before(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "lock-test")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir %s: %s", tmpDir, err)
+		}
+	})
+
+	it.After(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	when("#Lock", func() {
+		it("blocks until the lock is released", func() {
+			path := filepath.Join(tmpDir, "some.lock")
+			lock, err := fs.Lock(path)
+			if err != nil {
+				t.Fatalf("failed to lock: %s", err)
+			}
+
+			locked := make(chan *fs.FileLock)
+			go func() {
+				second, err := fs.Lock(path)
+				if err != nil {
+					close(locked)
+					return
+				}
+				locked <- second
+			}()
+
+			select {
+			case <-locked:
+				t.Fatal("expected the second lock to wait")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			if err := lock.Unlock(); err != nil {
+				t.Fatalf("failed to unlock: %s", err)
+			}
+			select {
+			case second := <-locked:
+				if second == nil {
+					t.Fatal("failed to take the second lock")
+				}
+				second.Unlock()
+			case <-time.After(2 * time.Second):
+				t.Fatal("expected the second lock to be taken")
+			}
+		})
+	})
+
+	when("#WriteFileAtomic", func() {
+		it("replaces the file and leaves no temporary files", func() {
+			path := filepath.Join(tmpDir, "some-file")
+			if err := ioutil.WriteFile(path, []byte("old"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := fs.WriteFileAtomic(path, []byte("new"), 0644); err != nil {
+				t.Fatalf("failed to write: %s", err)
+			}
+
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(contents) != "new" {
+				t.Fatalf(`expected "new", got %q`, contents)
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0644 {
+				t.Fatalf("expected mode 0644, got %s", fi.Mode())
+			}
+			files, err := ioutil.ReadDir(tmpDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 {
+				t.Fatalf("expected only some-file, got %d files", len(files))
+			}
+		})
+	})
+}
@@ -23,16 +23,35 @@ func (*FS) CreateTGZFile(tarFile, srcDir, tarDir string, uid, gid int) error {
 	defer fh.Close()
 	gzw := gzip.NewWriter(fh)
 	defer gzw.Close()
-	return writeTarArchive(gzw, srcDir, tarDir, uid, gid)
+	return writeTarArchive(gzw, srcDir, tarDir, uid, gid, nil, false)
 }
 
-func (*FS) CreateTarReader(srcDir, tarDir string, uid, gid int) (io.Reader, chan error) {
+func (f *FS) CreateTarReader(srcDir, tarDir string, uid, gid int) (io.Reader, chan error) {
+	return f.CreateTarReaderExcluding(srcDir, tarDir, uid, gid, nil)
+}
+
+// CreateTarReaderExcluding is like CreateTarReader, but leaves out files and
+// directories matching any of the exclude patterns. Patterns are matched with
+// filepath.Match against the path relative to srcDir, and patterns without a
+// slash also against every file and directory name.
+func (*FS) CreateTarReaderExcluding(srcDir, tarDir string, uid, gid int, exclude []string) (io.Reader, chan error) {
+	return createTarReader(srcDir, tarDir, uid, gid, exclude, false)
+}
+
+// CreateTarReaderWithDirs is like CreateTarReaderExcluding, but also writes an
+// entry for tarDir and every directory below it, so that they are owned by uid
+// and gid instead of root when the archive is extracted.
+func (*FS) CreateTarReaderWithDirs(srcDir, tarDir string, uid, gid int, exclude []string) (io.Reader, chan error) {
+	return createTarReader(srcDir, tarDir, uid, gid, exclude, true)
+}
+
+func createTarReader(srcDir, tarDir string, uid, gid int, exclude []string, withDirs bool) (io.Reader, chan error) {
 	r, w := io.Pipe()
 	errChan := make(chan error, 1)
 
 	go func() {
 		defer w.Close()
-		err := writeTarArchive(w, srcDir, tarDir, uid, gid)
+		err := writeTarArchive(w, srcDir, tarDir, uid, gid, exclude, withDirs)
 		w.Close()
 		errChan <- err
 	}()
@@ -54,7 +73,7 @@ func (*FS) CreateSingleFileTar(path, txt string) (io.Reader, error) {
 	return bytes.NewReader(buf.Bytes()), nil
 }
 
-func writeTarArchive(w io.Writer, srcDir, tarDir string, uid, gid int) error {
+func writeTarArchive(w io.Writer, srcDir, tarDir string, uid, gid int, exclude []string, withDirs bool) error {
 	tw := tar.NewWriter(w)
 	defer tw.Close()
 
@@ -62,13 +81,19 @@ func writeTarArchive(w io.Writer, srcDir, tarDir string, uid, gid int) error {
 		if err != nil {
 			return err
 		}
-		if fi.Mode().IsDir() {
-			return nil
-		}
 		relPath, err := filepath.Rel(srcDir, file)
 		if err != nil {
 			return err
 		}
+		if relPath != "." && isExcluded(filepath.ToSlash(relPath), exclude) {
+			if fi.Mode().IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.Mode().IsDir() && !withDirs {
+			return nil
+		}
 
 		var header *tar.Header
 		if fi.Mode()&os.ModeSymlink != 0 {
@@ -92,6 +117,8 @@ func writeTarArchive(w io.Writer, srcDir, tarDir string, uid, gid int) error {
 		}
 		header.Uid = uid
 		header.Gid = gid
+		header.Uname = ""
+		header.Gname = ""
 
 		if err := tw.WriteHeader(header); err != nil {
 			return err
@@ -110,6 +137,21 @@ func writeTarArchive(w io.Writer, srcDir, tarDir string, uid, gid int) error {
 	})
 }
 
+func isExcluded(relPath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+		if matched, _ := filepath.Match(pattern, relPath); matched {
+			return true
+		}
+		if !strings.Contains(pattern, "/") {
+			if matched, _ := filepath.Match(pattern, filepath.Base(relPath)); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (*FS) AddTextToTar(tw *tar.Writer, name string, contents []byte) error {
 	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}
 	if err := tw.WriteHeader(hdr); err != nil {
@@ -134,6 +176,9 @@ func (*FS) AddFileToTar(tw *tar.Writer, name string, contents *os.File) error {
 
 func (*FS) Untar(r io.Reader, dest string) error {
 	tr := tar.NewReader(r)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -144,7 +189,17 @@ func (*FS) Untar(r io.Reader, dest string) error {
 			return err
 		}
 
-		path := filepath.Join(dest, hdr.Name)
+		path, ok := archivePath(dest, hdr.Name)
+		if !ok {
+			return fmt.Errorf("illegal file path in tar: %s", hdr.Name)
+		}
+		var linkname string
+		if hdr.Typeflag == tar.TypeSymlink {
+			linkname = hdr.Linkname
+		}
+		if err := CheckExtractPath(dest, path, linkname); err != nil {
+			return fmt.Errorf("illegal file path in tar: %s: %s", hdr.Name, err)
+		}
 
 		switch hdr.Typeflag {
 		case tar.TypeDir:
@@ -177,3 +232,54 @@ func (*FS) Untar(r io.Reader, dest string) error {
 		}
 	}
 }
+
+// archivePath returns where the archive entry name is extracted to in dest,
+// and false when name is absolute or leaves dest once cleaned.
+func archivePath(dest, name string) (string, bool) {
+	if filepath.IsAbs(name) || strings.HasPrefix(filepath.ToSlash(name), "/") {
+		return "", false
+	}
+	path := filepath.Join(dest, name)
+	if !within(dest, path) {
+		return "", false
+	}
+	return path, true
+}
+
+// CheckExtractPath returns an error when extracting an archive entry to path,
+// which must be inside dest, would write outside of dest through a symlink
+// extracted earlier, or when linkname, the target of a symlink entry, is
+// absolute or leads outside of dest.
+func CheckExtractPath(dest, path, linkname string) error {
+	if linkname != "" {
+		if filepath.IsAbs(linkname) || strings.HasPrefix(filepath.ToSlash(linkname), "/") {
+			return fmt.Errorf("symlink to absolute path %s", linkname)
+		}
+		if !within(dest, filepath.Join(filepath.Dir(path), linkname)) {
+			return fmt.Errorf("symlink to %s leads outside of the destination", linkname)
+		}
+	}
+
+	existing := path
+	for existing != filepath.Dir(existing) {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	realDest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	realPath, err := filepath.EvalSymlinks(existing)
+	if err != nil || !within(realDest, realPath) {
+		rel, _ := filepath.Rel(dest, existing)
+		return fmt.Errorf("%s is a symlink leading outside of the destination", filepath.ToSlash(rel))
+	}
+	return nil
+}
+
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
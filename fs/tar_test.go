@@ -2,11 +2,14 @@ package fs_test
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bytes"
 	"compress/gzip"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -94,4 +97,217 @@ func testFS(t *testing.T, when spec.G, it spec.S) {
 			t.Fatalf(`expected to link-file to have atrget "../some-file.txt" got %s`, header.Linkname)
 		}
 	})
+
+	it("leaves out excluded files and directories", func() {
+		for _, excluded := range [][]string{{"sub-dir"}, {"/sub-dir/"}, {"link-*"}, {"sub-dir/*"}} {
+			tr, errChan := fs.CreateTarReaderExcluding(src, "/dir-in-archive", 0, 0, excluded)
+			var names []string
+			reader := tar.NewReader(tr)
+			for {
+				header, err := reader.Next()
+				if err != nil {
+					break
+				}
+				names = append(names, header.Name)
+			}
+			if err := <-errChan; err != nil {
+				t.Fatalf("CreateTarReaderExcluding failed: %s", err)
+			}
+			if len(names) != 1 || names[0] != "/dir-in-archive/some-file.txt" {
+				t.Fatalf("excluding %v: expected only /dir-in-archive/some-file.txt, got %v", excluded, names)
+			}
+		}
+	})
+
+	it("writes owned entries for every directory when asked to", func() {
+		tr, errChan := fs.CreateTarReaderWithDirs(src, "/dir-in-archive", 1234, 2345, nil)
+		dirs := map[string]bool{}
+		reader := tar.NewReader(tr)
+		for {
+			header, err := reader.Next()
+			if err != nil {
+				break
+			}
+			if header.Typeflag == tar.TypeDir {
+				if header.Uid != 1234 || header.Gid != 2345 {
+					t.Fatalf(`expected %s to be owned by 1234:2345, was %d:%d`, header.Name, header.Uid, header.Gid)
+				}
+				dirs[header.Name] = true
+			}
+		}
+		if err := <-errChan; err != nil {
+			t.Fatalf("CreateTarReaderWithDirs failed: %s", err)
+		}
+		if len(dirs) != 2 || !dirs["/dir-in-archive"] || !dirs["/dir-in-archive/sub-dir"] {
+			t.Fatalf("expected entries for /dir-in-archive and /dir-in-archive/sub-dir, got %v", dirs)
+		}
+	})
+
+	it("unzips into the dest dir and rejects paths outside of it", func() {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, err := zw.Create("sub-dir/some-file.txt")
+		if err != nil {
+			t.Fatalf("failed to create zip entry: %s", err)
+		}
+		w.Write([]byte("some-content"))
+		zw.Close()
+
+		if err := fs.Unzip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), tmpDir); err != nil {
+			t.Fatalf("Unzip failed: %s", err)
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "sub-dir", "some-file.txt"))
+		if err != nil {
+			t.Fatalf("failed to read unzipped file: %s", err)
+		}
+		if string(contents) != "some-content" {
+			t.Fatalf(`expected some-file.txt to have "some-content" got %s`, string(contents))
+		}
+
+		buf.Reset()
+		zw = zip.NewWriter(&buf)
+		if _, err := zw.Create("../escaped.txt"); err != nil {
+			t.Fatalf("failed to create zip entry: %s", err)
+		}
+		zw.Close()
+		if err := fs.Unzip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), tmpDir); err == nil {
+			t.Fatal("expected Unzip to reject a path outside of the dest dir")
+		}
+
+		buf.Reset()
+		zw = zip.NewWriter(&buf)
+		if _, err := zw.Create("/absolute.txt"); err != nil {
+			t.Fatalf("failed to create zip entry: %s", err)
+		}
+		zw.Close()
+		if err := fs.Unzip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), tmpDir); err == nil {
+			t.Fatal("expected Unzip to reject an absolute path")
+		}
+	})
+
+	it("untars into the dest dir and rejects paths outside of it", func() {
+		tarWith := func(name string) *bytes.Buffer {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			if err := fs.AddTextToTar(tw, name, []byte("some-content")); err != nil {
+				t.Fatalf("failed to create tar entry: %s", err)
+			}
+			tw.Close()
+			return &buf
+		}
+
+		if err := fs.Untar(tarWith("./sub-dir/some-file.txt"), tmpDir); err != nil {
+			t.Fatalf("Untar failed: %s", err)
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "sub-dir", "some-file.txt"))
+		if err != nil {
+			t.Fatalf("failed to read untarred file: %s", err)
+		}
+		if string(contents) != "some-content" {
+			t.Fatalf(`expected some-file.txt to have "some-content" got %s`, string(contents))
+		}
+
+		for _, name := range []string{"../escaped.txt", "sub-dir/../../escaped.txt", "/absolute.txt"} {
+			err := fs.Untar(tarWith(name), filepath.Join(tmpDir, "dest"))
+			if err == nil || err.Error() != "illegal file path in tar: "+name {
+				t.Fatalf("expected Untar to reject %s, got %v", name, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(tmpDir, "escaped.txt")); !os.IsNotExist(err) {
+			t.Fatalf("expected escaped.txt not to be written, got %v", err)
+		}
+	})
+
+	when("an archive has symlinks", func() {
+		type entry struct{ name, linkname string }
+		var outside string
+
+		it.Before(func() {
+			outside = filepath.Join(tmpDir, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatalf("failed to create dir: %s", err)
+			}
+		})
+
+		tarWith := func(entries ...entry) *bytes.Buffer {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, e := range entries {
+				if e.linkname != "" {
+					tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeSymlink, Linkname: e.linkname, Mode: 0777})
+				} else if err := fs.AddTextToTar(tw, e.name, []byte("some-content")); err != nil {
+					t.Fatalf("failed to create tar entry: %s", err)
+				}
+			}
+			tw.Close()
+			return &buf
+		}
+
+		zipWith := func(entries ...entry) *bytes.Buffer {
+			var buf bytes.Buffer
+			zw := zip.NewWriter(&buf)
+			for _, e := range entries {
+				header := &zip.FileHeader{Name: e.name}
+				content := "some-content"
+				if e.linkname != "" {
+					header.SetMode(os.ModeSymlink | 0777)
+					content = e.linkname
+				} else {
+					header.SetMode(0644)
+				}
+				w, err := zw.CreateHeader(header)
+				if err != nil {
+					t.Fatalf("failed to create zip entry: %s", err)
+				}
+				w.Write([]byte(content))
+			}
+			zw.Close()
+			return &buf
+		}
+
+		escapes := func() map[string][]entry {
+			return map[string][]entry{
+				"an absolute target":               {{"a", outside}, {"a/x", ""}},
+				"a target outside of the dest dir": {{"a", "../outside"}, {"a/x", ""}},
+				"a chain of symlinks leading out":  {{"x", "."}, {"a", "x/.."}, {"a/outside/x", ""}},
+				"a file written through a symlink": {{"x", "."}, {"a", "x/../outside/x"}, {"a", ""}},
+			}
+		}
+
+		it("untars symlinks inside the dest dir", func() {
+			dest := filepath.Join(tmpDir, "dest")
+			if err := fs.Untar(tarWith(entry{"sub-dir/some-file.txt", ""}, entry{"link", "sub-dir"}, entry{"link/other-file.txt", ""}), dest); err != nil {
+				t.Fatalf("Untar failed: %s", err)
+			}
+			contents, err := ioutil.ReadFile(filepath.Join(dest, "sub-dir", "other-file.txt"))
+			if err != nil || string(contents) != "some-content" {
+				t.Fatalf(`expected other-file.txt to have "some-content", got %q, %v`, contents, err)
+			}
+		})
+
+		it("rejects tar symlinks leading outside of the dest dir", func() {
+			for desc, entries := range escapes() {
+				dest := filepath.Join(tmpDir, "dest-"+strings.Replace(desc, " ", "-", -1))
+				if err := fs.Untar(tarWith(entries...), dest); err == nil || !strings.HasPrefix(err.Error(), "illegal file path in tar: ") {
+					t.Fatalf("expected Untar to reject %s, got %v", desc, err)
+				}
+			}
+			if files, _ := ioutil.ReadDir(outside); len(files) != 0 {
+				t.Fatalf("expected nothing to be written outside of the dest dir, found %s", files[0].Name())
+			}
+		})
+
+		it("rejects zip symlinks leading outside of the dest dir", func() {
+			for desc, entries := range escapes() {
+				dest := filepath.Join(tmpDir, "dest-"+strings.Replace(desc, " ", "-", -1))
+				buf := zipWith(entries...)
+				if err := fs.Unzip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dest); err == nil || !strings.HasPrefix(err.Error(), "illegal file path in zip: ") {
+					t.Fatalf("expected Unzip to reject %s, got %v", desc, err)
+				}
+			}
+			if files, _ := ioutil.ReadDir(outside); len(files) != 0 {
+				t.Fatalf("expected nothing to be written outside of the dest dir, found %s", files[0].Name())
+			}
+		})
+	})
 }
@@ -0,0 +1,94 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+// Watch polls srcDir every interval for changes to the files that don't match
+// any of the exclude patterns, using the same matching as
+// CreateTarReaderExcluding. Once a change has settled for debounce, it sends
+// on the returned channel; changes made before the receiver catches up are
+// coalesced. Watching stops when stop is closed.
+func Watch(srcDir string, exclude []string, interval, debounce time.Duration, stop <-chan struct{}) (<-chan struct{}, error) {
+	last, err := snapshot(srcDir, exclude)
+	if err != nil {
+		return nil, err
+	}
+	changes := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var changedAt time.Time
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				current, err := snapshot(srcDir, exclude)
+				if err != nil {
+					// files may disappear while walking, try again on the next tick
+					continue
+				}
+				if !sameSnapshot(last, current) {
+					last = current
+					changedAt = now
+					continue
+				}
+				if !changedAt.IsZero() && now.Sub(changedAt) >= debounce {
+					changedAt = time.Time{}
+					select {
+					case changes <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
+
+func snapshot(srcDir string, exclude []string) (map[string]fileState, error) {
+	files := map[string]fileState{}
+	err := filepath.Walk(srcDir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcDir, file)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if isExcluded(filepath.ToSlash(relPath), exclude) {
+			if fi.Mode().IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		files[relPath] = fileState{modTime: fi.ModTime(), size: fi.Size(), mode: fi.Mode()}
+		return nil
+	})
+	return files, err
+}
+
+func sameSnapshot(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, state := range a {
+		other, ok := b[path]
+		if !ok || !other.modTime.Equal(state.modTime) || other.size != state.size || other.mode != state.mode {
+			return false
+		}
+	}
+	return true
+}
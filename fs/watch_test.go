@@ -0,0 +1,92 @@
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/pack/fs"
+)
+
+func TestWatch(t *testing.T) {
+	spec.Run(t, "watch", testWatch, spec.Report(report.Terminal{}))
+}
+
+func testWatch(t *testing.T, when spec.G, it spec.S) {
+	var (
+		tmpDir string
+		stop   chan struct{}
+	)
+
+	it.Before(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "watch-test")
+		if err != nil {
+			t.Fatalf("failed to create tmp dir %s: %s", tmpDir, err)
+		}
+		if err := os.MkdirAll(filepath.Join(tmpDir, "node_modules"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, "app.js"), []byte("v1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stop = make(chan struct{})
+	})
+
+	it.After(func() {
+		close(stop)
+		os.RemoveAll(tmpDir)
+	})
+
+	when("#Watch", func() {
+		it("reports a change once it has settled", func() {
+			changes, err := fs.Watch(tmpDir, []string{"node_modules"}, 10*time.Millisecond, 50*time.Millisecond, stop)
+			if err != nil {
+				t.Fatalf("failed to watch: %s", err)
+			}
+
+			if err := ioutil.WriteFile(filepath.Join(tmpDir, "app.js"), []byte("version 2"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(tmpDir, "other.js"), []byte("new"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-changes:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected a change")
+			}
+			select {
+			case <-changes:
+				t.Fatal("expected the changes to be reported once")
+			case <-time.After(200 * time.Millisecond):
+			}
+		})
+
+		it("ignores changes to excluded files", func() {
+			changes, err := fs.Watch(tmpDir, []string{"node_modules", "*.log"}, 10*time.Millisecond, 20*time.Millisecond, stop)
+			if err != nil {
+				t.Fatalf("failed to watch: %s", err)
+			}
+
+			if err := ioutil.WriteFile(filepath.Join(tmpDir, "node_modules", "dep.js"), []byte("dep"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(tmpDir, "server.log"), []byte("log"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-changes:
+				t.Fatal("expected no changes")
+			case <-time.After(200 * time.Millisecond):
+			}
+		})
+	})
+}
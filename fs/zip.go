@@ -0,0 +1,85 @@
+package fs
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func (*FS) Unzip(r io.ReaderAt, size int64, dest string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		path, ok := archivePath(dest, f.Name)
+		if !ok {
+			return fmt.Errorf("illegal file path in zip: %s", f.Name)
+		}
+		var linkname string
+		if f.Mode()&os.ModeSymlink != 0 {
+			target, err := readZipFile(f)
+			if err != nil {
+				return err
+			}
+			linkname = string(target)
+		}
+		if err := CheckExtractPath(dest, path, linkname); err != nil {
+			return fmt.Errorf("illegal file path in zip: %s: %s", f.Name, err)
+		}
+
+		switch mode := f.Mode(); {
+		case mode.IsDir():
+			if err := os.MkdirAll(path, mode.Perm()); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(linkname, path); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := writeZipFile(f, path); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown file type in zip %s", mode)
+		}
+	}
+	return nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func writeZipFile(f *zip.File, path string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	_, err = io.Copy(fh, rc)
+	return err
+}
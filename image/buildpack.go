@@ -0,0 +1,135 @@
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+
+	"github.com/buildpack/pack/fs"
+)
+
+// ExtractBuildpack copies the contents of /buildpacks/<id>/<version> in img to
+// dir and returns the buildpack version. Layers holding nothing but that
+// buildpack are returned so they can be appended to another image unchanged.
+// When the buildpack shares a layer with other content no layers are returned.
+func ExtractBuildpack(img v1.Image, id, dir string) (string, []v1.Layer, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "read image layers")
+	}
+
+	var (
+		version        string
+		bpLayers       []v1.Layer
+		sharesAnyLayer bool
+	)
+	bpDir := path.Join("buildpacks", id)
+	for _, layer := range layers {
+		found, onlyBuildpack, err := extractBuildpackLayer(layer, bpDir, dir, &version)
+		if err != nil {
+			return "", nil, err
+		}
+		if !found {
+			continue
+		}
+		if onlyBuildpack {
+			bpLayers = append(bpLayers, layer)
+		} else {
+			sharesAnyLayer = true
+		}
+	}
+	if version == "" {
+		return "", nil, fmt.Errorf("buildpack '%s' was not found in /buildpacks", id)
+	}
+	if sharesAnyLayer {
+		bpLayers = nil
+	}
+	return version, bpLayers, nil
+}
+
+func extractBuildpackLayer(layer v1.Layer, bpDir, dest string, version *string) (found bool, onlyBuildpack bool, err error) {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return false, false, errors.Wrap(err, "read layer")
+	}
+	defer rc.Close()
+
+	onlyBuildpack = true
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return found, onlyBuildpack, nil
+		}
+		if err != nil {
+			return false, false, errors.Wrap(err, "read layer")
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "buildpacks" || name == bpDir {
+			continue
+		}
+		if !strings.HasPrefix(name, bpDir+"/") {
+			onlyBuildpack = false
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(name, bpDir+"/"), "/", 2)
+		if parts[0] == "latest" {
+			onlyBuildpack = false
+			continue
+		}
+		if *version == "" {
+			*version = parts[0]
+		} else if *version != parts[0] {
+			return false, false, fmt.Errorf("found versions '%s' and '%s' of buildpack '%s', expected exactly one", *version, parts[0], path.Base(bpDir))
+		}
+		found = true
+		if len(parts) == 1 {
+			continue
+		}
+
+		target := filepath.Join(dest, filepath.FromSlash(parts[1]))
+		var linkname string
+		if hdr.Typeflag == tar.TypeSymlink {
+			linkname = hdr.Linkname
+		}
+		if err := fs.CheckExtractPath(dest, target, linkname); err != nil {
+			return false, false, fmt.Errorf("illegal file path in layer: %s: %s", hdr.Name, err)
+		}
+		if err := extractEntry(tr, hdr, target); err != nil {
+			return false, false, err
+		}
+	}
+}
+
+func extractEntry(r io.Reader, hdr *tar.Header, target string) error {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(target, hdr.FileInfo().Mode())
+	case tar.TypeReg, tar.TypeRegA:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		fh, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, hdr.FileInfo().Mode())
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		_, err = io.Copy(fh, r)
+		return err
+	case tar.TypeSymlink:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.Symlink(hdr.Linkname, target)
+	}
+	return nil
+}
@@ -2,13 +2,14 @@ package image
 
 import (
 	"context"
+	"fmt"
 	"io"
-	"log"
 	"os"
 
 	"github.com/buildpack/lifecycle/img"
 	"github.com/buildpack/pack/docker"
 	"github.com/buildpack/pack/fs"
+	"github.com/buildpack/pack/logging"
 	"github.com/buildpack/packs"
 	"github.com/docker/docker/api/types"
 	"github.com/google/go-containerregistry/pkg/v1"
@@ -23,10 +24,22 @@ type Image interface {
 	SetLabel(string, string) error
 	TopLayer() (string, error)
 	AddLayer(path string) error
+	AddLayerWithDiffID(path, diffID string) error
 	ReuseLayer(sha string) error
 	Save() (string, error)
 }
 
+// NotFoundError is returned when an image that does not exist is read from
+// or changed.
+type NotFoundError struct {
+	Action   string
+	RepoName string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("failed to %s, image '%s' does not exist", e.Action, e.RepoName)
+}
+
 type Docker interface {
 	PullImage(ref string) error
 	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
@@ -38,23 +51,24 @@ type Docker interface {
 
 type Factory struct {
 	Docker Docker
-	Log    *log.Logger
+	Log    *logging.Logger
 	Stdout io.Writer
 	FS     *fs.FS
 }
 
-func DefaultFactory() (*Factory, error) {
+func DefaultFactory(logger *logging.Logger) (*Factory, error) {
 	f := &Factory{
 		Stdout: os.Stdout,
-		Log:    log.New(os.Stdout, "", log.LstdFlags),
+		Log:    logger,
 		FS:     &fs.FS{},
 	}
 
-	var err error
-	f.Docker, err = docker.New()
+	cli, err := docker.New()
 	if err != nil {
 		return nil, err
 	}
+	cli.Progress = logger.Progress()
+	f.Docker = cli
 
 	return f, nil
 }
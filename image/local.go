@@ -13,10 +13,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/buildpack/pack/fs"
+	"github.com/buildpack/pack/logging"
 	"github.com/docker/docker/api/types"
 	dockercli "github.com/docker/docker/client"
 	"github.com/google/go-containerregistry/pkg/name"
@@ -24,22 +24,36 @@ import (
 )
 
 type local struct {
-	RepoName         string
-	Docker           Docker
-	Inspect          types.ImageInspect
-	layerPaths       []string
-	Stdout           io.Writer
-	FS               *fs.FS
-	currentTempImage string
-	prevDir          string
-	prevMap          map[string]string
-	prevOnce         *sync.Once
-	easyAddLayers    []string
+	RepoName      string
+	Docker        Docker
+	Inspect       types.ImageInspect
+	layers        []localLayer
+	Stdout        io.Writer
+	Log           *logging.Logger
+	FS            *fs.FS
+	easyAddLayers []string
+	prevName      string
+	prevDir       string
+	prevLayers    map[string]string
 }
 
-func (f *Factory) NewLocal(repoName string, pull bool) (Image, error) {
+// localLayer describes where Save finds the contents of each entry in
+// Inspect.RootFS.Layers. A layer with neither a path nor reuse set is already
+// known to the daemon and is referenced without sending its contents. An empty
+// entry in Inspect.RootFS.Layers is a layer added with AddLayer whose diffID
+// is computed while Save streams it to the daemon.
+type localLayer struct {
+	path  string
+	reuse bool
+}
+
+func (f *Factory) NewLocal(repoName string, policy PullPolicy) (Image, error) {
+	pull, err := NeedsPull(f.Docker, repoName, policy)
+	if err != nil {
+		return nil, err
+	}
 	if pull {
-		f.Log.Printf("Pulling image '%s'\n", repoName)
+		f.Log.Info("Pulling image '%s'", repoName)
 		if err := f.Docker.PullImage(repoName); err != nil {
 			return nil, fmt.Errorf("failed to pull image '%s' : %s", repoName, err)
 		}
@@ -51,19 +65,19 @@ func (f *Factory) NewLocal(repoName string, pull bool) (Image, error) {
 	}
 
 	return &local{
-		Docker:     f.Docker,
-		RepoName:   repoName,
-		Inspect:    inspect,
-		layerPaths: make([]string, len(inspect.RootFS.Layers)),
-		Stdout:     f.Stdout,
-		FS:         f.FS,
-		prevOnce:   &sync.Once{},
+		Docker:   f.Docker,
+		RepoName: repoName,
+		Inspect:  inspect,
+		layers:   make([]localLayer, len(inspect.RootFS.Layers)),
+		Stdout:   f.Stdout,
+		Log:      f.Log,
+		FS:       f.FS,
 	}, nil
 }
 
 func (l *local) Label(key string) (string, error) {
 	if l.Inspect.Config == nil {
-		return "", fmt.Errorf("failed to get label, image '%s' does not exist", l.RepoName)
+		return "", &NotFoundError{Action: "get label", RepoName: l.RepoName}
 	}
 	labels := l.Inspect.Config.Labels
 	return labels[key], nil
@@ -86,7 +100,7 @@ func (l *local) Name() string {
 
 func (l *local) Digest() (string, error) {
 	if l.Inspect.Config == nil {
-		return "", fmt.Errorf("failed to get digest, image '%s' does not exist", l.RepoName)
+		return "", &NotFoundError{Action: "get digest", RepoName: l.RepoName}
 	}
 	if len(l.Inspect.RepoDigests) == 0 {
 		return "", nil
@@ -101,6 +115,10 @@ func (l *local) Digest() (string, error) {
 func (l *local) Rebase(baseTopLayer string, newBase Image) error {
 	ctx := context.Background()
 
+	if err := l.hashLayers(); err != nil {
+		return err
+	}
+
 	// FIND TOP LAYER
 	keepLayers := -1
 	for i, diffID := range l.Inspect.RootFS.Layers {
@@ -112,38 +130,20 @@ func (l *local) Rebase(baseTopLayer string, newBase Image) error {
 	if keepLayers == -1 {
 		return fmt.Errorf("'%s' not found in '%s' during rebase", baseTopLayer, l.RepoName)
 	}
+	upperLayers := l.Inspect.RootFS.Layers[len(l.Inspect.RootFS.Layers)-keepLayers:]
 
 	// SWITCH BASE LAYERS
 	newBaseInspect, _, err := l.Docker.ImageInspectWithRaw(ctx, newBase.Name())
 	if err != nil {
 		return errors.Wrap(err, "analyze read previous image config")
 	}
-	l.Inspect.RootFS.Layers = newBaseInspect.RootFS.Layers
-	l.layerPaths = make([]string, len(l.Inspect.RootFS.Layers))
-
-	// SAVE CURRENT IMAGE TO DISK
-	if err := l.prevDownload(); err != nil {
-		return err
-	}
-
-	// READ MANIFEST.JSON
-	b, err := ioutil.ReadFile(filepath.Join(l.prevDir, "manifest.json"))
-	if err != nil {
-		return err
-	}
-	var manifest []struct{ Layers []string }
-	if err := json.Unmarshal(b, &manifest); err != nil {
-		return err
-	}
-	if len(manifest) != 1 {
-		return fmt.Errorf("expected 1 image received %d", len(manifest))
-	}
+	l.Inspect.RootFS.Layers = append([]string{}, newBaseInspect.RootFS.Layers...)
+	l.layers = make([]localLayer, len(l.Inspect.RootFS.Layers))
+	l.easyAddLayers = nil
 
-	// ADD EXISTING LAYERS
-	for _, filename := range manifest[0].Layers[(len(manifest[0].Layers) - keepLayers):] {
-		if err := l.AddLayer(filepath.Join(l.prevDir, filename)); err != nil {
-			return err
-		}
+	// REFERENCE EXISTING LAYERS, their contents are only read during Save
+	for _, diffID := range upperLayers {
+		l.reuseFromPrevious(diffID)
 	}
 
 	return nil
@@ -151,55 +151,95 @@ func (l *local) Rebase(baseTopLayer string, newBase Image) error {
 
 func (l *local) SetLabel(key, val string) error {
 	if l.Inspect.Config == nil {
-		return fmt.Errorf("failed to set label, image '%s' does not exist", l.RepoName)
+		return &NotFoundError{Action: "set label", RepoName: l.RepoName}
 	}
 	l.Inspect.Config.Labels[key] = val
 	return nil
 }
 
 func (l *local) TopLayer() (string, error) {
+	if err := l.hashLayers(); err != nil {
+		return "", err
+	}
 	all := l.Inspect.RootFS.Layers
 	topLayer := all[len(all)-1]
 	return topLayer, nil
 }
 
 func (l *local) AddLayer(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return errors.Wrapf(err, "AddLayer: open layer: %s", path)
+	}
+
+	l.Inspect.RootFS.Layers = append(l.Inspect.RootFS.Layers, "")
+	l.layers = append(l.layers, localLayer{path: path})
+	l.easyAddLayers = nil
+
+	return nil
+}
+
+func (l *local) AddLayerWithDiffID(path, diffID string) error {
+	if _, err := os.Stat(path); err != nil {
+		return errors.Wrapf(err, "AddLayer: open layer: %s", path)
+	}
+
+	l.Inspect.RootFS.Layers = append(l.Inspect.RootFS.Layers, diffID)
+	l.layers = append(l.layers, localLayer{path: path})
+	l.easyAddLayers = nil
+
+	return nil
+}
+
+func hashLayer(path string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return errors.Wrapf(err, "AddLayer: open layer: %s", path)
+		return "", errors.Wrapf(err, "AddLayer: open layer: %s", path)
 	}
 	defer f.Close()
 	hasher := sha256.New()
 	if _, err := io.Copy(hasher, f); err != nil {
-		return errors.Wrapf(err, "AddLayer: calculate checksum: %s", path)
+		return "", errors.Wrapf(err, "AddLayer: calculate checksum: %s", path)
 	}
-	sha := hex.EncodeToString(hasher.Sum(make([]byte, 0, hasher.Size())))
-
-	l.Inspect.RootFS.Layers = append(l.Inspect.RootFS.Layers, "sha256:"+sha)
-	l.layerPaths = append(l.layerPaths, path)
-	l.easyAddLayers = nil
+	return "sha256:" + hex.EncodeToString(hasher.Sum(make([]byte, 0, hasher.Size()))), nil
+}
 
+// hashLayers fills in the diffIDs of layers added with AddLayer when they are
+// needed before Save. Save reuses them instead of hashing those layers again.
+func (l *local) hashLayers() error {
+	for i, diffID := range l.Inspect.RootFS.Layers {
+		if diffID != "" {
+			continue
+		}
+		diffID, err := hashLayer(l.layers[i].path)
+		if err != nil {
+			return err
+		}
+		l.Inspect.RootFS.Layers[i] = diffID
+	}
 	return nil
 }
 
 func (l *local) ReuseLayer(sha string) error {
 	if len(l.easyAddLayers) > 0 && l.easyAddLayers[0] == sha {
 		l.Inspect.RootFS.Layers = append(l.Inspect.RootFS.Layers, sha)
-		l.layerPaths = append(l.layerPaths, "")
+		l.layers = append(l.layers, localLayer{})
 		l.easyAddLayers = l.easyAddLayers[1:]
 		return nil
 	}
 
-	if err := l.prevDownload(); err != nil {
-		return err
-	}
+	l.reuseFromPrevious(sha)
+	l.easyAddLayers = nil
+	return nil
+}
 
-	reuseLayer, ok := l.prevMap[sha]
-	if !ok {
-		return fmt.Errorf("SHA %s was not found in %s", sha, l.RepoName)
+// reuseFromPrevious appends a layer whose contents will be read out of the
+// image currently named RepoName when the image is saved.
+func (l *local) reuseFromPrevious(sha string) {
+	if l.prevName == "" {
+		l.prevName = l.RepoName
 	}
-
-	return l.AddLayer(filepath.Join(l.prevDir, reuseLayer))
+	l.Inspect.RootFS.Layers = append(l.Inspect.RootFS.Layers, sha)
+	l.layers = append(l.layers, localLayer{reuse: true})
 }
 
 func (l *local) Save() (string, error) {
@@ -212,17 +252,64 @@ func (l *local) Save() (string, error) {
 	}
 	repoName := t.String()
 
+	if err := l.fetchPrevLayers(); err != nil {
+		return "", err
+	}
+	defer l.cleanupPrevLayers()
+
 	pr, pw := io.Pipe()
 	go func() {
 		res, err := l.Docker.ImageLoad(ctx, pr, true)
-		if err != nil {
+		if err == nil {
 			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
 		}
+		// unblock the writer when the daemon stops reading early
+		pr.CloseWithError(err)
 		done <- err
 	}()
 
-	tw := tar.NewWriter(pw)
+	imgID, err := l.writeImage(pw, repoName)
+	pw.CloseWithError(err)
+	loadErr := <-done
+	if err != nil {
+		return "", err
+	}
+	if loadErr != nil {
+		return "", loadErr
+	}
+
+	// every layer is now known to the daemon
+	l.layers = make([]localLayer, len(l.Inspect.RootFS.Layers))
+	l.prevName = ""
+
+	return imgID, nil
+}
+
+// writeImage writes the tarball loaded by the daemon to w and returns the
+// image ID.
+func (l *local) writeImage(w io.Writer, repoName string) (string, error) {
+	tw := tar.NewWriter(w)
+
+	var layerPaths []string
+	for i, layer := range l.layers {
+		path := layer.path
+		if layer.reuse {
+			path = l.prevLayers[l.Inspect.RootFS.Layers[i]]
+		}
+		if path == "" {
+			layerPaths = append(layerPaths, "")
+			continue
+		}
+		layerName := fmt.Sprintf("/%x.tar", sha256.Sum256([]byte(path)))
+		if err := l.addLayerToTar(tw, layerName, path, i); err != nil {
+			return "", err
+		}
+		layerPaths = append(layerPaths, layerName)
+	}
 
+	// the config is written after the layers, whose diffIDs are only known
+	// once they have been streamed; the daemon reads the whole tarball first
 	imgConfig := map[string]interface{}{
 		"os":      "linux",
 		"created": time.Now().Format(time.RFC3339),
@@ -240,26 +327,6 @@ func (l *local) Save() (string, error) {
 		return "", err
 	}
 
-	var layerPaths []string
-	for _, path := range l.layerPaths {
-		if path == "" {
-			layerPaths = append(layerPaths, "")
-			continue
-		}
-		layerName := fmt.Sprintf("/%x.tar", sha256.Sum256([]byte(path)))
-		f, err := os.Open(path)
-		if err != nil {
-			return "", err
-		}
-		defer f.Close()
-		if err := l.FS.AddFileToTar(tw, layerName, f); err != nil {
-			return "", err
-		}
-		f.Close()
-		layerPaths = append(layerPaths, layerName)
-
-	}
-
 	formatted, err = json.Marshal([]map[string]interface{}{
 		{
 			"Config":   imgID + ".json",
@@ -273,96 +340,152 @@ func (l *local) Save() (string, error) {
 	if err := l.FS.AddTextToTar(tw, "manifest.json", formatted); err != nil {
 		return "", err
 	}
+	return imgID, tw.Close()
+}
 
-	tw.Close()
-	pw.Close()
-	err = <-done
-
-	if l.prevDir != "" {
-		os.RemoveAll(l.prevDir)
-		l.prevDir = ""
-		l.prevMap = nil
-		l.prevOnce = &sync.Once{}
+// addLayerToTar streams the layer at path into the tarball loaded by the
+// daemon, computing its diffID on the way when it is not known yet.
+func (l *local) addLayerToTar(tw *tar.Writer, layerName, path string, index int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: layerName, Mode: 0644, Size: fi.Size()}); err != nil {
+		return err
 	}
 
-	return imgID, err
+	var r io.Reader = f
+	hasher := sha256.New()
+	if l.Inspect.RootFS.Layers[index] == "" {
+		r = io.TeeReader(f, hasher)
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return errors.Wrapf(err, "load layer: %s", path)
+	}
+	if l.Inspect.RootFS.Layers[index] == "" {
+		l.Inspect.RootFS.Layers[index] = "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+	}
+	l.Log.Info("Loaded layer %d/%d '%s' (%d bytes)", index+1, len(l.layers), l.Inspect.RootFS.Layers[index], fi.Size())
+	return nil
 }
 
-func (l *local) prevDownload() error {
-	var outerErr error
-	l.prevOnce.Do(func() {
-		ctx := context.Background()
-
-		tarFile, err := l.Docker.ImageSave(ctx, []string{l.RepoName})
-		if err != nil {
-			outerErr = err
-			return
+// fetchPrevLayers streams the previous image out of the daemon and keeps only
+// the layers that are reused, reading no further once all of them are found.
+func (l *local) fetchPrevLayers() error {
+	wanted := map[string]bool{}
+	for i, layer := range l.layers {
+		diffID := l.Inspect.RootFS.Layers[i]
+		if _, ok := l.prevLayers[diffID]; layer.reuse && !ok {
+			wanted[diffID] = true
 		}
-		defer tarFile.Close()
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
 
+	if l.prevDir == "" {
+		var err error
 		l.prevDir, err = ioutil.TempDir("", "packs.local.reuse-layer.")
 		if err != nil {
-			outerErr = errors.Wrap(err, "local reuse-layer create temp dir")
-			return
-		}
-
-		err = l.FS.Untar(tarFile, l.prevDir)
-		if err != nil {
-			outerErr = err
-			return
+			return errors.Wrap(err, "local reuse-layer create temp dir")
 		}
+		l.prevLayers = map[string]string{}
+	}
 
-		mf, err := os.Open(filepath.Join(l.prevDir, "manifest.json"))
-		if err != nil {
-			outerErr = err
-			return
-		}
-		defer mf.Close()
+	if err := l.readPrevImage(wanted); err != nil {
+		return err
+	}
+	for diffID := range wanted {
+		return fmt.Errorf("SHA %s was not found in %s", diffID, l.prevName)
+	}
+	return nil
+}
 
-		var manifest []struct {
-			Config string
-			Layers []string
-		}
-		if err := json.NewDecoder(mf).Decode(&manifest); err != nil {
-			outerErr = err
-			return
-		}
+// readPrevImage copies the wanted layers out of a single export of the
+// previous image, discarding everything else. Newer daemons name layer blobs
+// by diffID. Older daemons put each layer.tar in a directory named by layer
+// ID, so every layer.tar is copied while its diffID is computed, and dropped
+// again unless it turns out to be wanted.
+func (l *local) readPrevImage(wanted map[string]bool) error {
+	tarFile, err := l.Docker.ImageSave(context.Background(), []string{l.prevName})
+	if err != nil {
+		return err
+	}
+	defer tarFile.Close()
 
-		if len(manifest) != 1 {
-			outerErr = fmt.Errorf("manifest.json had unexpected number of entries: %d", len(manifest))
-			return
+	tr := tar.NewReader(tarFile)
+	for len(wanted) > 0 {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
 		}
-
-		df, err := os.Open(filepath.Join(l.prevDir, manifest[0].Config))
 		if err != nil {
-			outerErr = err
-			return
+			return errors.Wrapf(err, "read image '%s' from daemon", l.prevName)
 		}
-		defer df.Close()
-
-		var details struct {
-			RootFS struct {
-				DiffIDs []string `json:"diff_ids"`
-			} `json:"rootfs"`
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
 		}
 
-		if err = json.NewDecoder(df).Decode(&details); err != nil {
-			outerErr = err
-			return
+		switch {
+		case strings.HasPrefix(hdr.Name, "blobs/sha256/"):
+			diffID := "sha256:" + filepath.Base(hdr.Name)
+			if !wanted[diffID] {
+				continue
+			}
+			path, actual, err := l.copyPrevLayer(tr)
+			if err != nil {
+				return err
+			}
+			if actual != diffID {
+				os.Remove(path)
+				return fmt.Errorf("layer %s of image '%s' has diffID %s", diffID, l.prevName, actual)
+			}
+			l.prevLayers[diffID] = path
+			delete(wanted, diffID)
+		case filepath.Base(hdr.Name) == "layer.tar":
+			path, diffID, err := l.copyPrevLayer(tr)
+			if err != nil {
+				return err
+			}
+			if !wanted[diffID] {
+				os.Remove(path)
+				continue
+			}
+			l.prevLayers[diffID] = path
+			delete(wanted, diffID)
 		}
+	}
+	return nil
+}
 
-		if len(manifest[0].Layers) != len(details.RootFS.DiffIDs) {
-			outerErr = fmt.Errorf("layers and diff IDs do not match, there are %d layers and %d diffIDs", len(manifest[0].Layers), len(details.RootFS.DiffIDs))
-			return
-		}
+// copyPrevLayer copies a layer out of the previous image and returns the file
+// it was copied to along with its diffID.
+func (l *local) copyPrevLayer(r io.Reader) (string, string, error) {
+	f, err := ioutil.TempFile(l.prevDir, "layer.")
+	if err != nil {
+		return "", "", errors.Wrap(err, "local reuse-layer create layer file")
+	}
+	defer f.Close()
 
-		l.prevMap = make(map[string]string, len(manifest[0].Layers))
-		for i, diffID := range details.RootFS.DiffIDs {
-			layerID := manifest[0].Layers[i]
-			l.prevMap[diffID] = layerID
-		}
-	})
-	return outerErr
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, hasher), r); err != nil {
+		os.Remove(f.Name())
+		return "", "", errors.Wrapf(err, "read layer from image '%s'", l.prevName)
+	}
+	return f.Name(), "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (l *local) cleanupPrevLayers() {
+	if l.prevDir != "" {
+		os.RemoveAll(l.prevDir)
+	}
+	l.prevDir = ""
+	l.prevLayers = nil
 }
 
 // TODO copied from exporter.go
@@ -4,10 +4,10 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"os"
 	"regexp"
@@ -19,13 +19,18 @@ import (
 	"github.com/buildpack/pack/docker"
 	"github.com/buildpack/pack/fs"
 	"github.com/buildpack/pack/image"
+	"github.com/buildpack/pack/logging"
+	"github.com/buildpack/pack/mocks"
 	h "github.com/buildpack/pack/testhelpers"
 	dockertypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/golang/mock/gomock"
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
 )
 
+//go:generate mockgen -package mocks -destination ../mocks/image_docker.go -mock_names Docker=MockImageDocker github.com/buildpack/pack/image Docker
+
 func TestLocal(t *testing.T) {
 	t.Parallel()
 	rand.Seed(time.Now().UTC().UnixNano())
@@ -44,7 +49,7 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 		h.AssertNil(t, err)
 		factory = image.Factory{
 			Docker: dockerCli,
-			Log:    log.New(&buf, "", log.LstdFlags),
+			Log:    logging.New(&buf, &buf, logging.Options{Verbose: true}),
 			Stdout: &buf,
 			FS:     &fs.FS{},
 		}
@@ -66,7 +71,7 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 			})
 
 			it("returns the label value", func() {
-				img, err := factory.NewLocal(repoName, false)
+				img, err := factory.NewLocal(repoName, image.PullNever)
 				h.AssertNil(t, err)
 
 				label, err := img.Label("mykey")
@@ -75,7 +80,7 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 			})
 
 			it("returns an empty string for a missing label", func() {
-				img, err := factory.NewLocal(repoName, false)
+				img, err := factory.NewLocal(repoName, image.PullNever)
 				h.AssertNil(t, err)
 
 				label, err := img.Label("missing-label")
@@ -86,7 +91,7 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 
 		when("image NOT exists", func() {
 			it("returns an error", func() {
-				img, err := factory.NewLocal(repoName, false)
+				img, err := factory.NewLocal(repoName, image.PullNever)
 				h.AssertNil(t, err)
 
 				_, err = img.Label("mykey")
@@ -97,7 +102,7 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 
 	when("#Name", func() {
 		it("always returns the original name", func() {
-			img, err := factory.NewLocal(repoName, false)
+			img, err := factory.NewLocal(repoName, image.PullNever)
 			h.AssertNil(t, err)
 
 			h.AssertEq(t, img.Name(), repoName)
@@ -113,7 +118,7 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 			})
 
 			it("returns the image digest", func() {
-				img, _ := factory.NewLocal("busybox:1.29", true)
+				img, _ := factory.NewLocal("busybox:1.29", image.PullAlways)
 				digest, err := img.Digest()
 				h.AssertNil(t, err)
 				h.AssertEq(t, digest, expectedDigest)
@@ -133,7 +138,7 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 			})
 
 			it("returns an empty string", func() {
-				img, _ := factory.NewLocal(repoName, false)
+				img, _ := factory.NewLocal(repoName, image.PullNever)
 				digest, err := img.Digest()
 				h.AssertNil(t, err)
 				h.AssertEq(t, digest, "")
@@ -153,7 +158,7 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 					FROM scratch
 					LABEL some-key=some-value
 				`)
-				img, err = factory.NewLocal(repoName, false)
+				img, err = factory.NewLocal(repoName, image.PullNever)
 				h.AssertNil(t, err)
 				origID = h.ImageID(t, repoName)
 			})
@@ -231,9 +236,9 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 				h.AssertEq(t, txt, "old-base\n")
 
 				// Run rebase
-				img, err := factory.NewLocal(repoName, false)
+				img, err := factory.NewLocal(repoName, image.PullNever)
 				h.AssertNil(t, err)
-				newBaseImg, err := factory.NewLocal(newBase, false)
+				newBaseImg, err := factory.NewLocal(newBase, image.PullNever)
 				h.AssertNil(t, err)
 				err = img.Rebase(oldTopLayer, newBaseImg)
 				h.AssertNil(t, err)
@@ -284,7 +289,7 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 			})
 
 			it("returns the digest for the top layer (useful for rebasing)", func() {
-				img, err := factory.NewLocal(repoName, false)
+				img, err := factory.NewLocal(repoName, image.PullNever)
 				h.AssertNil(t, err)
 
 				actualTopLayer, err := img.TopLayer()
@@ -315,7 +320,7 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 			h.AssertNil(t, err)
 			tarPath = tarFile.Name()
 
-			img, err = factory.NewLocal(repoName, false)
+			img, err = factory.NewLocal(repoName, image.PullNever)
 			h.AssertNil(t, err)
 			origID = h.ImageID(t, repoName)
 		})
@@ -341,6 +346,71 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 			h.AssertNil(t, err)
 			h.AssertEq(t, output, "new-layer")
 		})
+
+		it("computes the diffID of the layer", func() {
+			h.AssertNil(t, img.AddLayer(tarPath))
+
+			topLayer, err := img.TopLayer()
+			h.AssertNil(t, err)
+			h.AssertEq(t, topLayer, fileSHA(t, tarPath))
+		})
+
+		it("reports the diffID of each layer it loads", func() {
+			h.AssertNil(t, img.AddLayer(tarPath))
+
+			_, err := img.Save()
+			h.AssertNil(t, err)
+
+			h.AssertMatch(t, buf.String(), regexp.MustCompile(fmt.Sprintf(`Loaded layer 3/3 '%s' \(\d+ bytes\)`, fileSHA(t, tarPath))))
+		})
+	})
+
+	when("#AddLayerWithDiffID", func() {
+		var (
+			tarPath string
+			img     image.Image
+			origID  string
+		)
+		it.Before(func() {
+			createImageOnLocal(t, dockerCli, repoName, `
+					FROM busybox
+					RUN echo -n old-layer > old-layer.txt
+				`)
+			tr, err := (&fs.FS{}).CreateSingleFileTar("/new-layer.txt", "new-layer")
+			h.AssertNil(t, err)
+			tarFile, err := ioutil.TempFile("", "add-layer-test")
+			h.AssertNil(t, err)
+			defer tarFile.Close()
+			_, err = io.Copy(tarFile, tr)
+			h.AssertNil(t, err)
+			tarPath = tarFile.Name()
+
+			img, err = factory.NewLocal(repoName, image.PullNever)
+			h.AssertNil(t, err)
+			origID = h.ImageID(t, repoName)
+		})
+
+		it.After(func() {
+			err := os.Remove(tarPath)
+			h.AssertNil(t, err)
+			h.AssertNil(t, dockerRmi(dockerCli, repoName, origID))
+		})
+
+		it("appends a layer using the given diffID", func() {
+			diffID := fileSHA(t, tarPath)
+			h.AssertNil(t, img.AddLayerWithDiffID(tarPath, diffID))
+
+			topLayer, err := img.TopLayer()
+			h.AssertNil(t, err)
+			h.AssertEq(t, topLayer, diffID)
+
+			_, err = img.Save()
+			h.AssertNil(t, err)
+
+			output, err := copySingleFileFromImage(dockerCli, repoName, "new-layer.txt")
+			h.AssertNil(t, err)
+			h.AssertEq(t, output, "new-layer")
+		})
 	})
 
 	when("#ReuseLayer", func() {
@@ -367,7 +437,7 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 			layer1SHA = inspect.RootFS.Layers[1]
 			layer2SHA = inspect.RootFS.Layers[2]
 
-			img, err = factory.NewLocal("busybox", false)
+			img, err = factory.NewLocal("busybox", image.PullNever)
 			h.AssertNil(t, err)
 
 			img.Rename(repoName)
@@ -409,6 +479,180 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 			_, err = copySingleFileFromImage(dockerCli, repoName, "layer-2.txt")
 			h.AssertMatch(t, err.Error(), regexp.MustCompile(`Error: No such container:path: .*:layer-2.txt`))
 		})
+
+		it("reuses several layers in any order", func() {
+			h.AssertNil(t, img.ReuseLayer(layer2SHA))
+			h.AssertNil(t, img.ReuseLayer(layer1SHA))
+
+			_, err := img.Save()
+			h.AssertNil(t, err)
+
+			output, err := copySingleFileFromImage(dockerCli, repoName, "layer-1.txt")
+			h.AssertNil(t, err)
+			h.AssertEq(t, output, "old-layer-1")
+
+			output, err = copySingleFileFromImage(dockerCli, repoName, "layer-2.txt")
+			h.AssertNil(t, err)
+			h.AssertEq(t, output, "old-layer-2")
+		})
+
+		it("returns an error on save when the layer is not in the previous image", func() {
+			h.AssertNil(t, img.ReuseLayer("sha256:0000000000000000000000000000000000000000000000000000000000000000"))
+
+			_, err := img.Save()
+			h.AssertError(t, err, fmt.Sprintf("SHA sha256:0000000000000000000000000000000000000000000000000000000000000000 was not found in %s", repoName))
+		})
+	})
+
+	when("an older daemon exports layers in directories named by layer ID", func() {
+		var (
+			mockController *gomock.Controller
+			mockDocker     *mocks.MockImageDocker
+			loaded         map[string]string
+		)
+
+		layerSHA := func(contents string) string {
+			return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(contents)))
+		}
+
+		// legacyExport writes an image in the format of older daemons, which
+		// name layer directories by layer ID and put manifest.json and the
+		// config after the layers
+		legacyExport := func() io.ReadCloser {
+			var export bytes.Buffer
+			tw := tar.NewWriter(&export)
+			for _, entry := range [][2]string{
+				{"run/layer.tar", "run-layer"},
+				{"app1/layer.tar", "app-layer-1"},
+				{"app2/layer.tar", "app-layer-2"},
+				{"config.json", fmt.Sprintf(`{"rootfs": {"diff_ids": [%q, %q, %q]}}`, layerSHA("run-layer"), layerSHA("app-layer-1"), layerSHA("app-layer-2"))},
+				{"manifest.json", `[{"Config": "config.json", "Layers": ["run/layer.tar", "app1/layer.tar", "app2/layer.tar"]}]`},
+			} {
+				h.AssertNil(t, tw.WriteHeader(&tar.Header{Name: entry[0], Mode: 0644, Size: int64(len(entry[1]))}))
+				_, err := tw.Write([]byte(entry[1]))
+				h.AssertNil(t, err)
+			}
+			h.AssertNil(t, tw.Close())
+			return ioutil.NopCloser(&export)
+		}
+
+		it.Before(func() {
+			mockController = gomock.NewController(t)
+			mockDocker = mocks.NewMockImageDocker(mockController)
+			factory.Docker = mockDocker
+
+			mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/run").Return(dockertypes.ImageInspect{
+				RootFS: dockertypes.RootFS{Layers: []string{layerSHA("run-layer")}},
+			}, nil, nil)
+			mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/app").Return(dockertypes.ImageInspect{
+				RootFS: dockertypes.RootFS{Layers: []string{layerSHA("run-layer"), layerSHA("app-layer-1"), layerSHA("app-layer-2")}},
+			}, nil, nil)
+			mockDocker.EXPECT().ImageLoad(gomock.Any(), gomock.Any(), true).DoAndReturn(func(_ context.Context, r io.Reader, _ bool) (dockertypes.ImageLoadResponse, error) {
+				loaded = map[string]string{}
+				tr := tar.NewReader(r)
+				for {
+					hdr, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					h.AssertNil(t, err)
+					contents, err := ioutil.ReadAll(tr)
+					h.AssertNil(t, err)
+					loaded[hdr.Name] = string(contents)
+				}
+				return dockertypes.ImageLoadResponse{Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+			})
+		})
+
+		it.After(func() {
+			mockController.Finish()
+		})
+
+		it("copies only the reused layers from a single export", func() {
+			mockDocker.EXPECT().ImageSave(gomock.Any(), []string{"some/app"}).DoAndReturn(func(context.Context, []string) (io.ReadCloser, error) {
+				return legacyExport(), nil
+			}).Times(1)
+
+			img, err := factory.NewLocal("some/run", image.PullNever)
+			h.AssertNil(t, err)
+			img.Rename("some/app")
+			h.AssertNil(t, img.ReuseLayer(layerSHA("app-layer-2")))
+
+			_, err = img.Save()
+			h.AssertNil(t, err)
+
+			var layers []string
+			for name, contents := range loaded {
+				if strings.HasSuffix(name, ".tar") {
+					layers = append(layers, contents)
+				}
+			}
+			h.AssertEq(t, layers, []string{"app-layer-2"})
+		})
+	})
+
+	when("saving fails", func() {
+		var (
+			mockController *gomock.Controller
+			mockDocker     *mocks.MockImageDocker
+		)
+
+		it.Before(func() {
+			mockController = gomock.NewController(t)
+			mockDocker = mocks.NewMockImageDocker(mockController)
+			factory.Docker = mockDocker
+
+			mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), "some/run").Return(dockertypes.ImageInspect{}, nil, nil)
+		})
+
+		it.After(func() {
+			mockController.Finish()
+		})
+
+		save := func(removeLayer bool) error {
+			img, err := factory.NewLocal("some/run", image.PullNever)
+			h.AssertNil(t, err)
+			layer, err := ioutil.TempFile("", "pack-local-test-layer")
+			h.AssertNil(t, err)
+			defer os.Remove(layer.Name())
+			h.AssertNil(t, layer.Close())
+			h.AssertNil(t, img.AddLayer(layer.Name()))
+			if removeLayer {
+				h.AssertNil(t, os.Remove(layer.Name()))
+			}
+
+			saved := make(chan error, 1)
+			go func() {
+				_, err := img.Save()
+				saved <- err
+			}()
+			select {
+			case err := <-saved:
+				return err
+			case <-time.After(5 * time.Second):
+				t.Fatal("Save did not return")
+				return nil
+			}
+		}
+
+		it("stops loading the image when a layer can't be read", func() {
+			var loadErr error
+			mockDocker.EXPECT().ImageLoad(gomock.Any(), gomock.Any(), true).DoAndReturn(func(_ context.Context, r io.Reader, _ bool) (dockertypes.ImageLoadResponse, error) {
+				_, loadErr = ioutil.ReadAll(r)
+				return dockertypes.ImageLoadResponse{}, loadErr
+			})
+
+			err := save(true)
+			h.AssertNotNil(t, err)
+			h.AssertContains(t, err.Error(), "pack-local-test-layer")
+			h.AssertEq(t, loadErr, err)
+		})
+
+		it("returns the error of a daemon that stops reading the image", func() {
+			mockDocker.EXPECT().ImageLoad(gomock.Any(), gomock.Any(), true).Return(dockertypes.ImageLoadResponse{}, fmt.Errorf("some daemon error"))
+
+			h.AssertError(t, save(false), "some daemon error")
+		})
 	})
 
 	when("#Save", func() {
@@ -423,7 +667,7 @@ func testLocal(t *testing.T, when spec.G, it spec.S) {
 					FROM busybox
 					LABEL mykey=oldValue
 				`)
-				img, err = factory.NewLocal(repoName, false)
+				img, err = factory.NewLocal(repoName, image.PullNever)
 				h.AssertNil(t, err)
 				origID = h.ImageID(t, repoName)
 			})
@@ -501,3 +745,10 @@ func dockerRmi(dockerCli *docker.Client, repoNames ...string) error {
 	}
 	return err
 }
+
+func fileSHA(t *testing.T, path string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	h.AssertNil(t, err)
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
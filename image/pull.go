@@ -0,0 +1,53 @@
+package image
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	dockercli "github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// PullPolicy decides when an image is pulled before it is used.
+type PullPolicy string
+
+const (
+	// PullAlways pulls the image every time, which is the default
+	PullAlways PullPolicy = "always"
+	// PullIfNotPresent pulls the image only when the daemon doesn't have it
+	PullIfNotPresent PullPolicy = "if-not-present"
+	// PullNever uses the image the daemon has, if any
+	PullNever PullPolicy = "never"
+)
+
+// ParsePullPolicy parses the value of --pull-policy, where an empty value
+// means PullAlways.
+func ParsePullPolicy(policy string) (PullPolicy, error) {
+	switch p := PullPolicy(policy); p {
+	case "":
+		return PullAlways, nil
+	case PullAlways, PullIfNotPresent, PullNever:
+		return p, nil
+	}
+	return "", fmt.Errorf(`invalid pull policy "%s", expected one of: %s, %s, %s`, policy, PullAlways, PullIfNotPresent, PullNever)
+}
+
+type Inspector interface {
+	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+}
+
+// NeedsPull reports whether the image named ref has to be pulled under policy.
+func NeedsPull(d Inspector, ref string, policy PullPolicy) (bool, error) {
+	switch policy {
+	case PullNever:
+		return false, nil
+	case PullIfNotPresent:
+		if _, _, err := d.ImageInspectWithRaw(context.Background(), ref); err == nil {
+			return false, nil
+		} else if !dockercli.IsErrNotFound(err) {
+			return false, errors.Wrapf(err, "inspect image '%s'", ref)
+		}
+	}
+	return true, nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/buildpack/lifecycle/img"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	v1remote "github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/pkg/errors"
 )
@@ -22,7 +23,7 @@ func (f *Factory) NewRemote(repoName string) (Image, error) {
 	}
 	image, err := repoStore.Image()
 	if err != nil {
-		return nil, errors.New("connect to repo store")
+		return nil, errors.Wrap(err, "connect to repo store")
 	}
 
 	return &remote{
@@ -33,8 +34,11 @@ func (f *Factory) NewRemote(repoName string) (Image, error) {
 
 func (r *remote) Label(key string) (string, error) {
 	cfg, err := r.Image.ConfigFile()
+	if err != nil && !isNotFound(err) {
+		return "", errors.Wrapf(err, "failed to get label of image '%s'", r.RepoName)
+	}
 	if err != nil || cfg == nil {
-		return "", fmt.Errorf("failed to get label, image '%s' does not exist", r.RepoName)
+		return "", &NotFoundError{Action: "get label", RepoName: r.RepoName}
 	}
 	labels := cfg.Config.Labels
 	return labels[key], nil
@@ -98,6 +102,10 @@ func (r *remote) AddLayer(path string) error {
 	panic("Not Implemented")
 }
 
+func (r *remote) AddLayerWithDiffID(path, diffID string) error {
+	panic("Not Implemented")
+}
+
 func (r *remote) ReuseLayer(sha string) error {
 	panic("Not Implemented")
 }
@@ -147,3 +155,15 @@ func (si *subImage) Manifest() (*v1.Manifest, error)         { panic("Not Implem
 func (si *subImage) RawManifest() ([]byte, error)            { panic("Not Implemented") }
 func (si *subImage) LayerByDigest(v1.Hash) (v1.Layer, error) { panic("Not Implemented") }
 func (si *subImage) LayerByDiffID(v1.Hash) (v1.Layer, error) { panic("Not Implemented") }
+
+// isNotFound tells a registry answering that an image does not exist apart
+// from failures such as denied access or network errors.
+func isNotFound(err error) bool {
+	if remoteErr, ok := err.(*v1remote.Error); ok && len(remoteErr.Errors) > 0 {
+		switch remoteErr.Errors[0].Code {
+		case v1remote.ManifestUnknownErrorCode, v1remote.NameUnknownErrorCode:
+			return true
+		}
+	}
+	return false
+}
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net/http"
 	"strings"
@@ -18,6 +17,7 @@ import (
 	"github.com/buildpack/pack/docker"
 	"github.com/buildpack/pack/fs"
 	"github.com/buildpack/pack/image"
+	"github.com/buildpack/pack/logging"
 	h "github.com/buildpack/pack/testhelpers"
 	dockertypes "github.com/docker/docker/api/types"
 	"github.com/sclevine/spec"
@@ -48,7 +48,7 @@ func testRemote(t *testing.T, when spec.G, it spec.S) {
 		h.AssertNil(t, err)
 		factory = image.Factory{
 			Docker: dockerCli,
-			Log:    log.New(&buf, "", log.LstdFlags),
+			Log:    logging.New(&buf, &buf, logging.Options{}),
 			Stdout: &buf,
 			FS:     &fs.FS{},
 		}
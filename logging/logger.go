@@ -0,0 +1,209 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/term"
+)
+
+const timestampFormat = "2006/01/02 15:04:05"
+
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+	colorGray   = "\x1b[90m"
+)
+
+type Options struct {
+	// Verbose shows debug output
+	Verbose bool
+	// Quiet hides everything but warnings, errors and the error output of
+	// lifecycle phases
+	Quiet bool
+	// Color highlights warnings, errors and phase names
+	Color bool
+	// Timestamps prefixes every line with the time
+	Timestamps bool
+	// Transcript receives all output with timestamps and without color,
+	// including output hidden by Verbose and Quiet
+	Transcript io.Writer
+}
+
+// Logger writes the output of pack and of the containers it runs.
+type Logger struct {
+	mu         sync.Mutex
+	stdout     io.Writer
+	stderr     io.Writer
+	transcript io.Writer
+	verbose    bool
+	quiet      bool
+	color      bool
+	timestamps bool
+}
+
+func New(stdout, stderr io.Writer, opts Options) *Logger {
+	return &Logger{
+		stdout:     stdout,
+		stderr:     stderr,
+		transcript: opts.Transcript,
+		verbose:    opts.Verbose,
+		quiet:      opts.Quiet,
+		color:      opts.Color,
+		timestamps: opts.Timestamps,
+	}
+}
+
+// Debug writes a line shown only with Verbose.
+func (l *Logger) Debug(format string, a ...interface{}) {
+	l.writeLine(l.stdout, l.verbose && !l.quiet, "", colorGray, format, a...)
+}
+
+// Info writes a line hidden by Quiet.
+func (l *Logger) Info(format string, a ...interface{}) {
+	l.writeLine(l.stdout, !l.quiet, "", "", format, a...)
+}
+
+// Warn writes a line to stderr prefixed with WARNING.
+func (l *Logger) Warn(format string, a ...interface{}) {
+	l.writeLine(l.stderr, true, "WARNING: ", colorYellow, format, a...)
+}
+
+// Error writes a line to stderr prefixed with ERROR.
+func (l *Logger) Error(format string, a ...interface{}) {
+	l.writeLine(l.stderr, true, "ERROR: ", colorRed, format, a...)
+}
+
+// Phase returns writers for the output of a lifecycle phase, which prefix
+// every line with the name of the phase. Quiet hides the standard output.
+func (l *Logger) Phase(name string) (stdout, stderr io.Writer) {
+	return &lineWriter{logger: l, out: l.stdout, show: !l.quiet, prefix: "[" + name + "] ", atLineStart: true},
+		&lineWriter{logger: l, out: l.stderr, show: true, prefix: "[" + name + "] ", atLineStart: true}
+}
+
+// Stdout returns a writer for output that is always shown as is, such as that
+// of an app, which is also written to the transcript.
+func (l *Logger) Stdout() io.Writer {
+	return &lineWriter{logger: l, out: l.stdout, show: true, raw: true, atLineStart: true}
+}
+
+// Stderr is like Stdout for error output.
+func (l *Logger) Stderr() io.Writer {
+	return &lineWriter{logger: l, out: l.stderr, show: true, raw: true, atLineStart: true}
+}
+
+// Progress returns a writer for progress output, such as that of image pulls,
+// which is hidden by Quiet and not written to the transcript. It tells
+// whether stdout is a terminal, so that progress can be rendered in place.
+func (l *Logger) Progress() *ProgressWriter {
+	return &ProgressWriter{logger: l}
+}
+
+func (l *Logger) writeLine(out io.Writer, show bool, prefix, color, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+		msg += "\n"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if show {
+		line := prefix + msg
+		if l.color && color != "" {
+			line = color + prefix + msg[:len(msg)-1] + colorReset + "\n"
+		}
+		io.WriteString(out, l.timestamp(now, l.timestamps)+line)
+	}
+	if l.transcript != nil {
+		io.WriteString(l.transcript, l.timestamp(now, true)+prefix+msg)
+	}
+}
+
+func (l *Logger) timestamp(now time.Time, show bool) string {
+	if !show {
+		return ""
+	}
+	return now.Format(timestampFormat) + " "
+}
+
+// lineWriter prefixes each line written to it, without waiting for the line
+// to end, so that prompts and progress are shown as they are written.
+type lineWriter struct {
+	logger      *Logger
+	out         io.Writer
+	show        bool
+	prefix      string
+	raw         bool
+	atLineStart bool
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	l := w.logger
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var shown, transcript bytes.Buffer
+	for rest := p; len(rest) > 0; {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+
+		if w.atLineStart {
+			if !w.raw {
+				shown.WriteString(l.timestamp(now, l.timestamps))
+				if l.color {
+					shown.WriteString(colorCyan + w.prefix + colorReset)
+				} else {
+					shown.WriteString(w.prefix)
+				}
+			}
+			transcript.WriteString(l.timestamp(now, true) + w.prefix)
+		}
+		shown.Write(line)
+		transcript.Write(line)
+		w.atLineStart = line[len(line)-1] == '\n'
+	}
+
+	if w.show {
+		if _, err := w.out.Write(shown.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	if l.transcript != nil {
+		l.transcript.Write(transcript.Bytes())
+	}
+	return len(p), nil
+}
+
+type ProgressWriter struct {
+	logger *Logger
+}
+
+func (w *ProgressWriter) Write(p []byte) (int, error) {
+	l := w.logger
+	if l.quiet {
+		return len(p), nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stdout.Write(p)
+}
+
+func (w *ProgressWriter) FD() uintptr {
+	fd, _ := term.GetFdInfo(w.logger.stdout)
+	return fd
+}
+
+func (w *ProgressWriter) IsTerminal() bool {
+	_, isTerminal := term.GetFdInfo(w.logger.stdout)
+	return isTerminal && !w.logger.quiet
+}
@@ -0,0 +1,146 @@
+package logging_test
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/pack/logging"
+	h "github.com/buildpack/pack/testhelpers"
+)
+
+func TestLogger(t *testing.T) {
+	spec.Run(t, "logger", testLogger, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+func testLogger(t *testing.T, when spec.G, it spec.S) {
+	var stdout, stderr, transcript bytes.Buffer
+
+	it.Before(func() {
+		stdout.Reset()
+		stderr.Reset()
+		transcript.Reset()
+	})
+
+	when("no options are set", func() {
+		it("writes info to stdout and warnings and errors to stderr", func() {
+			logger := logging.New(&stdout, &stderr, logging.Options{})
+
+			logger.Debug("some debug")
+			logger.Info("some info %d", 1)
+			logger.Warn("some warning\n")
+			logger.Error("some error")
+
+			h.AssertEq(t, stdout.String(), "some info 1\n")
+			h.AssertEq(t, stderr.String(), "WARNING: some warning\nERROR: some error\n")
+		})
+
+		it("prefixes each line of a phase with its name", func() {
+			logger := logging.New(&stdout, &stderr, logging.Options{})
+			phaseOut, phaseErr := logger.Phase("detector")
+
+			fmt.Fprint(phaseOut, "first line\nsecond ")
+			fmt.Fprint(phaseOut, "line\n")
+			fmt.Fprint(phaseErr, "some error\n")
+
+			h.AssertEq(t, stdout.String(), "[detector] first line\n[detector] second line\n")
+			h.AssertEq(t, stderr.String(), "[detector] some error\n")
+		})
+
+		it("writes app output as is", func() {
+			logger := logging.New(&stdout, &stderr, logging.Options{})
+
+			fmt.Fprint(logger.Stdout(), "app output\n")
+			fmt.Fprint(logger.Stderr(), "app error\n")
+
+			h.AssertEq(t, stdout.String(), "app output\n")
+			h.AssertEq(t, stderr.String(), "app error\n")
+		})
+	})
+
+	when("verbose", func() {
+		it("writes debug output", func() {
+			logger := logging.New(&stdout, &stderr, logging.Options{Verbose: true})
+
+			logger.Debug("some debug")
+
+			h.AssertEq(t, stdout.String(), "some debug\n")
+		})
+	})
+
+	when("quiet", func() {
+		it("only writes warnings, errors and the error output of phases", func() {
+			logger := logging.New(&stdout, &stderr, logging.Options{Quiet: true, Verbose: true})
+			phaseOut, phaseErr := logger.Phase("builder")
+
+			logger.Debug("some debug")
+			logger.Info("some info")
+			logger.Warn("some warning")
+			fmt.Fprint(phaseOut, "some output\n")
+			fmt.Fprint(phaseErr, "some error\n")
+
+			h.AssertEq(t, stdout.String(), "")
+			h.AssertEq(t, stderr.String(), "WARNING: some warning\n[builder] some error\n")
+		})
+
+		it("hides progress", func() {
+			logger := logging.New(&stdout, &stderr, logging.Options{Quiet: true})
+
+			fmt.Fprint(logger.Progress(), "some progress\n")
+
+			h.AssertEq(t, stdout.String(), "")
+			h.AssertEq(t, logger.Progress().IsTerminal(), false)
+		})
+	})
+
+	when("color", func() {
+		it("highlights warnings, errors and phase names", func() {
+			logger := logging.New(&stdout, &stderr, logging.Options{Color: true})
+			phaseOut, _ := logger.Phase("exporter")
+
+			logger.Info("some info")
+			logger.Error("some error")
+			fmt.Fprint(phaseOut, "some output\n")
+
+			h.AssertEq(t, stdout.String(), "some info\n\x1b[36m[exporter] \x1b[0msome output\n")
+			h.AssertEq(t, stderr.String(), "\x1b[31mERROR: some error\x1b[0m\n")
+		})
+	})
+
+	when("timestamps", func() {
+		it("prefixes lines with the time", func() {
+			logger := logging.New(&stdout, &stderr, logging.Options{Timestamps: true})
+			phaseOut, _ := logger.Phase("analyzer")
+
+			logger.Info("some info")
+			fmt.Fprint(phaseOut, "some output\n")
+
+			h.AssertMatch(t, stdout.String(), regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d some info\n\d{4}/\d\d/\d\d \d\d:\d\d:\d\d \[analyzer\] some output\n$`))
+		})
+	})
+
+	when("there is a transcript", func() {
+		it("writes all output with timestamps and without color", func() {
+			logger := logging.New(&stdout, &stderr, logging.Options{Quiet: true, Color: true, Transcript: &transcript})
+			phaseOut, _ := logger.Phase("builder")
+
+			logger.Debug("some debug")
+			logger.Info("some info")
+			logger.Error("some error")
+			fmt.Fprint(phaseOut, "some output\n")
+			fmt.Fprint(logger.Stdout(), "app output\n")
+
+			h.AssertMatch(t, transcript.String(), regexp.MustCompile(`^`+
+				`\d{4}/\d\d/\d\d \d\d:\d\d:\d\d some debug\n`+
+				`\d{4}/\d\d/\d\d \d\d:\d\d:\d\d some info\n`+
+				`\d{4}/\d\d/\d\d \d\d:\d\d:\d\d ERROR: some error\n`+
+				`\d{4}/\d\d/\d\d \d\d:\d\d:\d\d \[builder\] some output\n`+
+				`\d{4}/\d\d/\d\d \d\d:\d\d:\d\d app output\n$`))
+			h.AssertEq(t, stdout.String(), "app output\n")
+		})
+	})
+}
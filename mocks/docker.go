@@ -50,6 +50,32 @@ func (mr *MockDockerMockRecorder) ContainerCreate(arg0, arg1, arg2, arg3, arg4 i
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ContainerCreate", reflect.TypeOf((*MockDocker)(nil).ContainerCreate), arg0, arg1, arg2, arg3, arg4)
 }
 
+// ContainerInspect mocks base method
+func (m *MockDocker) ContainerInspect(arg0 context.Context, arg1 string) (types.ContainerJSON, error) {
+	ret := m.ctrl.Call(m, "ContainerInspect", arg0, arg1)
+	ret0, _ := ret[0].(types.ContainerJSON)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ContainerInspect indicates an expected call of ContainerInspect
+func (mr *MockDockerMockRecorder) ContainerInspect(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ContainerInspect", reflect.TypeOf((*MockDocker)(nil).ContainerInspect), arg0, arg1)
+}
+
+// ContainerLogs mocks base method
+func (m *MockDocker) ContainerLogs(arg0 context.Context, arg1 string, arg2 types.ContainerLogsOptions) (io.ReadCloser, error) {
+	ret := m.ctrl.Call(m, "ContainerLogs", arg0, arg1, arg2)
+	ret0, _ := ret[0].(io.ReadCloser)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ContainerLogs indicates an expected call of ContainerLogs
+func (mr *MockDockerMockRecorder) ContainerLogs(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ContainerLogs", reflect.TypeOf((*MockDocker)(nil).ContainerLogs), arg0, arg1, arg2)
+}
+
 // ContainerRemove mocks base method
 func (m *MockDocker) ContainerRemove(arg0 context.Context, arg1 string, arg2 types.ContainerRemoveOptions) error {
 	ret := m.ctrl.Call(m, "ContainerRemove", arg0, arg1, arg2)
@@ -62,6 +88,18 @@ func (mr *MockDockerMockRecorder) ContainerRemove(arg0, arg1, arg2 interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ContainerRemove", reflect.TypeOf((*MockDocker)(nil).ContainerRemove), arg0, arg1, arg2)
 }
 
+// ContainerStart mocks base method
+func (m *MockDocker) ContainerStart(arg0 context.Context, arg1 string, arg2 types.ContainerStartOptions) error {
+	ret := m.ctrl.Call(m, "ContainerStart", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ContainerStart indicates an expected call of ContainerStart
+func (mr *MockDockerMockRecorder) ContainerStart(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ContainerStart", reflect.TypeOf((*MockDocker)(nil).ContainerStart), arg0, arg1, arg2)
+}
+
 // CopyFromContainer mocks base method
 func (m *MockDocker) CopyFromContainer(arg0 context.Context, arg1, arg2 string) (io.ReadCloser, types.ContainerPathStat, error) {
 	ret := m.ctrl.Call(m, "CopyFromContainer", arg0, arg1, arg2)
@@ -71,6 +71,32 @@ func (mr *MockFSMockRecorder) CreateTarReader(arg0, arg1, arg2, arg3 interface{}
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateTarReader", reflect.TypeOf((*MockFS)(nil).CreateTarReader), arg0, arg1, arg2, arg3)
 }
 
+// CreateTarReaderExcluding mocks base method
+func (m *MockFS) CreateTarReaderExcluding(arg0, arg1 string, arg2, arg3 int, arg4 []string) (io.Reader, chan error) {
+	ret := m.ctrl.Call(m, "CreateTarReaderExcluding", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(io.Reader)
+	ret1, _ := ret[1].(chan error)
+	return ret0, ret1
+}
+
+// CreateTarReaderExcluding indicates an expected call of CreateTarReaderExcluding
+func (mr *MockFSMockRecorder) CreateTarReaderExcluding(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateTarReaderExcluding", reflect.TypeOf((*MockFS)(nil).CreateTarReaderExcluding), arg0, arg1, arg2, arg3, arg4)
+}
+
+// CreateTarReaderWithDirs mocks base method
+func (m *MockFS) CreateTarReaderWithDirs(arg0, arg1 string, arg2, arg3 int, arg4 []string) (io.Reader, chan error) {
+	ret := m.ctrl.Call(m, "CreateTarReaderWithDirs", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(io.Reader)
+	ret1, _ := ret[1].(chan error)
+	return ret0, ret1
+}
+
+// CreateTarReaderWithDirs indicates an expected call of CreateTarReaderWithDirs
+func (mr *MockFSMockRecorder) CreateTarReaderWithDirs(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateTarReaderWithDirs", reflect.TypeOf((*MockFS)(nil).CreateTarReaderWithDirs), arg0, arg1, arg2, arg3, arg4)
+}
+
 // Untar mocks base method
 func (m *MockFS) Untar(arg0 io.Reader, arg1 string) error {
 	ret := m.ctrl.Call(m, "Untar", arg0, arg1)
@@ -82,3 +108,15 @@ func (m *MockFS) Untar(arg0 io.Reader, arg1 string) error {
 func (mr *MockFSMockRecorder) Untar(arg0, arg1 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Untar", reflect.TypeOf((*MockFS)(nil).Untar), arg0, arg1)
 }
+
+// Unzip mocks base method
+func (m *MockFS) Unzip(arg0 io.ReaderAt, arg1 int64, arg2 string) error {
+	ret := m.ctrl.Call(m, "Unzip", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Unzip indicates an expected call of Unzip
+func (mr *MockFSMockRecorder) Unzip(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unzip", reflect.TypeOf((*MockFS)(nil).Unzip), arg0, arg1, arg2)
+}
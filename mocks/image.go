@@ -45,6 +45,18 @@ func (mr *MockImageMockRecorder) AddLayer(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddLayer", reflect.TypeOf((*MockImage)(nil).AddLayer), arg0)
 }
 
+// AddLayerWithDiffID mocks base method
+func (m *MockImage) AddLayerWithDiffID(arg0, arg1 string) error {
+	ret := m.ctrl.Call(m, "AddLayerWithDiffID", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddLayerWithDiffID indicates an expected call of AddLayerWithDiffID
+func (mr *MockImageMockRecorder) AddLayerWithDiffID(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddLayerWithDiffID", reflect.TypeOf((*MockImage)(nil).AddLayerWithDiffID), arg0, arg1)
+}
+
 // Digest mocks base method
 func (m *MockImage) Digest() (string, error) {
 	ret := m.ctrl.Call(m, "Digest")
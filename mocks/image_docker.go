@@ -0,0 +1,114 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: github.com/buildpack/pack/image (interfaces: Docker)
+
+// Package mocks is a generated GoMock package.
+package mocks
+
+import (
+	context "context"
+	types "github.com/docker/docker/api/types"
+	gomock "github.com/golang/mock/gomock"
+	io "io"
+	reflect "reflect"
+)
+
+// MockImageDocker is a mock of Docker interface
+type MockImageDocker struct {
+	ctrl     *gomock.Controller
+	recorder *MockImageDockerMockRecorder
+}
+
+// MockImageDockerMockRecorder is the mock recorder for MockImageDocker
+type MockImageDockerMockRecorder struct {
+	mock *MockImageDocker
+}
+
+// NewMockImageDocker creates a new mock instance
+func NewMockImageDocker(ctrl *gomock.Controller) *MockImageDocker {
+	mock := &MockImageDocker{ctrl: ctrl}
+	mock.recorder = &MockImageDockerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockImageDocker) EXPECT() *MockImageDockerMockRecorder {
+	return m.recorder
+}
+
+// ImageBuild mocks base method
+func (m *MockImageDocker) ImageBuild(arg0 context.Context, arg1 io.Reader, arg2 types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+	ret := m.ctrl.Call(m, "ImageBuild", arg0, arg1, arg2)
+	ret0, _ := ret[0].(types.ImageBuildResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ImageBuild indicates an expected call of ImageBuild
+func (mr *MockImageDockerMockRecorder) ImageBuild(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ImageBuild", reflect.TypeOf((*MockImageDocker)(nil).ImageBuild), arg0, arg1, arg2)
+}
+
+// ImageInspectWithRaw mocks base method
+func (m *MockImageDocker) ImageInspectWithRaw(arg0 context.Context, arg1 string) (types.ImageInspect, []byte, error) {
+	ret := m.ctrl.Call(m, "ImageInspectWithRaw", arg0, arg1)
+	ret0, _ := ret[0].(types.ImageInspect)
+	ret1, _ := ret[1].([]byte)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ImageInspectWithRaw indicates an expected call of ImageInspectWithRaw
+func (mr *MockImageDockerMockRecorder) ImageInspectWithRaw(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ImageInspectWithRaw", reflect.TypeOf((*MockImageDocker)(nil).ImageInspectWithRaw), arg0, arg1)
+}
+
+// ImageLoad mocks base method
+func (m *MockImageDocker) ImageLoad(arg0 context.Context, arg1 io.Reader, arg2 bool) (types.ImageLoadResponse, error) {
+	ret := m.ctrl.Call(m, "ImageLoad", arg0, arg1, arg2)
+	ret0, _ := ret[0].(types.ImageLoadResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ImageLoad indicates an expected call of ImageLoad
+func (mr *MockImageDockerMockRecorder) ImageLoad(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ImageLoad", reflect.TypeOf((*MockImageDocker)(nil).ImageLoad), arg0, arg1, arg2)
+}
+
+// ImageRemove mocks base method
+func (m *MockImageDocker) ImageRemove(arg0 context.Context, arg1 string, arg2 types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error) {
+	ret := m.ctrl.Call(m, "ImageRemove", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]types.ImageDeleteResponseItem)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ImageRemove indicates an expected call of ImageRemove
+func (mr *MockImageDockerMockRecorder) ImageRemove(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ImageRemove", reflect.TypeOf((*MockImageDocker)(nil).ImageRemove), arg0, arg1, arg2)
+}
+
+// ImageSave mocks base method
+func (m *MockImageDocker) ImageSave(arg0 context.Context, arg1 []string) (io.ReadCloser, error) {
+	ret := m.ctrl.Call(m, "ImageSave", arg0, arg1)
+	ret0, _ := ret[0].(io.ReadCloser)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ImageSave indicates an expected call of ImageSave
+func (mr *MockImageDockerMockRecorder) ImageSave(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ImageSave", reflect.TypeOf((*MockImageDocker)(nil).ImageSave), arg0, arg1)
+}
+
+// PullImage mocks base method
+func (m *MockImageDocker) PullImage(arg0 string) error {
+	ret := m.ctrl.Call(m, "PullImage", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PullImage indicates an expected call of PullImage
+func (mr *MockImageDockerMockRecorder) PullImage(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PullImage", reflect.TypeOf((*MockImageDocker)(nil).PullImage), arg0)
+}
@@ -34,7 +34,7 @@ func (m *MockImageFactory) EXPECT() *MockImageFactoryMockRecorder {
 }
 
 // NewLocal mocks base method
-func (m *MockImageFactory) NewLocal(arg0 string, arg1 bool) (image.Image, error) {
+func (m *MockImageFactory) NewLocal(arg0 string, arg1 image.PullPolicy) (image.Image, error) {
 	ret := m.ctrl.Call(m, "NewLocal", arg0, arg1)
 	ret0, _ := ret[0].(image.Image)
 	ret1, _ := ret[1].(error)
@@ -0,0 +1,211 @@
+package pack
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildpack/lifecycle/img"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/pkg/errors"
+
+	"github.com/buildpack/pack/logging"
+)
+
+type PackageFactory struct {
+	Log    *logging.Logger
+	FS     FS
+	Images Images
+}
+
+type PackageBuildpackFlags struct {
+	BuildpackDir string
+	OutputPath   string
+	ImageName    string
+	Publish      bool
+}
+
+type PackageConfig struct {
+	BuildpackDir string
+	ID           string
+	Version      string
+	OutputPath   string
+	ImageName    string
+	Repo         img.Store
+}
+
+// normalizedModTime is set on every packaged file so that packaging the same
+// buildpack twice produces the same archive.
+var normalizedModTime = time.Date(1980, time.January, 1, 0, 0, 1, 0, time.UTC)
+
+func (f *PackageFactory) PackageConfigFromFlags(flags PackageBuildpackFlags) (PackageConfig, error) {
+	dir, err := filepath.Abs(flags.BuildpackDir)
+	if err != nil {
+		return PackageConfig{}, err
+	}
+	data, err := validateBuildpackDir(dir)
+	if err != nil {
+		return PackageConfig{}, err
+	}
+
+	config := PackageConfig{
+		BuildpackDir: dir,
+		ID:           data.BP.ID,
+		Version:      data.BP.Version,
+		OutputPath:   flags.OutputPath,
+		ImageName:    flags.ImageName,
+	}
+	if config.OutputPath == "" {
+		config.OutputPath = fmt.Sprintf("%s-%s.tgz", data.BP.ID, data.BP.Version)
+	}
+	if flags.ImageName != "" {
+		config.Repo, err = f.Images.RepoStore(flags.ImageName, !flags.Publish)
+		if err != nil {
+			return PackageConfig{}, fmt.Errorf(`failed to create repository store for buildpack image "%s": %s`, flags.ImageName, err)
+		}
+	}
+	return config, nil
+}
+
+// validateBuildpackDir reports every problem that would keep the buildpack in
+// dir from being used by a builder.
+func validateBuildpackDir(dir string) (*BuildpackData, error) {
+	if _, err := os.Stat(filepath.Join(dir, "buildpack.toml")); os.IsNotExist(err) {
+		return nil, fmt.Errorf("invalid buildpack %q: missing buildpack.toml", dir)
+	}
+	data, err := readBuildpackData(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	if data.BP.ID == "" {
+		problems = append(problems, "buildpack.toml must provide id")
+	}
+	if data.BP.Version == "" {
+		problems = append(problems, "buildpack.toml must provide version")
+	}
+	if len(data.Stacks) == 0 {
+		problems = append(problems, "buildpack.toml must provide at least one stack")
+	}
+	for _, bin := range []string{"detect", "build"} {
+		if fi, err := os.Stat(filepath.Join(dir, "bin", bin)); err != nil || !fi.Mode().IsRegular() {
+			problems = append(problems, fmt.Sprintf("missing executable bin/%s", bin))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid buildpack %q:\n  %s", dir, strings.Join(problems, "\n  "))
+	}
+	return data, nil
+}
+
+func (f *PackageFactory) Package(config PackageConfig) error {
+	tmpDir, err := ioutil.TempDir("", "package-buildpack")
+	if err != nil {
+		return fmt.Errorf(`failed to create temporary directory: %s`, err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	stageDir := filepath.Join(tmpDir, "buildpack")
+	if err := stageBuildpack(config.BuildpackDir, stageDir); err != nil {
+		return errors.Wrap(err, "normalizing buildpack")
+	}
+
+	if err := f.FS.CreateTGZFile(config.OutputPath, stageDir, ".", 0, 0); err != nil {
+		return errors.Wrapf(err, "writing %s", config.OutputPath)
+	}
+	digest, err := archiveDigest(config.OutputPath)
+	if err != nil {
+		return err
+	}
+	f.Log.Info("Packaged buildpack %s@%s to %s", config.ID, config.Version, config.OutputPath)
+	f.Log.Info("sha256: %s", digest)
+
+	if config.Repo == nil {
+		return nil
+	}
+	layerTar := filepath.Join(tmpDir, "layer.tgz")
+	if err := f.FS.CreateTGZFile(layerTar, stageDir, filepath.Join("/buildpacks", config.ID, config.Version), 0, 0); err != nil {
+		return fmt.Errorf(`failed generate layer for buildpack "%s": %s`, config.ID, err)
+	}
+	bpImage, _, err := img.Append(empty.Image, layerTar)
+	if err != nil {
+		return fmt.Errorf(`failed append buildpack layer to image: %s`, err)
+	}
+	if err := config.Repo.Write(bpImage); err != nil {
+		return err
+	}
+	f.Log.Info("Successfully created buildpack image: %s", config.ImageName)
+	f.Log.Info(`Tip: Use uri = "docker://%s" in builder.toml to add this buildpack to a builder`, config.ImageName)
+	return nil
+}
+
+// stageBuildpack copies a buildpack with fixed modes and modification times:
+// everything in bin/ is executable, other files are read-only for group and others.
+func stageBuildpack(src, dest string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, relPath)
+
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			mode := os.FileMode(0644)
+			if strings.HasPrefix(filepath.ToSlash(relPath), "bin/") {
+				mode = 0755
+			}
+			if err := copyFile(path, target, mode); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported file type %s: %s", fi.Mode(), relPath)
+		}
+		return os.Chtimes(target, normalizedModTime, normalizedModTime)
+	})
+}
+
+func copyFile(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	// the umask may have dropped bits from mode
+	return out.Chmod(mode)
+}
+
+func archiveDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return fileDigest(file)
+}
@@ -0,0 +1,202 @@
+package pack_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/pack"
+	"github.com/buildpack/pack/fs"
+	"github.com/buildpack/pack/logging"
+	"github.com/buildpack/pack/mocks"
+	h "github.com/buildpack/pack/testhelpers"
+)
+
+func TestPackageBuildpack(t *testing.T) {
+	spec.Run(t, "package-buildpack", testPackageBuildpack, spec.Sequential(), spec.Report(report.Terminal{}))
+}
+
+func testPackageBuildpack(t *testing.T, when spec.G, it spec.S) {
+	var (
+		mockController *gomock.Controller
+		mockImages     *mocks.MockImages
+		factory        pack.PackageFactory
+		buf            bytes.Buffer
+		tmpDir         string
+		buildpackDir   string
+	)
+
+	writeFile := func(path, contents string, mode os.FileMode) {
+		path = filepath.Join(buildpackDir, path)
+		h.AssertNil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		h.AssertNil(t, ioutil.WriteFile(path, []byte(contents), mode))
+	}
+
+	readTar := func(r io.Reader) map[string]*tar.Header {
+		headers := map[string]*tar.Header{}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return headers
+			}
+			h.AssertNil(t, err)
+			headers[hdr.Name] = hdr
+		}
+	}
+
+	it.Before(func() {
+		mockController = gomock.NewController(t)
+		mockImages = mocks.NewMockImages(mockController)
+		factory = pack.PackageFactory{
+			FS:     &fs.FS{},
+			Log:    logging.New(&buf, &buf, logging.Options{}),
+			Images: mockImages,
+		}
+
+		var err error
+		tmpDir, err = ioutil.TempDir("", "package-buildpack-test")
+		h.AssertNil(t, err)
+		buildpackDir = filepath.Join(tmpDir, "buildpack")
+
+		writeFile("buildpack.toml", `[buildpack]
+id = "some.bp"
+version = "1.2.3"
+
+[[stacks]]
+id = "some.stack"
+`, 0600)
+		writeFile(filepath.Join("bin", "detect"), "#!/bin/sh\n", 0700)
+		writeFile(filepath.Join("bin", "build"), "#!/bin/sh\n", 0600)
+	})
+
+	it.After(func() {
+		mockController.Finish()
+		os.RemoveAll(tmpDir)
+	})
+
+	when("#PackageConfigFromFlags", func() {
+		it("reads the id and version from buildpack.toml", func() {
+			config, err := factory.PackageConfigFromFlags(pack.PackageBuildpackFlags{BuildpackDir: buildpackDir})
+			h.AssertNil(t, err)
+			h.AssertEq(t, config.ID, "some.bp")
+			h.AssertEq(t, config.Version, "1.2.3")
+			h.AssertEq(t, config.OutputPath, "some.bp-1.2.3.tgz")
+			h.AssertEq(t, config.Repo, nil)
+		})
+
+		it("fails without a buildpack.toml", func() {
+			h.AssertNil(t, os.Remove(filepath.Join(buildpackDir, "buildpack.toml")))
+			_, err := factory.PackageConfigFromFlags(pack.PackageBuildpackFlags{BuildpackDir: buildpackDir})
+			h.AssertError(t, err, fmt.Sprintf(`invalid buildpack %q: missing buildpack.toml`, buildpackDir))
+		})
+
+		it("reports every problem with the buildpack", func() {
+			writeFile("buildpack.toml", `[buildpack]
+id = "some.bp"
+`, 0644)
+			h.AssertNil(t, os.Remove(filepath.Join(buildpackDir, "bin", "build")))
+
+			_, err := factory.PackageConfigFromFlags(pack.PackageBuildpackFlags{BuildpackDir: buildpackDir})
+			h.AssertError(t, err, fmt.Sprintf(`invalid buildpack %q:
+  buildpack.toml must provide version
+  buildpack.toml must provide at least one stack
+  missing executable bin/build`, buildpackDir))
+		})
+
+		it("creates a repo store when an image name is given", func() {
+			mockImageStore := mocks.NewMockStore(mockController)
+			mockImages.EXPECT().RepoStore("some/buildpack", false).Return(mockImageStore, nil)
+
+			config, err := factory.PackageConfigFromFlags(pack.PackageBuildpackFlags{
+				BuildpackDir: buildpackDir,
+				ImageName:    "some/buildpack",
+				Publish:      true,
+			})
+			h.AssertNil(t, err)
+			h.AssertSameInstance(t, config.Repo, mockImageStore)
+		})
+	})
+
+	when("#Package", func() {
+		it("writes a normalized archive and prints its sha256", func() {
+			output := filepath.Join(tmpDir, "bp.tgz")
+			h.AssertNil(t, factory.Package(pack.PackageConfig{
+				BuildpackDir: buildpackDir,
+				ID:           "some.bp",
+				Version:      "1.2.3",
+				OutputPath:   output,
+			}))
+
+			file, err := os.Open(output)
+			h.AssertNil(t, err)
+			defer file.Close()
+			gzr, err := gzip.NewReader(file)
+			h.AssertNil(t, err)
+			headers := readTar(gzr)
+
+			h.AssertEq(t, headers["bin/detect"].Mode, int64(0755))
+			h.AssertEq(t, headers["bin/build"].Mode, int64(0755))
+			h.AssertEq(t, headers["buildpack.toml"].Mode, int64(0644))
+			h.AssertEq(t, headers["buildpack.toml"].Uid, 0)
+			h.AssertEq(t, headers["buildpack.toml"].Gid, 0)
+			h.AssertContains(t, buf.String(), "Packaged buildpack some.bp@1.2.3 to "+output)
+			h.AssertContains(t, buf.String(), "sha256: ")
+		})
+
+		it("produces the same archive every time", func() {
+			digests := []string{}
+			for _, name := range []string{"first.tgz", "second.tgz"} {
+				buf.Reset()
+				h.AssertNil(t, factory.Package(pack.PackageConfig{
+					BuildpackDir: buildpackDir,
+					ID:           "some.bp",
+					Version:      "1.2.3",
+					OutputPath:   filepath.Join(tmpDir, name),
+				}))
+				digests = append(digests, buf.String()[strings.Index(buf.String(), "sha256: "):])
+			}
+			h.AssertEq(t, digests[0], digests[1])
+		})
+
+		it("writes a buildpack image when a repo is given", func() {
+			mockImageStore := mocks.NewMockStore(mockController)
+			var names []string
+			mockImageStore.EXPECT().Write(gomock.Any()).Do(func(i v1.Image) {
+				// layer files only exist until Package returns
+				layers, err := i.Layers()
+				h.AssertNil(t, err)
+				h.AssertEq(t, len(layers), 1)
+				rc, err := layers[0].Uncompressed()
+				h.AssertNil(t, err)
+				defer rc.Close()
+				for name := range readTar(rc) {
+					names = append(names, name)
+				}
+			})
+
+			h.AssertNil(t, factory.Package(pack.PackageConfig{
+				BuildpackDir: buildpackDir,
+				ID:           "some.bp",
+				Version:      "1.2.3",
+				OutputPath:   filepath.Join(tmpDir, "bp.tgz"),
+				ImageName:    "some/buildpack",
+				Repo:         mockImageStore,
+			}))
+			h.AssertContains(t, strings.Join(names, ","), "/buildpacks/some.bp/1.2.3/bin/detect")
+			h.AssertContains(t, buf.String(), `uri = "docker://some/buildpack"`)
+		})
+	})
+}
@@ -0,0 +1,281 @@
+package pack
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/buildpack/pack/config"
+)
+
+// Policy restricts the images and buildpacks pack uses. A rule without entries
+// allows everything. A buildpack is allowed when any of the buildpack rules
+// whose ID matches it allows its version, whatever their order.
+type Policy struct {
+	// Builders are builder image repositories, namespaces or digests (sha256:...)
+	Builders   []string          `toml:"builders"`
+	Buildpacks []PolicyBuildpack `toml:"buildpacks"`
+	// RunImages are run image repositories, namespaces or digests (sha256:...)
+	RunImages []string `toml:"run-images"`
+	// PublishRegistries are the registries that images may be published to
+	PublishRegistries []string `toml:"publish-registries"`
+	Path              string   `toml:"-"`
+}
+
+type PolicyBuildpack struct {
+	// ID may contain wildcards, such as "io.buildpacks.*"
+	ID string `toml:"id"`
+	// Versions are comma separated constraints, such as ">=1.2.0, <2"
+	Versions string `toml:"versions"`
+}
+
+// ReadPolicy reads the policy at policyPath, or when it is empty, policy.toml in
+// packHome. It returns nil when there is no policy.
+func ReadPolicy(packHome, policyPath string) (*Policy, error) {
+	if policyPath == "" {
+		policyPath = filepath.Join(packHome, "policy.toml")
+		if _, err := os.Stat(policyPath); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+
+	policy := &Policy{Path: policyPath}
+	md, err := toml.DecodeFile(policyPath, policy)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to read policy "%s": %s`, policyPath, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf(`invalid policy "%s": unknown key "%s"`, policyPath, undecoded[0])
+	}
+	for i, bp := range policy.Buildpacks {
+		if bp.ID == "" {
+			return nil, fmt.Errorf(`invalid policy "%s": buildpack %d must provide id`, policyPath, i+1)
+		}
+		if _, err := path.Match(bp.ID, ""); err != nil {
+			return nil, fmt.Errorf(`invalid policy "%s": invalid buildpack id "%s": %s`, policyPath, bp.ID, err)
+		}
+		if _, err := versionAllowed("0", bp.Versions); err != nil {
+			return nil, fmt.Errorf(`invalid policy "%s": invalid versions of buildpack "%s": %s`, policyPath, bp.ID, err)
+		}
+	}
+	return policy, nil
+}
+
+// The checks below allow everything when the policy is nil.
+
+// CheckBuilder fails unless the builder is in an allowed repository or
+// namespace, or one of its digests is allowed. digests is only called for digest rules.
+// When digests is nil, the digest rules are not checked, so that an image can be
+// checked by name before it is pulled and again by digest afterwards.
+func (p *Policy) CheckBuilder(builder string, digests func() ([]string, error)) error {
+	if p == nil {
+		return nil
+	}
+	return p.checkImage("builders", "builder", p.Builders, builder, digests)
+}
+
+// CheckRunImage is like CheckBuilder for run images.
+func (p *Policy) CheckRunImage(runImage string, digests func() ([]string, error)) error {
+	if p == nil {
+		return nil
+	}
+	return p.checkImage("run-images", "run image", p.RunImages, runImage, digests)
+}
+
+// CheckBuildpack fails unless a rule allows the ID and version of the
+// buildpack. An empty version only satisfies rules without versions.
+func (p *Policy) CheckBuildpack(id, version string) error {
+	if p == nil || len(p.Buildpacks) == 0 {
+		return nil
+	}
+	var ids, versions []string
+	for _, rule := range p.Buildpacks {
+		if matched, _ := path.Match(rule.ID, id); !matched {
+			ids = append(ids, rule.ID)
+			continue
+		}
+		if rule.Versions == "" {
+			return nil
+		}
+		if allowed, _ := versionAllowed(version, rule.Versions); allowed && version != "" {
+			return nil
+		}
+		versions = append(versions, rule.Versions)
+	}
+	switch {
+	case len(versions) == 0:
+		return p.violation("buildpacks", fmt.Sprintf(`buildpack "%s"`, id), ids)
+	case version == "":
+		return p.violation("buildpacks", fmt.Sprintf(`buildpack "%s" of unknown version`, id), versions)
+	default:
+		return p.violation("buildpacks", fmt.Sprintf(`version "%s" of buildpack "%s"`, version, id), versions)
+	}
+}
+
+// CheckPublish fails unless the registry of repoName is allowed.
+func (p *Policy) CheckPublish(repoName string) error {
+	if p == nil || len(p.PublishRegistries) == 0 {
+		return nil
+	}
+	registry, err := config.Registry(repoName)
+	if err != nil {
+		return err
+	}
+	for _, allowed := range p.PublishRegistries {
+		if registry == allowed {
+			return nil
+		}
+	}
+	return p.violation("publish-registries", fmt.Sprintf(`publishing "%s" to registry "%s"`, repoName, registry), p.PublishRegistries)
+}
+
+func (p *Policy) hasBuildpackRules() bool {
+	return p != nil && len(p.Buildpacks) > 0
+}
+
+func (p *Policy) checkImage(rule, kind string, allowed []string, image string, digests func() ([]string, error)) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	fullName := image
+	if ref, err := name.ParseReference(image, name.WeakValidation); err == nil {
+		fullName = ref.Name()
+	}
+	var allowedDigests []string
+	for _, entry := range allowed {
+		if strings.Contains(entry, "sha256:") {
+			allowedDigests = append(allowedDigests, entry)
+		} else if imageMatches(image, entry) || imageMatches(fullName, entry) || imageMatches(fullName, fullPrefix(entry)) {
+			return nil
+		}
+	}
+	if len(allowedDigests) > 0 && digests == nil {
+		return nil
+	}
+	if len(allowedDigests) > 0 {
+		imageDigests, err := digests()
+		if err != nil {
+			return fmt.Errorf(`failed to read digest of %s "%s" to check policy "%s": %s`, kind, image, p.Path, err)
+		}
+		for _, digest := range imageDigests {
+			for _, entry := range allowedDigests {
+				if digest == entry || strings.HasSuffix(digest, "@"+entry) {
+					return nil
+				}
+			}
+		}
+	}
+	return p.violation(rule, fmt.Sprintf(`%s "%s"`, kind, image), allowed)
+}
+
+// imageMatches tells whether the image name is the repository named by entry,
+// optionally with a tag or digest, or is in the namespace named by entry. A
+// namespace ends at a slash, so that "gcr.io/acme" doesn't match
+// "gcr.io/acme-evil/bp".
+func imageMatches(image, entry string) bool {
+	if strings.HasSuffix(entry, "/") {
+		return strings.HasPrefix(image, entry)
+	}
+	if image == entry {
+		return true
+	}
+	for _, sep := range []string{":", "@", "/"} {
+		if strings.HasPrefix(image, entry+sep) {
+			return true
+		}
+	}
+	return false
+}
+
+// fullPrefix adds the default registry to a prefix naming a repository, or a
+// namespace when it ends with a slash, such as "packs/" for "index.docker.io/packs/".
+func fullPrefix(prefix string) string {
+	repo, err := name.NewRepository(strings.TrimSuffix(prefix, "/"), name.WeakValidation)
+	if err != nil {
+		return prefix
+	}
+	if strings.HasSuffix(prefix, "/") {
+		return repo.Name() + "/"
+	}
+	return repo.Name()
+}
+
+func (p *Policy) violation(rule, subject string, allowed []string) error {
+	return fmt.Errorf(`policy "%s": %s is not allowed by rule "%s" (allowed: %s)`, p.Path, subject, rule, strings.Join(allowed, ", "))
+}
+
+// versionAllowed tells whether version satisfies every comma separated
+// constraint. A constraint is a version optionally preceded by =, !=, <, <=, >
+// or >=.
+func versionAllowed(version, constraints string) (bool, error) {
+	for _, constraint := range strings.Split(constraints, ",") {
+		constraint = strings.TrimSpace(constraint)
+		if constraint == "" {
+			continue
+		}
+		op := strings.TrimRight(constraint, "0123456789.-+abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ ")
+		bound := strings.TrimSpace(strings.TrimPrefix(constraint, op))
+		if bound == "" {
+			return false, fmt.Errorf(`constraint "%s" has no version`, constraint)
+		}
+		cmp := compareVersions(version, bound)
+		var ok bool
+		switch op {
+		case "", "=":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		default:
+			return false, fmt.Errorf(`constraint "%s" has unknown operator "%s"`, constraint, op)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// compareVersions compares dot separated versions segment by segment, as
+// numbers where both segments are numbers. Missing segments count as 0.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xErr := strconv.Atoi(x)
+		yn, yErr := strconv.Atoi(y)
+		switch {
+		case xErr == nil && yErr == nil && xn != yn:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case (xErr != nil || yErr != nil) && x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
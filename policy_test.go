@@ -0,0 +1,192 @@
+package pack_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/pack"
+	h "github.com/buildpack/pack/testhelpers"
+)
+
+func TestPolicy(t *testing.T) {
+	spec.Run(t, "policy", testPolicy, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+func testPolicy(t *testing.T, when spec.G, it spec.S) {
+	var (
+		tmpDir     string
+		policyPath string
+	)
+
+	writePolicy := func(contents string) {
+		h.AssertNil(t, ioutil.WriteFile(policyPath, []byte(contents), 0666))
+	}
+
+	noDigests := func() ([]string, error) {
+		return nil, errors.New("digests should not be read")
+	}
+
+	it.Before(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "policy-test")
+		h.AssertNil(t, err)
+		policyPath = filepath.Join(tmpDir, "policy.toml")
+	})
+
+	it.After(func() {
+		h.AssertNil(t, os.RemoveAll(tmpDir))
+	})
+
+	when("#ReadPolicy", func() {
+		it("reads policy.toml in pack home", func() {
+			writePolicy(`builders = ["registry.example.com/builders/"]`)
+
+			policy, err := pack.ReadPolicy(tmpDir, "")
+			h.AssertNil(t, err)
+			h.AssertEq(t, policy.Path, policyPath)
+			h.AssertEq(t, policy.Builders, []string{"registry.example.com/builders/"})
+		})
+
+		it("returns no policy when there is none", func() {
+			policy, err := pack.ReadPolicy(tmpDir, "")
+			h.AssertNil(t, err)
+			h.AssertEq(t, policy == nil, true)
+		})
+
+		it("fails when the given policy is missing", func() {
+			_, err := pack.ReadPolicy(tmpDir, filepath.Join(tmpDir, "missing.toml"))
+			h.AssertNotNil(t, err)
+		})
+
+		it("rejects unknown keys and invalid versions", func() {
+			writePolicy(`builder = ["some/builder"]`)
+			_, err := pack.ReadPolicy(tmpDir, "")
+			h.AssertError(t, err, `invalid policy "`+policyPath+`": unknown key "builder"`)
+
+			writePolicy(`[[buildpacks]]
+id = "some.bp"
+versions = "~>1.0"
+`)
+			_, err = pack.ReadPolicy(tmpDir, "")
+			h.AssertError(t, err, `invalid policy "`+policyPath+`": invalid versions of buildpack "some.bp": constraint "~>1.0" has unknown operator "~>"`)
+		})
+	})
+
+	when("the policy has rules", func() {
+		var policy *pack.Policy
+
+		it.Before(func() {
+			writePolicy(`
+builders = ["registry.example.com/builders/", "packs/samples", "sha256:abc123"]
+run-images = ["registry.example.com/run/"]
+publish-registries = ["registry.example.com"]
+
+[[buildpacks]]
+  id = "io.buildpacks.nodejs"
+  versions = ">=1.2.0, <2"
+
+[[buildpacks]]
+  id = "com.example.*"
+`)
+			var err error
+			policy, err = pack.ReadPolicy(tmpDir, "")
+			h.AssertNil(t, err)
+		})
+
+		it("allows builders by prefix or digest", func() {
+			h.AssertNil(t, policy.CheckBuilder("registry.example.com/builders/node:v1", noDigests))
+			h.AssertNil(t, policy.CheckBuilder("index.docker.io/packs/samples", noDigests))
+			h.AssertNil(t, policy.CheckBuilder("other/builder", func() ([]string, error) {
+				return []string{"other/builder@sha256:abc123"}, nil
+			}))
+
+			err := policy.CheckBuilder("other/builder", func() ([]string, error) {
+				return []string{"other/builder@sha256:def456"}, nil
+			})
+			h.AssertError(t, err, `policy "`+policyPath+`": builder "other/builder" is not allowed by rule "builders" (allowed: registry.example.com/builders/, packs/samples, sha256:abc123)`)
+		})
+
+		it("doesn't allow images whose names only start like an allowed name", func() {
+			otherDigest := func() ([]string, error) { return []string{"sha256:def456"}, nil }
+			h.AssertError(t, policy.CheckBuilder("packs/samples-malicious", otherDigest), `policy "`+policyPath+`": builder "packs/samples-malicious" is not allowed by rule "builders" (allowed: registry.example.com/builders/, packs/samples, sha256:abc123)`)
+			h.AssertError(t, policy.CheckBuilder("registry.example.com/builders-evil/node", otherDigest), `policy "`+policyPath+`": builder "registry.example.com/builders-evil/node" is not allowed by rule "builders" (allowed: registry.example.com/builders/, packs/samples, sha256:abc123)`)
+			h.AssertNil(t, policy.CheckBuilder("packs/samples:v1", noDigests))
+			h.AssertNil(t, policy.CheckBuilder("packs/samples@sha256:abc", noDigests))
+		})
+
+		it("allows run images by prefix", func() {
+			h.AssertNil(t, policy.CheckRunImage("registry.example.com/run/bionic", noDigests))
+			h.AssertError(t, policy.CheckRunImage("packs/run", noDigests), `policy "`+policyPath+`": run image "packs/run" is not allowed by rule "run-images" (allowed: registry.example.com/run/)`)
+		})
+
+		it("allows buildpacks by id and version range", func() {
+			h.AssertNil(t, policy.CheckBuildpack("io.buildpacks.nodejs", "1.2.0"))
+			h.AssertNil(t, policy.CheckBuildpack("io.buildpacks.nodejs", "1.10.3"))
+			h.AssertNil(t, policy.CheckBuildpack("com.example.java", ""))
+
+			h.AssertError(t, policy.CheckBuildpack("io.buildpacks.nodejs", "2.0.0"), `policy "`+policyPath+`": version "2.0.0" of buildpack "io.buildpacks.nodejs" is not allowed by rule "buildpacks" (allowed: >=1.2.0, <2)`)
+			h.AssertError(t, policy.CheckBuildpack("io.buildpacks.nodejs", ""), `policy "`+policyPath+`": buildpack "io.buildpacks.nodejs" of unknown version is not allowed by rule "buildpacks" (allowed: >=1.2.0, <2)`)
+			h.AssertError(t, policy.CheckBuildpack("io.buildpacks.ruby", "1.0.0"), `policy "`+policyPath+`": buildpack "io.buildpacks.ruby" is not allowed by rule "buildpacks" (allowed: io.buildpacks.nodejs, com.example.*)`)
+		})
+
+		it("defers the digest rules when there are no digests yet", func() {
+			h.AssertNil(t, policy.CheckBuilder("other/builder", nil))
+
+			writePolicy(`builders = ["registry.example.com/builders/"]`)
+			policy, err := pack.ReadPolicy(tmpDir, "")
+			h.AssertNil(t, err)
+			h.AssertError(t, policy.CheckBuilder("other/builder", nil), `policy "`+policyPath+`": builder "other/builder" is not allowed by rule "builders" (allowed: registry.example.com/builders/)`)
+		})
+
+		it("allows publishing to registries", func() {
+			h.AssertNil(t, policy.CheckPublish("registry.example.com/my/app"))
+			h.AssertError(t, policy.CheckPublish("my/app"), `policy "`+policyPath+`": publishing "my/app" to registry "index.docker.io" is not allowed by rule "publish-registries" (allowed: registry.example.com)`)
+		})
+	})
+
+	when("several buildpack rules match", func() {
+		var policy *pack.Policy
+
+		it.Before(func() {
+			writePolicy(`
+[[buildpacks]]
+  id = "io.buildpacks.*"
+  versions = "<2"
+
+[[buildpacks]]
+  id = "io.buildpacks.nodejs"
+  versions = ">=2, <3"
+`)
+			var err error
+			policy, err = pack.ReadPolicy(tmpDir, "")
+			h.AssertNil(t, err)
+		})
+
+		it("allows the versions that any of them allows", func() {
+			h.AssertNil(t, policy.CheckBuildpack("io.buildpacks.nodejs", "1.0.0"))
+			h.AssertNil(t, policy.CheckBuildpack("io.buildpacks.nodejs", "2.1.0"))
+			h.AssertError(t, policy.CheckBuildpack("io.buildpacks.ruby", "2.1.0"), `policy "`+policyPath+`": version "2.1.0" of buildpack "io.buildpacks.ruby" is not allowed by rule "buildpacks" (allowed: <2)`)
+		})
+
+		it("lists the versions of all of them", func() {
+			h.AssertError(t, policy.CheckBuildpack("io.buildpacks.nodejs", "3.0.0"), `policy "`+policyPath+`": version "3.0.0" of buildpack "io.buildpacks.nodejs" is not allowed by rule "buildpacks" (allowed: <2, >=2, <3)`)
+			h.AssertError(t, policy.CheckBuildpack("io.buildpacks.nodejs", ""), `policy "`+policyPath+`": buildpack "io.buildpacks.nodejs" of unknown version is not allowed by rule "buildpacks" (allowed: <2, >=2, <3)`)
+		})
+	})
+
+	when("there is no policy", func() {
+		it("allows everything", func() {
+			var policy *pack.Policy
+			h.AssertNil(t, policy.CheckBuilder("some/builder", noDigests))
+			h.AssertNil(t, policy.CheckRunImage("some/run", noDigests))
+			h.AssertNil(t, policy.CheckBuildpack("some.bp", "1.0.0"))
+			h.AssertNil(t, policy.CheckPublish("some/app"))
+		})
+	})
+}
@@ -0,0 +1,84 @@
+package pack
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+// projectDescriptorNames are the files looked up in the app directory when no
+// descriptor is given, in order of preference.
+var projectDescriptorNames = []string{"project.toml", "pack.toml"}
+
+// ProjectDescriptor holds the build settings an app keeps next to its source.
+// Flags given to `pack build` take precedence over it.
+type ProjectDescriptor struct {
+	Builder    string                       `toml:"builder"`
+	RunImage   string                       `toml:"run-image"`
+	Buildpacks []ProjectDescriptorBuildpack `toml:"buildpacks"`
+	Env        map[string]string            `toml:"env"`
+	Exclude    []string                     `toml:"exclude"`
+}
+
+type ProjectDescriptorBuildpack struct {
+	ID      string `toml:"id"`
+	Version string `toml:"version"`
+	URI     string `toml:"uri"`
+}
+
+// ReadProjectDescriptor reads the descriptor at path, or when path is empty,
+// the first of project.toml and pack.toml found in appDir. It returns an empty
+// descriptor and no path when there is none.
+func ReadProjectDescriptor(appDir, path string) (*ProjectDescriptor, string, error) {
+	if path == "" {
+		for _, name := range projectDescriptorNames {
+			candidate := filepath.Join(appDir, name)
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+		if path == "" {
+			return &ProjectDescriptor{}, "", nil
+		}
+	}
+
+	descriptor := &ProjectDescriptor{}
+	md, err := toml.DecodeFile(path, descriptor)
+	if err != nil {
+		return nil, "", fmt.Errorf(`failed to read project descriptor "%s": %s`, path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, "", fmt.Errorf(`invalid project descriptor "%s": unknown key "%s"`, path, undecoded[0])
+	}
+	for i, bp := range descriptor.Buildpacks {
+		if bp.ID == "" && bp.URI == "" {
+			return nil, "", fmt.Errorf(`invalid project descriptor "%s": buildpack %d must provide id or uri`, path, i+1)
+		}
+	}
+	return descriptor, path, nil
+}
+
+// buildpackRefs returns the buildpacks in the form taken by --buildpack, with
+// relative paths resolved against dir.
+func (d *ProjectDescriptor) buildpackRefs(dir string) []string {
+	var refs []string
+	for _, bp := range d.Buildpacks {
+		switch {
+		case bp.URI != "":
+			uri := bp.URI
+			if u, err := url.Parse(uri); err == nil && u.Scheme == "" && !filepath.IsAbs(uri) {
+				uri = filepath.Join(dir, uri)
+			}
+			refs = append(refs, uri)
+		case bp.Version != "":
+			refs = append(refs, bp.ID+"@"+bp.Version)
+		default:
+			refs = append(refs, bp.ID)
+		}
+	}
+	return refs
+}
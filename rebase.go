@@ -3,11 +3,11 @@ package pack
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 
 	"github.com/buildpack/lifecycle"
 	"github.com/buildpack/pack/config"
 	"github.com/buildpack/pack/image"
+	"github.com/buildpack/pack/logging"
 	"github.com/google/go-containerregistry/pkg/v1"
 )
 
@@ -21,29 +21,47 @@ type WritableStore interface {
 }
 
 type RebaseFactory struct {
-	Log          *log.Logger
+	Log          *logging.Logger
 	Config       *config.Config
 	ImageFactory ImageFactory
 }
 
 type RebaseFlags struct {
-	RepoName string
-	Publish  bool
-	NoPull   bool
+	RepoName   string
+	Publish    bool
+	PullPolicy string
+	Policy     string
 }
 
 type ImageFactory interface {
-	NewLocal(string, bool) (image.Image, error)
+	NewLocal(string, image.PullPolicy) (image.Image, error)
 	NewRemote(string) (image.Image, error)
 }
 
 func (f *RebaseFactory) RebaseConfigFromFlags(flags RebaseFlags) (RebaseConfig, error) {
+	pullPolicy, err := image.ParsePullPolicy(flags.PullPolicy)
+	if err != nil {
+		return RebaseConfig{}, err
+	}
+	policy, err := ReadPolicy(f.Config.Path(), flags.Policy)
+	if err != nil {
+		return RebaseConfig{}, err
+	}
+	if policy != nil {
+		f.Log.Info("Using policy '%s'", policy.Path)
+	}
+	if flags.Publish {
+		if err := policy.CheckPublish(flags.RepoName); err != nil {
+			return RebaseConfig{}, err
+		}
+	}
+
 	var newImage func(string) (image.Image, error)
 	if flags.Publish {
 		newImage = f.ImageFactory.NewRemote
 	} else {
 		newImage = func(name string) (image.Image, error) {
-			return f.ImageFactory.NewLocal(name, !flags.NoPull)
+			return f.ImageFactory.NewLocal(name, pullPolicy)
 		}
 	}
 
@@ -62,10 +80,20 @@ func (f *RebaseFactory) RebaseConfigFromFlags(flags RebaseFlags) (RebaseConfig,
 		return RebaseConfig{}, err
 	}
 
+	if err := policy.CheckRunImage(baseImageName, nil); err != nil {
+		return RebaseConfig{}, err
+	}
 	baseImage, err := newImage(baseImageName)
 	if err != nil {
 		return RebaseConfig{}, err
 	}
+	err = policy.CheckRunImage(baseImageName, func() ([]string, error) {
+		digest, err := baseImage.Digest()
+		return []string{digest}, err
+	})
+	if err != nil {
+		return RebaseConfig{}, err
+	}
 	return RebaseConfig{
 		Image:        image,
 		NewBaseImage: baseImage,
@@ -102,7 +130,7 @@ func (f *RebaseFactory) Rebase(cfg RebaseConfig) error {
 	if err != nil {
 		return err
 	}
-	f.Log.Printf("Successfully replaced %s with %s\n", cfg.Image.Name(), digest)
+	f.Log.Info("Successfully replaced %s with %s", cfg.Image.Name(), digest)
 	return nil
 }
 
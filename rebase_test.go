@@ -3,12 +3,16 @@ package pack_test
 import (
 	"bytes"
 	"encoding/json"
-	"log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/buildpack/lifecycle"
 	"github.com/buildpack/pack"
 	"github.com/buildpack/pack/config"
+	"github.com/buildpack/pack/image"
+	"github.com/buildpack/pack/logging"
 	"github.com/buildpack/pack/mocks"
 	h "github.com/buildpack/pack/testhelpers"
 	"github.com/golang/mock/gomock"
@@ -37,7 +41,7 @@ func testRebase(t *testing.T, when spec.G, it spec.S) {
 			mockImageFactory = mocks.NewMockImageFactory(mockController)
 
 			factory = pack.RebaseFactory{
-				Log: log.New(&buf, "", log.LstdFlags),
+				Log: logging.New(&buf, &buf, logging.Options{}),
 				Config: &config.Config{
 					DefaultStackID: "some.default.stack",
 					Stacks: []config.Stack{
@@ -63,18 +67,17 @@ func testRebase(t *testing.T, when spec.G, it spec.S) {
 
 		when("#RebaseConfigFromFlags", func() {
 			when("publish is false", func() {
-				when("no-pull is false", func() {
+				when("pull policy is not set", func() {
 					it("XXXX", func() {
 						mockBaseImage := mocks.NewMockImage(mockController)
 						mockImage := mocks.NewMockImage(mockController)
-						mockImageFactory.EXPECT().NewLocal("default/run", true).Return(mockBaseImage, nil)
-						mockImageFactory.EXPECT().NewLocal("myorg/myrepo", true).Return(mockImage, nil)
+						mockImageFactory.EXPECT().NewLocal("default/run", image.PullAlways).Return(mockBaseImage, nil)
+						mockImageFactory.EXPECT().NewLocal("myorg/myrepo", image.PullAlways).Return(mockImage, nil)
 						mockImage.EXPECT().Label("io.buildpacks.stack.id").Return("some.default.stack", nil)
 
 						cfg, err := factory.RebaseConfigFromFlags(pack.RebaseFlags{
 							RepoName: "myorg/myrepo",
 							Publish:  false,
-							NoPull:   false,
 						})
 						h.AssertNil(t, err)
 
@@ -83,18 +86,18 @@ func testRebase(t *testing.T, when spec.G, it spec.S) {
 					})
 				})
 
-				when("no-pull is true", func() {
+				when("pull policy is never", func() {
 					it("XXXX", func() {
 						mockBaseImage := mocks.NewMockImage(mockController)
 						mockImage := mocks.NewMockImage(mockController)
-						mockImageFactory.EXPECT().NewLocal("default/run", false).Return(mockBaseImage, nil)
-						mockImageFactory.EXPECT().NewLocal("myorg/myrepo", false).Return(mockImage, nil)
+						mockImageFactory.EXPECT().NewLocal("default/run", image.PullNever).Return(mockBaseImage, nil)
+						mockImageFactory.EXPECT().NewLocal("myorg/myrepo", image.PullNever).Return(mockImage, nil)
 						mockImage.EXPECT().Label("io.buildpacks.stack.id").Return("some.default.stack", nil)
 
 						cfg, err := factory.RebaseConfigFromFlags(pack.RebaseFlags{
-							RepoName: "myorg/myrepo",
-							Publish:  false,
-							NoPull:   true,
+							RepoName:   "myorg/myrepo",
+							Publish:    false,
+							PullPolicy: "never",
 						})
 						h.AssertNil(t, err)
 
@@ -104,8 +107,34 @@ func testRebase(t *testing.T, when spec.G, it spec.S) {
 				})
 			})
 
+			it("fails for an invalid pull policy", func() {
+				_, err := factory.RebaseConfigFromFlags(pack.RebaseFlags{
+					RepoName:   "myorg/myrepo",
+					PullPolicy: "sometimes",
+				})
+				h.AssertError(t, err, `invalid pull policy "sometimes", expected one of: always, if-not-present, never`)
+			})
+
+			it("fails for a run image that the policy does not allow without pulling it", func() {
+				tmpDir, err := ioutil.TempDir("", "rebase-policy-test")
+				h.AssertNil(t, err)
+				defer os.RemoveAll(tmpDir)
+				policyPath := filepath.Join(tmpDir, "policy.toml")
+				h.AssertNil(t, ioutil.WriteFile(policyPath, []byte(`run-images = ["registry.example.com/"]`), 0666))
+
+				mockImage := mocks.NewMockImage(mockController)
+				mockImageFactory.EXPECT().NewLocal("myorg/myrepo", image.PullAlways).Return(mockImage, nil)
+				mockImage.EXPECT().Label("io.buildpacks.stack.id").Return("some.default.stack", nil)
+
+				_, err = factory.RebaseConfigFromFlags(pack.RebaseFlags{
+					RepoName: "myorg/myrepo",
+					Policy:   policyPath,
+				})
+				h.AssertError(t, err, `policy "`+policyPath+`": run image "default/run" is not allowed by rule "run-images" (allowed: registry.example.com/)`)
+			})
+
 			when("publish is true", func() {
-				when("no-pull is anything", func() {
+				when("pull policy is anything", func() {
 					it("XXXX", func() {
 						mockBaseImage := mocks.NewMockImage(mockController)
 						mockImage := mocks.NewMockImage(mockController)
@@ -114,9 +143,9 @@ func testRebase(t *testing.T, when spec.G, it spec.S) {
 						mockImage.EXPECT().Label("io.buildpacks.stack.id").Return("some.default.stack", nil)
 
 						cfg, err := factory.RebaseConfigFromFlags(pack.RebaseFlags{
-							RepoName: "myorg/myrepo",
-							Publish:  true,
-							NoPull:   false,
+							RepoName:   "myorg/myrepo",
+							Publish:    true,
+							PullPolicy: "if-not-present",
 						})
 						h.AssertNil(t, err)
 
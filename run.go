@@ -4,53 +4,126 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	dockercli "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 	"github.com/pkg/errors"
+
+	"github.com/buildpack/pack/fs"
+	"github.com/buildpack/pack/logging"
+)
+
+const (
+	watchInterval = 500 * time.Millisecond
+	watchDebounce = time.Second
+	readyInterval = 250 * time.Millisecond
+	dumpLogLines  = 50
 )
 
+var healthClient = &http.Client{Timeout: 2 * time.Second}
+
 type RunFlags struct {
-	BuildFlags BuildFlags
-	Port       string
+	BuildFlags   BuildFlags
+	Port         string
+	Watch        bool
+	Env          []string
+	EnvFile      string
+	Process      string
+	Args         []string
+	Volumes      []string
+	Name         string
+	Detach       bool
+	HealthPath   string
+	ReadyTimeout time.Duration
 }
 
 type RunConfig struct {
 	Port  string
 	Build Task
+	// Env are KEY=VAL pairs set in the app container
+	Env []string
+	// Process is the process type to launch, instead of web
+	Process string
+	// Args replace the start command of the process
+	Args    []string
+	Volumes []string
+	Name    string
+	// Detach leaves the app running in the background
+	Detach bool
+	// HealthPath is requested over HTTP to check that the app is ready,
+	// instead of connecting to every published port
+	HealthPath string
+	// ReadyTimeout is how long to wait for the app to be ready, when set
+	ReadyTimeout time.Duration
+	// PortFree, when set, tells whether a host port can be published. Busy
+	// ports are left for docker to pick.
+	PortFree func(hostIP, hostPort string) bool
+	// Watch, when set, returns a channel that receives when the app changes,
+	// until stop is closed. Run rebuilds and restarts the app on each change.
+	Watch func(stop <-chan struct{}) (<-chan struct{}, error)
 	// All below are from BuildConfig
 	RepoName string
 	Cli      Docker
 	Stdout   io.Writer
 	Stderr   io.Writer
-	Log      *log.Logger
+	Log      *logging.Logger
 }
 
 func (bf *BuildFactory) RunConfigFromFlags(f *RunFlags) (*RunConfig, error) {
+	if f.Watch && f.Detach {
+		return nil, fmt.Errorf("--watch cannot be used with --detach")
+	}
+	if f.Process != "" && len(f.Args) > 0 {
+		return nil, fmt.Errorf("--process cannot be used with arguments, they replace the start command of the process")
+	}
+	env, err := parseRunEnv(f.EnvFile, f.Env)
+	if err != nil {
+		return nil, err
+	}
 	bc, err := bf.BuildConfigFromFlags(&f.BuildFlags)
 	if err != nil {
 		return nil, err
 	}
 	rc := &RunConfig{
-		Build: bc,
-		Port:  f.Port,
+		Build:        bc,
+		Port:         f.Port,
+		Env:          env,
+		Process:      f.Process,
+		Args:         f.Args,
+		Volumes:      f.Volumes,
+		Name:         f.Name,
+		Detach:       f.Detach,
+		HealthPath:   f.HealthPath,
+		ReadyTimeout: f.ReadyTimeout,
+		PortFree:     PortFree,
 		// All below are from BuildConfig
 		RepoName: bc.RepoName,
 		Cli:      bc.Cli,
-		Stdout:   bc.Stdout,
-		Stderr:   bc.Stderr,
+		Stdout:   bc.Log.Stdout(),
+		Stderr:   bc.Log.Stderr(),
 		Log:      bc.Log,
 	}
+	if f.Watch {
+		rc.Watch = func(stop <-chan struct{}) (<-chan struct{}, error) {
+			return fs.Watch(bc.AppDir, bc.Exclude, watchInterval, watchDebounce, stop)
+		}
+	}
 
 	return rc, nil
 }
 
 func Run(appDir, buildImage, runImage, port string, makeStopCh func() <-chan struct{}) error {
-	bf, err := DefaultBuildFactory()
+	bf, err := DefaultBuildFactory(logging.New(os.Stdout, os.Stderr, logging.Options{}), "")
 	if err != nil {
 		return err
 	}
@@ -71,12 +144,22 @@ func Run(appDir, buildImage, runImage, port string, makeStopCh func() <-chan str
 func (r *RunConfig) Run(makeStopCh func() <-chan struct{}) error {
 	ctx := context.Background()
 
+	var changes <-chan struct{}
+	if r.Watch != nil {
+		stopWatching := make(chan struct{})
+		defer close(stopWatching)
+		var err error
+		if changes, err = r.Watch(stopWatching); err != nil {
+			return errors.Wrap(err, "watch app dir")
+		}
+	}
+
 	err := r.Build.Run()
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("*** RUNNING:")
+	r.Log.Info("*** RUNNING:")
 	if r.Port == "" {
 		r.Port, err = r.exposedPorts(ctx, r.RepoName)
 		if err != nil {
@@ -87,17 +170,18 @@ func (r *RunConfig) Run(makeStopCh func() <-chan struct{}) error {
 	if err != nil {
 		return err
 	}
-	ctr, err := r.Cli.ContainerCreate(ctx, &container.Config{
-		Image:        r.RepoName,
-		AttachStdout: true,
-		AttachStderr: true,
-		ExposedPorts: exposedPorts,
-	}, &container.HostConfig{
-		AutoRemove:   true,
-		PortBindings: portBindings,
-	}, nil, "")
+	if changes != nil {
+		return r.runWatching(ctx, exposedPorts, portBindings, changes, makeStopCh())
+	}
+	ctr, err := r.createContainer(ctx, exposedPorts, portBindings)
+	if err != nil {
+		return err
+	}
+	if r.Detach {
+		return r.startDetached(ctx, ctr.ID, portBindings)
+	}
 
-	logContainerListening(r.Log, portBindings)
+	exited := r.startContainer(ctx, ctr.ID)
 	running := true
 	stopCh := makeStopCh()
 	go func() {
@@ -107,13 +191,149 @@ func (r *RunConfig) Run(makeStopCh func() <-chan struct{}) error {
 			Force: true,
 		})
 	}()
-	if err = r.Cli.RunContainer(ctx, ctr.ID, r.Stdout, r.Stderr); err != nil && running {
+	// the output of the container is already shown, so it isn't dumped when it isn't ready
+	if err := r.waitReady(ctx, ctr.ID, portBindings); err != nil && running {
+		r.Cli.ContainerRemove(ctx, ctr.ID, types.ContainerRemoveOptions{
+			Force: true,
+		})
+		<-exited
+		return err
+	}
+	if err = <-exited; err != nil && running {
 		return errors.Wrap(err, "run container")
 	}
 
 	return nil
 }
 
+// runWatching runs the app until stopCh receives, replacing the container
+// after each successful rebuild. A failed rebuild leaves the previous
+// container running.
+func (r *RunConfig) runWatching(ctx context.Context, exposedPorts nat.PortSet, portBindings nat.PortMap, changes, stopCh <-chan struct{}) error {
+	ctr, err := r.createContainer(ctx, exposedPorts, portBindings)
+	if err != nil {
+		return err
+	}
+	exited, stopWaiting := r.startWatched(ctx, ctr.ID, portBindings)
+	r.Log.Info("Watching for changes")
+
+	stopContainer := func() {
+		stopWaiting()
+		if exited == nil {
+			return
+		}
+		r.Cli.ContainerRemove(ctx, ctr.ID, types.ContainerRemoveOptions{
+			Force: true,
+		})
+		<-exited
+		exited = nil
+	}
+
+	for {
+		select {
+		case <-stopCh:
+			stopContainer()
+			return nil
+		case err := <-exited:
+			exited = nil
+			if err != nil {
+				r.Log.Info("Container exited: %s", err)
+			} else {
+				r.Log.Info("Container exited")
+			}
+		case <-changes:
+			r.Log.Info("Detected changes, rebuilding")
+			if err := r.Build.Run(); err != nil {
+				if exited != nil {
+					r.Log.Error("Rebuild failed, keeping the previous container running: %s", err)
+				} else {
+					r.Log.Error("Rebuild failed: %s", err)
+				}
+				continue
+			}
+			stopContainer()
+			if ctr, err = r.createContainer(ctx, exposedPorts, portBindings); err != nil {
+				return err
+			}
+			exited, stopWaiting = r.startWatched(ctx, ctr.ID, portBindings)
+		}
+	}
+}
+
+// startWatched starts the container and reports its readiness in the
+// background, until stopWaiting is called. The app is expected to change, so a
+// container that isn't ready is left running.
+func (r *RunConfig) startWatched(ctx context.Context, id string, portBindings nat.PortMap) (exited <-chan error, stopWaiting func()) {
+	exited = r.startContainer(ctx, id)
+	readyCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := r.waitReady(readyCtx, id, portBindings); err != nil && readyCtx.Err() == nil {
+			r.Log.Warn("Container is not ready: %s", err)
+		}
+	}()
+	return exited, func() {
+		cancel()
+		<-done
+	}
+}
+
+func (r *RunConfig) createContainer(ctx context.Context, exposedPorts nat.PortSet, portBindings nat.PortMap) (container.ContainerCreateCreatedBody, error) {
+	env := r.Env
+	if r.Process != "" {
+		env = append(append([]string{}, env...), "PACK_PROCESS_TYPE="+r.Process)
+	}
+	ctr, err := r.Cli.ContainerCreate(ctx, &container.Config{
+		Image:        r.RepoName,
+		AttachStdout: true,
+		AttachStderr: true,
+		ExposedPorts: exposedPorts,
+		Env:          env,
+		Cmd:          r.Args,
+	}, &container.HostConfig{
+		// detached containers are kept after exiting, so that their logs can be read
+		AutoRemove:   !r.Detach,
+		PortBindings: r.availableBindings(portBindings),
+		Binds:        r.Volumes,
+	}, nil, r.Name)
+	if err != nil {
+		return ctr, errors.Wrap(err, "create container")
+	}
+	return ctr, nil
+}
+
+func (r *RunConfig) startDetached(ctx context.Context, id string, portBindings nat.PortMap) error {
+	if err := r.Cli.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+		r.Cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+		return errors.Wrap(err, "container start")
+	}
+	if err := r.waitReady(ctx, id, portBindings); err != nil {
+		r.dumpLogs(ctx, id)
+		r.Cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+		return err
+	}
+	name := r.Name
+	if name == "" {
+		name = id
+		if len(name) > 12 {
+			name = name[:12]
+		}
+	}
+	r.Log.Info("Started container '%s', use 'pack logs %s' to see its output and 'pack stop %s' to stop it", name, name, name)
+	return nil
+}
+
+// startContainer runs the container in the background. The returned channel
+// receives once the container exits.
+func (r *RunConfig) startContainer(ctx context.Context, id string) <-chan error {
+	exited := make(chan error, 1)
+	go func() {
+		exited <- r.Cli.RunContainer(ctx, id, r.Stdout, r.Stderr)
+	}()
+	return exited
+}
+
 func (r *RunConfig) exposedPorts(ctx context.Context, imageID string) (string, error) {
 	i, _, err := r.Cli.ImageInspectWithRaw(ctx, imageID)
 	if err != nil {
@@ -140,21 +360,245 @@ func parsePorts(port string) (nat.PortSet, nat.PortMap, error) {
 	return nat.ParsePortSpecs(ports)
 }
 
-func logContainerListening(log *log.Logger, portBindings nat.PortMap) {
-	// TODO handle case with multiple ports, for now when there is more than
-	// one port we assume you know what you're doing and don't need guidance
-	if len(portBindings) == 1 {
-		for _, bindings := range portBindings {
-			if len(bindings) == 1 {
-				binding := bindings[0]
-				host := binding.HostIP
-				port := binding.HostPort
-				if host == "127.0.0.1" {
-					host = "localhost"
-				}
-				// TODO the service may not be http based
-				log.Printf("Starting container listening at http://%s:%s/\n", host, port)
+// availableBindings returns a copy of portBindings where busy host ports are
+// left for docker to pick.
+func (r *RunConfig) availableBindings(portBindings nat.PortMap) nat.PortMap {
+	if r.PortFree == nil {
+		return portBindings
+	}
+	available := nat.PortMap{}
+	for port, bindings := range portBindings {
+		for _, binding := range bindings {
+			if binding.HostPort != "" && !r.PortFree(binding.HostIP, binding.HostPort) {
+				r.Log.Warn("Port %s is busy, publishing container port %s on a free port instead", binding.HostPort, port)
+				binding.HostPort = ""
+			}
+			available[port] = append(available[port], binding)
+		}
+	}
+	return available
+}
+
+// PortFree tells whether a port can be listened on at hostIP.
+func PortFree(hostIP, hostPort string) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(hostIP, hostPort))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+type endpoint struct {
+	hostIP        string
+	hostPort      string
+	containerPort nat.Port
+}
+
+func (e endpoint) address() string {
+	host := e.hostIP
+	switch host {
+	case "", "0.0.0.0", "::", "127.0.0.1":
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, e.hostPort)
+}
+
+// waitReady waits up to ReadyTimeout for the container to run with every port
+// in portBindings published, and for every published TCP port to accept
+// connections or, when HealthPath is set, for it to respond with 2xx on the
+// first published port. It then logs the endpoints. Without ReadyTimeout it
+// only logs the requested endpoints.
+func (r *RunConfig) waitReady(ctx context.Context, id string, portBindings nat.PortMap) error {
+	if r.ReadyTimeout == 0 {
+		var endpoints []endpoint
+		for _, port := range sortedPorts(portBindings) {
+			for _, binding := range portBindings[port] {
+				endpoints = append(endpoints, endpoint{binding.HostIP, binding.HostPort, port})
 			}
 		}
+		r.logEndpoints("Starting container listening at", endpoints)
+		return nil
+	}
+
+	timeout := time.After(r.ReadyTimeout)
+	for {
+		endpoints, notReady, err := r.checkReady(ctx, id, portBindings)
+		if err != nil {
+			return err
+		}
+		if notReady == "" {
+			r.logEndpoints("Container is ready, listening at", endpoints)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("container was not ready after %s: %s", r.ReadyTimeout, notReady)
+		case <-time.After(readyInterval):
+		}
+	}
+}
+
+// checkReady returns the endpoints of the container, or why it isn't ready
+// yet. It fails when the container won't become ready.
+func (r *RunConfig) checkReady(ctx context.Context, id string, portBindings nat.PortMap) ([]endpoint, string, error) {
+	ctr, err := r.Cli.ContainerInspect(ctx, id)
+	if dockercli.IsErrNotFound(err) {
+		return nil, "", fmt.Errorf("container exited before it was ready")
+	} else if err != nil {
+		return nil, "", errors.Wrap(err, "inspect container")
+	}
+	if ctr.State == nil || !ctr.State.Running {
+		if ctr.State != nil && (ctr.State.Status == "exited" || ctr.State.Status == "dead") {
+			return nil, "", fmt.Errorf("container exited with status code %d before it was ready", ctr.State.ExitCode)
+		}
+		return nil, "container is not running", nil
+	}
+
+	var endpoints []endpoint
+	for _, port := range sortedPorts(portBindings) {
+		var bindings []nat.PortBinding
+		if ctr.NetworkSettings != nil {
+			bindings = ctr.NetworkSettings.Ports[port]
+		}
+		if len(bindings) == 0 {
+			return nil, fmt.Sprintf("port %s is not published", port), nil
+		}
+		for _, binding := range bindings {
+			endpoints = append(endpoints, endpoint{binding.HostIP, binding.HostPort, port})
+		}
+	}
+
+	if r.HealthPath != "" {
+		if len(endpoints) == 0 {
+			return nil, "", fmt.Errorf("checking health path '%s' requires a published port", r.HealthPath)
+		}
+		url := fmt.Sprintf("http://%s/%s", endpoints[0].address(), strings.TrimPrefix(r.HealthPath, "/"))
+		resp, err := healthClient.Get(url)
+		if err != nil {
+			return nil, fmt.Sprintf("GET %s failed: %s", url, err), nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, fmt.Sprintf("GET %s returned status %d", url, resp.StatusCode), nil
+		}
+		return endpoints, "", nil
+	}
+
+	for _, e := range endpoints {
+		if e.containerPort.Proto() == "tcp" && !acceptsConnections(e.address()) {
+			return nil, fmt.Sprintf("%s does not accept connections", e.address()), nil
+		}
+	}
+	return endpoints, "", nil
+}
+
+// acceptsConnections tells whether a connection to address stays open. The
+// userland proxy of docker accepts connections to published ports even when
+// the app doesn't listen yet, and closes them right away.
+func acceptsConnections(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		netErr, ok := err.(net.Error)
+		return ok && netErr.Timeout()
+	}
+	return true
+}
+
+func (r *RunConfig) logEndpoints(prefix string, endpoints []endpoint) {
+	for _, e := range endpoints {
+		if e.hostPort == "" {
+			continue
+		}
+		r.Log.Info("%s %s (container port %s)", prefix, e.address(), e.containerPort)
+	}
+}
+
+func (r *RunConfig) dumpLogs(ctx context.Context, id string) {
+	logs, err := r.Cli.ContainerLogs(ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(dumpLogLines),
+	})
+	if err != nil {
+		r.Log.Warn("Failed to read the output of the container: %s", err)
+		return
+	}
+	defer logs.Close()
+	r.Log.Info("Last %d lines of output of the container:", dumpLogLines)
+	stdcopy.StdCopy(r.Stdout, r.Stderr, logs)
+}
+
+func sortedPorts(portBindings nat.PortMap) []nat.Port {
+	var ports []nat.Port
+	for port := range portBindings {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i] < ports[j]
+	})
+	return ports
+}
+
+// Logs writes the output of the container to stdout and stderr. With follow it
+// keeps writing until the container exits.
+func Logs(cli Docker, container string, follow bool, stdout, stderr io.Writer) error {
+	logs, err := cli.ContainerLogs(context.Background(), container, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     follow,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "read logs of container '%s'", container)
+	}
+	defer logs.Close()
+	_, err = stdcopy.StdCopy(stdout, stderr, logs)
+	return err
+}
+
+// Stop stops and removes a container, such as one started by run with Detach.
+func Stop(cli Docker, container string) error {
+	if err := cli.ContainerRemove(context.Background(), container, types.ContainerRemoveOptions{Force: true}); err != nil {
+		return errors.Wrapf(err, "stop container '%s'", container)
+	}
+	return nil
+}
+
+// parseRunEnv reads envFile, if any, and then the KEY=VAL pairs of env. A KEY
+// without a value takes it from the environment of pack.
+func parseRunEnv(envFile string, env []string) ([]string, error) {
+	vars := map[string]string{}
+	if envFile != "" {
+		var err error
+		if vars, err = parseEnvFile(envFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, kv := range env {
+		arr := strings.SplitN(kv, "=", 2)
+		if arr[0] == "" {
+			return nil, fmt.Errorf(`invalid run env "%s", expected KEY=VAL`, kv)
+		}
+		if len(arr) > 1 {
+			vars[arr[0]] = arr[1]
+		} else {
+			vars[arr[0]] = os.Getenv(arr[0])
+		}
+	}
+	if len(vars) == 0 {
+		return nil, nil
+	}
+	out := make([]string, 0, len(vars))
+	for k, v := range vars {
+		out = append(out, k+"="+v)
 	}
+	sort.Strings(out)
+	return out, nil
 }
@@ -6,8 +6,12 @@ import (
 	"crypto/md5"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"reflect"
 	"testing"
@@ -17,6 +21,7 @@ import (
 	dockertypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	dockercontainer "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 	"github.com/golang/mock/gomock"
 	"github.com/sclevine/spec"
@@ -25,6 +30,7 @@ import (
 	"github.com/buildpack/pack"
 	"github.com/buildpack/pack/config"
 	"github.com/buildpack/pack/fs"
+	"github.com/buildpack/pack/logging"
 	"github.com/buildpack/pack/mocks"
 	h "github.com/buildpack/pack/testhelpers"
 )
@@ -60,9 +66,7 @@ func testRun(t *testing.T, when spec.G, it spec.S) {
 		it.Before(func() {
 			factory = &pack.BuildFactory{
 				Cli:    mockDocker,
-				Stdout: &buf,
-				Stderr: &buf,
-				Log:    log.New(&buf, "", log.LstdFlags|log.Lshortfile),
+				Log:    logging.New(&buf, &buf, logging.Options{}),
 				FS:     &fs.FS{},
 				Images: mockImages,
 				Config: &config.Config{
@@ -108,11 +112,10 @@ func testRun(t *testing.T, when spec.G, it spec.S) {
 
 			build, ok := run.Build.(*pack.BuildConfig)
 			h.AssertEq(t, ok, true)
+			h.AssertNil(t, build.CheckRunImage())
 			for _, field := range []string{
 				"RepoName",
 				"Cli",
-				"Stdout",
-				"Stderr",
 				"Log",
 			} {
 				h.AssertSameInstance(
@@ -123,6 +126,64 @@ func testRun(t *testing.T, when spec.G, it spec.S) {
 			}
 		})
 
+		it("configures the app container", func() {
+			mockDocker.EXPECT().PullImage(gomock.Any()).AnyTimes()
+			mockDocker.EXPECT().ImageInspectWithRaw(gomock.Any(), gomock.Any()).Return(dockertypes.ImageInspect{
+				Config: &dockercontainer.Config{
+					Labels: map[string]string{"io.buildpacks.stack.id": "some.stack.id"},
+				},
+			}, nil, nil).AnyTimes()
+
+			tmpDir, err := ioutil.TempDir("", "run-env")
+			h.AssertNil(t, err)
+			defer os.RemoveAll(tmpDir)
+			envFile := filepath.Join(tmpDir, "env")
+			h.AssertNil(t, ioutil.WriteFile(envFile, []byte("SOME_VAR=from-file\nOTHER_VAR=other\n"), 0644))
+
+			run, err := factory.RunConfigFromFlags(&pack.RunFlags{
+				BuildFlags: pack.BuildFlags{
+					AppDir:   "acceptance/testdata/node_app",
+					Builder:  "some/builder",
+					RunImage: "some/run",
+				},
+				Env:     []string{"SOME_VAR=from-flag", "EMPTY="},
+				EnvFile: envFile,
+				Process: "worker",
+				Volumes: []string{"some-volume:/data"},
+				Name:    "some-app",
+				Detach:  true,
+			})
+			h.AssertNil(t, err)
+
+			h.AssertEq(t, run.Env, []string{"EMPTY=", "OTHER_VAR=other", "SOME_VAR=from-flag"})
+			h.AssertEq(t, run.Process, "worker")
+			h.AssertEq(t, run.Volumes, []string{"some-volume:/data"})
+			h.AssertEq(t, run.Name, "some-app")
+			h.AssertEq(t, run.Detach, true)
+		})
+
+		it("fails when a process and arguments are both given", func() {
+			_, err := factory.RunConfigFromFlags(&pack.RunFlags{
+				Process: "worker",
+				Args:    []string{"echo", "hi"},
+			})
+			h.AssertError(t, err, "--process cannot be used with arguments, they replace the start command of the process")
+		})
+
+		it("fails when watching a detached app", func() {
+			_, err := factory.RunConfigFromFlags(&pack.RunFlags{
+				Watch:  true,
+				Detach: true,
+			})
+			h.AssertError(t, err, "--watch cannot be used with --detach")
+		})
+
+		it("fails on an invalid run env", func() {
+			_, err := factory.RunConfigFromFlags(&pack.RunFlags{
+				Env: []string{"=value"},
+			})
+			h.AssertError(t, err, `invalid run env "=value", expected KEY=VAL`)
+		})
 	})
 
 	when("#Run", func() {
@@ -144,7 +205,7 @@ func testRun(t *testing.T, when spec.G, it spec.S) {
 				RepoName: "pack.local/run/346ffb210a2c6d138c8d058d6d4025a0",
 				Port:     "1370",
 				Cli:      mockDocker,
-				Log:      log.New(&buf, "", log.LstdFlags|log.Lshortfile),
+				Log:      logging.New(&buf, &buf, logging.Options{}),
 				Stdout:   &buf,
 				Stderr:   &buf,
 			}
@@ -173,7 +234,7 @@ func testRun(t *testing.T, when spec.G, it spec.S) {
 			err := subject.Run(makeStopCh)
 			h.AssertNil(t, err)
 
-			h.AssertContains(t, buf.String(), "Starting container listening at http://localhost:1370/")
+			h.AssertContains(t, buf.String(), "Starting container listening at localhost:1370 (container port 1370/tcp)")
 		})
 
 		when("the build fails", func() {
@@ -293,5 +354,336 @@ func testRun(t *testing.T, when spec.G, it spec.S) {
 				h.AssertNil(t, err)
 			})
 		})
+
+		when("the app container is configured", func() {
+			it("passes the env, process, args, volumes and name to the container", func() {
+				subject.Env = []string{"SOME_VAR=some-value"}
+				subject.Process = "worker"
+				subject.Volumes = []string{"/some/dir:/data:ro"}
+				subject.Name = "some-app"
+				exposedPorts, portBindings, _ := nat.ParsePortSpecs([]string{"127.0.0.1:1370:1370/tcp"})
+
+				mockBuild.EXPECT().Run().Return(nil)
+				mockDocker.EXPECT().ContainerCreate(gomock.Any(), &container.Config{
+					Image:        subject.RepoName,
+					AttachStdout: true,
+					AttachStderr: true,
+					ExposedPorts: exposedPorts,
+					Env:          []string{"SOME_VAR=some-value", "PACK_PROCESS_TYPE=worker"},
+				}, &container.HostConfig{
+					AutoRemove:   true,
+					PortBindings: portBindings,
+					Binds:        []string{"/some/dir:/data:ro"},
+				}, nil, "some-app").Return(ctr, nil)
+				mockDocker.EXPECT().RunContainer(gomock.Any(), ctr.ID, subject.Stdout, subject.Stderr).Return(nil)
+
+				err := subject.Run(makeStopCh)
+				h.AssertNil(t, err)
+				h.AssertEq(t, subject.Env, []string{"SOME_VAR=some-value"})
+			})
+
+			it("passes arguments as the start command", func() {
+				subject.Args = []string{"npm", "test"}
+
+				mockBuild.EXPECT().Run().Return(nil)
+				mockDocker.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, "").DoAndReturn(
+					func(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig interface{}, name string) (container.ContainerCreateCreatedBody, error) {
+						h.AssertEq(t, []string(config.Cmd), []string{"npm", "test"})
+						return ctr, nil
+					})
+				mockDocker.EXPECT().RunContainer(gomock.Any(), ctr.ID, subject.Stdout, subject.Stderr).Return(nil)
+
+				err := subject.Run(makeStopCh)
+				h.AssertNil(t, err)
+			})
+		})
+
+		when("detached", func() {
+			it.Before(func() {
+				subject.Detach = true
+			})
+
+			it("starts the container and keeps it after it exits", func() {
+				mockBuild.EXPECT().Run().Return(nil)
+				mockDocker.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, "").DoAndReturn(
+					func(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig interface{}, name string) (container.ContainerCreateCreatedBody, error) {
+						h.AssertEq(t, hostConfig.AutoRemove, false)
+						return ctr, nil
+					})
+				mockDocker.EXPECT().ContainerStart(gomock.Any(), ctr.ID, gomock.Any()).Return(nil)
+				mockDocker.EXPECT().RunContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+				err := subject.Run(makeStopCh)
+				h.AssertNil(t, err)
+				h.AssertContains(t, buf.String(), "Started container '29aef5a011dd', use 'pack logs 29aef5a011dd'")
+			})
+
+			it("removes the container when it fails to start", func() {
+				mockBuild.EXPECT().Run().Return(nil)
+				mockDocker.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, "").Return(ctr, nil)
+				mockDocker.EXPECT().ContainerStart(gomock.Any(), ctr.ID, gomock.Any()).Return(fmt.Errorf("port is already allocated"))
+				mockDocker.EXPECT().ContainerRemove(gomock.Any(), ctr.ID, types.ContainerRemoveOptions{Force: true}).Return(nil)
+
+				err := subject.Run(makeStopCh)
+				h.AssertError(t, err, "container start: port is already allocated")
+			})
+		})
+
+		when("waiting for the container to be ready", func() {
+			var (
+				listener net.Listener
+				hostPort string
+			)
+
+			it.Before(func() {
+				var err error
+				listener, err = net.Listen("tcp", "127.0.0.1:0")
+				h.AssertNil(t, err)
+				go func() {
+					for {
+						conn, err := listener.Accept()
+						if err != nil {
+							return
+						}
+						go func() {
+							io.Copy(ioutil.Discard, conn)
+							conn.Close()
+						}()
+					}
+				}()
+				_, hostPort, _ = net.SplitHostPort(listener.Addr().String())
+
+				subject.ReadyTimeout = 5 * time.Second
+				subject.Detach = true
+			})
+
+			it.After(func() {
+				listener.Close()
+			})
+
+			inspectResult := func(state types.ContainerState, hostPort string) types.ContainerJSON {
+				return types.ContainerJSON{
+					ContainerJSONBase: &types.ContainerJSONBase{State: &state},
+					NetworkSettings: &types.NetworkSettings{
+						NetworkSettingsBase: types.NetworkSettingsBase{
+							Ports: nat.PortMap{"1370/tcp": {{HostIP: "127.0.0.1", HostPort: hostPort}}},
+						},
+					},
+				}
+			}
+			running := types.ContainerState{Status: "running", Running: true}
+
+			it("waits until the published ports accept connections and logs the bound endpoints", func() {
+				mockBuild.EXPECT().Run().Return(nil)
+				mockDocker.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, "").Return(ctr, nil)
+				mockDocker.EXPECT().ContainerStart(gomock.Any(), ctr.ID, gomock.Any()).Return(nil)
+				gomock.InOrder(
+					mockDocker.EXPECT().ContainerInspect(gomock.Any(), ctr.ID).Return(inspectResult(types.ContainerState{Status: "created"}, ""), nil),
+					mockDocker.EXPECT().ContainerInspect(gomock.Any(), ctr.ID).Return(inspectResult(running, hostPort), nil),
+				)
+
+				err := subject.Run(makeStopCh)
+				h.AssertNil(t, err)
+				h.AssertContains(t, buf.String(), fmt.Sprintf("Container is ready, listening at localhost:%s (container port 1370/tcp)", hostPort))
+			})
+
+			it("waits for the health path to respond with 2xx", func() {
+				var requests []string
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					requests = append(requests, req.URL.Path)
+					if len(requests) == 1 {
+						w.WriteHeader(http.StatusServiceUnavailable)
+					}
+				}))
+				defer server.Close()
+				_, serverPort, _ := net.SplitHostPort(server.Listener.Addr().String())
+				subject.HealthPath = "/health"
+
+				mockBuild.EXPECT().Run().Return(nil)
+				mockDocker.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, "").Return(ctr, nil)
+				mockDocker.EXPECT().ContainerStart(gomock.Any(), ctr.ID, gomock.Any()).Return(nil)
+				mockDocker.EXPECT().ContainerInspect(gomock.Any(), ctr.ID).Return(inspectResult(running, serverPort), nil).Times(2)
+
+				err := subject.Run(makeStopCh)
+				h.AssertNil(t, err)
+				h.AssertEq(t, requests, []string{"/health", "/health"})
+				h.AssertContains(t, buf.String(), fmt.Sprintf("Container is ready, listening at localhost:%s (container port 1370/tcp)", serverPort))
+			})
+
+			it("dumps the recent output and fails when the container exits", func() {
+				var logs bytes.Buffer
+				stdcopy.NewStdWriter(&logs, stdcopy.Stderr).Write([]byte("some app error\n"))
+
+				mockBuild.EXPECT().Run().Return(nil)
+				mockDocker.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, "").Return(ctr, nil)
+				mockDocker.EXPECT().ContainerStart(gomock.Any(), ctr.ID, gomock.Any()).Return(nil)
+				mockDocker.EXPECT().ContainerInspect(gomock.Any(), ctr.ID).Return(inspectResult(types.ContainerState{Status: "exited", ExitCode: 3}, ""), nil)
+				mockDocker.EXPECT().ContainerLogs(gomock.Any(), ctr.ID, types.ContainerLogsOptions{
+					ShowStdout: true,
+					ShowStderr: true,
+					Tail:       "50",
+				}).Return(ioutil.NopCloser(&logs), nil)
+				mockDocker.EXPECT().ContainerRemove(gomock.Any(), ctr.ID, types.ContainerRemoveOptions{Force: true}).Return(nil)
+
+				err := subject.Run(makeStopCh)
+				h.AssertError(t, err, "container exited with status code 3 before it was ready")
+				h.AssertContains(t, buf.String(), "some app error")
+			})
+
+			it("fails when the ports don't accept connections in time", func() {
+				listener.Close()
+				subject.ReadyTimeout = 300 * time.Millisecond
+
+				mockBuild.EXPECT().Run().Return(nil)
+				mockDocker.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, "").Return(ctr, nil)
+				mockDocker.EXPECT().ContainerStart(gomock.Any(), ctr.ID, gomock.Any()).Return(nil)
+				mockDocker.EXPECT().ContainerInspect(gomock.Any(), ctr.ID).Return(inspectResult(running, hostPort), nil).MinTimes(1)
+				mockDocker.EXPECT().ContainerLogs(gomock.Any(), ctr.ID, gomock.Any()).Return(ioutil.NopCloser(&bytes.Buffer{}), nil)
+				mockDocker.EXPECT().ContainerRemove(gomock.Any(), ctr.ID, types.ContainerRemoveOptions{Force: true}).Return(nil)
+
+				err := subject.Run(makeStopCh)
+				h.AssertError(t, err, fmt.Sprintf("container was not ready after 300ms: localhost:%s does not accept connections", hostPort))
+			})
+
+			it("removes a foreground container that exits before it is ready", func() {
+				subject.Detach = false
+				exited := make(chan struct{})
+
+				mockBuild.EXPECT().Run().Return(nil)
+				mockDocker.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, "").Return(ctr, nil)
+				mockDocker.EXPECT().RunContainer(gomock.Any(), ctr.ID, subject.Stdout, subject.Stderr).DoAndReturn(func(ctx context.Context, id string, stdout io.Writer, stderr io.Writer) error {
+					<-exited
+					return nil
+				})
+				mockDocker.EXPECT().ContainerInspect(gomock.Any(), ctr.ID).Return(types.ContainerJSON{}, notFoundError{})
+				mockDocker.EXPECT().ContainerRemove(gomock.Any(), ctr.ID, types.ContainerRemoveOptions{Force: true}).DoAndReturn(func(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
+					close(exited)
+					return nil
+				})
+
+				err := subject.Run(makeStopCh)
+				h.AssertError(t, err, "container exited before it was ready")
+			})
+		})
+
+		when("a requested host port is busy", func() {
+			it("lets docker pick a free port", func() {
+				subject.PortFree = func(hostIP, hostPort string) bool {
+					return hostPort != "1370"
+				}
+				subject.Port = "1370, 8080"
+				exposedPorts, portBindings, _ := nat.ParsePortSpecs([]string{
+					"127.0.0.1::1370/tcp",
+					"127.0.0.1:8080:8080/tcp",
+				})
+
+				mockBuild.EXPECT().Run().Return(nil)
+				mockDocker.EXPECT().ContainerCreate(gomock.Any(), &container.Config{
+					Image:        subject.RepoName,
+					AttachStdout: true,
+					AttachStderr: true,
+					ExposedPorts: exposedPorts,
+				}, &container.HostConfig{
+					AutoRemove:   true,
+					PortBindings: portBindings,
+				}, nil, "").Return(ctr, nil)
+				mockDocker.EXPECT().RunContainer(gomock.Any(), ctr.ID, subject.Stdout, subject.Stderr).Return(nil)
+
+				err := subject.Run(makeStopCh)
+				h.AssertNil(t, err)
+				h.AssertContains(t, buf.String(), "Port 1370 is busy, publishing container port 1370/tcp on a free port instead")
+			})
+		})
+
+		when("watching for changes", func() {
+			var (
+				changes chan struct{}
+				exited  chan struct{}
+				ctr2    container.ContainerCreateCreatedBody
+			)
+
+			it.Before(func() {
+				changes = make(chan struct{})
+				exited = make(chan struct{}, 2)
+				subject.Watch = func(stop <-chan struct{}) (<-chan struct{}, error) {
+					return changes, nil
+				}
+				ctr2 = container.ContainerCreateCreatedBody{ID: "9d1c4d6d7b1a"}
+			})
+
+			runUntilRemoved := func(ctx context.Context, id string, stdout io.Writer, stderr io.Writer) error {
+				<-exited
+				return nil
+			}
+			remove := func(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
+				exited <- struct{}{}
+				return nil
+			}
+
+			it("replaces the container on the same ports after a rebuild", func() {
+				exposedPorts, portBindings, _ := nat.ParsePortSpecs([]string{"127.0.0.1:1370:1370/tcp"})
+				config := &container.Config{
+					Image:        subject.RepoName,
+					AttachStdout: true,
+					AttachStderr: true,
+					ExposedPorts: exposedPorts,
+				}
+				hostConfig := &container.HostConfig{
+					AutoRemove:   true,
+					PortBindings: portBindings,
+				}
+
+				gomock.InOrder(
+					mockBuild.EXPECT().Run().Return(nil),
+					mockDocker.EXPECT().ContainerCreate(gomock.Any(), config, hostConfig, nil, "").Return(ctr, nil),
+					mockBuild.EXPECT().Run().Return(nil),
+					mockDocker.EXPECT().ContainerRemove(gomock.Any(), ctr.ID, types.ContainerRemoveOptions{Force: true}).DoAndReturn(remove),
+					mockDocker.EXPECT().ContainerCreate(gomock.Any(), config, hostConfig, nil, "").Return(ctr2, nil),
+					mockDocker.EXPECT().ContainerRemove(gomock.Any(), ctr2.ID, types.ContainerRemoveOptions{Force: true}).DoAndReturn(remove),
+				)
+				mockDocker.EXPECT().RunContainer(gomock.Any(), ctr.ID, subject.Stdout, subject.Stderr).DoAndReturn(runUntilRemoved)
+				mockDocker.EXPECT().RunContainer(gomock.Any(), ctr2.ID, subject.Stdout, subject.Stderr).DoAndReturn(runUntilRemoved)
+
+				go func() {
+					changes <- struct{}{}
+					// the next change is only received once the rebuild is done
+					changes <- struct{}{}
+				}()
+				mockBuild.EXPECT().Run().DoAndReturn(func() error {
+					stopCh <- struct{}{}
+					return fmt.Errorf("stopping")
+				})
+
+				err := subject.Run(makeStopCh)
+				h.AssertNil(t, err)
+				h.AssertContains(t, buf.String(), "Detected changes, rebuilding")
+			})
+
+			it("keeps the previous container running when the rebuild fails", func() {
+				gomock.InOrder(
+					mockBuild.EXPECT().Run().Return(nil),
+					mockDocker.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, "").Return(ctr, nil),
+					mockBuild.EXPECT().Run().DoAndReturn(func() error {
+						stopCh <- struct{}{}
+						return fmt.Errorf("some build error")
+					}),
+					mockDocker.EXPECT().ContainerRemove(gomock.Any(), ctr.ID, types.ContainerRemoveOptions{Force: true}).DoAndReturn(remove),
+				)
+				mockDocker.EXPECT().RunContainer(gomock.Any(), ctr.ID, subject.Stdout, subject.Stderr).DoAndReturn(runUntilRemoved)
+
+				go func() {
+					changes <- struct{}{}
+				}()
+
+				err := subject.Run(makeStopCh)
+				h.AssertNil(t, err)
+				h.AssertContains(t, buf.String(), "Rebuild failed, keeping the previous container running: some build error")
+			})
+		})
 	})
 }
+
+type notFoundError struct{}
+
+func (notFoundError) Error() string  { return "No such container" }
+func (notFoundError) NotFound() bool { return true }
@@ -0,0 +1,100 @@
+package pack
+
+import (
+	"github.com/buildpack/pack/config"
+	"github.com/buildpack/pack/image"
+)
+
+type StackSummary struct {
+	ID          string   `json:"id"`
+	BuildImages []string `json:"build-images"`
+	RunImages   []string `json:"run-images"`
+	Default     bool     `json:"default"`
+}
+
+type StackDetails struct {
+	StackSummary
+	Images []StackImage `json:"images"`
+}
+
+type StackImage struct {
+	Name   string             `json:"name"`
+	Type   string             `json:"type"`
+	Local  StackImageLocation `json:"local"`
+	Remote StackImageLocation `json:"remote"`
+}
+
+type StackImageLocation struct {
+	Exists  bool   `json:"exists"`
+	StackID string `json:"stack-id,omitempty"`
+	// Error is why it isn't known whether the image exists, such as denied
+	// access or an unreachable daemon or registry
+	Error string `json:"error,omitempty"`
+}
+
+// Matches tells whether an image that exists carries the given stack label.
+func (l StackImageLocation) Matches(stackID string) bool {
+	return !l.Exists || l.StackID == stackID
+}
+
+type StackInspector struct {
+	Config       *config.Config
+	ImageFactory ImageFactory
+}
+
+func ListStacks(cfg *config.Config) []StackSummary {
+	var stacks []StackSummary
+	for _, stack := range cfg.Stacks {
+		stacks = append(stacks, stackSummary(cfg, stack))
+	}
+	return stacks
+}
+
+func stackSummary(cfg *config.Config, stack config.Stack) StackSummary {
+	return StackSummary{
+		ID:          stack.ID,
+		BuildImages: stack.BuildImages,
+		RunImages:   stack.RunImages,
+		Default:     stack.ID == cfg.DefaultStackID,
+	}
+}
+
+// Inspect looks up every build and run image of the stack in the local docker
+// daemon and in its registry. Images are not pulled.
+func (s *StackInspector) Inspect(stackID string) (StackDetails, error) {
+	stack, err := s.Config.Get(stackID)
+	if err != nil {
+		return StackDetails{}, err
+	}
+	details := StackDetails{StackSummary: stackSummary(s.Config, *stack)}
+	for _, name := range stack.BuildImages {
+		details.Images = append(details.Images, s.inspectImage(name, "build"))
+	}
+	for _, name := range stack.RunImages {
+		details.Images = append(details.Images, s.inspectImage(name, "run"))
+	}
+	return details, nil
+}
+
+func (s *StackInspector) inspectImage(name, imageType string) StackImage {
+	local, err := s.ImageFactory.NewLocal(name, image.PullNever)
+	stackImage := StackImage{Name: name, Type: imageType, Local: stackImageLocation(local, err)}
+	remote, err := s.ImageFactory.NewRemote(name)
+	stackImage.Remote = stackImageLocation(remote, err)
+	return stackImage
+}
+
+// stackImageLocation reads the stack label of img, which could not be looked
+// up when err is set. Only an image that is not found is reported as missing.
+func stackImageLocation(img image.Image, err error) StackImageLocation {
+	if err == nil {
+		var stackID string
+		if stackID, err = img.Label("io.buildpacks.stack.id"); err == nil {
+			return StackImageLocation{Exists: true, StackID: stackID}
+		}
+	}
+	if _, ok := err.(*image.NotFoundError); ok {
+		return StackImageLocation{}
+	}
+	return StackImageLocation{Error: err.Error()}
+}
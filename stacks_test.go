@@ -0,0 +1,153 @@
+package pack_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/pack"
+	"github.com/buildpack/pack/config"
+	"github.com/buildpack/pack/image"
+	"github.com/buildpack/pack/mocks"
+	h "github.com/buildpack/pack/testhelpers"
+)
+
+func TestStacks(t *testing.T) {
+	spec.Run(t, "stacks", testStacks, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+func testStacks(t *testing.T, when spec.G, it spec.S) {
+	var (
+		mockController   *gomock.Controller
+		mockImageFactory *mocks.MockImageFactory
+		cfg              *config.Config
+	)
+
+	it.Before(func() {
+		mockController = gomock.NewController(t)
+		mockImageFactory = mocks.NewMockImageFactory(mockController)
+		cfg = &config.Config{
+			DefaultStackID: "some.default.stack",
+			Stacks: []config.Stack{
+				{
+					ID:          "some.default.stack",
+					BuildImages: []string{"default/build", "registry.com/build/image"},
+					RunImages:   []string{"default/run"},
+				},
+				{
+					ID:          "some.other.stack",
+					BuildImages: []string{"other/build"},
+					RunImages:   []string{"other/run"},
+				},
+			},
+		}
+	})
+
+	it.After(func() {
+		mockController.Finish()
+	})
+
+	when("#ListStacks", func() {
+		it("lists every stack and marks the default", func() {
+			h.AssertEq(t, pack.ListStacks(cfg), []pack.StackSummary{
+				{
+					ID:          "some.default.stack",
+					BuildImages: []string{"default/build", "registry.com/build/image"},
+					RunImages:   []string{"default/run"},
+					Default:     true,
+				},
+				{
+					ID:          "some.other.stack",
+					BuildImages: []string{"other/build"},
+					RunImages:   []string{"other/run"},
+					Default:     false,
+				},
+			})
+		})
+	})
+
+	when("#StackInspector", func() {
+		var inspector pack.StackInspector
+
+		it.Before(func() {
+			inspector = pack.StackInspector{Config: cfg, ImageFactory: mockImageFactory}
+		})
+
+		it("reports where each image exists and its stack label", func() {
+			localBuild := mocks.NewMockImage(mockController)
+			localBuild.EXPECT().Label("io.buildpacks.stack.id").Return("some.other.stack", nil)
+			remoteBuild := mocks.NewMockImage(mockController)
+			remoteBuild.EXPECT().Label("io.buildpacks.stack.id").Return("", &image.NotFoundError{Action: "get label", RepoName: "other/build"})
+			mockImageFactory.EXPECT().NewLocal("other/build", image.PullNever).Return(localBuild, nil)
+			mockImageFactory.EXPECT().NewRemote("other/build").Return(remoteBuild, nil)
+
+			remoteRun := mocks.NewMockImage(mockController)
+			remoteRun.EXPECT().Label("io.buildpacks.stack.id").Return("some.other.stack", nil)
+			mockImageFactory.EXPECT().NewLocal("other/run", image.PullNever).Return(nil, errors.New("some docker error"))
+			mockImageFactory.EXPECT().NewRemote("other/run").Return(remoteRun, nil)
+
+			details, err := inspector.Inspect("some.other.stack")
+			h.AssertNil(t, err)
+			h.AssertEq(t, details, pack.StackDetails{
+				StackSummary: pack.StackSummary{
+					ID:          "some.other.stack",
+					BuildImages: []string{"other/build"},
+					RunImages:   []string{"other/run"},
+				},
+				Images: []pack.StackImage{
+					{
+						Name:   "other/build",
+						Type:   "build",
+						Local:  pack.StackImageLocation{Exists: true, StackID: "some.other.stack"},
+						Remote: pack.StackImageLocation{},
+					},
+					{
+						Name:   "other/run",
+						Type:   "run",
+						Local:  pack.StackImageLocation{Error: "some docker error"},
+						Remote: pack.StackImageLocation{Exists: true, StackID: "some.other.stack"},
+					},
+				},
+			})
+		})
+
+		it("reports why an image could not be looked up instead of reporting it missing", func() {
+			localBuild := mocks.NewMockImage(mockController)
+			localBuild.EXPECT().Label("io.buildpacks.stack.id").Return("", &image.NotFoundError{Action: "get label", RepoName: "other/build"})
+			remoteBuild := mocks.NewMockImage(mockController)
+			remoteBuild.EXPECT().Label("io.buildpacks.stack.id").Return("", errors.New("failed to get label of image 'other/build': UNAUTHORIZED"))
+			mockImageFactory.EXPECT().NewLocal("other/build", image.PullNever).Return(localBuild, nil)
+			mockImageFactory.EXPECT().NewRemote("other/build").Return(remoteBuild, nil)
+
+			localRun := mocks.NewMockImage(mockController)
+			localRun.EXPECT().Label("io.buildpacks.stack.id").Return("some.other.stack", nil)
+			mockImageFactory.EXPECT().NewLocal("other/run", image.PullNever).Return(localRun, nil)
+			mockImageFactory.EXPECT().NewRemote("other/run").Return(nil, errors.New("connect to repo store: dial tcp: no such host"))
+
+			details, err := inspector.Inspect("some.other.stack")
+			h.AssertNil(t, err)
+			h.AssertEq(t, details.Images, []pack.StackImage{
+				{
+					Name:   "other/build",
+					Type:   "build",
+					Local:  pack.StackImageLocation{},
+					Remote: pack.StackImageLocation{Error: "failed to get label of image 'other/build': UNAUTHORIZED"},
+				},
+				{
+					Name:   "other/run",
+					Type:   "run",
+					Local:  pack.StackImageLocation{Exists: true, StackID: "some.other.stack"},
+					Remote: pack.StackImageLocation{Error: "connect to repo store: dial tcp: no such host"},
+				},
+			})
+		})
+
+		it("fails for an unknown stack", func() {
+			_, err := inspector.Inspect("some.missing.stack")
+			h.AssertError(t, err, `Missing stack: stack with id "some.missing.stack" not found in pack config.toml`)
+		})
+	})
+}